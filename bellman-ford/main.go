@@ -0,0 +1,515 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type message struct {
+	from int
+	seq int // messages can overtake each other, older vectors are ignored
+	dist []int // the sender's distance to every node
+}
+
+type nodePool struct {
+	*sim.Pool
+	participants int
+	send func(from, to int, m message)
+	topology *sim.Topology
+
+	// link weights, only known to the two ends of each link, and the links a
+	// partition took down whatever their weight
+	weights [][]int
+	severed [][]bool
+	weightsMu sync.Mutex
+
+	// a distance this large means unreachable
+	infinity int
+
+	updates atomic.Int64
+	changes atomic.Int64
+	lastChange atomic.Int64
+
+	// deliberately weaken the protocol for demonstration
+	skipPoison atomic.Bool
+}
+
+func newNodePool(participants int, send func(from, to int, m message), topology *sim.Topology) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.participants = participants
+	pool.send = send
+	pool.topology = topology
+	pool.weights = make([][]int, participants)
+	pool.severed = make([][]bool, participants)
+	for i := range pool.weights {
+		pool.weights[i] = make([]int, participants)
+		pool.severed[i] = make([]bool, participants)
+		for _, j := range topology.Neighbors(i) {
+			pool.weights[i][j] = 1
+		}
+	}
+	pool.infinity = 16
+	pool.updates.Store(0)
+	pool.changes.Store(0)
+	pool.lastChange.Store(time.Now().UnixNano())
+	pool.skipPoison.Store(false)
+	return pool
+}
+
+// weight of the link between two neighbors, infinity if it is down
+func (pool *nodePool) weight(a, b int) int {
+	pool.weightsMu.Lock()
+	defer pool.weightsMu.Unlock()
+
+	if pool.severed[a][b] || pool.weights[a][b] < 0 || pool.weights[a][b] > pool.infinity {
+		return pool.infinity
+	}
+	return pool.weights[a][b]
+}
+
+// taken down with a negative weight, a partition aside
+func (pool *nodePool) down(a, b int) bool {
+	pool.weightsMu.Lock()
+	defer pool.weightsMu.Unlock()
+
+	return pool.weights[a][b] < 0
+}
+
+// sever or reconnect a link for a partition, returns whether that changed it
+func (pool *nodePool) sever(a, b int, severed bool) bool {
+	pool.weightsMu.Lock()
+	defer pool.weightsMu.Unlock()
+
+	changed := pool.severed[a][b] != severed
+	pool.severed[a][b] = severed
+	pool.severed[b][a] = severed
+	return changed
+}
+
+func (pool *nodePool) setWeight(a, b, w int) {
+	pool.weightsMu.Lock()
+	defer pool.weightsMu.Unlock()
+
+	pool.weights[a][b] = w
+	pool.weights[b][a] = w
+}
+
+// shortest distances from a node over the current weights, as an
+// omniscient observer would compute them
+func (pool *nodePool) shortest(from int) []int {
+	dist := make([]int, pool.participants)
+	for i := range dist {
+		dist[i] = pool.infinity
+	}
+	dist[from] = 0
+
+	for round := 0; round < pool.participants; round++ {
+		for a := range dist {
+			for _, b := range pool.topology.Neighbors(a) {
+				if d := dist[a] + pool.weight(a, b); d < dist[b] {
+					dist[b] = d
+				}
+			}
+		}
+	}
+	return dist
+}
+
+type node struct {
+	*sim.Process
+	pool *nodePool
+
+	dist []int
+	next []int // first hop towards each node, -1 if unreachable
+	vectors map[int][]int // last distance vector heard from each neighbor
+	heard map[int]int // sequence number of that vector
+	seq int
+	mu sync.Mutex
+
+	inbox chan message
+}
+
+func newNode(pool *nodePool, id, clockSpeed int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.dist = make([]int, pool.participants)
+	n.next = make([]int, pool.participants)
+	for i := range n.dist {
+		n.dist[i] = pool.infinity
+		n.next[i] = -1
+	}
+	n.dist[id] = 0
+	n.next[id] = id
+	n.vectors = make(map[int][]int)
+	n.heard = make(map[int]int)
+	n.seq = 0
+	n.inbox = make(chan message)
+	return n
+}
+
+func (n *node) Run() {
+	// periodic updates, in case a triggered one was lost
+	n.Start(n.tick)
+
+	// poll distance vectors
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
+
+// send the distance vector to every neighbor (node lock must be held)
+func (n *node) advertise() {
+	n.seq++
+	for _, to := range n.pool.topology.Neighbors(n.ID()) {
+		dist := make([]int, len(n.dist))
+		copy(dist, n.dist)
+
+		// poisoned reverse: never offer a neighbor a route that goes through it
+		if !n.pool.skipPoison.Load() {
+			for d := range dist {
+				if d != n.ID() && n.next[d] == to {
+					dist[d] = n.pool.infinity
+				}
+			}
+		}
+
+		n.pool.updates.Add(1)
+		n.pool.send(n.ID(), to, message{from: n.ID(), seq: n.seq, dist: dist})
+	}
+}
+
+// pick the best neighbor for every destination from the vectors heard so
+// far, reporting whether anything changed (node lock must be held)
+func (n *node) recompute() bool {
+	changed := false
+	for d := range n.dist {
+		if d == n.ID() {
+			continue
+		}
+
+		best, hop := n.pool.infinity, -1
+		for _, via := range n.pool.topology.Neighbors(n.ID()) {
+			vector, ok := n.vectors[via]
+			if !ok {
+				continue
+			}
+			cost := n.pool.weight(n.ID(), via) + vector[d]
+			if cost < best {
+				best, hop = cost, via
+			}
+		}
+
+		if best == n.dist[d] && hop == n.next[d] {
+			continue
+		}
+		changed = true
+		n.dist[d], n.next[d] = best, hop
+		n.pool.changes.Add(1)
+		n.pool.lastChange.Store(time.Now().UnixNano())
+
+		if hop < 0 {
+			n.Printf("Node %d: node %d is unreachable", n.ID(), d)
+		} else {
+			n.Printf("Node %d: route to node %d costs %d via node %d", n.ID(), d, best, hop)
+		}
+	}
+	return changed
+}
+
+// one of the node's links changed weight
+func (n *node) linkChanged() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.recompute() {
+		n.advertise()
+	}
+}
+
+func (n *node) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.recompute()
+	n.advertise()
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if m.seq <= n.heard[m.from] {
+		return
+	}
+	n.vectors[m.from] = m.dist
+	n.heard[m.from] = m.seq
+
+	// triggered update: neighbors hear about a change right away
+	if n.recompute() {
+		n.advertise()
+	}
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func main() {
+	topology := flag.String("topology", "line", "how nodes are wired: mesh, ring, line, star, tree, random:<p> or file:<path>")
+	infinity := flag.Int("infinity", 16, "distance that counts as unreachable")
+	period := flag.Duration("period", 2*time.Second, "interval between periodic updates")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *infinity < 2 || *period < time.Millisecond {
+		fmt.Println("Infinity must be at least 2 and period must be positive")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	wiring, err := sim.ParseTopology(*topology, nodeCount)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	var lmin, lmax atomic.Int64
+	lmin.Store(20)
+	lmax.Store(100)
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		return sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+	})
+	network.SetTopology(wiring)
+
+	sender := func(from, to int, m message) {
+		network.Send(from, to, m, sim.Latency(int(lmin.Load()), int(lmax.Load())))
+	}
+
+	pool := newNodePool(nodeCount, sender, wiring)
+	pool.infinity = *infinity
+	for i := 0; i < nodeCount; i++ {
+		nodes[i] = newNode(pool, i, int(*period/time.Millisecond), l)
+		nodes[i].Run()
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: routes, path, weight, converged, latency, stats, partition, heal, logs, toggle, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "routes" {
+			fmt.Printf("Topology: %s, infinity: %d\n", wiring, pool.infinity)
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				fmt.Printf("Node %d:", i)
+				for d := range nodes {
+					if d == i {
+						continue
+					}
+					if nodes[i].next[d] < 0 {
+						fmt.Printf(" %d: -", d)
+					} else {
+						fmt.Printf(" %d: %d via %d", d, nodes[i].dist[d], nodes[i].next[d])
+					}
+				}
+				fmt.Println()
+				nodes[i].mu.Unlock()
+			}
+		} else if cmd == "path" {
+			// follow the next hops, as a packet would
+			var source, target int
+
+			con.Scan("Source node: ", &source)
+			con.Scan("Target node: ", &target)
+
+			path := []int{source}
+			visited := map[int]bool{source: true}
+			at := source
+			for at != target {
+				nodes[at].mu.Lock()
+				next := nodes[at].next[target]
+				nodes[at].mu.Unlock()
+
+				if next < 0 {
+					fmt.Printf("Path %v stops, node %d has no route to node %d\n", path, at, target)
+					break
+				}
+				path = append(path, next)
+				if visited[next] {
+					fmt.Printf("Path %v loops\n", path)
+					break
+				}
+				visited[next] = true
+				at = next
+			}
+			if at == target {
+				fmt.Printf("Path %v\n", path)
+			}
+		} else if cmd == "weight" {
+			var a, b, w int
+
+			con.Scan("Node: ", &a)
+			con.Scan("Other node: ", &b)
+			con.Scan("Weight (-1 takes the link down): ", &w)
+
+			wired := false
+			for _, neighbor := range wiring.Neighbors(a) {
+				wired = wired || neighbor == b
+			}
+			if !wired {
+				fmt.Printf("Nodes %d and %d are not wired\n", a, b)
+				continue
+			}
+
+			// a link that is down carries no updates either
+			pool.setWeight(a, b, w)
+			network.Cut(a, b, w < 0)
+			network.Cut(b, a, w < 0)
+
+			if w < 0 {
+				fmt.Printf("Link %d <-> %d is down\n", a, b)
+			} else {
+				fmt.Printf("Link %d <-> %d now weighs %d\n", a, b, w)
+			}
+
+			// both ends notice at once
+			nodes[a].linkChanged()
+			nodes[b].linkChanged()
+		} else if cmd == "converged" {
+			wrong := 0
+			for i := range nodes {
+				want := pool.shortest(i)
+
+				nodes[i].mu.Lock()
+				for d := range nodes {
+					if nodes[i].dist[d] != want[d] {
+						fmt.Printf("Node %d thinks node %d is %d away, actually %d\n", i, d, nodes[i].dist[d], want[d])
+						wrong++
+					}
+				}
+				nodes[i].mu.Unlock()
+			}
+
+			since := time.Since(time.Unix(0, pool.lastChange.Load())).Round(time.Millisecond)
+			if wrong == 0 {
+				fmt.Printf("Every route is the shortest, last change %v ago\n", since)
+			} else {
+				fmt.Printf("%d route(s) are wrong, last change %v ago\n", wrong, since)
+			}
+		} else if cmd == "latency" {
+			var lo, hi int64
+
+			con.Scan("Min latency (ms): ", &lo)
+			con.Scan("Max latency (ms): ", &hi)
+
+			lmin.Store(lo)
+			lmax.Store(hi)
+		} else if cmd == "stats" {
+			fmt.Printf("Distance vectors sent: %d (%d dropped)\n", pool.updates.Load(), network.Stats.Dropped.Load())
+			fmt.Printf("Route changes: %d\n", pool.changes.Load())
+		} else if cmd == "partition" || cmd == "heal" {
+			// split brain: the links between groups go down, and both ends
+			// notice as if their weight were -1
+			group := make([]int, nodeCount)
+			if cmd == "partition" {
+				var spec string
+
+				con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+				groups, err := sim.ParseGroups(spec, nodeCount)
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+
+				for i := range group {
+					group[i] = -1
+				}
+				for g := range groups {
+					for _, id := range groups[g] {
+						group[id] = g
+					}
+				}
+				network.Partition(groups)
+			} else {
+				network.Heal()
+			}
+
+			for a := range nodes {
+				for _, b := range wiring.Neighbors(a) {
+					if a > b {
+						continue
+					}
+
+					// links taken down by weight stay down
+					if pool.down(a, b) {
+						network.Cut(a, b, true)
+						network.Cut(b, a, true)
+					}
+					if pool.sever(a, b, group[a] != group[b] || group[a] < 0) {
+						nodes[a].linkChanged()
+						nodes[b].linkChanged()
+					}
+				}
+			}
+
+			if cmd == "partition" {
+				fmt.Println("Network partitioned, nodes left out are isolated")
+			} else {
+				fmt.Println("Network healed")
+			}
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "toggle" {
+			var mechanism string
+			con.Scan("Mechanism (poison): ", &mechanism)
+
+			if mechanism == "poison" {
+				skip := !pool.skipPoison.Load()
+				pool.skipPoison.Store(skip)
+				fmt.Printf("Poisoned reverse: %s\n", enabledString(!skip))
+			} else {
+				fmt.Println("Unknown mechanism")
+			}
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+const undecided = -1
+
+type message struct {
+	kind string // report, proposal, decided
+	sender int
+	round int
+	value int // undecided ("?") is only valid for proposals
+}
+
+type nodePool struct {
+	*sim.Pool
+
+	participants int
+	faulty int
+	maxRounds int
+	broadcast func(m message)
+
+	stop chan bool
+	messages atomic.Int64
+}
+
+func newNodePool(participants int, broadcast func(m message)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.participants = participants
+	pool.faulty = (participants - 1) / 2
+	pool.maxRounds = 50
+	pool.broadcast = broadcast
+	return pool
+}
+
+type node struct {
+	pool *nodePool
+	id int
+	l sim.Logger
+
+	input int
+	x int
+	round int
+	decision int
+	crashed atomic.Bool
+
+	inbox chan message
+	reports map[int]map[int]int
+	proposals map[int]map[int]int
+	decidedPeers map[int]int
+}
+
+func newNode(pool *nodePool, id, input int, l sim.Logger) *node {
+	n := new(node)
+	n.pool = pool
+	n.id = id
+	n.l = l
+	n.input = input
+	n.crashed.Store(false)
+	n.reset()
+	return n
+}
+
+func (n *node) reset() {
+	n.x = n.input
+	n.round = 0
+	n.decision = undecided
+	n.inbox = make(chan message, n.pool.participants*4)
+	n.reports = make(map[int]map[int]int)
+	n.proposals = make(map[int]map[int]int)
+	n.decidedPeers = make(map[int]int)
+}
+
+func (n *node) store(m message) {
+	var target map[int]map[int]int
+	if m.kind == "report" {
+		target = n.reports
+	} else if m.kind == "proposal" {
+		target = n.proposals
+	} else {
+		// a decided node counts as reporting and proposing its value in every later round
+		n.decidedPeers[m.sender] = m.value
+		return
+	}
+
+	if target[m.round] == nil {
+		target[m.round] = make(map[int]int)
+	}
+	target[m.round][m.sender] = m.value
+}
+
+// collect the values of round r, counting decided peers as well
+func (n *node) collect(received map[int]map[int]int, r int) map[int]int {
+	values := make(map[int]int)
+	for sender, v := range received[r] {
+		values[sender] = v
+	}
+	for sender, v := range n.decidedPeers {
+		if _, ok := values[sender]; !ok {
+			values[sender] = v
+		}
+	}
+	return values
+}
+
+// wait for n - f values of round r
+func (n *node) wait(received map[int]map[int]int, r int) (map[int]int, bool) {
+	for {
+		values := n.collect(received, r)
+		if len(values) >= n.pool.participants-n.pool.faulty {
+			return values, true
+		}
+
+		select {
+		case m := <-n.inbox:
+			n.store(m)
+		case <-n.pool.stop:
+			return nil, false
+		}
+
+		if n.crashed.Load() {
+			return nil, false
+		}
+	}
+}
+
+func (n *node) send(kind string, value int) {
+	n.pool.broadcast(message{
+		kind: kind,
+		sender: n.id,
+		round: n.round,
+		value: value,
+	})
+}
+
+func (n *node) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for n.round = 1; n.round <= n.pool.maxRounds; n.round++ {
+		if n.crashed.Load() {
+			return
+		}
+
+		// phase 1: report the current estimate
+		n.send("report", n.x)
+		reports, ok := n.wait(n.reports, n.round)
+		if !ok {
+			return
+		}
+
+		proposal := undecided
+		counts := make(map[int]int)
+		for _, v := range reports {
+			counts[v]++
+			if counts[v]*2 > n.pool.participants {
+				proposal = v
+			}
+		}
+
+		// phase 2: propose a value backed by a majority (or "?")
+		n.send("proposal", proposal)
+		proposals, ok := n.wait(n.proposals, n.round)
+		if !ok {
+			return
+		}
+
+		counts = make(map[int]int)
+		seen := undecided
+		for _, v := range proposals {
+			if v != undecided {
+				counts[v]++
+				seen = v
+			}
+		}
+
+		if seen != undecided && counts[seen] >= n.pool.faulty+1 {
+			n.decision = seen
+			n.l.Printf("Node %d decides %d in round %d", n.id, seen, n.round)
+			n.send("decided", seen)
+			return
+		}
+
+		if seen != undecided {
+			n.x = seen
+			n.l.Printf("Node %d adopts %d in round %d", n.id, seen, n.round)
+		} else {
+			// flip a coin
+			n.x = int(sim.Random(2))
+			n.l.Printf("Node %d flips coin %d in round %d", n.id, n.x, n.round)
+		}
+	}
+}
+
+func main() {
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	var lmin, lmax atomic.Int64
+	lmin.Store(10)
+	lmax.Store(100)
+
+	// adversarial scheduling: messages carrying a value are slowed down
+	biasValue, biasDelay := undecided, 0
+
+	nodes := make([]*node, nodeCount)
+	broadcaster := func(m message) {
+		pool := nodes[m.sender].pool
+		pool.messages.Add(int64(len(nodes)))
+
+		stop := pool.stop
+		for i := range nodes {
+			inbox := nodes[i].inbox
+
+			// broadcast delay
+			latency := lmin.Load() + sim.Random(lmax.Load()-lmin.Load())
+			if m.value == biasValue {
+				latency += int64(biasDelay)
+			}
+			pool.Go(func() {
+				time.Sleep(time.Duration(latency) * time.Millisecond)
+
+				select {
+				case inbox <- m:
+				case <-stop:
+				}
+			})
+		}
+	}
+
+	pool := newNodePool(nodeCount, broadcaster)
+	for i := range nodes {
+		nodes[i] = newNode(pool, i, i%2, l)
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, input, crash, recover, latency, bias, run, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			fmt.Printf("Tolerated crashes: %d, latency: %d-%dms", pool.faulty, lmin.Load(), lmax.Load())
+			if biasValue != undecided {
+				fmt.Printf(", value %d delayed by %dms", biasValue, biasDelay)
+			}
+			fmt.Println()
+
+			for i := range nodes {
+				fmt.Printf("Node %d (input: %d, estimate: %d, round: %d, decision: %d, crashed: %v)\n", nodes[i].id, nodes[i].input, nodes[i].x, nodes[i].round, nodes[i].decision, nodes[i].crashed.Load())
+			}
+		} else if cmd == "input" {
+			var id, value int
+
+			con.Scan("Node: ", &id)
+			con.Scan("Input (0 or 1): ", &value)
+
+			nodes[id].input = value
+		} else if cmd == "crash" || cmd == "recover" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			nodes[id].crashed.Store(cmd == "crash")
+		} else if cmd == "latency" {
+			var lo, hi int64
+
+			con.Scan("Min latency (ms): ", &lo)
+			con.Scan("Max latency (ms): ", &hi)
+
+			lmin.Store(lo)
+			lmax.Store(hi)
+		} else if cmd == "bias" {
+			con.Scan("Value to delay (-1 for none): ", &biasValue)
+			con.Scan("Extra delay (ms): ", &biasDelay)
+		} else if cmd == "run" {
+			var timeout int
+
+			con.Scan("Timeout (s): ", &timeout)
+
+			pool.stop = make(chan bool)
+			pool.messages.Store(0)
+
+			// every inbox is replaced before any node starts sending
+			for i := range nodes {
+				nodes[i].reset()
+			}
+
+			var wg sync.WaitGroup
+			for i := range nodes {
+				if nodes[i].crashed.Load() {
+					continue
+				}
+
+				wg.Add(1)
+				go nodes[i].run(&wg)
+			}
+
+			done := make(chan bool)
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+
+			start := time.Now()
+			select {
+			case <-done:
+			case <-time.After(time.Duration(timeout) * time.Second):
+				fmt.Println("Timed out")
+			}
+			close(pool.stop)
+			<-done
+
+			decisions := make(map[int]bool)
+			for i := range nodes {
+				if nodes[i].crashed.Load() {
+					fmt.Printf("Node %d crashed\n", nodes[i].id)
+				} else if nodes[i].decision != undecided {
+					decisions[nodes[i].decision] = true
+					fmt.Printf("Node %d decides %d in round %d\n", nodes[i].id, nodes[i].decision, nodes[i].round)
+				} else {
+					fmt.Printf("Node %d undecided\n", nodes[i].id)
+				}
+			}
+
+			if len(decisions) > 1 {
+				fmt.Println("Agreement VIOLATED")
+			}
+			fmt.Printf("Elapsed: %v, messages: %d\n", time.Since(start), pool.messages.Load())
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	fmt.Println("Waiting for messages in flight")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
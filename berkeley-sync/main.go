@@ -0,0 +1,345 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+const master = 0
+
+type message struct {
+	kind string // poll, reply or adjust
+	from int
+	round int
+	sent time.Time // poll and reply: the master's clock when it polled
+	time time.Time // reply: the node's clock when it answered
+	delta time.Duration // adjust: how far to set the clock forward
+}
+
+type nodePool struct {
+	*sim.Pool
+	participants int
+	send func(from, to int, m message)
+
+	// clocks further than this from the median are left out of the average
+	tolerance time.Duration
+
+	// deliberately weaken the protocol for demonstration
+	skipFilter atomic.Bool
+}
+
+func newNodePool(participants int, send func(from, to int, m message)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.participants = participants
+	pool.send = send
+	pool.tolerance = 0
+	pool.skipFilter.Store(false)
+	return pool
+}
+
+type node struct {
+	*sim.Process
+	pool *nodePool
+
+	clock *sim.PhysicalClock
+
+	// master only: the round being collected and the outcome of the last one
+	round int
+	offsets map[int]time.Duration // each clock minus the master's
+	last string
+
+	mu sync.Mutex
+
+	inbox chan message
+}
+
+func newNode(pool *nodePool, id, clockSpeed int, clock *sim.PhysicalClock, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.clock = clock
+	n.round = 0
+	n.offsets = nil
+	n.last = "no round finished yet"
+	n.inbox = make(chan message)
+	return n
+}
+
+func (n *node) Run() {
+	// the master polls every tick, the others only answer
+	if n.ID() == master {
+		n.Start(n.tick)
+	} else {
+		n.Start(nil)
+	}
+
+	// poll polls, replies and adjustments
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
+
+func (n *node) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// nodes that have not answered by now sit this round out
+	if n.offsets != nil {
+		n.finish()
+	}
+
+	n.round++
+	n.offsets = map[int]time.Duration{master: 0}
+	for i := 0; i < n.pool.participants; i++ {
+		if i != master {
+			n.pool.send(n.ID(), i, message{kind: "poll", from: n.ID(), round: n.round, sent: n.clock.Now()})
+		}
+	}
+}
+
+// average the clocks that agree and tell every node how to get there
+// (node lock must be held)
+func (n *node) finish() {
+	ids := []int{}
+	offsets := []time.Duration{}
+	for id, offset := range n.offsets {
+		ids = append(ids, id)
+		offsets = append(offsets, offset)
+	}
+	sort.Ints(ids)
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	median := offsets[len(offsets)/2]
+
+	// fault tolerance: a clock far off would drag everyone with it
+	var sum time.Duration
+	used := 0
+	ignored := []int{}
+	for _, id := range ids {
+		off := n.offsets[id] - median
+		if !n.pool.skipFilter.Load() && (off > n.pool.tolerance || off < -n.pool.tolerance) {
+			ignored = append(ignored, id)
+			continue
+		}
+		sum += n.offsets[id]
+		used++
+	}
+	average := sum / time.Duration(used)
+
+	for _, id := range ids {
+		delta := average - n.offsets[id]
+		if id == master {
+			n.clock.Adjust(delta)
+		} else {
+			n.pool.send(n.ID(), id, message{kind: "adjust", from: n.ID(), round: n.round, delta: delta})
+		}
+	}
+
+	n.last = fmt.Sprintf("Round %d: %d clock(s) answered, averaged %d, ignored %v, master moved %v", n.round, len(ids), used, ignored, average.Round(time.Millisecond))
+	n.Printf("%s", n.last)
+	n.offsets = nil
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch m.kind {
+	case "poll":
+		n.pool.send(n.ID(), m.from, message{kind: "reply", from: n.ID(), round: m.round, sent: m.sent, time: n.clock.Now()})
+
+	case "reply":
+		if m.round != n.round || n.offsets == nil {
+			return
+		}
+
+		// the answer is taken to be half a round trip old
+		now := n.clock.Now()
+		rtt := now.Sub(m.sent)
+		n.offsets[m.from] = m.time.Add(rtt / 2).Sub(now)
+
+		if len(n.offsets) == n.pool.participants {
+			n.finish()
+		}
+
+	case "adjust":
+		n.clock.Adjust(m.delta)
+		n.Printf("Node %d sets its clock by %v in round %d", n.ID(), m.delta.Round(time.Millisecond), m.round)
+	}
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func main() {
+	period := flag.Duration("period", 3*time.Second, "interval between the master's polls")
+	skew := flag.Duration("skew", 2*time.Second, "start every clock off real time by up to this much")
+	drift := flag.Float64("drift", 0.01, "let every clock run up to this much faster or slower")
+	tolerance := flag.Duration("tolerance", time.Second, "clocks further than this from the median are left out of the average")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *period < time.Millisecond || *skew < 0 || *drift < 0 || *tolerance <= 0 {
+		fmt.Println("Period and tolerance must be positive, skew and drift not negative")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	var lmin, lmax atomic.Int64
+	lmin.Store(20)
+	lmax.Store(100)
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		return sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+	})
+
+	sender := func(from, to int, m message) {
+		network.Send(from, to, m, sim.Latency(int(lmin.Load()), int(lmax.Load())))
+	}
+
+	pool := newNodePool(nodeCount, sender)
+	pool.tolerance = *tolerance
+	for i := 0; i < nodeCount; i++ {
+		offset := time.Duration(sim.Random(int64(2**skew)+1)) - *skew
+		rate := 1 + (float64(sim.Random(2001))/1000-1)**drift
+		nodes[i] = newNode(pool, i, int(*period/time.Millisecond), sim.NewPhysicalClock(offset, rate), l)
+		nodes[i].Run()
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: clocks, last, skew, crash, latency, partition, heal, logs, toggle, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "clocks" {
+			var lo, hi time.Duration
+			first := true
+			for i := range nodes {
+				status := ""
+				if !nodes[i].Running() {
+					status = " (crashed)"
+				}
+
+				skew := nodes[i].clock.Skew()
+				fmt.Printf("Node %d%s: %v off real time, rate %.3f\n", i, status, skew.Round(time.Millisecond), nodes[i].clock.Rate())
+
+				if nodes[i].Running() {
+					if first || skew < lo {
+						lo = skew
+					}
+					if first || skew > hi {
+						hi = skew
+					}
+					first = false
+				}
+			}
+			fmt.Printf("Spread between running clocks: %v\n", (hi - lo).Round(time.Millisecond))
+		} else if cmd == "last" {
+			nodes[master].mu.Lock()
+			fmt.Println(nodes[master].last)
+			nodes[master].mu.Unlock()
+		} else if cmd == "skew" {
+			// set a clock off, the next rounds pull it back (or the others towards it)
+			var id int
+			var offset string
+
+			con.Scan("Node: ", &id)
+			con.Scan("Offset (e.g. 5s or -300ms): ", &offset)
+
+			d, err := time.ParseDuration(offset)
+			if err != nil {
+				fmt.Println("Invalid duration")
+				continue
+			}
+			nodes[id].clock.Adjust(d)
+
+			fmt.Printf("Clock of node %d is now %v off real time\n", id, nodes[id].clock.Skew().Round(time.Millisecond))
+		} else if cmd == "crash" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			if id == master {
+				fmt.Println("The master cannot crash in this demo")
+				continue
+			}
+			nodes[id].Stop()
+		} else if cmd == "latency" {
+			var lo, hi int64
+
+			con.Scan("Min latency (ms): ", &lo)
+			con.Scan("Max latency (ms): ", &hi)
+
+			lmin.Store(lo)
+			lmax.Store(hi)
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "toggle" {
+			var mechanism string
+			con.Scan("Mechanism (filter): ", &mechanism)
+
+			if mechanism == "filter" {
+				skip := !pool.skipFilter.Load()
+				pool.skipFilter.Store(skip)
+				fmt.Printf("Leaving clocks far from the median out of the average: %s\n", enabledString(!skip))
+			} else {
+				fmt.Println("Unknown mechanism")
+			}
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type link struct {
+	latency int // extra latency (network jam)
+	down bool // partitioned, messages are dropped
+}
+
+type network struct {
+	links []link // server <-> client i, both directions
+	mu sync.Mutex
+
+	lmin, lmax int
+}
+
+// deliver after network delay, false if the message was lost
+func (net *network) send(client int) bool {
+	net.mu.Lock()
+	l := net.links[client]
+	net.mu.Unlock()
+
+	if l.down {
+		return false
+	}
+
+	time.Sleep(time.Duration(l.latency)*time.Millisecond + sim.Latency(net.lmin, net.lmax))
+
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	return !net.links[client].down
+}
+
+type record struct {
+	value string
+	version int
+	commits []time.Time // commit time of each version, for measuring staleness
+	leases map[int]time.Time // client -> expiry in server time
+	writing bool
+}
+
+type server struct {
+	*sim.Pool
+
+	net *network
+	clients []*client
+	l sim.Logger
+
+	leaseDuration time.Duration
+	records map[string]*record
+	mu sync.Mutex
+
+	// deliberately weaken the protocol for demonstration
+	skipWait atomic.Bool
+}
+
+func newServer(net *network, l sim.Logger) *server {
+	s := new(server)
+	s.Pool = sim.NewPool()
+	s.net = net
+	s.l = l
+	s.leaseDuration = 2 * time.Second
+	s.records = make(map[string]*record)
+	s.skipWait.Store(false)
+	return s
+}
+
+func (s *server) record(key string) *record {
+	r, ok := s.records[key]
+	if !ok {
+		r = &record{value: "", version: 0, leases: make(map[int]time.Time)}
+		s.records[key] = r
+	}
+	return r
+}
+
+// grant a lease unless a write is waiting for the current ones to go away
+func (s *server) read(client int, key string) (string, int, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.record(key)
+	if r.writing {
+		return r.value, r.version, 0
+	}
+	r.leases[client] = time.Now().Add(s.leaseDuration)
+	return r.value, r.version, s.leaseDuration
+}
+
+func (s *server) write(key, value string) {
+	start := time.Now()
+
+	s.mu.Lock()
+	r := s.record(key)
+	for r.writing {
+		s.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		s.mu.Lock()
+	}
+	r.writing = true
+
+	holders := make(map[int]time.Time)
+	for id, expiry := range r.leases {
+		if time.Now().Before(expiry) {
+			holders[id] = expiry
+		}
+	}
+	s.mu.Unlock()
+
+	// invalidate every holder, a holder counts as gone once it acks or its lease expires
+	acks := make(chan int, len(holders))
+	for id := range holders {
+		id := id
+		s.Go(func() {
+			if !s.net.send(id) {
+				return
+			}
+			s.clients[id].invalidate(key)
+			if s.net.send(id) {
+				acks <- id
+			}
+		})
+	}
+
+	if !s.skipWait.Load() {
+		for len(holders) > 0 {
+			latest := time.Time{}
+			for _, expiry := range holders {
+				if expiry.After(latest) {
+					latest = expiry
+				}
+			}
+
+			select {
+			case id := <-acks:
+				delete(holders, id)
+			case <-time.After(time.Until(latest)):
+				for id := range holders {
+					s.l.Printf("Server: lease of client %d on %s expired without an ack", id, key)
+				}
+				holders = nil
+			}
+		}
+	}
+
+	s.mu.Lock()
+	r.value = value
+	r.version++
+	r.commits = append(r.commits, time.Now())
+	r.leases = make(map[int]time.Time)
+	r.writing = false
+	version := r.version
+	s.mu.Unlock()
+
+	s.l.Printf("Server: %s = %s committed as version %d after %v", key, value, version, time.Since(start).Round(time.Millisecond))
+}
+
+// how long the given version has been out of date
+func (s *server) staleness(key string, version int) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.record(key)
+	if version >= r.version {
+		return 0
+	}
+	return time.Since(r.commits[version])
+}
+
+type cached struct {
+	value string
+	version int
+	expires time.Time // in the client's local time
+}
+
+type client struct {
+	id int
+	server *server
+	net *network
+	l sim.Logger
+
+	cache map[string]cached
+	rate float64 // local clock speed relative to real time
+	base, ref time.Time // local time at the real time ref
+	mu sync.Mutex
+
+	staleReads int
+	maxStaleness time.Duration
+}
+
+func newClient(id int, s *server, net *network, l sim.Logger) *client {
+	c := new(client)
+	c.id = id
+	c.server = s
+	c.net = net
+	c.l = l
+	c.cache = make(map[string]cached)
+	c.rate = 1
+	c.base = time.Now()
+	c.ref = c.base
+	c.staleReads = 0
+	c.maxStaleness = 0
+	return c
+}
+
+func (c *client) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.base.Add(time.Duration(float64(time.Since(c.ref)) * c.rate))
+}
+
+func (c *client) invalidate(key string) {
+	c.mu.Lock()
+	delete(c.cache, key)
+	c.mu.Unlock()
+	c.l.Printf("Client %d invalidated %s", c.id, key)
+}
+
+func (c *client) read(key string) (string, bool) {
+	now := c.now()
+
+	c.mu.Lock()
+	entry, ok := c.cache[key]
+	c.mu.Unlock()
+
+	source := "cache"
+	if !ok || !now.Before(entry.expires) {
+		// the lease is measured from when the request was sent, to stay on the safe side
+		sent := now
+		if !c.net.send(c.id) {
+			c.l.Printf("Client %d cannot reach the server for %s", c.id, key)
+			return "", false
+		}
+		value, version, lease := c.server.read(c.id, key)
+		if !c.net.send(c.id) {
+			c.l.Printf("Client %d lost the reply for %s", c.id, key)
+			return "", false
+		}
+
+		entry = cached{value: value, version: version, expires: sent.Add(lease)}
+		if lease > 0 {
+			c.mu.Lock()
+			c.cache[key] = entry
+			c.mu.Unlock()
+		}
+		source = "server"
+	}
+
+	stale := c.server.staleness(key, entry.version)
+	if stale > 0 {
+		c.mu.Lock()
+		c.staleReads++
+		if stale > c.maxStaleness {
+			c.maxStaleness = stale
+		}
+		c.mu.Unlock()
+		c.l.Printf("Client %d read %s = %s (version %d) from %s, STALE by %v", c.id, key, entry.value, entry.version, source, stale.Round(time.Millisecond))
+	} else {
+		c.l.Printf("Client %d read %s = %s (version %d) from %s", c.id, key, entry.value, entry.version, source)
+	}
+	return entry.value, true
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func main() {
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var clientCount int
+	con.Scan("Number of clients: ", &clientCount)
+
+	net := &network{links: make([]link, clientCount), lmin: 20, lmax: 80}
+	s := newServer(net, l)
+
+	clients := make([]*client, clientCount)
+	for i := range clients {
+		clients[i] = newClient(i, s, net, l)
+	}
+	s.clients = clients
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, read, write, watch, lease, jam, cut, restore, skew, toggle, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			s.mu.Lock()
+			fmt.Printf("Lease duration: %v, wait for invalidations: %s\n", s.leaseDuration, enabledString(!s.skipWait.Load()))
+
+			keys := make([]string, 0, len(s.records))
+			for k := range s.records {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				r := s.records[k]
+				holders := []string{}
+				for id, expiry := range r.leases {
+					if left := time.Until(expiry); left > 0 {
+						holders = append(holders, fmt.Sprintf("%d (%v left)", id, left.Round(time.Millisecond)))
+					}
+				}
+				sort.Strings(holders)
+				fmt.Printf("Server %s = %s (version %d, writing: %v) leases: %s\n", k, r.value, r.version, r.writing, strings.Join(holders, ", "))
+			}
+			s.mu.Unlock()
+
+			for _, c := range clients {
+				net.mu.Lock()
+				link := net.links[c.id]
+				net.mu.Unlock()
+
+				c.mu.Lock()
+				fmt.Printf("Client %d (clock rate: %.2f, jam: %dms, partitioned: %v, cached: %d, stale reads: %d, max staleness: %v)\n", c.id, c.rate, link.latency, link.down, len(c.cache), c.staleReads, c.maxStaleness.Round(time.Millisecond))
+				c.mu.Unlock()
+			}
+		} else if cmd == "read" {
+			var id int
+			var key string
+
+			con.Scan("Client: ", &id)
+			con.Scan("Key: ", &key)
+
+			if v, ok := clients[id].read(key); ok {
+				fmt.Printf("%s = %s\n", key, v)
+			} else {
+				fmt.Println("Server unreachable")
+			}
+		} else if cmd == "write" {
+			var key, value string
+
+			con.Scan("Key: ", &key)
+			con.Scan("Value: ", &value)
+
+			// the write blocks until leases are gone, results appear in the logs
+			s.Go(func() {
+				s.write(key, value)
+			})
+		} else if cmd == "watch" {
+			// every client keeps reading the key, then report staleness windows
+			var key string
+			var period, duration string
+
+			con.Scan("Key: ", &key)
+			con.Scan("Read period (e.g. 100ms): ", &period)
+			con.Scan("Duration (e.g. 5s): ", &duration)
+
+			p, err1 := time.ParseDuration(period)
+			d, err2 := time.ParseDuration(duration)
+			if err1 != nil || err2 != nil || p <= 0 {
+				fmt.Println("Invalid duration")
+				continue
+			}
+
+			var wg sync.WaitGroup
+			deadline := time.Now().Add(d)
+			for _, c := range clients {
+				wg.Add(1)
+				go func(c *client) {
+					defer wg.Done()
+					for time.Now().Before(deadline) {
+						c.read(key)
+						time.Sleep(p)
+					}
+				}(c)
+			}
+			wg.Wait()
+
+			for _, c := range clients {
+				c.mu.Lock()
+				fmt.Printf("Client %d: %d stale read(s), max staleness %v\n", c.id, c.staleReads, c.maxStaleness.Round(time.Millisecond))
+				c.mu.Unlock()
+			}
+		} else if cmd == "lease" {
+			var duration string
+
+			con.Scan("Lease duration (e.g. 2s): ", &duration)
+
+			d, err := time.ParseDuration(duration)
+			if err != nil {
+				fmt.Println("Invalid duration")
+				continue
+			}
+			s.mu.Lock()
+			s.leaseDuration = d
+			s.mu.Unlock()
+		} else if cmd == "jam" {
+			var id, latency int
+
+			con.Scan("Client: ", &id)
+			con.Scan("Extra latency (ms): ", &latency)
+
+			net.mu.Lock()
+			net.links[id].latency = latency
+			net.mu.Unlock()
+		} else if cmd == "cut" || cmd == "restore" {
+			var id int
+
+			con.Scan("Client: ", &id)
+
+			net.mu.Lock()
+			net.links[id].down = cmd == "cut"
+			net.mu.Unlock()
+
+			if cmd == "cut" {
+				fmt.Printf("Client %d is partitioned from the server\n", id)
+			} else {
+				fmt.Printf("Client %d is reconnected\n", id)
+			}
+		} else if cmd == "skew" {
+			// a slow clock makes the client believe its lease lasts longer than the server does
+			var id int
+			var rate float64
+
+			con.Scan("Client: ", &id)
+			con.Scan("Clock rate (1 = accurate, 0.5 = half speed): ", &rate)
+
+			c := clients[id]
+			now := c.now()
+			c.mu.Lock()
+			c.base = now
+			c.ref = time.Now()
+			c.rate = rate
+			c.mu.Unlock()
+		} else if cmd == "toggle" {
+			var mechanism string
+			con.Scan("Mechanism (wait): ", &mechanism)
+
+			if mechanism == "wait" {
+				skip := !s.skipWait.Load()
+				s.skipWait.Store(skip)
+				fmt.Printf("Writes wait for invalidation acks or lease expiry: %s\n", enabledString(!skip))
+			} else {
+				fmt.Println("Unknown mechanism")
+			}
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	fmt.Println("Waiting for writes in flight")
+	s.Wait()
+
+	l.Flush(os.Stdout)
+}
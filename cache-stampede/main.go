@@ -0,0 +1,523 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+// backing store whose latency grows with the number of concurrent fetches
+type store struct {
+	*sim.Pool
+
+	base, penalty int
+	inflight atomic.Int64
+	peak atomic.Int64
+}
+
+func newStore() *store {
+	s := new(store)
+	s.Pool = sim.NewPool()
+	s.base = 50
+	s.penalty = 10
+	s.inflight.Store(0)
+	s.peak.Store(0)
+	return s
+}
+
+func (s *store) fetch(key string) string {
+	n := s.inflight.Add(1)
+	defer s.inflight.Add(-1)
+
+	if n > s.peak.Load() {
+		s.peak.Store(n)
+	}
+
+	time.Sleep(time.Duration(int64(s.base)+int64(s.penalty)*(n-1)+sim.Random(10)) * time.Millisecond)
+	return fmt.Sprintf("%s@%s", key, time.Now().Format("15:04:05.000"))
+}
+
+type entry struct {
+	value string
+	valid bool
+	expires time.Time
+	refreshing chan struct{} // closed once the in-flight fetch completes
+}
+
+type mitigations struct {
+	coalesce atomic.Bool
+	jitter atomic.Bool
+	lock atomic.Bool
+}
+
+type cacheNode struct {
+	id int
+	store *store
+	mitigations *mitigations
+	ttl time.Duration
+
+	entries map[string]*entry
+	mu sync.Mutex
+}
+
+func newCacheNode(id int, s *store, m *mitigations, ttl time.Duration) *cacheNode {
+	c := new(cacheNode)
+	c.id = id
+	c.store = s
+	c.mitigations = m
+	c.ttl = ttl
+	c.entries = make(map[string]*entry)
+	return c
+}
+
+func (c *cacheNode) expiry() time.Time {
+	ttl := c.ttl
+	if c.mitigations.jitter.Load() {
+		// spread expiries over an extra half TTL
+		ttl += time.Duration(sim.Random(int64(c.ttl / 2)))
+	}
+	return time.Now().Add(ttl)
+}
+
+func (c *cacheNode) fill(key string, e *entry, done chan struct{}) string {
+	v := c.store.fetch(key)
+
+	c.mu.Lock()
+	e.value = v
+	e.valid = true
+	e.expires = c.expiry()
+	if e.refreshing == done {
+		e.refreshing = nil
+	}
+	c.mu.Unlock()
+
+	close(done)
+	return v
+}
+
+// returns the value and whether the store was hit on behalf of this request
+func (c *cacheNode) get(key string) (string, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		e = &entry{valid: false}
+		c.entries[key] = e
+	}
+
+	if e.valid && time.Now().Before(e.expires) {
+		v := e.value
+		c.mu.Unlock()
+		return v, false
+	}
+
+	lock := c.mitigations.lock.Load()
+	coalesce := c.mitigations.coalesce.Load()
+
+	fetcher := e.refreshing == nil
+	if fetcher {
+		e.refreshing = make(chan struct{})
+	}
+	done := e.refreshing
+	stale, value := e.valid, e.value
+	c.mu.Unlock()
+
+	if lock && stale {
+		// the lock holder refreshes in the background, everyone serves the stale value
+		if fetcher {
+			c.store.Go(func() {
+				c.fill(key, e, done)
+			})
+		}
+		return value, false
+	}
+
+	if (lock || coalesce) && !fetcher {
+		<-done
+		c.mu.Lock()
+		v := e.value
+		c.mu.Unlock()
+		return v, false
+	}
+
+	if fetcher {
+		return c.fill(key, e, done), true
+	}
+
+	// no mitigation: every miss goes to the store on its own
+	v := c.store.fetch(key)
+	c.mu.Lock()
+	e.value = v
+	e.valid = true
+	e.expires = c.expiry()
+	c.mu.Unlock()
+	return v, true
+}
+
+func (c *cacheNode) flush() {
+	c.mu.Lock()
+	c.entries = make(map[string]*entry)
+	c.mu.Unlock()
+}
+
+// per-second samples collected during a run
+type bucket struct {
+	requests int
+	fetches int
+	latencies []time.Duration
+}
+
+type metrics struct {
+	start time.Time
+	buckets []bucket
+	mu sync.Mutex
+}
+
+func newMetrics(seconds int) *metrics {
+	m := new(metrics)
+	m.start = time.Now()
+	m.buckets = make([]bucket, seconds)
+	return m
+}
+
+func (m *metrics) record(latency time.Duration, fetched bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := int(time.Since(m.start) / time.Second)
+	if i >= len(m.buckets) {
+		return
+	}
+	m.buckets[i].requests++
+	m.buckets[i].latencies = append(m.buckets[i].latencies, latency)
+	if fetched {
+		m.buckets[i].fetches++
+	}
+}
+
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func bar(value, max, width int) string {
+	if max == 0 {
+		return ""
+	}
+	return strings.Repeat("#", value*width/max)
+}
+
+type config struct {
+	open bool
+	clients int // closed loop: virtual users
+	think int
+	rate int // open loop: arrivals per second
+	keys int
+}
+
+func (cfg config) String() string {
+	if cfg.open {
+		return fmt.Sprintf("open loop, %d arrival(s)/s, %d hot key(s)", cfg.rate, cfg.keys)
+	}
+	return fmt.Sprintf("closed loop, %d virtual user(s), %dms think time, %d hot key(s)", cfg.clients, cfg.think, cfg.keys)
+}
+
+func request(caches []*cacheNode, cfg config) bool {
+	k := int(sim.Random(int64(cfg.keys)))
+	_, fetched := caches[k%len(caches)].get(fmt.Sprintf("k%d", k))
+	return fetched
+}
+
+// clients hammering a small hot key set
+func run(caches []*cacheNode, cfg config, seconds int) *metrics {
+	m := newMetrics(seconds)
+	deadline := m.start.Add(time.Duration(seconds) * time.Second)
+
+	var wg sync.WaitGroup
+	if cfg.open {
+		// arrivals keep coming regardless of how slow responses are (Poisson process),
+		// latency counts from the scheduled arrival so queueing is not hidden
+		next := m.start
+		for next.Before(deadline) {
+			time.Sleep(time.Until(next))
+
+			wg.Add(1)
+			go func(arrival time.Time) {
+				defer wg.Done()
+				fetched := request(caches, cfg)
+				m.record(time.Since(arrival), fetched)
+			}(next)
+
+			gap := time.Duration(sim.ExpFloat64() * float64(time.Second) / float64(cfg.rate))
+			next = next.Add(gap)
+		}
+		wg.Wait()
+
+		// background refreshes still count against the store
+		caches[0].store.Wait()
+		return m
+	}
+
+	// each virtual user waits for its response and thinks before the next request
+	for i := 0; i < cfg.clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				start := time.Now()
+				fetched := request(caches, cfg)
+				m.record(time.Since(start), fetched)
+
+				time.Sleep(time.Duration(cfg.think) * time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// background refreshes still count against the store
+	caches[0].store.Wait()
+	return m
+}
+
+func plot(m *metrics) {
+	maxRequests, maxFetches, maxP99 := 0, 0, 0
+	for _, b := range m.buckets {
+		if b.requests > maxRequests {
+			maxRequests = b.requests
+		}
+		if b.fetches > maxFetches {
+			maxFetches = b.fetches
+		}
+		if p99 := int(percentile(b.latencies, 0.99) / time.Millisecond); p99 > maxP99 {
+			maxP99 = p99
+		}
+	}
+
+	fmt.Printf("%4s  %-28s  %-24s  %s\n", "t", "throughput (req/s)", "store fetches/s", "p99 latency")
+	for i, b := range m.buckets {
+		p99 := percentile(b.latencies, 0.99)
+		fmt.Printf("%3ds  %5d %-22s  %4d %-19s  %5dms %s\n", i, b.requests, bar(b.requests, maxRequests, 20), b.fetches, bar(b.fetches, maxFetches, 15), p99/time.Millisecond, bar(int(p99/time.Millisecond), maxP99, 20))
+	}
+}
+
+func latencies(m *metrics) []time.Duration {
+	all := []time.Duration{}
+	for _, b := range m.buckets {
+		all = append(all, b.latencies...)
+	}
+	return all
+}
+
+func summary(m *metrics) (int, int, time.Duration, time.Duration) {
+	requests, fetches := 0, 0
+	for _, b := range m.buckets {
+		requests += b.requests
+		fetches += b.fetches
+	}
+	all := latencies(m)
+	return requests, fetches, percentile(all, 0.5), percentile(all, 0.99)
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func main() {
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var cacheCount int
+	var ttl string
+	cfg := config{open: false, clients: 100, think: 20, rate: 2000, keys: 5}
+
+	con.Scan("Number of cache nodes: ", &cacheCount)
+	con.Scan("Cache TTL (e.g. 2s): ", &ttl)
+
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		d = 2 * time.Second
+	}
+
+	s := newStore()
+	m := new(mitigations)
+
+	caches := make([]*cacheNode, cacheCount)
+	for i := range caches {
+		caches[i] = newCacheNode(i, s, m, d)
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, workload, models, latency, toggle, flush, run, compare, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			fmt.Printf("Workload: %s, TTL %v\n", cfg, d)
+			fmt.Printf("Store: %dms + %dms per concurrent fetch, peak %d concurrent\n", s.base, s.penalty, s.peak.Load())
+			fmt.Printf("Coalescing: %s, jittered TTL: %s, lock (serve stale): %s\n", enabledString(m.coalesce.Load()), enabledString(m.jitter.Load()), enabledString(m.lock.Load()))
+			for _, c := range caches {
+				c.mu.Lock()
+				fresh := 0
+				for _, e := range c.entries {
+					if e.valid && time.Now().Before(e.expires) {
+						fresh++
+					}
+				}
+				fmt.Printf("Cache %d (entries: %d, fresh: %d)\n", c.id, len(c.entries), fresh)
+				c.mu.Unlock()
+			}
+		} else if cmd == "workload" {
+			var model string
+
+			con.Scan("Load model (closed, open): ", &model)
+
+			if model == "closed" {
+				cfg.open = false
+				con.Scan("Virtual users: ", &cfg.clients)
+				con.Scan("Think time (ms): ", &cfg.think)
+			} else if model == "open" {
+				cfg.open = true
+				con.Scan("Arrival rate (req/s): ", &cfg.rate)
+				if cfg.rate <= 0 {
+					cfg.rate = 1
+				}
+			} else {
+				fmt.Println("Unknown load model")
+				continue
+			}
+			con.Scan("Hot keys: ", &cfg.keys)
+		} else if cmd == "models" {
+			// same caches, both load models back to back, to compare tail latency under saturation
+			var seconds int
+			con.Scan("Duration per model (s): ", &seconds)
+
+			closed, open := cfg, cfg
+			closed.open = false
+			open.open = true
+
+			fmt.Printf("%-70s %8s %9s %9s %9s\n", "model", "req/s", "p50", "p99", "p99.9")
+			for _, model := range []config{closed, open} {
+				for _, c := range caches {
+					c.flush()
+				}
+				result := run(caches, model, seconds)
+				requests, _, p50, p99 := summary(result)
+				p999 := percentile(latencies(result), 0.999)
+				fmt.Printf("%-70s %8.1f %9v %9v %9v\n", model, float64(requests)/float64(seconds), p50.Round(time.Microsecond), p99.Round(time.Microsecond), p999.Round(time.Microsecond))
+			}
+		} else if cmd == "latency" {
+			con.Scan("Store base latency (ms): ", &s.base)
+			con.Scan("Penalty per concurrent fetch (ms): ", &s.penalty)
+		} else if cmd == "toggle" {
+			var mechanism string
+			con.Scan("Mechanism (coalesce, jitter, lock): ", &mechanism)
+
+			if mechanism == "coalesce" {
+				m.coalesce.Store(!m.coalesce.Load())
+				fmt.Printf("Request coalescing: %s\n", enabledString(m.coalesce.Load()))
+			} else if mechanism == "jitter" {
+				m.jitter.Store(!m.jitter.Load())
+				fmt.Printf("Jittered TTL: %s\n", enabledString(m.jitter.Load()))
+			} else if mechanism == "lock" {
+				m.lock.Store(!m.lock.Load())
+				fmt.Printf("Refresh lock: %s\n", enabledString(m.lock.Load()))
+			} else {
+				fmt.Println("Unknown mechanism")
+			}
+		} else if cmd == "flush" {
+			// cold start: every cache forgets everything at once
+			for _, c := range caches {
+				c.flush()
+			}
+			l.Printf("All caches flushed")
+		} else if cmd == "run" {
+			var seconds int
+			con.Scan("Duration (s): ", &seconds)
+
+			s.peak.Store(0)
+			result := run(caches, cfg, seconds)
+			plot(result)
+
+			requests, fetches, p50, p99 := summary(result)
+			l.Printf("Run of %ds: %d store fetch(es), peak %d concurrent", seconds, fetches, s.peak.Load())
+			fmt.Printf("%d request(s), %d store fetch(es), p50 %v, p99 %v, peak %d concurrent fetches\n", requests, fetches, p50.Round(time.Microsecond), p99.Round(time.Microsecond), s.peak.Load())
+		} else if cmd == "compare" {
+			// each mitigation from a cold start with the same workload
+			var seconds int
+			con.Scan("Duration per mitigation (s): ", &seconds)
+
+			saved := [3]bool{m.coalesce.Load(), m.jitter.Load(), m.lock.Load()}
+			settings := []struct {
+				name string
+				coalesce, jitter, lock bool
+			}{
+				{"none", false, false, false},
+				{"coalesce", true, false, false},
+				{"jitter", false, true, false},
+				{"lock", false, false, true},
+				{"all", true, true, true},
+			}
+
+			results := make([]string, 0, len(settings))
+			for _, setting := range settings {
+				m.coalesce.Store(setting.coalesce)
+				m.jitter.Store(setting.jitter)
+				m.lock.Store(setting.lock)
+				for _, c := range caches {
+					c.flush()
+				}
+				s.peak.Store(0)
+
+				fmt.Printf("== %s ==\n", setting.name)
+				result := run(caches, cfg, seconds)
+				plot(result)
+
+				requests, fetches, p50, p99 := summary(result)
+				l.Printf("Mitigation %s: %d store fetch(es), peak %d concurrent", setting.name, fetches, s.peak.Load())
+				results = append(results, fmt.Sprintf("%-10s %8.1f %10d %8v %8v %6d", setting.name, float64(requests)/float64(seconds), fetches, p50.Round(time.Microsecond), p99.Round(time.Microsecond), s.peak.Load()))
+			}
+
+			fmt.Printf("%-10s %8s %10s %8s %8s %6s\n", "mitigation", "req/s", "fetches", "p50", "p99", "peak")
+			for _, r := range results {
+				fmt.Println(r)
+			}
+
+			m.coalesce.Store(saved[0])
+			m.jitter.Store(saved[1])
+			m.lock.Store(saved[2])
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type vectorClock []int
+
+func (v vectorClock) String() string {
+	s := make([]string, len(v))
+	for i := range v {
+		s[i] = strconv.Itoa(v[i])
+	}
+	return "[" + strings.Join(s, ", ") + "]"
+}
+
+// every entry of v is at most the matching entry of other
+func (v vectorClock) before(other vectorClock) bool {
+	for i := range v {
+		if v[i] > other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type message struct {
+	sender int
+	deps vectorClock // broadcasts from each node the sender had delivered, plus its own earlier ones
+	data string
+
+	// ground truth order assigned by the omniscient observer at send time
+	global int64
+}
+
+type nodePool struct {
+	*sim.Pool
+	participants int
+	broadcast func(m message, lmin, lmax int, overrides map[int]time.Duration)
+
+	oracle atomic.Int64
+
+	// deliberately weaken the protocol for demonstration
+	skipHoldBack atomic.Bool
+}
+
+func newNodePool(participants int, broadcast func(m message, lmin, lmax int, overrides map[int]time.Duration)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.participants = participants
+	pool.broadcast = broadcast
+	pool.oracle.Store(0)
+	pool.skipHoldBack.Store(false)
+	return pool
+}
+
+type node struct {
+	*sim.Process
+	pool *nodePool
+
+	sendSeq int
+	delivered vectorClock
+	buffer *list.List
+	violations int
+	mu sync.Mutex
+
+	broadcast chan message
+
+	// real-time order of delivered messages
+	history *sim.History
+}
+
+func newNode(pool *nodePool, id, clockSpeed int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.sendSeq = 0
+	n.delivered = make(vectorClock, pool.participants)
+	n.buffer = list.New()
+	n.violations = 0
+	n.broadcast = make(chan message)
+	n.history = sim.NewHistory(0, 0)
+	return n
+}
+
+func (n *node) Run() {
+	n.Start(nil)
+
+	// poll broadcast messages
+	sim.Listen(n.Process, n.broadcast, n.receive)
+}
+
+func (n *node) send(data string, lmin, lmax int, overrides map[int]time.Duration) {
+	n.mu.Lock()
+	deps := append(vectorClock{}, n.delivered...)
+	deps[n.ID()] = n.sendSeq
+	n.sendSeq++
+	n.mu.Unlock()
+
+	m := message{
+		sender: n.ID(),
+		deps: deps,
+		data: data,
+		global: n.pool.oracle.Add(1) - 1,
+	}
+
+	n.Printf("Node %d sends broadcast: %s %v", n.ID(), data, deps)
+
+	n.pool.broadcast(m, lmin, lmax, overrides)
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.pool.skipHoldBack.Load() {
+		// deliver immediately without waiting for causal predecessors
+		n.deliver(m)
+		return
+	}
+
+	n.buffer.PushBack(m)
+	if !m.deps.before(n.delivered) {
+		n.Printf("Node %d holds back %s from node %d: needs %v, has %v", n.ID(), m.data, m.sender, m.deps, n.delivered)
+	}
+
+	for {
+		var ok bool
+
+		ok = false
+		var deliver message
+		for e := n.buffer.Front(); e != nil; e = e.Next() {
+			deliver = e.Value.(message)
+			if deliver.deps.before(n.delivered) {
+				ok = true
+				n.buffer.Remove(e)
+				break
+			}
+		}
+
+		if !ok {
+			break
+		}
+
+		n.deliver(deliver)
+	}
+}
+
+// deliver a message to the application (node lock must be held)
+func (n *node) deliver(m message) {
+	if !m.deps.before(n.delivered) {
+		n.violations++
+		n.Printf("Node %d VIOLATION: %s from node %d depends on %v but only %v delivered", n.ID(), m.data, m.sender, m.deps, n.delivered)
+	}
+	n.delivered[m.sender]++
+
+	n.Printf("Node %d receives broadcast: %s (from node %d) %v", n.ID(), m.data, m.sender, n.delivered)
+	n.history.Record(m.global)
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func main() {
+	distribution := flag.String("latency", "uniform", "latency distribution: uniform, normal, exponential or pareto")
+	topology := flag.String("topology", "mesh", "how nodes are wired: mesh, ring, line, star, tree, random:<p> or file:<path>")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		return sim.Deliver(nodes[to].Process, nodes[to].broadcast, m)
+	})
+
+	wiring, err := sim.ParseTopology(*topology, nodeCount)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	network.SetTopology(wiring)
+
+	network.Latencies, err = sim.ParseDistribution(*distribution)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	network.OnDrop = func(p *sim.Packet[message], reason string) {
+		l.Printf("Broadcast %s from node %d to node %d dropped (%s)", p.Msg.data, p.Msg.sender, p.To, reason)
+	}
+
+	network.OnSettled = func(r sim.BroadcastResult[message]) {
+		if len(r.Lost) > 0 {
+			con.Notify("Broadcast %s from node %d settled in %v: reached %v, lost at %v", r.Msg.data, r.From, r.Elapsed.Round(time.Millisecond), r.Reached, r.Lost)
+		} else {
+			con.Notify("Broadcast %s from node %d reached all nodes in %v", r.Msg.data, r.From, r.Elapsed.Round(time.Millisecond))
+		}
+	}
+
+	broadcaster := func(m message, lmin, lmax int, overrides map[int]time.Duration) {
+		network.Broadcast(m.sender, m, func(to int) time.Duration {
+			// broadcast delay (exact if overridden)
+			if latency, ok := overrides[to]; ok {
+				return latency
+			}
+			return network.Latency(m.sender, to, lmin, lmax)
+		})
+	}
+
+	pool := newNodePool(nodeCount, broadcaster)
+	for i := 0; i < nodeCount; i++ {
+		clockSpeed := int(500 + sim.Random(500))
+
+		nodes[i] = newNode(pool, i, clockSpeed, l)
+		nodes[i].Run()
+	}
+
+
+	network.OnBreak = func(p *sim.Packet[message], b sim.Breakpoint) {
+		con.Notify("Breakpoint #%d: broadcast %s %v from node %d about to be delivered to node %d, network paused (step or resume)", b.ID, p.Msg.data, p.Msg.deps, p.From, p.To)
+	}
+
+	watcher := sim.NewWatcher(nodeCount)
+	watcher.OnTrigger = func(alert string, pause bool) {
+		if pause && !network.Paused() {
+			network.Pause()
+			alert += ", network paused (resume to continue)"
+		}
+		con.Notify("%s", alert)
+	}
+	watcher.Probe("buffer", func(i int) int64 {
+		nodes[i].mu.Lock()
+		defer nodes[i].mu.Unlock()
+		return int64(nodes[i].buffer.Len())
+	})
+	watcher.Probe("delivered", func(i int) int64 {
+		return int64(nodes[i].history.Count())
+	})
+	watcher.Probe("seq", func(i int) int64 {
+		nodes[i].mu.Lock()
+		defer nodes[i].mu.Unlock()
+		return int64(nodes[i].sendSeq)
+	})
+
+	stopWatching := make(chan struct{})
+	watcher.Run(10*time.Millisecond, stopWatching)
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, broadcast, inflight, deliver, drop, oracle, stats, drain, loss, watch, unwatch, break, unbreak, step, resume, topology, partition, heal, logs, toggle, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				fmt.Printf("Node %d (seq: %d) delivered %v, %d held back\n", nodes[i].ID(), nodes[i].sendSeq, nodes[i].delivered, nodes[i].buffer.Len())
+				nodes[i].mu.Unlock()
+			}
+		} else if cmd == "broadcast" {
+			var sender int
+			var data, to string
+			var lmin, lmax int
+
+			con.Scan("Sender: ", &sender)
+			con.Scan("Data: ", &data)
+			con.Scan("Min latency (ms): ", &lmin)
+			con.Scan("Max latency (ms): ", &lmax)
+			con.Scan("Latency overrides (e.g. 1=500ms,2=50ms, - for none): ", &to)
+
+			overrides, err := sim.ParseOverrides(to)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			nodes[sender].send(data, lmin, lmax, overrides)
+		} else if cmd == "inflight" {
+			packets := network.InFlight()
+			if len(packets) == 0 {
+				fmt.Println("No messages in flight")
+			}
+			for _, p := range packets {
+				fmt.Printf("#%d: node %d -> node %d, %s %v, due in %v%s\n", p.ID, p.Msg.sender, p.To, p.Msg.data, p.Msg.deps, time.Until(p.Due).Round(time.Millisecond), sim.Via(p.Route))
+			}
+		} else if cmd == "deliver" || cmd == "drop" {
+			var id int
+
+			con.Scan("Message ID: ", &id)
+
+			if !network.Signal(id, cmd) {
+				fmt.Println("No such message in flight")
+			}
+		} else if cmd == "oracle" {
+			// delivery order against the real-time send order, concurrent broadcasts may legitimately swap
+			for i := range nodes {
+				order := nodes[i].history.Order()
+
+				s := make([]string, len(order))
+				for j := range order {
+					s[j] = strconv.FormatInt(order[j], 10)
+				}
+
+				nodes[i].mu.Lock()
+				violations := nodes[i].violations
+				nodes[i].mu.Unlock()
+
+				fmt.Printf("Node %d delivered [%s], %d inversion(s), %d causality violation(s)\n", nodes[i].ID(), strings.Join(s, ", "), sim.Inversions(order), violations)
+			}
+		} else if cmd == "drain" {
+			// deliver everything in flight now instead of waiting for it
+			fmt.Printf("Delivered %d message(s) early\n", network.Drain())
+		} else if cmd == "loss" {
+			// lossy link: every message on it is lost with the given probability
+
+			var source, target, percent int
+
+			con.Scan("Source node: ", &source)
+			con.Scan("Target node: ", &target)
+			con.Scan("Drop probability (%): ", &percent)
+
+			if percent < 0 || percent > 100 {
+				fmt.Println("Invalid percentage")
+				continue
+			}
+			network.Lose(source, target, percent)
+
+			fmt.Printf("Link %d -> %d loses %d%% of messages\n", source, target, percent)
+		} else if cmd == "stats" {
+			delivered := 0
+			for i := range nodes {
+				delivered += nodes[i].history.Count()
+			}
+			network.Stats.Report(os.Stdout, nodeCount, delivered)
+		} else if cmd == "watch" {
+			var expr, pause string
+
+			con.ScanLine(fmt.Sprintf("Expression (e.g. node[2].buffer > 5, probes: %s): ", strings.Join(watcher.Probes(), ", ")), &expr)
+			con.Scan("Pause when triggered (yes/no): ", &pause)
+
+			id, err := watcher.Watch(expr, pause == "yes")
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("Watching #%d\n", id)
+		} else if cmd == "unwatch" {
+			var id int
+
+			watches := watcher.List()
+			if len(watches) == 0 {
+				fmt.Println("No watches")
+				continue
+			}
+			for _, w := range watches {
+				fmt.Println(w)
+			}
+			con.Scan("Watch ID: ", &id)
+
+			if !watcher.Unwatch(id) {
+				fmt.Println("No such watch")
+			}
+		} else if cmd == "break" {
+			var spec string
+
+			con.ScanLine("Breakpoint (e.g. on deliver node=3 sender=1): ", &spec)
+
+			b, err := sim.ParseBreakpoint(spec)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("Breakpoint #%d set\n", network.Break(b))
+		} else if cmd == "unbreak" {
+			var id int
+
+			breakpoints := network.Breakpoints()
+			if len(breakpoints) == 0 {
+				fmt.Println("No breakpoints")
+				continue
+			}
+			for _, b := range breakpoints {
+				fmt.Println(b)
+			}
+			con.Scan("Breakpoint ID: ", &id)
+
+			if !network.Unbreak(id) {
+				fmt.Println("No such breakpoint")
+			}
+		} else if cmd == "step" {
+			// deliver the next packet while keeping everything else paused
+			p, ok := network.Step()
+			if !ok {
+				fmt.Println("No messages in flight")
+				continue
+			}
+			fmt.Printf("Stepped #%d: broadcast %s %v from node %d to node %d\n", p.ID, p.Msg.data, p.Msg.deps, p.From, p.To)
+		} else if cmd == "resume" {
+			if !network.Paused() {
+				fmt.Println("Network is not paused")
+				continue
+			}
+			network.Resume()
+			fmt.Println("Network resumed")
+		} else if cmd == "topology" {
+			// messages to non-neighbors are forwarded hop by hop along the shortest path
+			fmt.Printf("Topology: %s\n", wiring)
+			for i := 0; i < nodeCount; i++ {
+				fmt.Printf("Node %d: neighbors %v\n", i, wiring.Neighbors(i))
+			}
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "toggle" {
+			var mechanism string
+			con.Scan("Mechanism (holdback): ", &mechanism)
+
+			if mechanism == "holdback" {
+				skip := !pool.skipHoldBack.Load()
+				pool.skipHoldBack.Store(skip)
+				fmt.Printf("Causal hold-back: %s\n", enabledString(!skip))
+			} else {
+				fmt.Println("Unknown mechanism")
+			}
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	close(stopWatching)
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Resume()
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
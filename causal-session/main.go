@@ -0,0 +1,350 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type write struct {
+	origin int
+	seq int
+	key string
+	value string
+}
+
+type versionVector []int
+
+func (v versionVector) String() string {
+	s := make([]string, len(v))
+	for i := range v {
+		s[i] = strconv.Itoa(v[i])
+	}
+	return "[" + strings.Join(s, ", ") + "]"
+}
+
+func (v versionVector) dominates(other versionVector) bool {
+	for i := range v {
+		if v[i] < other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type entry struct {
+	value string
+	version versionVector // replica state right after the write was applied
+}
+
+type replicaPool struct {
+	*sim.Pool
+
+	participants int
+	replicate func(w write)
+
+	// session guarantees (read-your-writes, monotonic reads) on the client side
+	session atomic.Bool
+}
+
+func newReplicaPool(participants int, replicate func(w write)) *replicaPool {
+	pool := new(replicaPool)
+	pool.Pool = sim.NewPool()
+	pool.participants = participants
+	pool.replicate = replicate
+	pool.session.Store(true)
+	return pool
+}
+
+type replica struct {
+	pool *replicaPool
+	id int
+	l sim.Logger
+
+	store map[string]entry
+	applied versionVector
+	pending []write
+	mu sync.Mutex
+}
+
+func newReplica(pool *replicaPool, id int, l sim.Logger) *replica {
+	r := new(replica)
+	r.pool = pool
+	r.id = id
+	r.l = l
+	r.store = make(map[string]entry)
+	r.applied = make(versionVector, pool.participants)
+	r.pending = nil
+	return r
+}
+
+func (r *replica) version() versionVector {
+	r.mu.Lock()
+	v := append(versionVector{}, r.applied...)
+	r.mu.Unlock()
+	return v
+}
+
+func (r *replica) apply(w write) {
+	r.applied[w.origin] = w.seq
+	r.store[w.key] = entry{
+		value: w.value,
+		version: append(versionVector{}, r.applied...),
+	}
+}
+
+func (r *replica) put(key, value string) versionVector {
+	r.mu.Lock()
+	w := write{
+		origin: r.id,
+		seq: r.applied[r.id] + 1,
+		key: key,
+		value: value,
+	}
+	r.apply(w)
+	v := append(versionVector{}, r.applied...)
+	r.mu.Unlock()
+
+	r.l.Printf("Replica %d writes %s = %s (%d:%d)", r.id, key, value, w.origin, w.seq)
+
+	// asynchronous replication
+	r.pool.replicate(w)
+
+	return v
+}
+
+func (r *replica) get(key string) (entry, bool) {
+	r.mu.Lock()
+	e, ok := r.store[key]
+	r.mu.Unlock()
+	return e, ok
+}
+
+func (r *replica) receive(w write) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// writes of the same origin are applied in order
+	r.pending = append(r.pending, w)
+	for {
+		applied := false
+		for i := range r.pending {
+			if r.pending[i].seq == r.applied[r.pending[i].origin]+1 {
+				p := r.pending[i]
+				r.pending = append(r.pending[:i], r.pending[i+1:]...)
+				r.apply(p)
+				r.l.Printf("Replica %d applies %s = %s (%d:%d)", r.id, p.key, p.value, p.origin, p.seq)
+				applied = true
+				break
+			}
+		}
+
+		if !applied {
+			break
+		}
+	}
+}
+
+type client struct {
+	id int
+	replica *replica
+	session versionVector // everything this client has written or read
+	l sim.Logger
+}
+
+func newClient(id int, r *replica, l sim.Logger) *client {
+	c := new(client)
+	c.id = id
+	c.replica = r
+	c.session = make(versionVector, r.pool.participants)
+	c.l = l
+	return c
+}
+
+func (c *client) observe(v versionVector) {
+	for i := range v {
+		if v[i] > c.session[i] {
+			c.session[i] = v[i]
+		}
+	}
+}
+
+func (c *client) write(key, value string) {
+	c.observe(c.replica.put(key, value))
+}
+
+func (c *client) read(key string, timeout time.Duration) {
+	if c.replica.pool.session.Load() {
+		// wait until the replica has caught up with the client's session
+		deadline := time.Now().Add(timeout)
+		for !c.replica.version().dominates(c.session) {
+			if time.Now().After(deadline) {
+				fmt.Printf("Replica %d has not caught up with session %s, read refused\n", c.replica.id, c.session)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	e, ok := c.replica.get(key)
+	if !ok {
+		fmt.Printf("%s = (none) from replica %d\n", key, c.replica.id)
+	} else {
+		fmt.Printf("%s = %s from replica %d\n", key, e.value, c.replica.id)
+	}
+
+	if !c.replica.version().dominates(c.session) {
+		fmt.Printf("ANOMALY: replica %d %s is behind client %d session %s\n", c.replica.id, c.replica.version(), c.id, c.session)
+		c.l.Printf("Client %d stale read of %s at replica %d", c.id, key, c.replica.id)
+	}
+
+	if ok {
+		c.observe(e.version)
+	}
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func main() {
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var replicaCount, clientCount int
+	con.Scan("Number of replicas: ", &replicaCount)
+	con.Scan("Number of clients: ", &clientCount)
+
+	var lmin, lmax atomic.Int64
+	lmin.Store(500)
+	lmax.Store(2000)
+
+	replicas := make([]*replica, replicaCount)
+	replicator := func(w write) {
+		pool := replicas[w.origin].pool
+		for i := range replicas {
+			if i == w.origin {
+				continue
+			}
+
+			// replication delay
+			latency := lmin.Load() + sim.Random(lmax.Load()-lmin.Load())
+			target := replicas[i]
+			pool.Go(func() {
+				time.Sleep(time.Duration(latency) * time.Millisecond)
+				target.receive(w)
+			})
+		}
+	}
+
+	pool := newReplicaPool(replicaCount, replicator)
+	for i := range replicas {
+		replicas[i] = newReplica(pool, i, l)
+	}
+
+	clients := make([]*client, clientCount)
+	for i := range clients {
+		clients[i] = newClient(i, replicas[i%replicaCount], l)
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, write, read, migrate, latency, toggle, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			fmt.Printf("Session guarantees: %s, replication latency: %d-%dms\n", enabledString(pool.session.Load()), lmin.Load(), lmax.Load())
+			for i := range replicas {
+				replicas[i].mu.Lock()
+				keys := make([]string, 0, len(replicas[i].store))
+				for k := range replicas[i].store {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+
+				values := make([]string, len(keys))
+				for j := range keys {
+					values[j] = keys[j] + "=" + replicas[i].store[keys[j]].value
+				}
+
+				fmt.Printf("Replica %d %s {%s} (pending: %d)\n", replicas[i].id, replicas[i].applied, strings.Join(values, ", "), len(replicas[i].pending))
+				replicas[i].mu.Unlock()
+			}
+			for i := range clients {
+				fmt.Printf("Client %d at replica %d, session %s\n", clients[i].id, clients[i].replica.id, clients[i].session)
+			}
+		} else if cmd == "write" {
+			var id int
+			var key, value string
+
+			con.Scan("Client: ", &id)
+			con.Scan("Key: ", &key)
+			con.Scan("Value: ", &value)
+
+			clients[id].write(key, value)
+		} else if cmd == "read" {
+			var id int
+			var key string
+
+			con.Scan("Client: ", &id)
+			con.Scan("Key: ", &key)
+
+			clients[id].read(key, time.Duration(lmax.Load()*2)*time.Millisecond)
+		} else if cmd == "migrate" {
+			// failover: the client continues its session on another replica
+			var id, target int
+
+			con.Scan("Client: ", &id)
+			con.Scan("Replica: ", &target)
+
+			l.Printf("Client %d migrates from replica %d to replica %d", id, clients[id].replica.id, target)
+			clients[id].replica = replicas[target]
+		} else if cmd == "latency" {
+			var lo, hi int64
+
+			con.Scan("Min latency (ms): ", &lo)
+			con.Scan("Max latency (ms): ", &hi)
+
+			lmin.Store(lo)
+			lmax.Store(hi)
+		} else if cmd == "toggle" {
+			enabled := !pool.session.Load()
+			pool.session.Store(enabled)
+			fmt.Printf("Session guarantees: %s\n", enabledString(enabled))
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	fmt.Println("Waiting for writes in flight")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
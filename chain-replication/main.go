@@ -0,0 +1,410 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type update struct {
+	seq int
+	key string
+	value string
+	issued time.Time
+}
+
+// the master keeps the chain configuration
+type chainPool struct {
+	*sim.Pool
+
+	chain []int
+	chainMu sync.Mutex
+
+	nextSeq atomic.Int64
+	lmin, lmax atomic.Int64
+}
+
+func newChainPool(participants int) *chainPool {
+	pool := new(chainPool)
+	pool.Pool = sim.NewPool()
+	pool.chain = make([]int, participants)
+	for i := range pool.chain {
+		pool.chain[i] = i
+	}
+	pool.nextSeq.Store(1)
+	pool.lmin.Store(50)
+	pool.lmax.Store(200)
+	return pool
+}
+
+func (pool *chainPool) position(id int) int {
+	pool.chainMu.Lock()
+	defer pool.chainMu.Unlock()
+
+	for i := range pool.chain {
+		if pool.chain[i] == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (pool *chainPool) neighbor(id, offset int) int {
+	pool.chainMu.Lock()
+	defer pool.chainMu.Unlock()
+
+	for i := range pool.chain {
+		if pool.chain[i] == id {
+			if i+offset < 0 || i+offset >= len(pool.chain) {
+				return -1
+			}
+			return pool.chain[i+offset]
+		}
+	}
+	return -1
+}
+
+func (pool *chainPool) head() int {
+	pool.chainMu.Lock()
+	defer pool.chainMu.Unlock()
+	return pool.chain[0]
+}
+
+func (pool *chainPool) tail() int {
+	pool.chainMu.Lock()
+	defer pool.chainMu.Unlock()
+	return pool.chain[len(pool.chain)-1]
+}
+
+func (pool *chainPool) latency() time.Duration {
+	return sim.Latency(int(pool.lmin.Load()), int(pool.lmax.Load()))
+}
+
+type node struct {
+	*sim.Process
+
+	pool *chainPool
+	nodes []*node
+	id int
+	l sim.Logger
+
+	store *sim.KV
+	applied int
+	sent []update // forwarded downstream but not yet acknowledged by the tail
+	mu sync.Mutex
+
+	// FIFO links to the successor (updates) and predecessor (acks)
+	updates chan update
+	acks chan int
+
+	crashed atomic.Bool
+}
+
+func newNode(pool *chainPool, nodes []*node, id int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, 0, l)
+	n.pool = pool
+	n.nodes = nodes
+	n.id = id
+	n.l = l
+	n.store = sim.NewKV()
+	n.applied = 0
+	n.sent = nil
+	n.updates = make(chan update, 1024)
+	n.acks = make(chan int, 1024)
+	n.crashed.Store(false)
+	return n
+}
+
+func (n *node) run() {
+	// forward updates downstream in order
+	sim.Listen(n.Process, n.updates, func(u update) {
+		time.Sleep(n.pool.latency())
+
+		next := n.pool.neighbor(n.id, 1)
+		if n.crashed.Load() || next < 0 || n.nodes[next].crashed.Load() {
+			return
+		}
+		n.nodes[next].receive(u)
+	})
+
+	// forward acknowledgements upstream in order
+	sim.Listen(n.Process, n.acks, func(seq int) {
+		time.Sleep(n.pool.latency())
+
+		prev := n.pool.neighbor(n.id, -1)
+		if n.crashed.Load() || prev < 0 || n.nodes[prev].crashed.Load() {
+			return
+		}
+		n.nodes[prev].acknowledge(seq)
+	})
+}
+
+func (n *node) receive(u update) {
+	n.mu.Lock()
+	if u.seq <= n.applied {
+		// duplicate from a resend after reconfiguration
+		n.mu.Unlock()
+		return
+	}
+
+	n.store.Put(u.key, u.value)
+	n.applied = u.seq
+	tail := n.pool.tail() == n.id
+	if !tail {
+		n.sent = append(n.sent, u)
+	}
+	n.mu.Unlock()
+
+	if tail {
+		n.l.Printf("Node %d (tail) commits #%d %s = %s after %v", n.id, u.seq, u.key, u.value, time.Since(u.issued).Round(time.Millisecond))
+		n.acks <- u.seq
+	} else {
+		n.l.Printf("Node %d applies #%d %s = %s", n.id, u.seq, u.key, u.value)
+		n.updates <- u
+	}
+}
+
+func (n *node) acknowledge(seq int) {
+	n.mu.Lock()
+	i := 0
+	for i < len(n.sent) && n.sent[i].seq <= seq {
+		i++
+	}
+	n.sent = n.sent[i:]
+	n.mu.Unlock()
+
+	if n.pool.head() != n.id {
+		n.acks <- seq
+	}
+}
+
+func (n *node) read(key string) (string, bool) {
+	n.mu.Lock()
+	v, ok := n.store.Get(key)
+	n.mu.Unlock()
+	return v, ok
+}
+
+// master reaction to a crashed node
+func reconfigure(pool *chainPool, nodes []*node, id int, l sim.Logger) {
+	prev := pool.neighbor(id, -1)
+	next := pool.neighbor(id, 1)
+
+	pool.chainMu.Lock()
+	for i := range pool.chain {
+		if pool.chain[i] == id {
+			pool.chain = append(pool.chain[:i], pool.chain[i+1:]...)
+			break
+		}
+	}
+	pool.chainMu.Unlock()
+
+	if prev < 0 {
+		l.Printf("Master: head %d failed, node %d is the new head", id, next)
+	} else if next < 0 {
+		// the new tail commits everything it has forwarded
+		p := nodes[prev]
+		p.mu.Lock()
+		sent := p.sent
+		p.sent = nil
+		p.mu.Unlock()
+
+		l.Printf("Master: tail %d failed, node %d is the new tail (%d update(s) committed)", id, prev, len(sent))
+		if len(sent) > 0 {
+			p.acknowledge(sent[len(sent)-1].seq)
+		}
+	} else {
+		// the predecessor resends what the successor may have missed
+		p := nodes[prev]
+		p.mu.Lock()
+		sent := append([]update{}, p.sent...)
+		p.mu.Unlock()
+
+		// and the successor acknowledges again what the crashed node may
+		// have been holding on its way up
+		s := nodes[next]
+		s.mu.Lock()
+		acked := s.applied
+		if len(s.sent) > 0 {
+			acked = s.sent[0].seq - 1
+		}
+		s.mu.Unlock()
+
+		l.Printf("Master: node %d failed, linking %d -> %d, resending %d update(s) and acknowledging #%d again", id, prev, next, len(sent), acked)
+		for _, u := range sent {
+			p.updates <- u
+		}
+		if acked > 0 {
+			s.acks <- acked
+		}
+	}
+}
+
+func main() {
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	pool := newChainPool(nodeCount)
+
+	nodes := make([]*node, nodeCount)
+	for i := range nodes {
+		nodes[i] = newNode(pool, nodes, i, l)
+		nodes[i].run()
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, put, get, read, hash, crash, join, latency, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			pool.chainMu.Lock()
+			chain := make([]string, len(pool.chain))
+			for i := range pool.chain {
+				chain[i] = strconv.Itoa(pool.chain[i])
+			}
+			pool.chainMu.Unlock()
+			fmt.Printf("Chain: %s\n", strings.Join(chain, " -> "))
+
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				fmt.Printf("Node %d (applied: #%d, unacknowledged: %d, crashed: %v) %s\n", nodes[i].id, nodes[i].applied, len(nodes[i].sent), nodes[i].crashed.Load(), nodes[i].store)
+				nodes[i].mu.Unlock()
+			}
+		} else if cmd == "put" || cmd == "write" {
+			var key, value string
+
+			con.Scan("Key: ", &key)
+			con.Scan("Value: ", &value)
+
+			// writes always enter at the head
+			u := update{
+				seq: int(pool.nextSeq.Add(1) - 1),
+				key: key,
+				value: value,
+				issued: time.Now(),
+			}
+			nodes[pool.head()].receive(u)
+		} else if cmd == "read" || cmd == "get" || cmd == "readat" {
+			var key string
+			id := pool.tail()
+
+			if cmd != "read" {
+				con.Scan("Node: ", &id)
+			}
+			con.Scan("Key: ", &key)
+
+			v, ok := nodes[id].read(key)
+			if !ok {
+				v = "(none)"
+			}
+			fmt.Printf("%s = %s from node %d", key, v, id)
+
+			if id != pool.tail() {
+				// only the tail is guaranteed to return committed values
+				fmt.Printf(" (not the tail, may be uncommitted)")
+			}
+			fmt.Println()
+		} else if cmd == "hash" {
+			// lock every node at once so the digests come from one consistent cut
+			applied := make([]int, len(nodes))
+			stores := make([]*sim.KV, len(nodes))
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				applied[i] = nodes[i].applied
+				stores[i] = nodes[i].store.Clone()
+			}
+			for i := range nodes {
+				nodes[i].mu.Unlock()
+			}
+			sim.ReportDigests(os.Stdout, "Node", applied, stores)
+		} else if cmd == "crash" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			if nodes[id].crashed.Load() || pool.position(id) < 0 {
+				fmt.Println("Node is not in the chain")
+				continue
+			}
+			if pool.head() == pool.tail() {
+				fmt.Println("Cannot crash the last node in the chain")
+				continue
+			}
+			nodes[id].crashed.Store(true)
+			reconfigure(pool, nodes, id, l)
+		} else if cmd == "join" {
+			// a recovered node joins as the new tail after copying the current tail's state
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			if pool.position(id) >= 0 {
+				fmt.Println("Node is already in the chain")
+				continue
+			}
+
+			tail := nodes[pool.tail()]
+			tail.mu.Lock()
+			nodes[id].mu.Lock()
+			nodes[id].store = tail.store.Clone()
+			nodes[id].applied = tail.applied
+			nodes[id].sent = nil
+			nodes[id].mu.Unlock()
+
+			pool.chainMu.Lock()
+			pool.chain = append(pool.chain, id)
+			pool.chainMu.Unlock()
+			tail.mu.Unlock()
+
+			nodes[id].crashed.Store(false)
+			l.Printf("Master: node %d joins as the new tail at #%d", id, nodes[id].applied)
+		} else if cmd == "latency" {
+			var lmin, lmax int64
+
+			con.Scan("Min latency (ms): ", &lmin)
+			con.Scan("Max latency (ms): ", &lmax)
+
+			pool.lmin.Store(lmin)
+			pool.lmax.Store(lmax)
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
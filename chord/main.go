@@ -0,0 +1,599 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// a node as others know it: its place on the ring and where to reach it
+type ref struct {
+	id uint32
+	slot int // -1 for nobody
+}
+
+var nobody = ref{slot: -1}
+
+// x in (a, b], the whole ring when a == b
+func between(x, a, b uint32) bool {
+	if a < b {
+		return a < x && x <= b
+	}
+	return x > a || x <= b
+}
+
+// x in (a, b), all but a when a == b
+func strictlyBetween(x, a, b uint32) bool {
+	if a < b {
+		return a < x && x < b
+	}
+	return x > a || x < b
+}
+
+type message struct {
+	kind string // find, found, getpred, pred, notify or leave
+	from int
+
+	// find and found
+	lookup int64
+	target uint32
+	origin int
+	purpose string // lookup, join or finger
+	finger int
+	path []int // slots the find went through
+
+	node ref // found: the owner, pred: the predecessor, notify and leave: who to take instead
+}
+
+type nodePool struct {
+	*sim.Pool
+	bits int
+	send func(from, to int, m message)
+
+	// lookups the console waits for
+	pending map[int64]chan message
+	nextLookup int64
+	pendingMu sync.Mutex
+
+	answered atomic.Int64
+	lost atomic.Int64
+	hops atomic.Int64
+}
+
+func newNodePool(bits int, send func(from, to int, m message)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.bits = bits
+	pool.send = send
+	pool.pending = map[int64]chan message{}
+	pool.nextLookup = 0
+	pool.answered.Store(0)
+	pool.lost.Store(0)
+	pool.hops.Store(0)
+	return pool
+}
+
+// the identifier a name hashes to
+func (p *nodePool) id(s string) uint32 {
+	return hash(s) % (1 << p.bits)
+}
+
+// start of finger i of a node: id + 2^i
+func (p *nodePool) start(id uint32, i int) uint32 {
+	return (id + 1<<i) % (1 << p.bits)
+}
+
+type node struct {
+	*sim.Process
+	pool *nodePool
+	ref ref
+
+	successor ref
+	predecessor ref
+	fingers []ref // fingers[i] is the successor of id + 2^i
+	next int // finger fixed on the next stabilization round
+
+	mu sync.Mutex
+
+	inbox chan message
+}
+
+func newNode(pool *nodePool, slot int, id uint32, clockSpeed int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, slot, clockSpeed, l)
+	n.pool = pool
+	n.ref = ref{id: id, slot: slot}
+	n.successor = n.ref
+	n.predecessor = nobody
+	n.fingers = make([]ref, pool.bits)
+	for i := range n.fingers {
+		n.fingers[i] = n.ref
+	}
+	n.next = 0
+	n.inbox = make(chan message)
+	return n
+}
+
+func (n *node) Run() {
+	// every tick is a stabilization round
+	n.Start(n.stabilize)
+
+	// poll lookups and stabilization messages
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
+
+func (n *node) send(to int, m message) {
+	m.from = n.ID()
+	n.pool.send(n.ID(), to, m)
+}
+
+func (n *node) stabilize() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// ask the successor who it thinks comes before it
+	if n.successor.slot == n.ID() {
+		n.adoptLocked(n.predecessor)
+	} else {
+		n.send(n.successor.slot, message{kind: "getpred"})
+	}
+
+	// and refresh one finger
+	n.next = (n.next + 1) % n.pool.bits
+	n.findLocked(message{kind: "find", target: n.pool.start(n.ref.id, n.next), origin: n.ID(), purpose: "finger", finger: n.next})
+}
+
+// take p as successor if it sits between this node and the current one, then
+// let the successor know about this node (node lock must be held)
+func (n *node) adoptLocked(p ref) {
+	if p.slot >= 0 && p.slot != n.ID() && strictlyBetween(p.id, n.ref.id, n.successor.id) {
+		n.Printf("Node %d (id %d) takes node %d (id %d) as successor", n.ID(), n.ref.id, p.slot, p.id)
+		n.successor = p
+		n.fingers[0] = p
+	}
+	if n.successor.slot == n.ID() {
+		return
+	}
+	n.send(n.successor.slot, message{kind: "notify", node: n.ref})
+}
+
+// the finger that gets closest to target without passing it (node lock must
+// be held)
+func (n *node) closestPreceding(target uint32) ref {
+	for i := len(n.fingers) - 1; i >= 0; i-- {
+		f := n.fingers[i]
+		if f.slot != n.ID() && strictlyBetween(f.id, n.ref.id, target) {
+			return f
+		}
+	}
+	return n.ref
+}
+
+// answer the find if the successor owns the target, else pass it on along the
+// fingers (node lock must be held)
+func (n *node) findLocked(m message) {
+	m.path = append(append([]int{}, m.path...), n.ID())
+
+	next := n.closestPreceding(m.target)
+	if between(m.target, n.ref.id, n.successor.id) || next.slot == n.ID() {
+		m.kind = "found"
+		m.node = n.successor
+		if m.origin == n.ID() {
+			n.foundLocked(m)
+		} else {
+			n.send(m.origin, m)
+		}
+		return
+	}
+	n.send(next.slot, m)
+}
+
+// node lock must be held
+func (n *node) foundLocked(m message) {
+	switch m.purpose {
+	case "lookup":
+		n.pool.pendingMu.Lock()
+		answer, ok := n.pool.pending[m.lookup]
+		delete(n.pool.pending, m.lookup)
+		n.pool.pendingMu.Unlock()
+		if ok {
+			answer <- m
+		}
+
+	case "join":
+		n.Printf("Node %d (id %d) joins before node %d (id %d)", n.ID(), n.ref.id, m.node.slot, m.node.id)
+		n.successor = m.node
+		n.fingers[0] = m.node
+
+	case "finger":
+		n.fingers[m.finger] = m.node
+		if m.finger == 0 {
+			n.successor = m.node
+		}
+	}
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch m.kind {
+	case "find":
+		n.findLocked(m)
+
+	case "found":
+		n.foundLocked(m)
+
+	case "getpred":
+		n.send(m.from, message{kind: "pred", node: n.predecessor})
+
+	case "pred":
+		n.adoptLocked(m.node)
+
+	case "notify":
+		if n.predecessor.slot < 0 || strictlyBetween(m.node.id, n.predecessor.id, n.ref.id) {
+			n.predecessor = m.node
+		}
+
+	case "leave":
+		// a neighbour leaves and names who to take instead
+		if n.successor.slot == m.from {
+			n.successor = m.node
+			n.fingers[0] = m.node
+		}
+		if n.predecessor.slot == m.from {
+			n.predecessor = m.node
+		}
+	}
+}
+
+// hand the neighbours to each other before going
+func (n *node) leave() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.Printf("Node %d (id %d) leaves", n.ID(), n.ref.id)
+	if n.successor.slot != n.ID() {
+		n.send(n.successor.slot, message{kind: "leave", node: n.predecessor})
+	}
+	if n.predecessor.slot >= 0 && n.predecessor.slot != n.ID() {
+		n.send(n.predecessor.slot, message{kind: "leave", node: n.successor})
+	}
+}
+
+func main() {
+	bits := flag.Int("bits", 6, "identifier bits, the ring has 2^bits places")
+	maxNodes := flag.Int("max", 16, "most nodes the ring can grow to")
+	stabilize := flag.Duration("stabilize", 500*time.Millisecond, "how often a node checks its successor and refreshes a finger")
+	timeout := flag.Duration("timeout", 3*time.Second, "how long a lookup may take before it counts as lost")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *bits < 1 || *bits > 16 || *maxNodes < 1 || *maxNodes > 1<<*bits || *stabilize < time.Millisecond || *timeout <= 0 {
+		fmt.Println("Bits must be 1 to 16, max between 1 and 2^bits, stabilize at least 1ms and timeout positive")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	if nodeCount < 1 || nodeCount > *maxNodes {
+		fmt.Printf("Need between 1 and %d nodes\n", *maxNodes)
+		return
+	}
+
+	var lmin, lmax atomic.Int64
+	lmin.Store(20)
+	lmax.Store(100)
+
+	// room for every node that may join, nil until it does
+	nodes := make([]*node, *maxNodes)
+	var nodesMu sync.Mutex
+	network := sim.NewMesh(*maxNodes, l, func(to int, m message) bool {
+		nodesMu.Lock()
+		n := nodes[to]
+		nodesMu.Unlock()
+		if n == nil {
+			return false
+		}
+		return sim.Deliver(n.Process, n.inbox, m)
+	})
+
+	sender := func(from, to int, m message) {
+		network.Send(from, to, m, sim.Latency(int(lmin.Load()), int(lmax.Load())))
+	}
+
+	pool := newNodePool(*bits, sender)
+
+	members := func() []*node {
+		nodesMu.Lock()
+		defer nodesMu.Unlock()
+
+		live := []*node{}
+		for _, n := range nodes {
+			if n != nil {
+				live = append(live, n)
+			}
+		}
+		sort.Slice(live, func(i, j int) bool { return live[i].ref.id < live[j].ref.id })
+		return live
+	}
+
+	// the node that should own id given who is up, what stabilization aims for
+	owner := func(live []*node, id uint32) ref {
+		for _, n := range live {
+			if n.ref.id >= id {
+				return n.ref
+			}
+		}
+		return live[0].ref
+	}
+
+	// a free place on the ring for the node in slot
+	place := func(slot int) uint32 {
+		taken := map[uint32]bool{}
+		for _, n := range members() {
+			taken[n.ref.id] = true
+		}
+		id := pool.id(fmt.Sprintf("node%d", slot))
+		for taken[id] {
+			id = (id + 1) % (1 << *bits)
+		}
+		return id
+	}
+
+	describe := func(r ref) string {
+		if r.slot < 0 {
+			return "none"
+		}
+		return fmt.Sprintf("node %d (id %d)", r.slot, r.id)
+	}
+
+	// the first nodes start out with correct tables
+	for i := 0; i < nodeCount; i++ {
+		nodes[i] = newNode(pool, i, place(i), int(*stabilize/time.Millisecond), l)
+	}
+	live := members()
+	for i, n := range live {
+		n.successor = live[(i+1)%len(live)].ref
+		n.predecessor = live[(i+len(live)-1)%len(live)].ref
+		for f := range n.fingers {
+			n.fingers[f] = owner(live, pool.start(n.ref.id, f))
+		}
+		n.Run()
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: lookup, ring, fingers, join, leave, stats, latency, partition, heal, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "lookup" {
+			var from int
+			var key string
+
+			con.Scan("From node: ", &from)
+			con.Scan("Key: ", &key)
+
+			if from < 0 || from >= len(nodes) || nodes[from] == nil {
+				fmt.Println("No such node")
+				continue
+			}
+
+			answer := make(chan message, 1)
+			pool.pendingMu.Lock()
+			lookup := pool.nextLookup
+			pool.nextLookup++
+			pool.pending[lookup] = answer
+			pool.pendingMu.Unlock()
+
+			target := pool.id(key)
+			n := nodes[from]
+			n.mu.Lock()
+			n.findLocked(message{kind: "find", lookup: lookup, target: target, origin: from, purpose: "lookup"})
+			n.mu.Unlock()
+
+			select {
+			case m := <-answer:
+				hops := len(m.path) - 1
+				pool.answered.Add(1)
+				pool.hops.Add(int64(hops))
+
+				steps := []string{}
+				for _, slot := range m.path {
+					if n := nodes[slot]; n != nil {
+						steps = append(steps, describe(n.ref))
+					} else {
+						steps = append(steps, fmt.Sprintf("node %d", slot))
+					}
+				}
+				fmt.Printf("Key %s (id %d): %s, owner %s, %d hop(s)\n", key, target, strings.Join(steps, " -> "), describe(m.node), hops)
+				l.Printf("Lookup of %s (id %d) from node %d: %s -> owner %s", key, target, from, strings.Join(steps, " -> "), describe(m.node))
+
+				if expected := owner(members(), target); expected != m.node {
+					fmt.Printf("Wrong owner, %s should own it: the ring has not stabilized yet\n", describe(expected))
+				}
+			case <-time.After(*timeout):
+				pool.pendingMu.Lock()
+				delete(pool.pending, lookup)
+				pool.pendingMu.Unlock()
+				pool.lost.Add(1)
+				fmt.Printf("Key %s (id %d): no answer within %v, a finger probably points at a node that left\n", key, target, *timeout)
+			}
+		} else if cmd == "ring" {
+			live := members()
+			consistent := true
+			for i, n := range live {
+				n.mu.Lock()
+				correct := 0
+				for f := range n.fingers {
+					if n.fingers[f] == owner(live, pool.start(n.ref.id, f)) {
+						correct++
+					}
+				}
+				ok := n.successor == live[(i+1)%len(live)].ref && n.predecessor == live[(i+len(live)-1)%len(live)].ref
+				consistent = consistent && ok
+				fmt.Printf("Node %d (id %d): predecessor %s, successor %s, %d/%d finger(s) correct\n", n.ID(), n.ref.id, describe(n.predecessor), describe(n.successor), correct, len(n.fingers))
+				n.mu.Unlock()
+			}
+			if consistent {
+				fmt.Println("Every successor and predecessor is right")
+			} else {
+				fmt.Println("Some successors or predecessors are wrong, stabilization is still at work")
+			}
+		} else if cmd == "fingers" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			if id < 0 || id >= len(nodes) || nodes[id] == nil {
+				fmt.Println("No such node")
+				continue
+			}
+
+			live := members()
+			n := nodes[id]
+			n.mu.Lock()
+			for f, finger := range n.fingers {
+				start := pool.start(n.ref.id, f)
+				mark := ""
+				if expected := owner(live, start); finger != expected {
+					mark = fmt.Sprintf(" (stale, should be %s)", describe(expected))
+				}
+				fmt.Printf("  %d: start %d -> %s%s\n", f, start, describe(finger), mark)
+			}
+			n.mu.Unlock()
+		} else if cmd == "join" {
+			var via int
+
+			con.Scan("Via node: ", &via)
+
+			if via < 0 || via >= len(nodes) || nodes[via] == nil {
+				fmt.Println("No such node")
+				continue
+			}
+
+			slot := -1
+			for i, n := range nodes {
+				if n == nil {
+					slot = i
+					break
+				}
+			}
+			if slot < 0 {
+				fmt.Printf("The ring is full (%d nodes)\n", *maxNodes)
+				continue
+			}
+
+			// it only knows itself until the lookup of its own id comes back
+			n := newNode(pool, slot, place(slot), int(*stabilize/time.Millisecond), l)
+			nodesMu.Lock()
+			nodes[slot] = n
+			nodesMu.Unlock()
+			n.Run()
+			n.send(via, message{kind: "find", target: n.ref.id, origin: slot, purpose: "join"})
+
+			fmt.Printf("Node %d (id %d) joins via node %d\n", slot, n.ref.id, via)
+		} else if cmd == "leave" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			if id < 0 || id >= len(nodes) || nodes[id] == nil {
+				fmt.Println("No such node")
+				continue
+			}
+			if len(members()) == 1 {
+				fmt.Println("Cannot remove the last node")
+				continue
+			}
+
+			// others' fingers may still point at it until they are refreshed
+			n := nodes[id]
+			n.leave()
+			n.Stop()
+			nodesMu.Lock()
+			nodes[id] = nil
+			nodesMu.Unlock()
+		} else if cmd == "stats" {
+			answered := pool.answered.Load()
+			fmt.Printf("Lookups: %d answered, %d lost", answered, pool.lost.Load())
+			if answered > 0 {
+				fmt.Printf(", mean %.2f hop(s)", float64(pool.hops.Load())/float64(answered))
+			}
+			fmt.Println()
+			fmt.Printf("With %d nodes Chord needs about log2(n)/2 = %.2f hops on average, log2(n) = %.2f at most\n", len(members()), math.Log2(float64(len(members())))/2, math.Log2(float64(len(members()))))
+			fmt.Printf("Messages sent: %d (stabilization included)\n", network.Stats.Messages.Load())
+		} else if cmd == "latency" {
+			var lo, hi int64
+
+			con.Scan("Min latency (ms): ", &lo)
+			con.Scan("Max latency (ms): ", &hi)
+
+			lmin.Store(lo)
+			lmax.Store(hi)
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, network.Size())
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for _, n := range nodes {
+		if n != nil {
+			n.Stop()
+		}
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
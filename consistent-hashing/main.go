@@ -0,0 +1,413 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// a virtual node: one of the places a node takes on the ring
+type point struct {
+	hash uint32
+	node int
+}
+
+// ring maps every key to the first virtual node at or after its hash
+type ring struct {
+	points []point // sorted by hash
+	vnodes int
+}
+
+func newRing(vnodes int) *ring {
+	r := new(ring)
+	r.points = []point{}
+	r.vnodes = vnodes
+	return r
+}
+
+func (r *ring) add(node int) {
+	for v := 0; v < r.vnodes; v++ {
+		r.points = append(r.points, point{hash: hash(fmt.Sprintf("node%d#%d", node, v)), node: node})
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+}
+
+func (r *ring) remove(node int) {
+	kept := []point{}
+	for _, p := range r.points {
+		if p.node != node {
+			kept = append(kept, p)
+		}
+	}
+	r.points = kept
+}
+
+func (r *ring) owner(key string) int {
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		// wrap around
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// share of the hash space each node owns
+func (r *ring) shares() map[int]float64 {
+	shares := map[int]float64{}
+	for i, p := range r.points {
+		prev := r.points[(i+len(r.points)-1)%len(r.points)].hash
+		shares[p.node] += float64(p.hash-prev) / (1 << 32)
+	}
+	if len(r.points) == 1 {
+		shares[r.points[0].node] = 1
+	}
+	return shares
+}
+
+type message struct {
+	kind string // transfer
+	from int
+	key, value string
+}
+
+type nodePool struct {
+	*sim.Pool
+	send func(from, to int, m message)
+
+	inTransit atomic.Int64 // keys handed over but not yet arrived
+}
+
+func newNodePool(send func(from, to int, m message)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.send = send
+	pool.inTransit.Store(0)
+	return pool
+}
+
+type node struct {
+	*sim.Process
+	pool *nodePool
+
+	kv *sim.KV
+
+	inbox chan message
+}
+
+func newNode(pool *nodePool, id, clockSpeed int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.kv = sim.NewKV()
+	n.inbox = make(chan message)
+	return n
+}
+
+func (n *node) Run() {
+	n.Start(nil)
+
+	// poll keys handed over by other nodes
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
+
+func (n *node) receive(m message) {
+	if m.kind == "transfer" {
+		n.kv.Put(m.key, m.value)
+		n.pool.inTransit.Add(-1)
+	}
+}
+
+// hand every key that now belongs elsewhere to its new owner
+func (n *node) rebalance(r *ring) int {
+	moved := 0
+	for _, key := range n.kv.Keys() {
+		owner := r.owner(key)
+		if owner == n.ID() {
+			continue
+		}
+		value, _ := n.kv.Get(key)
+		n.kv.Delete(key)
+		n.pool.inTransit.Add(1)
+		n.pool.send(n.ID(), owner, message{kind: "transfer", from: n.ID(), key: key, value: value})
+		moved++
+	}
+	return moved
+}
+
+// keys that would change owner under plain hash mod n when the member list changes
+func moduloMoves(keys []string, before, after []int) int {
+	moved := 0
+	for _, key := range keys {
+		h := hash(key)
+		if before[h%uint32(len(before))] != after[h%uint32(len(after))] {
+			moved++
+		}
+	}
+	return moved
+}
+
+func main() {
+	vnodes := flag.Int("vnodes", 16, "virtual nodes per node on the ring")
+	keyCount := flag.Int("keys", 1000, "keys stored at the start")
+	maxNodes := flag.Int("max", 16, "most nodes the cluster can grow to")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *vnodes < 1 || *keyCount < 0 || *maxNodes < 1 {
+		fmt.Println("Vnodes and max must be positive, keys not negative")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	if nodeCount < 1 || nodeCount > *maxNodes {
+		fmt.Printf("Need between 1 and %d nodes\n", *maxNodes)
+		return
+	}
+
+	var lmin, lmax atomic.Int64
+	lmin.Store(20)
+	lmax.Store(100)
+
+	// room for every node that may join, nil until it does
+	nodes := make([]*node, *maxNodes)
+	var nodesMu sync.Mutex
+	network := sim.NewMesh(*maxNodes, l, func(to int, m message) bool {
+		nodesMu.Lock()
+		n := nodes[to]
+		nodesMu.Unlock()
+		if n == nil {
+			return false
+		}
+		return sim.Deliver(n.Process, n.inbox, m)
+	})
+
+	sender := func(from, to int, m message) {
+		network.Send(from, to, m, sim.Latency(int(lmin.Load()), int(lmax.Load())))
+	}
+
+	pool := newNodePool(sender)
+	r := newRing(*vnodes)
+	for i := 0; i < nodeCount; i++ {
+		nodes[i] = newNode(pool, i, 1000, l)
+		nodes[i].Run()
+		r.add(i)
+	}
+
+	for i := 0; i < *keyCount; i++ {
+		key := fmt.Sprintf("key%d", i)
+		nodes[r.owner(key)].kv.Put(key, fmt.Sprintf("v%d", i))
+	}
+
+	members := func() []int {
+		ids := []int{}
+		for i, n := range nodes {
+			if n != nil {
+				ids = append(ids, i)
+			}
+		}
+		return ids
+	}
+
+	allKeys := func() []string {
+		keys := []string{}
+		for _, id := range members() {
+			keys = append(keys, nodes[id].kv.Keys()...)
+		}
+		return keys
+	}
+
+	// one membership change at a time: let the keys still moving land first
+	settle := func() {
+		if pool.inTransit.Load() == 0 {
+			return
+		}
+		fmt.Println("Finishing the previous rebalance first")
+		network.Drain()
+		for pool.inTransit.Load() > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: ring, get, put, add, remove, latency, partition, heal, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "ring" {
+			shares := r.shares()
+			ids := members()
+
+			total := 0
+			counts := make([]int, len(ids))
+			for i, id := range ids {
+				counts[i] = len(nodes[id].kv.Keys())
+				total += counts[i]
+			}
+
+			mean := float64(total) / float64(len(ids))
+			lo, hi := counts[0], counts[0]
+			var squares float64
+			for i, id := range ids {
+				fmt.Printf("Node %d: %d virtual node(s), %.1f%% of the ring, %d key(s)\n", id, *vnodes, 100*shares[id], counts[i])
+				lo = min(lo, counts[i])
+				hi = max(hi, counts[i])
+				squares += (float64(counts[i]) - mean) * (float64(counts[i]) - mean)
+			}
+			fmt.Printf("Keys per node: min %d, max %d, mean %.1f, stddev %.1f (max/mean %.2f)\n", lo, hi, mean, math.Sqrt(squares/float64(len(ids))), float64(hi)/math.Max(mean, 1))
+			if transit := pool.inTransit.Load(); transit > 0 {
+				fmt.Printf("Keys in transit: %d\n", transit)
+			}
+		} else if cmd == "get" {
+			var key string
+
+			con.Scan("Key: ", &key)
+
+			owner := r.owner(key)
+			if value, ok := nodes[owner].kv.Get(key); ok {
+				fmt.Printf("Key %s (hash %08x) lives on node %d: %s\n", key, hash(key), owner, value)
+			} else if pool.inTransit.Load() > 0 {
+				fmt.Printf("Key %s (hash %08x) belongs to node %d, not there (yet?)\n", key, hash(key), owner)
+			} else {
+				fmt.Printf("Key %s (hash %08x) belongs to node %d, not found\n", key, hash(key), owner)
+			}
+		} else if cmd == "put" {
+			var key, value string
+
+			con.Scan("Key: ", &key)
+			con.Scan("Value: ", &value)
+
+			owner := r.owner(key)
+			nodes[owner].kv.Put(key, value)
+			fmt.Printf("Stored on node %d\n", owner)
+		} else if cmd == "add" {
+			settle()
+			ids := members()
+			id := -1
+			for i, n := range nodes {
+				if n == nil {
+					id = i
+					break
+				}
+			}
+			if id < 0 {
+				fmt.Printf("The cluster is full (%d nodes)\n", *maxNodes)
+				continue
+			}
+
+			keys := allKeys()
+			n := newNode(pool, id, 1000, l)
+			n.Run()
+			nodesMu.Lock()
+			nodes[id] = n
+			nodesMu.Unlock()
+			r.add(id)
+
+			// only keys that now hash to the new node move
+			moved := 0
+			for _, other := range ids {
+				moved += nodes[other].rebalance(r)
+			}
+
+			fmt.Printf("Node %d joined: %d of %d key(s) moved (%.1f%%, ideal %.1f%%), hash mod n would have moved %d\n", id, moved, len(keys), 100*float64(moved)/math.Max(float64(len(keys)), 1), 100/float64(len(ids)+1), moduloMoves(keys, ids, members()))
+		} else if cmd == "remove" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			settle()
+			ids := members()
+			if id < 0 || id >= len(nodes) || nodes[id] == nil {
+				fmt.Println("No such node")
+				continue
+			}
+			if len(ids) == 1 {
+				fmt.Println("Cannot remove the last node")
+				continue
+			}
+
+			keys := allKeys()
+			r.remove(id)
+
+			// its keys go to the next virtual nodes on the ring, nothing else moves
+			moved := nodes[id].rebalance(r)
+			nodes[id].Stop()
+			nodesMu.Lock()
+			nodes[id] = nil
+			nodesMu.Unlock()
+
+			fmt.Printf("Node %d left: %d of %d key(s) moved (%.1f%%, ideal %.1f%%), hash mod n would have moved %d\n", id, moved, len(keys), 100*float64(moved)/math.Max(float64(len(keys)), 1), 100/float64(len(ids)), moduloMoves(keys, ids, members()))
+		} else if cmd == "latency" {
+			var lo, hi int64
+
+			con.Scan("Min latency (ms): ", &lo)
+			con.Scan("Max latency (ms): ", &hi)
+
+			lmin.Store(lo)
+			lmax.Store(hi)
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, network.Size())
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for _, n := range nodes {
+		if n != nil {
+			n.Stop()
+		}
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+// How replicas exchange updates.
+const (
+	modeState = "state" // sync ships the whole state, merged by join
+	modeOps = "ops" // updates are broadcast as they happen, sync resends them
+)
+
+// gCounter is a grow-only counter: one slot per node, merged by max.
+type gCounter []int64
+
+func (c gCounter) value() int64 {
+	var sum int64
+	for _, v := range c {
+		sum += v
+	}
+	return sum
+}
+
+func (c gCounter) merge(other gCounter) {
+	for i, v := range other {
+		c[i] = max(c[i], v)
+	}
+}
+
+// pnCounter counts up in p and down in n.
+type pnCounter struct {
+	p, n gCounter
+}
+
+func (c pnCounter) value() int64 {
+	return c.p.value() - c.n.value()
+}
+
+// orSet is an observed-remove set: every add gets a unique tag and a remove
+// only removes the tags it has seen, so a concurrent add wins.
+type orSet struct {
+	adds map[string]map[string]bool // element to tags
+	removed map[string]bool // tombstoned tags
+}
+
+func newORSet() *orSet {
+	s := new(orSet)
+	s.adds = map[string]map[string]bool{}
+	s.removed = map[string]bool{}
+	return s
+}
+
+func (s *orSet) add(element, tag string) {
+	if s.adds[element] == nil {
+		s.adds[element] = map[string]bool{}
+	}
+	s.adds[element][tag] = true
+}
+
+// the tags of element seen so far, what a remove has to tombstone
+func (s *orSet) observed(element string) []string {
+	tags := []string{}
+	for tag := range s.adds[element] {
+		if !s.removed[tag] {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func (s *orSet) remove(tags []string) {
+	for _, tag := range tags {
+		s.removed[tag] = true
+	}
+}
+
+func (s *orSet) elements() []string {
+	elements := []string{}
+	for element := range s.adds {
+		if len(s.observed(element)) > 0 {
+			elements = append(elements, element)
+		}
+	}
+	sort.Strings(elements)
+	return elements
+}
+
+func (s *orSet) merge(other *orSet) {
+	for element, tags := range other.adds {
+		for tag := range tags {
+			s.add(element, tag)
+		}
+	}
+	for tag := range other.removed {
+		s.removed[tag] = true
+	}
+}
+
+func (s *orSet) clone() *orSet {
+	c := newORSet()
+	c.merge(s)
+	return c
+}
+
+// replica is one node's copy of every CRDT.
+type replica struct {
+	g gCounter
+	pn pnCounter
+	set *orSet
+}
+
+func newReplica(nodes int) *replica {
+	r := new(replica)
+	r.g = make(gCounter, nodes)
+	r.pn = pnCounter{p: make(gCounter, nodes), n: make(gCounter, nodes)}
+	r.set = newORSet()
+	return r
+}
+
+func (r *replica) clone() *replica {
+	c := newReplica(len(r.g))
+	c.merge(r)
+	return c
+}
+
+func (r *replica) merge(other *replica) {
+	r.g.merge(other.g)
+	r.pn.p.merge(other.pn.p)
+	r.pn.n.merge(other.pn.n)
+	r.set.merge(other.set)
+}
+
+// what a user of the replica sees
+func (r *replica) String() string {
+	return fmt.Sprintf("gcounter %d %v, pncounter %d (+%d -%d), orset {%s}", r.g.value(), []int64(r.g), r.pn.value(), r.pn.p.value(), r.pn.n.value(), strings.Join(r.set.elements(), ", "))
+}
+
+// the full state, two replicas with the same one have converged
+func (r *replica) fingerprint() string {
+	tags := []string{}
+	for element, ts := range r.set.adds {
+		for tag := range ts {
+			tags = append(tags, element+"/"+tag)
+		}
+	}
+	sort.Strings(tags)
+	removed := []string{}
+	for tag := range r.set.removed {
+		removed = append(removed, tag)
+	}
+	sort.Strings(removed)
+	return fmt.Sprint(r.g, r.pn.p, r.pn.n, tags, removed)
+}
+
+// op is one update in ops mode, applied once wherever it arrives.
+type op struct {
+	origin int
+	seq int64
+	crdt string // gcounter, pncounter or orset
+	amount int64
+	element string
+	tags []string // orset remove: the tags it observed, add: the new tag
+	remove bool
+}
+
+func (o op) apply(r *replica) {
+	switch o.crdt {
+	case "gcounter":
+		r.g[o.origin] += o.amount
+	case "pncounter":
+		if o.amount >= 0 {
+			r.pn.p[o.origin] += o.amount
+		} else {
+			r.pn.n[o.origin] -= o.amount
+		}
+	case "orset":
+		if o.remove {
+			r.set.remove(o.tags)
+		} else {
+			r.set.add(o.element, o.tags[0])
+		}
+	}
+}
+
+type message struct {
+	kind string // state or op
+	from int
+	state *replica
+	op op
+}
+
+type nodePool struct {
+	*sim.Pool
+	participants int
+	mode string
+	send func(from, to int, m message)
+}
+
+func newNodePool(participants int, mode string, send func(from, to int, m message)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.participants = participants
+	pool.mode = mode
+	pool.send = send
+	return pool
+}
+
+type node struct {
+	*sim.Process
+	pool *nodePool
+
+	replica *replica
+
+	// ops mode: this node's own updates, resent by sync, and every op applied
+	log []op
+	seen map[[2]int64]bool
+	seq int64
+
+	mu sync.Mutex
+
+	inbox chan message
+}
+
+func newNode(pool *nodePool, id, clockSpeed int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.replica = newReplica(pool.participants)
+	n.log = []op{}
+	n.seen = map[[2]int64]bool{}
+	n.seq = 0
+	n.inbox = make(chan message)
+	return n
+}
+
+func (n *node) Run(gossip bool) {
+	// anti-entropy: every tick syncs with one random peer
+	if gossip {
+		n.Start(n.gossip)
+	} else {
+		n.Start(nil)
+	}
+
+	// poll states and ops from other replicas
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
+
+func (n *node) gossip() {
+	peer := int(sim.Random(int64(n.pool.participants - 1)))
+	if peer >= n.ID() {
+		peer++
+	}
+	n.sync(peer)
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch m.kind {
+	case "state":
+		n.replica.merge(m.state)
+	case "op":
+		n.applyLocked(m.op)
+	}
+}
+
+// apply an op unless it was applied already (node lock must be held)
+func (n *node) applyLocked(o op) bool {
+	id := [2]int64{int64(o.origin), o.seq}
+	if n.seen[id] {
+		return false
+	}
+	n.seen[id] = true
+	o.apply(n.replica)
+	return true
+}
+
+// a local update, in ops mode also broadcast right away
+func (n *node) update(o op) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	o.origin = n.ID()
+	o.seq = n.seq
+	n.seq++
+	if o.crdt == "orset" {
+		if o.remove {
+			o.tags = n.replica.set.observed(o.element)
+		} else {
+			o.tags = []string{fmt.Sprintf("%d.%d", n.ID(), o.seq)}
+		}
+	}
+	n.applyLocked(o)
+	n.Printf("Node %d updates %s: %s", n.ID(), o.crdt, n.replica)
+
+	if n.pool.mode != modeOps {
+		return
+	}
+	n.log = append(n.log, o)
+	for i := 0; i < n.pool.participants; i++ {
+		if i != n.ID() {
+			n.pool.send(n.ID(), i, message{kind: "op", from: n.ID(), op: o})
+		}
+	}
+}
+
+// send a peer what it may have missed: the whole state, or every own op
+func (n *node) sync(peer int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.pool.mode == modeState {
+		n.pool.send(n.ID(), peer, message{kind: "state", from: n.ID(), state: n.replica.clone()})
+		return
+	}
+	for _, o := range n.log {
+		n.pool.send(n.ID(), peer, message{kind: "op", from: n.ID(), op: o})
+	}
+}
+
+func main() {
+	mode := flag.String("mode", modeState, "how replicas exchange updates: state or ops")
+	interval := flag.Duration("interval", 0, "sync with a random peer this often (0 syncs only on the sync command)")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *mode != modeState && *mode != modeOps {
+		fmt.Printf("Unknown mode: %s\n", *mode)
+		return
+	}
+	if *interval < 0 || (*interval > 0 && *interval < time.Millisecond) {
+		fmt.Println("Interval must be 0 or at least 1ms")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	if nodeCount < 2 {
+		fmt.Println("Need at least two nodes")
+		return
+	}
+
+	var lmin, lmax atomic.Int64
+	lmin.Store(20)
+	lmax.Store(100)
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		return sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+	})
+
+	sender := func(from, to int, m message) {
+		network.Send(from, to, m, sim.Latency(int(lmin.Load()), int(lmax.Load())))
+	}
+
+	pool := newNodePool(nodeCount, *mode, sender)
+	for i := 0; i < nodeCount; i++ {
+		clockSpeed := 1000
+		if *interval > 0 {
+			clockSpeed = int(*interval / time.Millisecond)
+		}
+		nodes[i] = newNode(pool, i, clockSpeed, l)
+		nodes[i].Run(*interval > 0)
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: update, sync, state, loss, partition, heal, latency, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "update" {
+			var id int
+			var crdt string
+
+			con.Scan("Node: ", &id)
+			con.Scan("CRDT (gcounter, pncounter or orset): ", &crdt)
+
+			o := op{crdt: crdt}
+			if crdt == "gcounter" {
+				con.Scan("Amount: ", &o.amount)
+				if o.amount <= 0 {
+					fmt.Println("A grow-only counter only grows")
+					continue
+				}
+			} else if crdt == "pncounter" {
+				con.Scan("Amount (negative to decrement): ", &o.amount)
+			} else if crdt == "orset" {
+				var action string
+
+				con.Scan("Action (add or remove): ", &action)
+				con.Scan("Element: ", &o.element)
+
+				if action != "add" && action != "remove" {
+					fmt.Println("Unknown action")
+					continue
+				}
+				o.remove = action == "remove"
+			} else {
+				fmt.Println("Unknown CRDT")
+				continue
+			}
+
+			nodes[id].update(o)
+		} else if cmd == "sync" {
+			var target string
+
+			con.Scan("Node (* for all): ", &target)
+
+			// every chosen node syncs with every other node
+			for i := range nodes {
+				if target != "*" && target != fmt.Sprint(i) {
+					continue
+				}
+				for peer := range nodes {
+					if peer != i {
+						nodes[i].sync(peer)
+					}
+				}
+			}
+		} else if cmd == "state" {
+			fingerprints := map[string]bool{}
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				fmt.Printf("Node %d: %s\n", i, nodes[i].replica)
+				fingerprints[nodes[i].replica.fingerprint()] = true
+				nodes[i].mu.Unlock()
+			}
+
+			if len(fingerprints) == 1 {
+				fmt.Println("All replicas have converged")
+			} else {
+				fmt.Printf("Replicas diverge: %d different states\n", len(fingerprints))
+			}
+		} else if cmd == "loss" {
+			// lossy link: every message on it is lost with the given probability
+
+			var source, target, percent int
+
+			con.Scan("Source node: ", &source)
+			con.Scan("Target node: ", &target)
+			con.Scan("Drop probability (%): ", &percent)
+
+			if percent < 0 || percent > 100 {
+				fmt.Println("Invalid percentage")
+				continue
+			}
+			network.Lose(source, target, percent)
+
+			fmt.Printf("Link %d -> %d loses %d%% of messages\n", source, target, percent)
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "latency" {
+			var lo, hi int64
+
+			con.Scan("Min latency (ms): ", &lo)
+			con.Scan("Max latency (ms): ", &hi)
+
+			lmin.Store(lo)
+			lmax.Store(hi)
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type sample struct {
+	rtt time.Duration
+	err time.Duration // estimated server time minus the real time when the reply arrived
+}
+
+// one request to the time server, whose clock is the real time
+func query(clock *sim.PhysicalClock, out, back time.Duration) sample {
+	t0 := clock.Now()
+
+	// network delay
+	time.Sleep(out)
+
+	serverTime := time.Now()
+
+	// network delay
+	time.Sleep(back)
+
+	t1 := clock.Now()
+	now := time.Now()
+
+	// assume the reply took half the round trip
+	rtt := t1.Sub(t0)
+	estimate := serverTime.Add(rtt / 2)
+
+	return sample{rtt: rtt, err: estimate.Sub(now)}
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// query the server repeatedly and keep the sample with the lowest round trip
+func run(name string, clock *sim.PhysicalClock, samples, lmin, lmax, extra int) sample {
+	fmt.Printf("%s delays: request %d-%dms, reply %d-%dms\n", name, lmin, lmax, lmin+extra, lmax+extra)
+	fmt.Println("  #   RTT        error      best RTT   best error  bound")
+
+	var best sample
+	for i := 1; i <= samples; i++ {
+		s := query(clock, sim.Latency(lmin, lmax), sim.Latency(lmin+extra, lmax+extra))
+		if i == 1 || s.rtt < best.rtt {
+			best = s
+		}
+
+		// Cristian's bound: each way took at least the min latency
+		bound := best.rtt/2 - time.Duration(lmin)*time.Millisecond
+		fmt.Printf("  %-3d %-10v %-10v %-10v %-11v ±%v\n", i, s.rtt.Round(time.Microsecond), s.err.Round(time.Microsecond), best.rtt.Round(time.Microsecond), best.err.Round(time.Microsecond), bound.Round(time.Microsecond))
+	}
+	fmt.Println()
+
+	return best
+}
+
+func main() {
+	samples := flag.Int("samples", 10, "requests sent to the time server per run")
+	skew := flag.Duration("skew", 2*time.Second, "how far the client clock is ahead of the server")
+	lmin := flag.Int("min", 20, "min one-way latency (ms)")
+	lmax := flag.Int("max", 100, "max one-way latency (ms)")
+	extra := flag.Int("asymmetry", 60, "added to every reply in the asymmetric run (ms)")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *samples < 1 || *lmin < 0 || *lmax < *lmin || *extra < 0 {
+		fmt.Println("Samples must be positive and latencies must satisfy 0 <= min <= max")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	clock := sim.NewPhysicalClock(*skew, 1)
+	fmt.Printf("Client clock skew before sync: %v\n\n", clock.Skew().Round(time.Microsecond))
+
+	symmetric := run("Symmetric", clock, *samples, *lmin, *lmax, 0)
+	asymmetric := run("Asymmetric", clock, *samples, *lmin, *lmax, *extra)
+
+	fmt.Printf("Symmetric: best of %d samples is off by %v\n", *samples, abs(symmetric.err).Round(time.Microsecond))
+	fmt.Printf("Asymmetric: best of %d samples is off by %v (the reply is %dms slower, half of it never averages out)\n", *samples, abs(asymmetric.err).Round(time.Microsecond), *extra)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type signature struct {
+	signer int
+	sig []byte
+}
+
+type message struct {
+	value int
+	chain []signature
+}
+
+// payload signed by the i-th signer: the value plus the previous signature
+func (m message) payload(i int) []byte {
+	prev := []byte{}
+	if i > 0 {
+		prev = m.chain[i-1].sig
+	}
+	return append([]byte(fmt.Sprintf("%d:", m.value)), prev...)
+}
+
+func (m message) signers() string {
+	s := make([]string, len(m.chain))
+	for i := range m.chain {
+		s[i] = fmt.Sprintf("%d", m.chain[i].signer)
+	}
+	return strings.Join(s, " -> ")
+}
+
+type nodePool struct {
+	participants int
+	sender int
+	rounds int
+	keys []ed25519.PublicKey
+}
+
+func newNodePool(participants int) *nodePool {
+	pool := new(nodePool)
+	pool.participants = participants
+	pool.sender = 0
+	pool.rounds = 2
+	pool.keys = make([]ed25519.PublicKey, participants)
+	return pool
+}
+
+// verify checks that the chain starts at the sender, has distinct signers and valid signatures
+func (pool *nodePool) verify(m message) bool {
+	if len(m.chain) == 0 || m.chain[0].signer != pool.sender {
+		return false
+	}
+
+	seen := make(map[int]bool)
+	for i := range m.chain {
+		s := m.chain[i]
+		if seen[s.signer] || !ed25519.Verify(pool.keys[s.signer], m.payload(i), s.sig) {
+			return false
+		}
+		seen[s.signer] = true
+	}
+	return true
+}
+
+type node struct {
+	pool *nodePool
+	id int
+	l sim.Logger
+	key ed25519.PrivateKey
+
+	behavior string // honest, silent, equivocate, late
+
+	extracted map[int]bool
+	inbox []message
+	inboxMu sync.Mutex
+	held []message
+}
+
+func newNode(pool *nodePool, id int, l sim.Logger) *node {
+	n := new(node)
+	n.pool = pool
+	n.id = id
+	n.l = l
+	n.behavior = "honest"
+
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	pool.keys[id] = pub
+	n.key = key
+
+	n.reset()
+	return n
+}
+
+func (n *node) reset() {
+	n.extracted = make(map[int]bool)
+	n.inbox = nil
+	n.held = nil
+}
+
+func (n *node) byzantine() bool {
+	return n.behavior != "honest"
+}
+
+func (n *node) sign(m message) message {
+	signed := message{
+		value: m.value,
+		chain: append(append([]signature{}, m.chain...), signature{}),
+	}
+	i := len(signed.chain) - 1
+	signed.chain[i] = signature{
+		signer: n.id,
+		sig: ed25519.Sign(n.key, signed.payload(i)),
+	}
+	return signed
+}
+
+func (n *node) receive(m message) {
+	n.inboxMu.Lock()
+	n.inbox = append(n.inbox, m)
+	n.inboxMu.Unlock()
+}
+
+func (n *node) signed(m message) bool {
+	for i := range m.chain {
+		if m.chain[i].signer == n.id {
+			return true
+		}
+	}
+	return false
+}
+
+// process the messages received in round r and return what to send in round r+1 (per target)
+func (n *node) process(r int, nodes []*node) map[int][]message {
+	n.inboxMu.Lock()
+	inbox := n.inbox
+	n.inbox = nil
+	n.inboxMu.Unlock()
+
+	out := make(map[int][]message)
+	for _, m := range inbox {
+		// a value is accepted in round r only with r valid signatures
+		if len(m.chain) != r || !n.pool.verify(m) {
+			n.l.Printf("Node %d rejects %d (signed by %s) in round %d", n.id, m.value, m.signers(), r)
+			continue
+		}
+
+		if n.byzantine() {
+			if n.behavior == "late" && !n.signed(m) {
+				n.held = append(n.held, n.sign(m))
+			}
+			continue
+		}
+
+		if n.extracted[m.value] {
+			continue
+		}
+		n.extracted[m.value] = true
+		n.l.Printf("Node %d extracts %d (signed by %s) in round %d", n.id, m.value, m.signers(), r)
+
+		relay := n.sign(m)
+		for i := range nodes {
+			if i != n.id {
+				out[i] = append(out[i], relay)
+			}
+		}
+	}
+
+	if n.behavior == "late" && r+1 == n.pool.rounds {
+		// reveal held chains in the last round, to a single honest node only
+		for i := range nodes {
+			if nodes[i].byzantine() {
+				continue
+			}
+			for _, m := range n.held {
+				if len(m.chain) == r+1 {
+					out[i] = append(out[i], m)
+				}
+			}
+			break
+		}
+	}
+
+	return out
+}
+
+func (n *node) decision() int {
+	if len(n.extracted) == 1 {
+		for v := range n.extracted {
+			return v
+		}
+	}
+
+	// default value when nothing or more than one value was extracted
+	return 0
+}
+
+func runRounds(nodes []*node, value, lmin, lmax int, l sim.Logger) {
+	pool := nodes[0].pool
+	for i := range nodes {
+		nodes[i].reset()
+	}
+
+	// round 1: the sender signs and sends its value
+	out := make([]map[int][]message, len(nodes))
+	for i := range out {
+		out[i] = make(map[int][]message)
+	}
+
+	sender := nodes[pool.sender]
+	for i := range nodes {
+		if i == sender.id {
+			continue
+		}
+
+		v := value
+		if sender.behavior == "equivocate" && i >= len(nodes)/2 {
+			v = value + 1
+		} else if sender.behavior == "late" && nodes[i].byzantine() {
+			v = value + 1
+		} else if sender.behavior == "silent" {
+			continue
+		}
+		out[sender.id][i] = append(out[sender.id][i], sender.sign(message{value: v}))
+	}
+	if !sender.byzantine() {
+		sender.extracted[value] = true
+	}
+
+	for r := 1; r <= pool.rounds; r++ {
+		l.Printf("Round %d begins", r)
+
+		// every message of this round is delivered before the next round starts
+		var wg sync.WaitGroup
+		for i := range nodes {
+			if nodes[i].behavior == "silent" && r > 1 {
+				continue
+			}
+
+			for target, msgs := range out[i] {
+				for _, m := range msgs {
+					wg.Add(1)
+					go func(target *node, m message) {
+						defer wg.Done()
+
+						// round delay
+						latency := int64(lmin) + sim.Random(int64(lmax - lmin))
+						time.Sleep(time.Duration(latency) * time.Millisecond)
+
+						target.receive(m)
+					}(nodes[target], m)
+				}
+			}
+		}
+		wg.Wait()
+
+		for i := range nodes {
+			out[i] = nodes[i].process(r, nodes)
+		}
+
+		l.Printf("Round %d ends", r)
+	}
+}
+
+func main() {
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	pool := newNodePool(nodeCount)
+
+	nodes := make([]*node, nodeCount)
+	for i := range nodes {
+		nodes[i] = newNode(pool, i, l)
+	}
+
+	value := 1
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, sender, value, byzantine, rounds, run, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			f := 0
+			for i := range nodes {
+				if nodes[i].byzantine() {
+					f++
+				}
+			}
+			fmt.Printf("Sender: node %d (value: %d), rounds: %d, f: %d (needs %d rounds)\n", pool.sender, value, pool.rounds, f, f+1)
+
+			for i := range nodes {
+				extracted := make([]int, 0, len(nodes[i].extracted))
+				for v := range nodes[i].extracted {
+					extracted = append(extracted, v)
+				}
+				sort.Ints(extracted)
+
+				fmt.Printf("Node %d (%s, extracted: %v)\n", nodes[i].id, nodes[i].behavior, extracted)
+			}
+		} else if cmd == "sender" {
+			con.Scan("Sender: ", &pool.sender)
+		} else if cmd == "value" {
+			con.Scan("Value: ", &value)
+		} else if cmd == "byzantine" {
+			var id int
+			var behavior string
+
+			con.Scan("Node: ", &id)
+			con.Scan("Behavior (honest, silent, equivocate, late): ", &behavior)
+
+			if behavior != "honest" && behavior != "silent" && behavior != "equivocate" && behavior != "late" {
+				fmt.Println("Unknown behavior")
+				continue
+			}
+			nodes[id].behavior = behavior
+		} else if cmd == "rounds" {
+			con.Scan("Rounds: ", &pool.rounds)
+		} else if cmd == "run" {
+			var lmin, lmax int
+
+			con.Scan("Min latency (ms): ", &lmin)
+			con.Scan("Max latency (ms): ", &lmax)
+
+			runRounds(nodes, value, lmin, lmax, l)
+
+			decisions := make(map[int]bool)
+			for i := range nodes {
+				if nodes[i].byzantine() {
+					continue
+				}
+
+				d := nodes[i].decision()
+				decisions[d] = true
+				fmt.Printf("Node %d decides %d\n", nodes[i].id, d)
+			}
+
+			if len(decisions) > 1 {
+				fmt.Println("Agreement VIOLATED")
+			} else if !nodes[pool.sender].byzantine() && !decisions[value] {
+				fmt.Println("Validity VIOLATED")
+			} else {
+				fmt.Println("Agreement holds")
+			}
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	l.Flush(os.Stdout)
+}
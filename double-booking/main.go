@@ -0,0 +1,450 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type booking struct {
+	owner string
+	ts int // write timestamp for last-writer-wins, or total order position
+}
+
+type replica struct {
+	id int
+	bookings map[string]booking
+	mu sync.Mutex
+}
+
+func newReplica(id int) *replica {
+	r := new(replica)
+	r.id = id
+	r.bookings = make(map[string]booking)
+	return r
+}
+
+func (r *replica) lookup(resource string) (booking, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.bookings[resource]
+	return b, ok
+}
+
+// last-writer-wins merge of a replicated booking
+func (r *replica) apply(resource string, b booking) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if current, ok := r.bookings[resource]; !ok || current.ts < b.ts || (current.ts == b.ts && current.owner < b.owner) {
+		r.bookings[resource] = b
+	}
+}
+
+type world struct {
+	*sim.Pool
+
+	replicas []*replica
+	lmin, lmax int
+	l sim.Logger
+
+	messages atomic.Int64 // replication, broadcast and ack messages of the current act
+}
+
+func newWorld(l sim.Logger) *world {
+	w := new(world)
+	w.Pool = sim.NewPool()
+	w.replicas = []*replica{newReplica(0), newReplica(1)}
+	w.lmin = 50
+	w.lmax = 300
+	w.l = l
+	return w
+}
+
+func (w *world) latency() time.Duration {
+	return sim.Latency(w.lmin, w.lmax)
+}
+
+// replicate a write to every other replica, done is closed once all have applied it
+func (w *world) replicate(from int, resource string, b booking) chan struct{} {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, r := range w.replicas {
+		if r.id == from {
+			continue
+		}
+		wg.Add(1)
+		w.messages.Add(1)
+		go func(r *replica) {
+			defer wg.Done()
+			time.Sleep(w.latency())
+			r.apply(resource, b)
+			w.l.Printf("Replica %d applied %s -> %s from replica %d", r.id, resource, b.owner, from)
+		}(r)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+func (w *world) report(resource string, confirmed []string) {
+	final := []string{}
+	for _, r := range w.replicas {
+		b, _ := r.lookup(resource)
+		final = append(final, fmt.Sprintf("replica %d: %s", r.id, b.owner))
+	}
+	fmt.Printf("  Confirmed to clients: %s\n", strings.Join(confirmed, ", "))
+	fmt.Printf("  Final state: %s\n", strings.Join(final, ", "))
+	fmt.Printf("  Network messages between replicas: %d\n", w.messages.Load())
+
+	if len(confirmed) > 1 {
+		fmt.Printf("  ANOMALY: %d clients were told they hold %s\n", len(confirmed), resource)
+	} else {
+		fmt.Println("  OK: exactly one client holds the resource")
+	}
+}
+
+// act 1: check-then-book on different replicas under asynchronous replication
+func (w *world) async(resource string) []string {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	confirmed := []string{}
+
+	clients := []string{"alice", "bob"}
+	for i, name := range clients {
+		wg.Add(1)
+		go func(name string, r *replica, ts int) {
+			defer wg.Done()
+			time.Sleep(w.latency())
+
+			// time of check
+			if b, ok := r.lookup(resource); ok {
+				w.l.Printf("Client %s sees %s taken by %s on replica %d", name, resource, b.owner, r.id)
+				return
+			}
+			w.l.Printf("Client %s sees %s free on replica %d", name, resource, r.id)
+
+			// time of use
+			b := booking{owner: name, ts: ts}
+			r.apply(resource, b)
+			mu.Lock()
+			confirmed = append(confirmed, name)
+			mu.Unlock()
+			w.l.Printf("Client %s booked %s on replica %d", name, resource, r.id)
+
+			<-w.replicate(r.id, resource, b)
+		}(name, w.replicas[i], i+1)
+	}
+	wg.Wait()
+
+	sort.Strings(confirmed)
+	return confirmed
+}
+
+// act 2: reservations go through total-order broadcast, every replica decides the same way
+type tobMessage struct {
+	ts int
+	sender int
+	ack bool
+	client string
+	resource string
+}
+
+func before(a, b tobMessage) bool {
+	if a.ts != b.ts {
+		return a.ts < b.ts
+	}
+	return a.sender < b.sender
+}
+
+type tobReplica struct {
+	*replica
+	w *world
+	peers []*tobReplica
+
+	clock int
+	queue []tobMessage
+	lastSeen []int
+	inbox []chan tobMessage // FIFO link from each peer
+	inflight *sync.WaitGroup // messages sent but not yet handled, shared by the peers
+	decisions map[string]chan bool
+	mu sync.Mutex
+}
+
+func (t *tobReplica) broadcast(m tobMessage) {
+	for _, p := range t.peers {
+		if p == t {
+			continue
+		}
+		t.w.messages.Add(1)
+		t.inflight.Add(1)
+		ch := p.inbox[t.id]
+		t.w.Go(func() { ch <- m })
+	}
+}
+
+func (t *tobReplica) listen(from int) {
+	for m := range t.inbox[from] {
+		time.Sleep(t.w.latency())
+		t.receive(m)
+		t.inflight.Done()
+	}
+}
+
+func (t *tobReplica) submit(client, resource string) chan bool {
+	t.mu.Lock()
+	t.clock++
+	m := tobMessage{ts: t.clock, sender: t.id, client: client, resource: resource}
+	decided := make(chan bool, 1)
+	t.decisions[client] = decided
+	t.queue = append(t.queue, m)
+	t.mu.Unlock()
+
+	t.w.l.Printf("Replica %d broadcasts reservation of %s for %s at ts %d", t.id, resource, client, m.ts)
+	t.broadcast(m)
+	return decided
+}
+
+func (t *tobReplica) receive(m tobMessage) {
+	t.mu.Lock()
+	if m.ts > t.clock {
+		t.clock = m.ts
+	}
+	t.clock++
+	t.lastSeen[m.sender] = m.ts
+
+	var ack tobMessage
+	if !m.ack {
+		t.queue = append(t.queue, m)
+		ack = tobMessage{ts: t.clock, sender: t.id, ack: true}
+	}
+	t.mu.Unlock()
+
+	if !m.ack {
+		t.broadcast(ack)
+	}
+	t.deliver()
+}
+
+// deliver the head of the queue once every peer has been heard from with a later timestamp
+func (t *tobReplica) deliver() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for len(t.queue) > 0 {
+		sort.Slice(t.queue, func(i, j int) bool { return before(t.queue[i], t.queue[j]) })
+		head := t.queue[0]
+
+		for _, p := range t.peers {
+			if p.id != t.id && p.id != head.sender && t.lastSeen[p.id] <= head.ts {
+				return
+			}
+		}
+		t.queue = t.queue[1:]
+
+		_, taken := t.lookup(head.resource)
+		if !taken {
+			t.apply(head.resource, booking{owner: head.client, ts: head.ts})
+		}
+		t.w.l.Printf("Replica %d delivers %s for %s (ts %d): %s", t.id, head.resource, head.client, head.ts, map[bool]string{true: "rejected", false: "booked"}[taken])
+
+		if decided, ok := t.decisions[head.client]; ok {
+			decided <- !taken
+			delete(t.decisions, head.client)
+		}
+	}
+}
+
+func (w *world) totalOrder(resource string) []string {
+	var inflight sync.WaitGroup
+	peers := make([]*tobReplica, len(w.replicas))
+	for i, r := range w.replicas {
+		peers[i] = &tobReplica{replica: r, w: w, lastSeen: make([]int, len(w.replicas)), inflight: &inflight, decisions: make(map[string]chan bool)}
+		peers[i].inbox = make([]chan tobMessage, len(w.replicas))
+		for j := range peers[i].inbox {
+			peers[i].inbox[j] = make(chan tobMessage, 64)
+		}
+	}
+	for _, p := range peers {
+		p.peers = peers
+		for j := range peers {
+			if j != p.id {
+				p, j := p, j
+				w.Go(func() { p.listen(j) })
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	confirmed := []string{}
+
+	clients := []string{"alice", "bob"}
+	for i, name := range clients {
+		wg.Add(1)
+		go func(name string, p *tobReplica) {
+			defer wg.Done()
+			time.Sleep(w.latency())
+
+			if <-p.submit(name, resource) {
+				mu.Lock()
+				confirmed = append(confirmed, name)
+				mu.Unlock()
+				w.l.Printf("Client %s confirmed %s", name, resource)
+			} else {
+				w.l.Printf("Client %s rejected for %s", name, resource)
+			}
+		}(name, peers[i])
+	}
+	wg.Wait()
+
+	// the other replicas may still be catching up, let every message and
+	// ack land before the links go away
+	inflight.Wait()
+	for _, p := range peers {
+		for _, ch := range p.inbox {
+			close(ch)
+		}
+	}
+	w.Wait()
+
+	sort.Strings(confirmed)
+	return confirmed
+}
+
+// act 3: a lock service serializes check-then-book, the lock is held until the booking has replicated
+type lockService struct {
+	token int
+	held chan struct{}
+}
+
+func (w *world) locked(resource string) []string {
+	locks := &lockService{token: 0, held: make(chan struct{}, 1)}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	confirmed := []string{}
+
+	clients := []string{"alice", "bob"}
+	for i, name := range clients {
+		wg.Add(1)
+		go func(name string, r *replica, ts int) {
+			defer wg.Done()
+			time.Sleep(w.latency())
+
+			locks.held <- struct{}{}
+			mu.Lock()
+			locks.token++
+			token := locks.token
+			mu.Unlock()
+			w.l.Printf("Client %s acquired the lock for %s (fencing token %d)", name, resource, token)
+
+			defer func() {
+				w.l.Printf("Client %s released the lock for %s", name, resource)
+				<-locks.held
+			}()
+
+			if b, ok := r.lookup(resource); ok {
+				w.l.Printf("Client %s sees %s taken by %s on replica %d", name, resource, b.owner, r.id)
+				return
+			}
+
+			b := booking{owner: name, ts: token}
+			r.apply(resource, b)
+			<-w.replicate(r.id, resource, b)
+
+			mu.Lock()
+			confirmed = append(confirmed, name)
+			mu.Unlock()
+			w.l.Printf("Client %s booked %s on replica %d, replicated before unlocking", name, resource, r.id)
+		}(name, w.replicas[i], i+1)
+	}
+	wg.Wait()
+
+	sort.Strings(confirmed)
+	return confirmed
+}
+
+func (w *world) reset() {
+	w.messages.Store(0)
+	for _, r := range w.replicas {
+		r.mu.Lock()
+		r.bookings = make(map[string]booking)
+		r.mu.Unlock()
+	}
+}
+
+func main() {
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	w := newWorld(l)
+
+	for {
+		var cmd string
+		fmt.Println("Commands: story, async, tob, lock, latency, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "story" {
+			// the whole lesson: the anomaly, then two ways to fix it
+			fmt.Println("Alice and Bob both want seat 12A. Alice talks to replica 0, Bob to replica 1.")
+
+			fmt.Println("Act 1: check then book, replicas sync asynchronously")
+			w.reset()
+			w.report("12A", w.async("12A"))
+
+			fmt.Println("Act 2: reservations are ordered by total-order broadcast, every replica runs the same check in the same order")
+			w.reset()
+			w.report("12A", w.totalOrder("12A"))
+
+			fmt.Println("Act 3: a lock service serializes check and book, the lock is released only after replication")
+			w.reset()
+			w.report("12A", w.locked("12A"))
+
+			fmt.Println("Run logs to see the interleavings")
+		} else if cmd == "async" || cmd == "tob" || cmd == "lock" {
+			var resource string
+			con.Scan("Resource: ", &resource)
+
+			w.reset()
+			if cmd == "async" {
+				w.report(resource, w.async(resource))
+			} else if cmd == "tob" {
+				w.report(resource, w.totalOrder(resource))
+			} else {
+				w.report(resource, w.locked(resource))
+			}
+		} else if cmd == "latency" {
+			con.Scan("Min latency (ms): ", &w.lmin)
+			con.Scan("Max latency (ms): ", &w.lmax)
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type message struct {
+	kind string // election or elected
+	from int
+	candidate int
+}
+
+type nodePool struct {
+	*sim.Pool
+	ring []int // node IDs in ring order
+	position []int // where each node sits on the ring
+	send func(from, to int, m message)
+	crashed func(id int) bool
+
+	// how long a participant waits for the outcome before it starts over
+	timeout time.Duration
+
+	started atomic.Int64 // elections started, by hand or after a timeout
+	restarts atomic.Int64
+	completed atomic.Int64 // announcements that went all the way round
+	bully atomic.Int64 // what the bully algorithm would send for the same starts
+}
+
+func newNodePool(ring []int, send func(from, to int, m message), crashed func(id int) bool) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.ring = ring
+	pool.position = make([]int, len(ring))
+	for i, id := range ring {
+		pool.position[id] = i
+	}
+	pool.send = send
+	pool.crashed = crashed
+	pool.timeout = 0
+	pool.started.Store(0)
+	pool.restarts.Store(0)
+	pool.completed.Store(0)
+	pool.bully.Store(0)
+	return pool
+}
+
+// the next node on the ring that is up, crashed nodes are skipped as if a
+// perfect failure detector told everyone
+func (p *nodePool) successor(id int) int {
+	for i := 1; i < len(p.ring); i++ {
+		next := p.ring[(p.position[id]+i)%len(p.ring)]
+		if !p.crashed(next) {
+			return next
+		}
+	}
+	return id
+}
+
+// messages the bully algorithm sends when starter calls an election: every
+// node up from the starter on challenges all higher IDs and hears back from
+// those that are up, then the winner tells everyone
+func (p *nodePool) bullyMessages(starter int) int {
+	n := len(p.ring)
+	total := n - 1
+	for j := starter; j < n; j++ {
+		if p.crashed(j) {
+			continue
+		}
+		for k := j + 1; k < n; k++ {
+			total++
+			if !p.crashed(k) {
+				total++
+			}
+		}
+	}
+	return total
+}
+
+type node struct {
+	*sim.Process
+	pool *nodePool
+
+	participant bool
+	since time.Time // when this node joined the election
+	leader int // -1 if unknown
+
+	crashed atomic.Bool
+	mu sync.Mutex
+
+	inbox chan message
+}
+
+func newNode(pool *nodePool, id, clockSpeed int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.participant = false
+	n.leader = -1
+	n.crashed.Store(false)
+	n.inbox = make(chan message)
+	return n
+}
+
+func (n *node) Run() {
+	// every tick checks whether the election is overdue
+	n.Start(n.tick)
+
+	// poll election and elected messages
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
+
+// node lock must be held
+func (n *node) forward(m message) {
+	if n.crashed.Load() {
+		return
+	}
+	m.from = n.ID()
+	n.pool.send(n.ID(), n.pool.successor(n.ID()), m)
+}
+
+func (n *node) elect() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.startLocked()
+}
+
+// node lock must be held
+func (n *node) startLocked() {
+	n.pool.started.Add(1)
+	n.pool.bully.Add(int64(n.pool.bullyMessages(n.ID())))
+
+	n.participant = true
+	n.since = time.Now()
+	n.Printf("Node %d starts an election", n.ID())
+	n.forward(message{kind: "election", candidate: n.ID()})
+}
+
+func (n *node) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.crashed.Load() || !n.participant || time.Since(n.since) < n.pool.timeout {
+		return
+	}
+
+	// the election message or the announcement died with a crashed node
+	n.pool.restarts.Add(1)
+	n.Printf("Node %d hears nothing for %v, starts over", n.ID(), n.pool.timeout)
+	n.startLocked()
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch m.kind {
+	case "election":
+		candidate := m.candidate
+		if n.pool.crashed(candidate) {
+			// a candidate known to be down cannot win
+			candidate = -1
+		}
+
+		if candidate == n.ID() {
+			// went all the way round: nobody higher is up
+			n.participant = false
+			n.leader = n.ID()
+			n.Printf("Node %d is elected, announces it", n.ID())
+			n.forward(message{kind: "elected", candidate: n.ID()})
+		} else if candidate > n.ID() {
+			n.participant = true
+			n.since = time.Now()
+			n.forward(message{kind: "election", candidate: candidate})
+		} else if !n.participant {
+			n.participant = true
+			n.since = time.Now()
+			n.forward(message{kind: "election", candidate: n.ID()})
+		}
+		// a lower candidate reaching a participant is swallowed, its own
+		// higher one is already on the way
+
+	case "elected":
+		if m.candidate == n.ID() {
+			n.pool.completed.Add(1)
+			n.Printf("Node %d's announcement went round, election complete", n.ID())
+			return
+		}
+		n.participant = false
+		n.leader = m.candidate
+		n.forward(m)
+	}
+}
+
+func main() {
+	ring := flag.String("ring", "", "order of the nodes on the ring, e.g. 0,2,1,3 (default by ID)")
+	timeout := flag.Duration("timeout", 2*time.Second, "how long a participant waits for the outcome before it starts over")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *timeout <= 0 {
+		fmt.Println("Timeout must be positive")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	order := make([]int, nodeCount)
+	for i := range order {
+		order[i] = i
+	}
+	if *ring != "" {
+		groups, err := sim.ParseGroups(*ring, nodeCount)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		seen := make([]bool, nodeCount)
+		for _, id := range groups[0] {
+			seen[id] = true
+		}
+		for _, ok := range seen {
+			if !ok || len(groups) != 1 || len(groups[0]) != nodeCount {
+				fmt.Println("The ring must list every node once")
+				return
+			}
+		}
+		order = groups[0]
+	}
+
+	var lmin, lmax atomic.Int64
+	lmin.Store(20)
+	lmax.Store(100)
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		if nodes[to].crashed.Load() {
+			return false
+		}
+		return sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+	})
+
+	sender := func(from, to int, m message) {
+		network.Send(from, to, m, sim.Latency(int(lmin.Load()), int(lmax.Load())))
+	}
+	crashed := func(id int) bool {
+		return nodes[id].crashed.Load()
+	}
+
+	pool := newNodePool(order, sender, crashed)
+	pool.timeout = *timeout
+	for i := 0; i < nodeCount; i++ {
+		nodes[i] = newNode(pool, i, 100, l)
+		nodes[i].Run()
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: elect, state, crash, recover, stats, latency, partition, heal, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "elect" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			if nodes[id].crashed.Load() {
+				fmt.Println("Node is crashed")
+				continue
+			}
+			nodes[id].elect()
+		} else if cmd == "state" {
+			fmt.Printf("Ring: %v\n", order)
+			for _, id := range order {
+				nodes[id].mu.Lock()
+				n := nodes[id]
+
+				status := "idle"
+				if n.crashed.Load() {
+					status = "crashed"
+				} else if n.participant {
+					status = fmt.Sprintf("participant for %v", time.Since(n.since).Round(time.Millisecond))
+				}
+				leader := "unknown"
+				if n.leader >= 0 {
+					leader = fmt.Sprintf("node %d", n.leader)
+				}
+
+				fmt.Printf("Node %d -> %d: %s, leader %s\n", id, pool.successor(id), status, leader)
+				nodes[id].mu.Unlock()
+			}
+		} else if cmd == "crash" {
+			// with a delay, to hit an election on its way round
+			var id int
+			var after string
+
+			con.Scan("Node: ", &id)
+			con.Scan("After (e.g. 150ms, 0 for now): ", &after)
+
+			d, err := time.ParseDuration(after)
+			if err != nil || d < 0 {
+				fmt.Println("Invalid duration")
+				continue
+			}
+
+			time.AfterFunc(d, func() {
+				nodes[id].crashed.Store(true)
+				nodes[id].Printf("Node %d crashes", id)
+			})
+		} else if cmd == "recover" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			// back with no memory of the election or the leader
+			nodes[id].mu.Lock()
+			nodes[id].participant = false
+			nodes[id].leader = -1
+			nodes[id].crashed.Store(false)
+			nodes[id].mu.Unlock()
+		} else if cmd == "stats" {
+			started, completed := pool.started.Load(), pool.completed.Load()
+			messages, bully := network.Stats.Messages.Load(), pool.bully.Load()
+
+			fmt.Printf("Elections started: %d (%d after a timeout), completed: %d\n", started, pool.restarts.Load(), completed)
+			fmt.Printf("Chang-Roberts messages: %d", messages)
+			if completed > 0 {
+				fmt.Printf(" (%.1f per completed election)", float64(messages)/float64(completed))
+			}
+			fmt.Println()
+			fmt.Printf("Bully algorithm for the same starts: %d", bully)
+			if completed > 0 {
+				fmt.Printf(" (%.1f per completed election)", float64(bully)/float64(completed))
+			}
+			fmt.Println()
+			fmt.Printf("Chang-Roberts with n = %d, announcement included: %d to %d messages with one starter, up to %d with everyone starting at once\n", nodeCount, 2*nodeCount, 3*nodeCount-1, nodeCount*(nodeCount+1)/2+nodeCount)
+		} else if cmd == "latency" {
+			var lo, hi int64
+
+			con.Scan("Min latency (ms): ", &lo)
+			con.Scan("Max latency (ms): ", &hi)
+
+			lmin.Store(lo)
+			lmax.Store(hi)
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
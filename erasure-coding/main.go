@@ -0,0 +1,580 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+// arithmetic in GF(2^8) with the 0x11d reducing polynomial
+var gfExp [512]byte
+var gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+func gfPow(a byte, n int) byte {
+	r := byte(1)
+	for i := 0; i < n; i++ {
+		r = gfMul(r, a)
+	}
+	return r
+}
+
+// Reed-Solomon: fragment i holds the data polynomial evaluated at x = i + 1
+func encode(data []byte, k, n int) [][]byte {
+	size := (len(data) + k - 1) / k
+	padded := make([]byte, size*k)
+	copy(padded, data)
+
+	fragments := make([][]byte, n)
+	for i := range fragments {
+		fragments[i] = make([]byte, size)
+		x := byte(i + 1)
+		for b := 0; b < size; b++ {
+			var sum byte
+			for j := 0; j < k; j++ {
+				sum ^= gfMul(padded[j*size+b], gfPow(x, j))
+			}
+			fragments[i][b] = sum
+		}
+	}
+	return fragments
+}
+
+// decode from any k fragments by solving the Vandermonde system
+func decode(indexes []int, fragments [][]byte, k, length int) ([]byte, error) {
+	if len(indexes) < k {
+		return nil, errors.New("not enough fragments")
+	}
+
+	// invert the k x k Vandermonde matrix with Gauss-Jordan elimination
+	m := make([][]byte, k)
+	inv := make([][]byte, k)
+	for r := 0; r < k; r++ {
+		m[r] = make([]byte, k)
+		inv[r] = make([]byte, k)
+		inv[r][r] = 1
+		for c := 0; c < k; c++ {
+			m[r][c] = gfPow(byte(indexes[r]+1), c)
+		}
+	}
+
+	for c := 0; c < k; c++ {
+		pivot := c
+		for pivot < k && m[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == k {
+			return nil, errors.New("singular matrix")
+		}
+		m[c], m[pivot] = m[pivot], m[c]
+		inv[c], inv[pivot] = inv[pivot], inv[c]
+
+		scale := gfInv(m[c][c])
+		for j := 0; j < k; j++ {
+			m[c][j] = gfMul(m[c][j], scale)
+			inv[c][j] = gfMul(inv[c][j], scale)
+		}
+
+		for r := 0; r < k; r++ {
+			if r == c || m[r][c] == 0 {
+				continue
+			}
+			factor := m[r][c]
+			for j := 0; j < k; j++ {
+				m[r][j] ^= gfMul(factor, m[c][j])
+				inv[r][j] ^= gfMul(factor, inv[c][j])
+			}
+		}
+	}
+
+	size := len(fragments[0])
+	data := make([]byte, size*k)
+	for j := 0; j < k; j++ {
+		for b := 0; b < size; b++ {
+			var sum byte
+			for r := 0; r < k; r++ {
+				sum ^= gfMul(inv[j][r], fragments[r][b])
+			}
+			data[j*size+b] = sum
+		}
+	}
+	return data[:length], nil
+}
+
+type policy struct {
+	k, n int // replication is k = 1 (every fragment is a full copy)
+}
+
+func (p policy) String() string {
+	if p.k == 1 {
+		return fmt.Sprintf("%dx replication", p.n)
+	}
+	return fmt.Sprintf("RS(%d of %d)", p.k, p.n)
+}
+
+// probability of losing an object when each fragment's node fails with probability q before repair
+func (p policy) lossProbability(q float64) float64 {
+	loss := 0.0
+	for lost := p.n - p.k + 1; lost <= p.n; lost++ {
+		loss += binomial(p.n, lost) * math.Pow(q, float64(lost)) * math.Pow(1-q, float64(p.n-lost))
+	}
+	return loss
+}
+
+func binomial(n, k int) float64 {
+	r := 1.0
+	for i := 1; i <= k; i++ {
+		r = r * float64(n-k+i) / float64(i)
+	}
+	return r
+}
+
+type object struct {
+	name string
+	length int
+	policy policy
+	placement []int // node holding each fragment, -1 if lost
+}
+
+type storageNode struct {
+	id int
+	fragments map[string][]byte // "object/fragment" -> bytes
+	failed bool
+}
+
+type cluster struct {
+	nodes []*storageNode
+	objects map[string]*object
+	mu sync.Mutex
+
+	repairBytes int
+	lmin, lmax int
+	l sim.Logger
+}
+
+func newCluster(nodeCount int, l sim.Logger) *cluster {
+	c := new(cluster)
+	c.nodes = make([]*storageNode, nodeCount)
+	for i := range c.nodes {
+		c.nodes[i] = &storageNode{id: i, fragments: make(map[string][]byte), failed: false}
+	}
+	c.objects = make(map[string]*object)
+	c.repairBytes = 0
+	c.lmin = 10
+	c.lmax = 50
+	c.l = l
+	return c
+}
+
+func (c *cluster) transfer() {
+	time.Sleep(sim.Latency(c.lmin, c.lmax))
+}
+
+// pick distinct healthy nodes not already holding a fragment of the object
+func (c *cluster) pickNodes(count int, exclude []int) ([]int, error) {
+	used := make(map[int]bool)
+	for _, id := range exclude {
+		used[id] = true
+	}
+
+	candidates := []int{}
+	for _, n := range c.nodes {
+		if !n.failed && !used[n.id] {
+			candidates = append(candidates, n.id)
+		}
+	}
+	if len(candidates) < count {
+		return nil, fmt.Errorf("need %d healthy nodes, only %d available", count, len(candidates))
+	}
+
+	// random placement
+	for i := len(candidates) - 1; i > 0; i-- {
+		j := int(sim.Random(int64(i + 1)))
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	}
+	return candidates[:count], nil
+}
+
+func fragmentKey(name string, i int) string {
+	return fmt.Sprintf("%s/%d", name, i)
+}
+
+func (c *cluster) put(name, data string, p policy) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	placement, err := c.pickNodes(p.n, nil)
+	if err != nil {
+		return err
+	}
+
+	fragments := encode([]byte(data), p.k, p.n)
+	for i, id := range placement {
+		c.transfer()
+		c.nodes[id].fragments[fragmentKey(name, i)] = fragments[i]
+	}
+
+	c.objects[name] = &object{name: name, length: len(data), policy: p, placement: placement}
+	c.l.Printf("Stored %s (%d bytes) as %s on nodes %v, %d bytes written", name, len(data), p, placement, p.n*len(fragments[0]))
+	return nil
+}
+
+// read any k surviving fragments
+func (c *cluster) collect(o *object) ([]int, [][]byte) {
+	indexes := []int{}
+	fragments := [][]byte{}
+	for i, id := range o.placement {
+		if id < 0 || c.nodes[id].failed {
+			continue
+		}
+
+		c.transfer()
+		indexes = append(indexes, i)
+		fragments = append(fragments, c.nodes[id].fragments[fragmentKey(o.name, i)])
+		if len(indexes) == o.policy.k {
+			break
+		}
+	}
+	return indexes, fragments
+}
+
+func (c *cluster) get(name string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	o, ok := c.objects[name]
+	if !ok {
+		return "", errors.New("no such object")
+	}
+
+	indexes, fragments := c.collect(o)
+	data, err := decode(indexes, fragments, o.policy.k, o.length)
+	if err != nil {
+		return "", fmt.Errorf("object lost: %v", err)
+	}
+	return string(data), nil
+}
+
+func (c *cluster) fail(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nodes[id].failed = true
+	c.nodes[id].fragments = make(map[string][]byte)
+	for _, o := range c.objects {
+		for i := range o.placement {
+			if o.placement[i] == id {
+				o.placement[i] = -1
+			}
+		}
+	}
+	c.l.Printf("Node %d failed, its fragments are gone", id)
+}
+
+// rebuild every lost fragment on a new node
+func (c *cluster) repair() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	repaired, traffic := 0, 0
+	names := make([]string, 0, len(c.objects))
+	for name := range c.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		o := c.objects[name]
+
+		missing := []int{}
+		for i, id := range o.placement {
+			if id < 0 {
+				missing = append(missing, i)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		indexes, fragments := c.collect(o)
+		data, err := decode(indexes, fragments, o.policy.k, o.length)
+		if err != nil {
+			c.l.Printf("Cannot repair %s: only %d of %d fragments left", name, len(indexes), o.policy.k)
+			continue
+		}
+		read := len(fragments) * len(fragments[0])
+
+		targets, err := c.pickNodes(len(missing), o.placement)
+		if err != nil {
+			c.l.Printf("Cannot repair %s: %v", name, err)
+			continue
+		}
+
+		rebuilt := encode(data, o.policy.k, o.policy.n)
+		for j, i := range missing {
+			c.transfer()
+			c.nodes[targets[j]].fragments[fragmentKey(name, i)] = rebuilt[i]
+			o.placement[i] = targets[j]
+		}
+
+		written := len(missing) * len(rebuilt[0])
+		c.l.Printf("Repaired %s (%s): read %d bytes, wrote %d bytes", name, o.policy, read, written)
+		repaired += len(missing)
+		traffic += read + written
+	}
+
+	c.repairBytes += traffic
+	return repaired, traffic
+}
+
+// well-known layouts plus whatever the stored objects use
+func (c *cluster) policies() []policy {
+	policies := []policy{{k: 1, n: 3}, {k: 4, n: 6}, {k: 6, n: 9}, {k: 10, n: 14}}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, o := range c.objects {
+		known := false
+		for _, p := range policies {
+			if p == o.policy {
+				known = true
+			}
+		}
+		if !known {
+			policies = append(policies, o.policy)
+		}
+	}
+	return policies
+}
+
+// accelerated years of independent node failures and repairs for a single stripe,
+// returns the number of trials that lost more than n - k fragments at once
+func monteCarlo(p policy, afr float64, repair time.Duration, years float64, trials int, rng *mrand.Rand) int {
+	rate := afr / (365 * 24) // failures per hour
+	horizon := years * 365 * 24
+	repairHours := repair.Hours()
+
+	losses := 0
+	nextFailure := make([]float64, p.n)
+	repairedAt := make([]float64, p.n) // 0 while healthy
+
+	for t := 0; t < trials; t++ {
+		for i := range nextFailure {
+			nextFailure[i] = rng.ExpFloat64() / rate
+			repairedAt[i] = 0
+		}
+
+		down := 0
+		for {
+			// next event: a healthy fragment fails or a lost fragment is rebuilt
+			now, next, failure := horizon, -1, false
+			for i := range nextFailure {
+				if repairedAt[i] == 0 && nextFailure[i] < now {
+					now, next, failure = nextFailure[i], i, true
+				} else if repairedAt[i] > 0 && repairedAt[i] < now {
+					now, next, failure = repairedAt[i], i, false
+				}
+			}
+			if next < 0 {
+				break
+			}
+
+			if failure {
+				repairedAt[next] = now + repairHours
+				down++
+				if down > p.n-p.k {
+					losses++
+					break
+				}
+			} else {
+				repairedAt[next] = 0
+				nextFailure[next] = now + rng.ExpFloat64()/rate
+				down--
+			}
+		}
+	}
+	return losses
+}
+
+func main() {
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	c := newCluster(nodeCount, l)
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, put, get, fail, recover, repair, durability, montecarlo, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			c.mu.Lock()
+			for _, n := range c.nodes {
+				fmt.Printf("Node %d (failed: %v, fragments: %d)\n", n.id, n.failed, len(n.fragments))
+			}
+
+			names := make([]string, 0, len(c.objects))
+			for name := range c.objects {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				o := c.objects[name]
+				alive := 0
+				for _, id := range o.placement {
+					if id >= 0 {
+						alive++
+					}
+				}
+				fmt.Printf("Object %s (%s, %d bytes, overhead %.2fx) fragments on %v, %d of %d alive\n", name, o.policy, o.length, float64(o.policy.n)/float64(o.policy.k), o.placement, alive, o.policy.n)
+			}
+			fmt.Printf("Total repair traffic: %d bytes\n", c.repairBytes)
+			c.mu.Unlock()
+		} else if cmd == "put" {
+			var name, data, scheme string
+			var k, n int
+
+			con.Scan("Name: ", &name)
+			con.Scan("Data: ", &data)
+			con.Scan("Scheme (ec, rep): ", &scheme)
+
+			if scheme == "ec" {
+				con.Scan("Data fragments (k): ", &k)
+				con.Scan("Total fragments (n): ", &n)
+			} else if scheme == "rep" {
+				k = 1
+				con.Scan("Replicas: ", &n)
+			} else {
+				fmt.Println("Unknown scheme")
+				continue
+			}
+
+			if k < 1 || n < k || n > 255 {
+				fmt.Println("Invalid parameters")
+				continue
+			}
+
+			if err := c.put(name, data, policy{k: k, n: n}); err != nil {
+				fmt.Println(err)
+			}
+		} else if cmd == "get" {
+			var name string
+
+			con.Scan("Name: ", &name)
+
+			data, err := c.get(name)
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Printf("%s = %s\n", name, data)
+			}
+		} else if cmd == "fail" || cmd == "recover" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			if cmd == "fail" {
+				c.fail(id)
+			} else {
+				// comes back empty, usable as a repair target
+				c.mu.Lock()
+				c.nodes[id].failed = false
+				c.mu.Unlock()
+			}
+		} else if cmd == "repair" {
+			start := time.Now()
+			repaired, traffic := c.repair()
+			fmt.Printf("Repaired %d fragment(s), %d bytes of repair traffic in %v\n", repaired, traffic, time.Since(start).Round(time.Millisecond))
+		} else if cmd == "durability" {
+			// compare policies for the same per-node failure probability within a repair window
+			var q float64
+
+			con.Scan("Node failure probability per repair window: ", &q)
+
+			policies := c.policies()
+			for _, p := range policies {
+				fmt.Printf("%-16s overhead %.2fx, tolerates %d loss(es), P(loss) = %.3g\n", p.String(), float64(p.n)/float64(p.k), p.n-p.k, p.lossProbability(q))
+			}
+		} else if cmd == "montecarlo" {
+			var seed int64
+			var afr, years float64
+			var window string
+			var trials int
+
+			con.Scan("Seed: ", &seed)
+			con.Scan("Annual node failure rate (e.g. 0.05): ", &afr)
+			con.Scan("Repair time (e.g. 24h): ", &window)
+			con.Scan("Years: ", &years)
+			con.Scan("Trials: ", &trials)
+
+			repair, err := time.ParseDuration(window)
+			if err != nil || afr <= 0 || years <= 0 || trials <= 0 {
+				fmt.Println("Invalid parameters")
+				continue
+			}
+
+			// every policy replays the same failure stream for a fair comparison
+			for _, p := range c.policies() {
+				start := time.Now()
+				losses := monteCarlo(p, afr, repair, years, trials, mrand.New(mrand.NewSource(seed)))
+				fmt.Printf("%-16s overhead %.2fx, %d of %d trial(s) lost data over %g year(s), P(loss) ~ %.3g (%v)\n", p.String(), float64(p.n)/float64(p.k), losses, trials, years, float64(losses)/float64(trials), time.Since(start).Round(time.Millisecond))
+			}
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type message struct {
+	from int
+}
+
+type nodePool struct {
+	*sim.Pool
+	participants int
+	send func(from, to int, m message)
+
+	// suspect a peer not heard from within its timeout, raised by this much after each mistake
+	timeout time.Duration
+	increase time.Duration
+
+	// the accrual detector suspects a peer once its phi reaches this
+	threshold float64
+
+	suspicions atomic.Int64
+	mistakes atomic.Int64
+
+	// deliberately weaken the protocol for demonstration
+	skipAdapt atomic.Bool
+}
+
+func newNodePool(participants int, send func(from, to int, m message)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.participants = participants
+	pool.send = send
+	pool.timeout = 0
+	pool.increase = 0
+	pool.threshold = 8
+	pool.suspicions.Store(0)
+	pool.mistakes.Store(0)
+	pool.skipAdapt.Store(false)
+	return pool
+}
+
+type node struct {
+	*sim.Process
+	pool *nodePool
+
+	lastHeard []time.Time
+	timeouts []time.Duration
+	suspected []bool
+	intervals []*sim.Backlog[time.Duration] // recent heartbeat inter-arrival times per peer
+	mu sync.Mutex
+
+	inbox chan message
+}
+
+func newNode(pool *nodePool, id, clockSpeed int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.lastHeard = make([]time.Time, pool.participants)
+	n.timeouts = make([]time.Duration, pool.participants)
+	n.suspected = make([]bool, pool.participants)
+	n.intervals = make([]*sim.Backlog[time.Duration], pool.participants)
+	for i := range n.lastHeard {
+		n.lastHeard[i] = time.Now()
+		n.timeouts[i] = pool.timeout
+		n.intervals[i] = sim.NewBacklog[time.Duration](100)
+	}
+	n.inbox = make(chan message)
+	return n
+}
+
+func (n *node) Run() {
+	// every tick sends heartbeats and checks the timeouts
+	n.Start(n.tick)
+
+	// poll heartbeats
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
+
+func (n *node) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for i := 0; i < n.pool.participants; i++ {
+		if i == n.ID() {
+			continue
+		}
+
+		n.pool.send(n.ID(), i, message{from: n.ID()})
+
+		if !n.suspected[i] && time.Since(n.lastHeard[i]) > n.timeouts[i] {
+			n.suspected[i] = true
+			n.pool.suspicions.Add(1)
+			n.Printf("Node %d suspects node %d (nothing for %v)", n.ID(), i, n.timeouts[i])
+		}
+	}
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.intervals[m.from].Add(time.Since(n.lastHeard[m.from]))
+	n.lastHeard[m.from] = time.Now()
+	if !n.suspected[m.from] {
+		return
+	}
+
+	// the peer was only slow, wait longer for it from now on
+	n.suspected[m.from] = false
+	n.pool.mistakes.Add(1)
+	if !n.pool.skipAdapt.Load() {
+		n.timeouts[m.from] += n.pool.increase
+	}
+	n.Printf("Node %d was wrong about node %d, timeout is now %v", n.ID(), m.from, n.timeouts[m.from])
+}
+
+// phi is the suspicion level of a peer: -log10 of the probability that its
+// next heartbeat is still this late, assuming its inter-arrival times are
+// normally distributed (node lock must be held)
+func (n *node) phi(peer int) float64 {
+	intervals := n.intervals[peer].All()
+	if len(intervals) < 2 {
+		return 0
+	}
+
+	mean := 0.0
+	for _, d := range intervals {
+		mean += float64(d)
+	}
+	mean /= float64(len(intervals))
+
+	variance := 0.0
+	for _, d := range intervals {
+		variance += (float64(d) - mean) * (float64(d) - mean)
+	}
+	variance /= float64(len(intervals))
+
+	// a very regular peer would otherwise be suspected after the slightest delay
+	std := math.Max(math.Sqrt(variance), mean/10)
+
+	elapsed := float64(time.Since(n.lastHeard[peer]))
+	later := 0.5 * math.Erfc((elapsed-mean)/(std*math.Sqrt2))
+	return -math.Log10(math.Max(later, 1e-300))
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func main() {
+	heartbeat := flag.Duration("heartbeat", 500*time.Millisecond, "interval between heartbeats")
+	timeout := flag.Duration("timeout", 1500*time.Millisecond, "initial time without a heartbeat before a peer is suspected")
+	threshold := flag.Float64("phi", 8, "phi at which the accrual detector suspects a peer")
+	increase := flag.Duration("increase", 500*time.Millisecond, "added to a peer's timeout each time it was wrongly suspected")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *heartbeat < time.Millisecond || *timeout <= 0 || *increase < 0 {
+		fmt.Println("Heartbeat and timeout must be positive")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	var lmin, lmax atomic.Int64
+	lmin.Store(50)
+	lmax.Store(300)
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		return sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+	})
+
+	sender := func(from, to int, m message) {
+		// heartbeat delay (+ network jam)
+		network.Send(from, to, m, time.Duration(network.Link(from, to).Latency)*time.Millisecond+sim.Latency(int(lmin.Load()), int(lmax.Load())))
+	}
+
+	// a heartbeat older than this says nothing about the peer anymore
+	var ttl atomic.Int64
+	network.TTL = func(m message) time.Duration {
+		return time.Duration(ttl.Load())
+	}
+
+	pool := newNodePool(nodeCount, sender)
+	pool.timeout = *timeout
+	pool.increase = *increase
+	pool.threshold = *threshold
+	for i := 0; i < nodeCount; i++ {
+		nodes[i] = newNode(pool, i, int(*heartbeat/time.Millisecond), l)
+		nodes[i].Run()
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: suspects, phi, crash, latency, jam, cut, restore, network, ping, stats, ttl, partition, heal, logs, toggle, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "suspects" {
+			for i := range nodes {
+				if !nodes[i].Running() {
+					fmt.Printf("Node %d: crashed\n", i)
+					continue
+				}
+
+				nodes[i].mu.Lock()
+				suspects := []int{}
+				wrong := []int{}
+				for j, suspected := range nodes[i].suspected {
+					if !suspected {
+						continue
+					}
+					suspects = append(suspects, j)
+					if nodes[j].Running() {
+						wrong = append(wrong, j)
+					}
+				}
+				fmt.Printf("Node %d suspects %v", i, suspects)
+				if len(wrong) > 0 {
+					fmt.Printf(", wrongly %v", wrong)
+				}
+				fmt.Printf(", timeouts %v\n", nodes[i].timeouts)
+				nodes[i].mu.Unlock()
+			}
+		} else if cmd == "phi" {
+			// the accrual detector next to the fixed timeouts, for the same heartbeats
+			fmt.Printf("Phi per peer (suspected by: P = phi >= %.1f, T = timeout)\n", pool.threshold)
+			for i := range nodes {
+				if !nodes[i].Running() {
+					fmt.Printf("Node %d: crashed\n", i)
+					continue
+				}
+
+				nodes[i].mu.Lock()
+				fmt.Printf("Node %d:", i)
+				for j := range nodes {
+					if j == i {
+						continue
+					}
+
+					phi := nodes[i].phi(j)
+					marks := ""
+					if phi >= pool.threshold {
+						marks += "P"
+					}
+					if nodes[i].suspected[j] {
+						marks += "T"
+					}
+					if marks != "" {
+						marks = " [" + marks + "]"
+					}
+					fmt.Printf(" %d: %.1f%s", j, phi, marks)
+				}
+				fmt.Println()
+				nodes[i].mu.Unlock()
+			}
+		} else if cmd == "crash" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			nodes[id].Stop()
+		} else if cmd == "latency" {
+			var lo, hi int64
+
+			con.Scan("Min latency (ms): ", &lo)
+			con.Scan("Max latency (ms): ", &hi)
+
+			lmin.Store(lo)
+			lmax.Store(hi)
+		} else if cmd == "jam" {
+			// slow link, heartbeats on it arrive late
+			var source, target, latency int
+
+			con.Scan("Source node: ", &source)
+			con.Scan("Target node: ", &target)
+			con.Scan("Added latency (ms): ", &latency)
+
+			network.Jam(source, target, latency)
+		} else if cmd == "network" {
+			var action string
+			con.Scan("Action (show): ", &action)
+
+			if action == "show" {
+				network.Heatmap(os.Stdout)
+			} else {
+				fmt.Println("Unknown action")
+			}
+		} else if cmd == "ping" {
+			var args string
+			con.ScanLine("From, to and probes (e.g. 0 3 or 0 3 10): ", &args)
+
+			from, to, count, err := sim.ParsePing(args, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			network.Ping(from, to, count, func(from, to int) time.Duration {
+				return time.Duration(network.Link(from, to).Latency)*time.Millisecond + sim.Latency(int(lmin.Load()), int(lmax.Load()))
+			}).Report(os.Stdout)
+		} else if cmd == "cut" || cmd == "restore" {
+			var source, target int
+
+			con.Scan("Source node: ", &source)
+			con.Scan("Target node: ", &target)
+
+			network.Cut(source, target, cmd == "cut")
+
+			if cmd == "cut" {
+				fmt.Printf("Link %d -> %d is down\n", source, target)
+			} else {
+				fmt.Printf("Link %d -> %d is restored\n", source, target)
+			}
+		} else if cmd == "stats" {
+			fmt.Printf("Heartbeats sent: %d (%d dropped, %d expired)\n", network.Stats.Messages.Load(), network.Stats.Dropped.Load(), network.Stats.Expired.Load())
+			fmt.Printf("Suspicions: %d, of which proved wrong: %d\n", pool.suspicions.Load(), pool.mistakes.Load())
+		} else if cmd == "ttl" {
+			var lifetime string
+
+			con.Scan("TTL (e.g. 200ms, 0 for none): ", &lifetime)
+
+			d, err := time.ParseDuration(lifetime)
+			if err != nil || d < 0 {
+				fmt.Println("Invalid duration")
+				continue
+			}
+			ttl.Store(int64(d))
+
+			if d == 0 {
+				fmt.Println("Heartbeats live until delivered")
+			} else {
+				fmt.Printf("Heartbeats expire %v after they are sent\n", d)
+			}
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "toggle" {
+			var mechanism string
+			con.Scan("Mechanism (adapt): ", &mechanism)
+
+			if mechanism == "adapt" {
+				skip := !pool.skipAdapt.Load()
+				pool.skipAdapt.Store(skip)
+				fmt.Printf("Raising timeouts after a mistake: %s\n", enabledString(!skip))
+			} else {
+				fmt.Println("Unknown mechanism")
+			}
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type backend struct {
+	id int
+	shard int
+	served atomic.Int64
+
+	busy atomic.Int64 // microseconds spent serving
+	wasted atomic.Int64 // microseconds spent on responses nobody used
+	cancelled atomic.Int64
+}
+
+type cluster struct {
+	*sim.Pool
+
+	shards [][]*backend
+
+	base, slow int // ms
+	slowChance int // per mille of requests that hit a hiccup (GC pause, queueing, ...)
+
+	hedge atomic.Bool
+	tied atomic.Bool
+	cancel atomic.Bool // propagate cancellation to requests whose answer is no longer needed
+	hedgeDelay int // ms
+}
+
+func newCluster(shardCount, replicaCount int) *cluster {
+	c := new(cluster)
+	c.Pool = sim.NewPool()
+	c.shards = make([][]*backend, shardCount)
+	for s := range c.shards {
+		c.shards[s] = make([]*backend, replicaCount)
+		for r := range c.shards[s] {
+			c.shards[s][r] = &backend{id: s*replicaCount + r, shard: s}
+		}
+	}
+	c.base = 10
+	c.slow = 200
+	c.slowChance = 10
+	c.hedge.Store(false)
+	c.tied.Store(false)
+	c.cancel.Store(false)
+	c.hedgeDelay = 15
+	return c
+}
+
+// serve a request unless it is cancelled first, returns false if cancelled
+func (c *cluster) handle(ctx context.Context, b *backend) bool {
+	b.served.Add(1)
+
+	d := int64(c.base) + sim.Random(int64(c.base/2))
+	if sim.Random(1000) < int64(c.slowChance) {
+		d = int64(c.slow) + sim.Random(int64(c.slow/2))
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(time.Duration(d) * time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		b.busy.Add(time.Since(start).Microseconds())
+		return true
+	case <-ctx.Done():
+		spent := time.Since(start).Microseconds()
+		b.busy.Add(spent)
+		b.wasted.Add(spent)
+		b.cancelled.Add(1)
+		return false
+	}
+}
+
+// rpc to one shard, optionally with a hedged or tied second copy on another replica;
+// the first response wins and the other copy is cancelled or, without cancellation, wasted
+func (c *cluster) call(ctx context.Context, shard int) bool {
+	replicas := c.shards[shard]
+	first := int(sim.Random(int64(len(replicas))))
+	second := (first + 1) % len(replicas)
+
+	if c.cancel.Load() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+	} else {
+		ctx = context.Background()
+	}
+
+	done := make(chan bool, 2)
+	answered := atomic.Bool{}
+	send := func(b *backend) {
+		start := time.Now()
+		if !c.handle(ctx, b) {
+			done <- false
+			return
+		}
+		if !answered.CompareAndSwap(false, true) {
+			// a duplicate that finished after the winner
+			b.wasted.Add(time.Since(start).Microseconds())
+		}
+		done <- true
+	}
+
+	c.Go(func() { send(replicas[first]) })
+	copies := 1
+
+	if len(replicas) > 1 && c.tied.Load() {
+		// both copies are sent up front
+		c.Go(func() { send(replicas[second]) })
+		copies++
+	} else if len(replicas) > 1 && c.hedge.Load() {
+		// the second copy only goes out if the first is slower than usual
+		select {
+		case ok := <-done:
+			return ok
+		case <-ctx.Done():
+			return false
+		case <-time.After(time.Duration(c.hedgeDelay) * time.Millisecond):
+			c.Go(func() { send(replicas[second]) })
+			copies++
+		}
+	}
+
+	for i := 0; i < copies; i++ {
+		if <-done {
+			return true
+		}
+	}
+	return false
+}
+
+// fan out to every shard and wait for the fastest k, the stragglers are cancelled if enabled
+func (c *cluster) fanout(k int) time.Duration {
+	start := time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	responses := make(chan struct{}, len(c.shards))
+	for s := range c.shards {
+		s := s
+		c.Go(func() {
+			if c.call(ctx, s) {
+				responses <- struct{}{}
+			}
+		})
+	}
+
+	for i := 0; i < k; i++ {
+		<-responses
+	}
+	return time.Since(start)
+}
+
+type usage struct {
+	served, cancelled int64
+	busy, wasted time.Duration
+}
+
+func (c *cluster) usage() usage {
+	u := usage{}
+	for _, replicas := range c.shards {
+		for _, b := range replicas {
+			u.served += b.served.Load()
+			u.cancelled += b.cancelled.Load()
+			u.busy += time.Duration(b.busy.Load()) * time.Microsecond
+			u.wasted += time.Duration(b.wasted.Load()) * time.Microsecond
+		}
+	}
+	return u
+}
+
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+// issue requests from a few concurrent frontends and collect latencies
+func measure(count int, request func() time.Duration) []time.Duration {
+	latencies := make([]time.Duration, count)
+	next := atomic.Int64{}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := next.Add(1) - 1
+				if i >= int64(count) {
+					return
+				}
+				latencies[i] = request()
+			}
+		}()
+	}
+	wg.Wait()
+	return latencies
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func main() {
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var shardCount, replicaCount int
+	con.Scan("Number of shards (fan-out): ", &shardCount)
+	con.Scan("Replicas per shard: ", &replicaCount)
+
+	c := newCluster(shardCount, replicaCount)
+	k := shardCount
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, latency, wait, hedge, toggle, run, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			fmt.Printf("Fan-out: %d shard(s) x %d replica(s), waiting for %d of %d\n", len(c.shards), replicaCount, k, len(c.shards))
+			fmt.Printf("Backend latency: %dms, %d/1000 hiccups of %dms\n", c.base, c.slowChance, c.slow)
+			fmt.Printf("Hedged requests: %s (after %dms), tied requests: %s, cancellation: %s\n", enabledString(c.hedge.Load()), c.hedgeDelay, enabledString(c.tied.Load()), enabledString(c.cancel.Load()))
+			u := c.usage()
+			fmt.Printf("Backend requests: %d served, %d cancelled, %v busy, %v wasted\n", u.served, u.cancelled, u.busy.Round(time.Millisecond), u.wasted.Round(time.Millisecond))
+		} else if cmd == "latency" {
+			con.Scan("Base latency (ms): ", &c.base)
+			con.Scan("Hiccup latency (ms): ", &c.slow)
+			con.Scan("Hiccups per 1000 requests: ", &c.slowChance)
+		} else if cmd == "wait" {
+			con.Scan(fmt.Sprintf("Responses to wait for (k of %d): ", len(c.shards)), &k)
+			if k < 1 || k > len(c.shards) {
+				k = len(c.shards)
+			}
+		} else if cmd == "hedge" {
+			con.Scan("Hedge delay (ms): ", &c.hedgeDelay)
+		} else if cmd == "toggle" {
+			var mechanism string
+			con.Scan("Mechanism (hedge, tied, cancel): ", &mechanism)
+
+			if mechanism == "hedge" {
+				c.hedge.Store(!c.hedge.Load())
+				fmt.Printf("Hedged requests: %s\n", enabledString(c.hedge.Load()))
+			} else if mechanism == "tied" {
+				c.tied.Store(!c.tied.Load())
+				fmt.Printf("Tied requests: %s\n", enabledString(c.tied.Load()))
+			} else if mechanism == "cancel" {
+				c.cancel.Store(!c.cancel.Load())
+				fmt.Printf("Cancellation propagation: %s\n", enabledString(c.cancel.Load()))
+			} else {
+				fmt.Println("Unknown mechanism")
+			}
+		} else if cmd == "run" {
+			var count int
+			con.Scan("Requests: ", &count)
+
+			// a single backend call versus the whole fan-out, same backends and settings
+			// let stragglers finish or notice cancellation so their work is counted
+			settle := c.Wait
+
+			before := c.usage()
+			single := measure(count, func() time.Duration {
+				start := time.Now()
+				c.call(context.Background(), int(sim.Random(int64(len(c.shards)))))
+				return time.Since(start)
+			})
+			settle()
+			after := c.usage()
+			singleUsage := usage{served: after.served - before.served, cancelled: after.cancelled - before.cancelled, busy: after.busy - before.busy, wasted: after.wasted - before.wasted}
+
+			before = c.usage()
+			fanned := measure(count, func() time.Duration { return c.fanout(k) })
+			settle()
+			after = c.usage()
+			fannedUsage := usage{served: after.served - before.served, cancelled: after.cancelled - before.cancelled, busy: after.busy - before.busy, wasted: after.wasted - before.wasted}
+
+			fmt.Printf("%-20s %7s %7s %7s %7s %9s %10s %10s %9s\n", "", "p50", "p90", "p99", "p99.9", "copies", "busy", "wasted", "cancelled")
+			row := func(name string, latencies []time.Duration, u usage) {
+				perRequest := func(d time.Duration) time.Duration { return (d / time.Duration(count)).Round(100 * time.Microsecond) }
+				fmt.Printf("%-20s %7v %7v %7v %7v %9.2f %10v %10v %9d\n", name, percentile(latencies, 0.5).Round(time.Millisecond), percentile(latencies, 0.9).Round(time.Millisecond), percentile(latencies, 0.99).Round(time.Millisecond), percentile(latencies, 0.999).Round(time.Millisecond), float64(u.served)/float64(count), perRequest(u.busy), perRequest(u.wasted), u.cancelled)
+			}
+			row("single backend", single, singleUsage)
+			row(fmt.Sprintf("fan-out %d of %d", k, len(c.shards)), fanned, fannedUsage)
+			fmt.Println("copies, busy and wasted are backend requests and backend time per frontend request")
+
+			// chance that a full fan-out touches at least one hiccup
+			fast := 1.0
+			for i := 0; i < len(c.shards); i++ {
+				fast *= 1 - float64(c.slowChance)/1000
+			}
+			fmt.Printf("Probability a %d-way fan-out touches at least one hiccup: %.1f%%\n", len(c.shards), (1-fast)*100)
+
+			l.Printf("Run of %d request(s) (hedge: %v, tied: %v, cancel: %v, k: %d): single p99 %v, fan-out p99 %v, %v wasted", count, c.hedge.Load(), c.tied.Load(), c.cancel.Load(), k, percentile(single, 0.99).Round(time.Millisecond), percentile(fanned, 0.99).Round(time.Millisecond), (singleUsage.wasted + fannedUsage.wasted).Round(time.Millisecond))
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	l.Flush(os.Stdout)
+}
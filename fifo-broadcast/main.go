@@ -1,113 +1,265 @@
 package main
 
 import (
-	"bufio"
 	"container/list"
-	"crypto/rand"
+	"flag"
 	"fmt"
-	"log"
-	"math/big"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
 )
 
+// ordering the pool runs in one epoch, changed online by reconfiguration
+type config struct {
+	epoch int
+	order string // fifo, or total through a sequencer
+	sequencer int
+}
+
+func (c config) String() string {
+	if c.order == "total" {
+		return fmt.Sprintf("epoch %d: total order, sequencer %d", c.epoch, c.sequencer)
+	}
+	return fmt.Sprintf("epoch %d: fifo", c.epoch)
+}
+
 type message struct {
+	kind string // data, order (sequencer), prepare or seal (reconfiguration)
+	epoch int
 	sender int
 	sequence int
 	data string
+
+	slot int // order: position of the ordered message in the total order
+	ordered [2]int // order: sender and sequence of that message
+	next config // prepare: the configuration to switch to
+	count int // seal: broadcasts the sender made before sealing
+
+	// ground truth order assigned by the omniscient observer at send time
+	global int64
+}
+
+// a broadcast asked for while the node is sealed
+type outgoing struct {
+	data string
+	lmin, lmax int
+	overrides map[int]time.Duration
 }
 
 type nodePool struct {
+	*sim.Pool
 	participants int
-	broadcast func(m message, lmin, lmax int)
+	broadcast func(m message, lmin, lmax int, overrides map[int]time.Duration)
+
+	oracle atomic.Int64
 
-	aliveCount atomic.Int64
+	// bounded delivery history, zero keeps everything
+	retainCount int
+	retainFor time.Duration
+
+	// recent broadcasts replayed to recovering nodes
+	replay *sim.Backlog[message]
+
+	// deliberately weaken the protocol for demonstration
+	skipHoldBack atomic.Bool
+	skipBarrier atomic.Bool
 }
 
-func newNodePool(participants int, broadcast func(m message, lmin, lmax int)) *nodePool {
+func newNodePool(participants int, broadcast func(m message, lmin, lmax int, overrides map[int]time.Duration)) *nodePool {
 	pool := new(nodePool)
 	pool.participants = participants
+	pool.Pool = sim.NewPool()
 	pool.broadcast = broadcast
-	pool.aliveCount.Store(0)
+	pool.oracle.Store(0)
+	pool.retainCount = 0
+	pool.retainFor = 0
+	pool.replay = sim.NewBacklog[message](0)
+	pool.skipHoldBack.Store(false)
+	pool.skipBarrier.Store(false)
 	return pool
 }
 
 type node struct {
+	*sim.Process
 	pool *nodePool
-	id int
-	clockSpeed int
-	l *log.Logger
 
 	sendSeq int
 	delivered []int
 	buffer *list.List
+	mu sync.Mutex
 	broadcast chan message
 
-	running atomic.Bool
+	// current configuration, and the next one while switching to it
+	cfg config
+	next *config
+	seals map[int]int // broadcasts each node made before sealing the current epoch
+	future []message // messages of the next epoch, held until it starts
+	queued []outgoing
+
+	// total order: messages waiting for their slot, slots announced by the
+	// sequencer and, on the sequencer, the next sequence to order per sender
+	pending map[[2]int]message
+	slots map[int][2]int
+	nextSlot int
+	assigned []int
+	ordering int // sequencer: next slot to give out
+
+	// crashed nodes lose every message that reaches them
+	crashed atomic.Bool
+
+	// real-time order of delivered messages
+	history *sim.History
 }
 
-func newNode(pool *nodePool, id, clockSpeed int, l *log.Logger) *node {
+func newNode(pool *nodePool, id, clockSpeed int, l sim.Logger) *node {
 	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
 	n.pool = pool
-	n.id = id
-	n.clockSpeed = clockSpeed
-	n.l = l
 	n.sendSeq = 0
 	n.delivered = make([]int, pool.participants)
 	n.buffer = list.New()
 	n.broadcast = make(chan message)
-	n.running.Store(false)
+	n.cfg = config{epoch: 0, order: "fifo"}
+	n.next = nil
+	n.seals = make(map[int]int)
+	n.future = nil
+	n.queued = nil
+	n.pending = make(map[[2]int]message)
+	n.slots = make(map[int][2]int)
+	n.nextSlot = 0
+	n.assigned = make([]int, pool.participants)
+	n.ordering = 0
+	n.crashed.Store(false)
+	n.history = sim.NewHistory(pool.retainCount, pool.retainFor)
 
 	return n
 }
 
-func (n *node) run() {
-	n.running.Store(true)
-
-	go func() {
-		n.pool.aliveCount.Add(1)
-		n.l.Printf("Node %d started at %dms clock speed", n.id, n.clockSpeed)
-		for n.running.Load() {
-			time.Sleep(time.Duration(n.clockSpeed) * time.Millisecond)
-		}
-		n.l.Printf("Node %d stopping", n.id)
-		n.pool.aliveCount.Add(-1)
-	}()
+func (n *node) Run() {
+	n.Start(nil)
 
 	// poll broadcast messages
-	go func() {
-		for n.running.Load() {
-			var ok bool
-
-			m, ok := <-n.broadcast
-			if ok {
-				n.receive(m)
-			}
-		}
-	}()
+	sim.Listen(n.Process, n.broadcast, n.receive)
 }
 
-func (n *node) stop() {
-	n.running.Store(false)
+func (n *node) send(data string, lmin, lmax int, overrides map[int]time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.sendLocked(outgoing{data: data, lmin: lmin, lmax: lmax, overrides: overrides})
 }
 
-func (n *node) send(data string, lmin, lmax int) {
-	m := message{
-		sender: n.id,
-		sequence: n.sendSeq,
-		data: data,
+// node lock must be held
+func (n *node) sendLocked(o outgoing) {
+	if n.next != nil && !n.pool.skipBarrier.Load() {
+		// sealed: the broadcast goes out in the next epoch
+		n.queued = append(n.queued, o)
+		n.Printf("Node %d holds broadcast %s until epoch %d starts", n.ID(), o.data, n.next.epoch)
+		return
 	}
 
-	n.l.Printf("Node %d sends broadcast #%d", n.id, n.sendSeq)
+	sequence := n.sendSeq
 	n.sendSeq++
 
-	n.pool.broadcast(m, lmin, lmax)
+	m := message{
+		kind: "data",
+		epoch: n.cfg.epoch,
+		sender: n.ID(),
+		sequence: sequence,
+		data: o.data,
+		global: n.pool.oracle.Add(1) - 1,
+	}
+
+	n.Printf("Node %d sends broadcast #%d", n.ID(), sequence)
+
+	n.pool.broadcast(m, o.lmin, o.lmax, o.overrides)
+}
+
+// control messages travel at an ordinary latency (node lock must be held)
+func (n *node) control(m message) {
+	m.sender = n.ID()
+	n.pool.broadcast(m, 20, 100, nil)
+}
+
+// start switching to another configuration
+func (n *node) reconfigure(next config) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.Printf("Node %d proposes %s", n.ID(), next)
+	n.control(message{kind: "prepare", epoch: n.cfg.epoch, next: next})
 }
 
 func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.handle(m)
+}
+
+// node lock must be held
+func (n *node) handle(m message) {
+	switch m.kind {
+	case "prepare":
+		n.prepare(m.next)
+		return
+
+	case "seal":
+		if m.epoch == n.cfg.epoch {
+			n.seals[m.sender] = m.count
+			n.activate()
+		}
+		return
+
+	case "order":
+		if m.epoch > n.cfg.epoch {
+			n.future = append(n.future, m)
+		} else if m.epoch == n.cfg.epoch && m.slot >= n.nextSlot {
+			n.slots[m.slot] = m.ordered
+			n.deliverOrdered()
+		}
+		return
+	}
+
+	if m.sequence < n.delivered[m.sender] {
+		// a replayed message that was delivered before the crash
+		return
+	}
+
+	if m.epoch > n.cfg.epoch {
+		// the sender has already switched, wait until this node has too
+		n.future = append(n.future, m)
+		return
+	}
+
+	if m.epoch == n.cfg.epoch && n.cfg.order == "total" {
+		n.pending[[2]int{m.sender, m.sequence}] = m
+		if n.cfg.sequencer == n.ID() {
+			n.assign()
+		}
+		n.deliverOrdered()
+		return
+	}
+
+	if m.epoch < n.cfg.epoch {
+		// only possible when switching without the barrier
+		n.Printf("Node %d gets broadcast #%d from node %d of old epoch %d, delivered outside the current ordering", n.ID(), m.sequence, m.sender, m.epoch)
+	}
+
+	if n.pool.skipHoldBack.Load() {
+		// deliver immediately without waiting for earlier messages
+		if m.sequence != n.delivered[m.sender] {
+			n.Printf("Node %d VIOLATION: broadcast #%d from node %d delivered while expecting #%d", n.ID(), m.sequence, m.sender, n.delivered[m.sender])
+		}
+		n.deliver(m)
+		return
+	}
+
 	n.buffer.PushBack(m)
 	for {
 		var ok bool
@@ -127,93 +279,569 @@ func (n *node) receive(m message) {
 			break
 		}
 
-		n.delivered[deliver.sender]++
+		n.deliver(deliver)
+	}
+}
+
+// node lock must be held
+func (n *node) deliver(m message) {
+	if m.sequence >= n.delivered[m.sender] {
+		n.delivered[m.sender] = m.sequence + 1
+	}
+
+	n.Printf("Node %d receives broadcast: %s (from node %d)", n.ID(), m.data, m.sender)
+	n.history.Record(m.global)
+
+	n.activate()
+}
+
+// sequencer: give every message that is next from its sender a slot, so the
+// total order keeps each sender's FIFO order (node lock must be held)
+func (n *node) assign() {
+	for {
+		progress := false
+		for sender := range n.assigned {
+			key := [2]int{sender, n.assigned[sender]}
+			if _, ok := n.pending[key]; !ok {
+				continue
+			}
+
+			n.control(message{kind: "order", epoch: n.cfg.epoch, slot: n.ordering, ordered: key})
+			n.ordering++
+			n.assigned[sender]++
+			progress = true
+		}
+		if !progress {
+			return
+		}
+	}
+}
+
+// deliver messages in slot order while both the slot and the message are in
+// (node lock must be held)
+func (n *node) deliverOrdered() {
+	for {
+		key, ok := n.slots[n.nextSlot]
+		if !ok {
+			return
+		}
+		m, ok := n.pending[key]
+		if !ok {
+			return
+		}
+
+		delete(n.slots, n.nextSlot)
+		delete(n.pending, key)
+		n.nextSlot++
+		n.deliver(m)
+	}
+}
+
+// a reconfiguration reached this node: stop broadcasting in the current
+// epoch and tell everyone how many broadcasts it made (node lock must be held)
+func (n *node) prepare(next config) {
+	if next.epoch <= n.cfg.epoch || n.next != nil {
+		return
+	}
+
+	n.next = &next
+	n.Printf("Node %d seals epoch %d after %d broadcast(s)", n.ID(), n.cfg.epoch, n.sendSeq)
+	n.control(message{kind: "seal", epoch: n.cfg.epoch, count: n.sendSeq})
+
+	n.activate()
+}
+
+// switch to the next configuration once every broadcast of the current
+// epoch is delivered here (node lock must be held)
+func (n *node) activate() {
+	if n.next == nil {
+		return
+	}
+
+	// the barrier: every node has sealed and everything it sent is delivered
+	if !n.pool.skipBarrier.Load() {
+		for i := range n.delivered {
+			count, ok := n.seals[i]
+			if !ok || n.delivered[i] < count {
+				return
+			}
+		}
+	}
+
+	n.cfg = *n.next
+	n.next = nil
+	n.seals = make(map[int]int)
+	n.pending = make(map[[2]int]message)
+	n.slots = make(map[int][2]int)
+	n.nextSlot = 0
+	n.ordering = 0
+	copy(n.assigned, n.delivered)
+	n.Printf("Node %d switches to %s", n.ID(), n.cfg)
+
+	future, queued := n.future, n.queued
+	n.future, n.queued = nil, nil
+	for _, m := range future {
+		n.handle(m)
+	}
+	for _, o := range queued {
+		n.sendLocked(o)
+	}
+}
+
+// the delivered counters survive a crash (stable storage), the hold-back buffer only if kept
+func (n *node) crash(keepBuffer bool) {
+	n.crashed.Store(true)
 
-		n.l.Printf("Node %d receives broadcast: %s (from node %d)", n.id, deliver.data, deliver.sender)
+	n.mu.Lock()
+	lost := 0
+	if !keepBuffer {
+		lost = n.buffer.Len()
+		n.buffer.Init()
+	}
+	n.mu.Unlock()
+
+	n.Printf("Node %d crashes, %d buffered message(s) lost", n.ID(), lost)
+}
+
+// replay retained broadcasts, those already delivered are skipped
+func (n *node) recover() {
+	n.crashed.Store(false)
+
+	replay := n.pool.replay.All()
+	n.Printf("Node %d recovers, replaying %d retained broadcast(s)", n.ID(), len(replay))
+
+	for _, m := range replay {
+		n.receive(m)
 	}
 }
 
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
 func main() {
-	var logBuilder strings.Builder
+	l := sim.NewLog()
+
+	retainCount := flag.Int("retain-count", 0, "keep at most this many delivered messages per node (0 keeps all)")
+	retainFor := flag.Duration("retain-for", 0, "forget delivered messages older than this (0 keeps all)")
+	replayCount := flag.Int("replay-count", 0, "broadcasts kept for replay to recovering nodes (0 keeps all)")
+	distribution := flag.String("latency", "uniform", "latency distribution: uniform, normal, exponential or pareto")
+	topology := flag.String("topology", "mesh", "how nodes are wired: mesh, ring, line, star, tree, random:<p> or file:<path>")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
 
-	l := log.New(&logBuilder, " [LOG] ", log.LstdFlags)
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
 	var nodeCount int
-	fmt.Printf("Number of nodes: ")
-	fmt.Scanf("%d", &nodeCount)
+	con.Scan("Number of nodes: ", &nodeCount)
 
 	nodes := make([]*node, nodeCount)
-	broadcaster := func(m message, lmin, lmax int) {
-		for i := range nodes {
-			go func(i int) {
-				// broadcast delay
-				r, _ := rand.Int(rand.Reader, big.NewInt(int64(lmax - lmin)))
-				latency := int64(lmin) + r.Int64()
-				time.Sleep(time.Duration(latency) * time.Millisecond)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		if nodes[to].crashed.Load() {
+			l.Printf("Node %d is crashed, broadcast #%d from node %d lost", to, m.sequence, m.sender)
+			return false
+		}
+		return sim.Deliver(nodes[to].Process, nodes[to].broadcast, m)
+	})
 
-				nodes[i].broadcast <- m
-			}(i)
+	wiring, err := sim.ParseTopology(*topology, nodeCount)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	network.SetTopology(wiring)
+
+	network.Latencies, err = sim.ParseDistribution(*distribution)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	network.Relaying = func(node int) bool {
+		return !nodes[node].crashed.Load()
+	}
+	network.OnDrop = func(p *sim.Packet[message], reason string) {
+		if p.Msg.kind != "data" {
+			l.Printf("%s from node %d to node %d dropped (%s)", p.Msg.kind, p.Msg.sender, p.To, reason)
+			return
 		}
+		l.Printf("Broadcast #%d from node %d to node %d dropped (%s)", p.Msg.sequence, p.Msg.sender, p.To, reason)
 	}
 
-	pool := newNodePool(nodeCount, broadcaster)
+	network.OnSettled = func(r sim.BroadcastResult[message]) {
+		if r.Msg.kind != "data" {
+			return
+		}
+		if len(r.Lost) > 0 {
+			con.Notify("Broadcast #%d from node %d settled in %v: reached %v, lost at %v", r.Msg.sequence, r.From, r.Elapsed.Round(time.Millisecond), r.Reached, r.Lost)
+		} else {
+			con.Notify("Broadcast #%d from node %d reached all nodes in %v", r.Msg.sequence, r.From, r.Elapsed.Round(time.Millisecond))
+		}
+	}
+
+	var pool *nodePool
+	broadcaster := func(m message, lmin, lmax int, overrides map[int]time.Duration) {
+		if m.kind == "data" || m.kind == "order" {
+			pool.replay.Add(m)
+		}
+		network.Broadcast(m.sender, m, func(to int) time.Duration {
+			// broadcast delay (exact if overridden)
+			if latency, ok := overrides[to]; ok {
+				return latency
+			}
+			return network.Latency(m.sender, to, lmin, lmax)
+		})
+	}
+
+	pool = newNodePool(nodeCount, broadcaster)
+	pool.retainCount = *retainCount
+	pool.retainFor = *retainFor
+	pool.replay = sim.NewBacklog[message](*replayCount)
 	for i := 0; i < nodeCount; i++ {
-		r, _ := rand.Int(rand.Reader, big.NewInt(500))
-		clockSpeed := int(500 + r.Int64())
+		clockSpeed := int(500 + sim.Random(500))
 
 		nodes[i] = newNode(pool, i, clockSpeed, l)
-		nodes[i].run()
+		nodes[i].Run()
+	}
+
+
+	network.OnBreak = func(p *sim.Packet[message], b sim.Breakpoint) {
+		con.Notify("Breakpoint #%d: broadcast #%d from node %d about to be delivered to node %d, network paused (step or resume)", b.ID, p.Msg.sequence, p.From, p.To)
 	}
 
+	watcher := sim.NewWatcher(nodeCount)
+	watcher.OnTrigger = func(alert string, pause bool) {
+		if pause && !network.Paused() {
+			network.Pause()
+			alert += ", network paused (resume to continue)"
+		}
+		con.Notify("%s", alert)
+	}
+	watcher.Probe("buffer", func(i int) int64 {
+		nodes[i].mu.Lock()
+		defer nodes[i].mu.Unlock()
+		return int64(nodes[i].buffer.Len())
+	})
+	watcher.Probe("delivered", func(i int) int64 {
+		return int64(nodes[i].history.Count())
+	})
+	watcher.Probe("seq", func(i int) int64 {
+		nodes[i].mu.Lock()
+		defer nodes[i].mu.Unlock()
+		return int64(nodes[i].sendSeq)
+	})
+
+	stopWatching := make(chan struct{})
+	watcher.Run(10*time.Millisecond, stopWatching)
+
 	for {
 		var cmd string
-		fmt.Println("Commands: state, broadcast, logs, exit")
-		fmt.Printf(" > ")
-		fmt.Scanf("%s", &cmd)
+		fmt.Println("Commands: state, broadcast, inflight, deliver, drop, oracle, stats, drain, loss, crash, recover, reconfigure, watch, unwatch, break, unbreak, step, resume, topology, partition, heal, logs, toggle, exit")
+		con.Scan(" > ", &cmd)
 
 		if cmd == "state" {
 			for i := range nodes {
-				fmt.Printf("Node %d (seq: %d) ", nodes[i].id, nodes[i].sendSeq)
+				nodes[i].mu.Lock()
+				fmt.Printf("Node %d (seq: %d) ", nodes[i].ID(), nodes[i].sendSeq)
 
 				delivered := make([]string, len(nodes[i].delivered))
 				for j := range delivered {
 					delivered[j] = strconv.Itoa(nodes[i].delivered[j])
 				}
 
-				fmt.Printf("[%s] \n", strings.Join(delivered, ", "))
+				status := ""
+				if nodes[i].crashed.Load() {
+					status = " crashed"
+				}
+				fmt.Printf("[%s] %d held back, %s", strings.Join(delivered, ", "), nodes[i].buffer.Len()+len(nodes[i].pending), nodes[i].cfg)
+				if nodes[i].next != nil {
+					fmt.Printf(", switching to epoch %d (%d seal(s), %d broadcast(s) waiting)", nodes[i].next.epoch, len(nodes[i].seals), len(nodes[i].queued))
+				}
+				fmt.Printf("%s\n", status)
+				nodes[i].mu.Unlock()
 			}
 		} else if cmd == "broadcast" {
 			var sender int
-			var data string
+			var data, to string
 			var lmin, lmax int
 
-			fmt.Printf("Sender: ")
-			fmt.Scanf("%d", &sender)
-			fmt.Printf("Data: ")
-			fmt.Scanf("%s", &data)
-			fmt.Printf("Min latency (ms): ")
-			fmt.Scanf("%d", &lmin)
-			fmt.Printf("Max latency (ms): ")
-			fmt.Scanf("%d", &lmax)
+			con.Scan("Sender: ", &sender)
+			con.Scan("Data: ", &data)
+			con.Scan("Min latency (ms): ", &lmin)
+			con.Scan("Max latency (ms): ", &lmax)
+			con.Scan("Latency overrides (e.g. 1=500ms,2=50ms, - for none): ", &to)
+
+			overrides, err := sim.ParseOverrides(to)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			if nodes[sender].crashed.Load() {
+				fmt.Println("Node is crashed")
+				continue
+			}
+			nodes[sender].send(data, lmin, lmax, overrides)
+		} else if cmd == "crash" {
+			var id int
+			var keep string
+
+			con.Scan("Node: ", &id)
+			con.Scan("Keep buffered messages (yes/no): ", &keep)
+
+			if nodes[id].crashed.Load() {
+				fmt.Println("Node is already crashed")
+				continue
+			}
+			nodes[id].crash(keep == "yes")
+		} else if cmd == "recover" {
+			var id int
+
+			con.Scan("Node: ", &id)
 
-			nodes[sender].send(data, lmin, lmax)
+			if !nodes[id].crashed.Load() {
+				fmt.Println("Node is not crashed")
+				continue
+			}
+			nodes[id].recover()
+		} else if cmd == "reconfigure" {
+			// switch the running pool to another ordering without a restart
+			var coordinator, sequencer int
+			var order string
+
+			con.Scan("Coordinator: ", &coordinator)
+			con.Scan("Order (fifo, total): ", &order)
+
+			next := config{order: order}
+			if order == "total" {
+				con.Scan("Sequencer: ", &sequencer)
+				next.sequencer = sequencer
+			} else if order != "fifo" {
+				fmt.Println("Unknown order")
+				continue
+			}
+
+			nodes[coordinator].mu.Lock()
+			busy := nodes[coordinator].next != nil
+			next.epoch = nodes[coordinator].cfg.epoch + 1
+			nodes[coordinator].mu.Unlock()
+
+			if busy {
+				fmt.Println("A reconfiguration is already in progress")
+				continue
+			}
+			nodes[coordinator].reconfigure(next)
+		} else if cmd == "inflight" {
+			packets := network.InFlight()
+			if len(packets) == 0 {
+				fmt.Println("No messages in flight")
+			}
+			for _, p := range packets {
+				if p.Msg.kind != "data" {
+					fmt.Printf("#%d: node %d -> node %d, %s (epoch %d), due in %v%s\n", p.ID, p.Msg.sender, p.To, p.Msg.kind, p.Msg.epoch, time.Until(p.Due).Round(time.Millisecond), sim.Via(p.Route))
+					continue
+				}
+				fmt.Printf("#%d: node %d -> node %d, %s (#%d), due in %v%s\n", p.ID, p.Msg.sender, p.To, p.Msg.data, p.Msg.sequence, time.Until(p.Due).Round(time.Millisecond), sim.Via(p.Route))
+			}
+		} else if cmd == "deliver" || cmd == "drop" {
+			var id int
+
+			con.Scan("Message ID: ", &id)
+
+			if !network.Signal(id, cmd) {
+				fmt.Println("No such message in flight")
+			}
+		} else if cmd == "oracle" {
+			// compare delivery order with the real-time send order
+			for i := range nodes {
+				order := nodes[i].history.Order()
+
+				s := make([]string, len(order))
+				for j := range order {
+					s[j] = strconv.FormatInt(order[j], 10)
+				}
+
+				fmt.Printf("Node %d delivered [%s], %d inversion(s)", nodes[i].ID(), strings.Join(s, ", "), sim.Inversions(order))
+				if forgotten := nodes[i].history.Count() - len(order); forgotten > 0 {
+					fmt.Printf(" in the last %d, %d older forgotten", len(order), forgotten)
+				}
+				fmt.Println()
+			}
+
+			// total order: every pair of messages two nodes both delivered comes in the same order
+			disagreements := 0
+			orders := make([][]int64, len(nodes))
+			for i := range nodes {
+				orders[i] = nodes[i].history.Order()
+			}
+			for i := range orders {
+				for j := i + 1; j < len(orders); j++ {
+					disagreements += sim.Disagreements(orders[i], orders[j])
+				}
+			}
+			fmt.Printf("Pairs of messages delivered in a different order by two nodes: %d\n", disagreements)
+		} else if cmd == "drain" {
+			// deliver everything in flight now instead of waiting for it
+			fmt.Printf("Delivered %d message(s) early\n", network.Drain())
+		} else if cmd == "loss" {
+			// lossy link: every message on it is lost with the given probability
+
+			var source, target, percent int
+
+			con.Scan("Source node: ", &source)
+			con.Scan("Target node: ", &target)
+			con.Scan("Drop probability (%): ", &percent)
+
+			if percent < 0 || percent > 100 {
+				fmt.Println("Invalid percentage")
+				continue
+			}
+			network.Lose(source, target, percent)
+
+			fmt.Printf("Link %d -> %d loses %d%% of messages\n", source, target, percent)
+		} else if cmd == "stats" {
+			delivered := 0
+			for i := range nodes {
+				delivered += nodes[i].history.Count()
+			}
+			network.Stats.Report(os.Stdout, nodeCount, delivered)
+		} else if cmd == "watch" {
+			var expr, pause string
+
+			con.ScanLine(fmt.Sprintf("Expression (e.g. node[2].buffer > 5, probes: %s): ", strings.Join(watcher.Probes(), ", ")), &expr)
+			con.Scan("Pause when triggered (yes/no): ", &pause)
+
+			id, err := watcher.Watch(expr, pause == "yes")
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("Watching #%d\n", id)
+		} else if cmd == "unwatch" {
+			var id int
+
+			watches := watcher.List()
+			if len(watches) == 0 {
+				fmt.Println("No watches")
+				continue
+			}
+			for _, w := range watches {
+				fmt.Println(w)
+			}
+			con.Scan("Watch ID: ", &id)
+
+			if !watcher.Unwatch(id) {
+				fmt.Println("No such watch")
+			}
+		} else if cmd == "break" {
+			var spec string
+
+			con.ScanLine("Breakpoint (e.g. on deliver node=3 sender=1): ", &spec)
+
+			b, err := sim.ParseBreakpoint(spec)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("Breakpoint #%d set\n", network.Break(b))
+		} else if cmd == "unbreak" {
+			var id int
+
+			breakpoints := network.Breakpoints()
+			if len(breakpoints) == 0 {
+				fmt.Println("No breakpoints")
+				continue
+			}
+			for _, b := range breakpoints {
+				fmt.Println(b)
+			}
+			con.Scan("Breakpoint ID: ", &id)
+
+			if !network.Unbreak(id) {
+				fmt.Println("No such breakpoint")
+			}
+		} else if cmd == "step" {
+			// deliver the next packet while keeping everything else paused
+			p, ok := network.Step()
+			if !ok {
+				fmt.Println("No messages in flight")
+				continue
+			}
+			fmt.Printf("Stepped #%d: broadcast #%d from node %d to node %d\n", p.ID, p.Msg.sequence, p.From, p.To)
+		} else if cmd == "resume" {
+			if !network.Paused() {
+				fmt.Println("Network is not paused")
+				continue
+			}
+			network.Resume()
+			fmt.Println("Network resumed")
+		} else if cmd == "topology" {
+			// messages to non-neighbors are forwarded hop by hop along the shortest path
+			fmt.Printf("Topology: %s\n", wiring)
+			for i := 0; i < nodeCount; i++ {
+				fmt.Printf("Node %d: neighbors %v\n", i, wiring.Neighbors(i))
+			}
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
 		} else if cmd == "logs" {
-			bufio.NewReader(strings.NewReader(logBuilder.String())).WriteTo(os.Stdout)
-			logBuilder.Reset()
+			l.Flush(os.Stdout)
+		} else if cmd == "toggle" {
+			var mechanism string
+			con.Scan("Mechanism (holdback, barrier): ", &mechanism)
+
+			if mechanism == "holdback" {
+				skip := !pool.skipHoldBack.Load()
+				pool.skipHoldBack.Store(skip)
+				fmt.Printf("Hold-back buffering: %s\n", enabledString(!skip))
+			} else if mechanism == "barrier" {
+				skip := !pool.skipBarrier.Load()
+				pool.skipBarrier.Store(skip)
+				fmt.Printf("Waiting for the old epoch to drain before switching: %s\n", enabledString(!skip))
+			} else {
+				fmt.Println("Unknown mechanism")
+			}
 		} else if cmd == "exit" {
 			fmt.Println("Bye")
 			break
 		}
 	}
 
+	close(stopWatching)
 	for i := range nodes {
-		nodes[i].stop()
+		nodes[i].Stop()
 	}
+	network.Resume()
+	network.Close()
 
 	fmt.Println("Waiting all nodes to shut down")
-	for pool.aliveCount.Load() > 0 {
-	}
+	pool.Wait()
 
-	bufio.NewReader(strings.NewReader(logBuilder.String())).WriteTo(os.Stdout)
+	l.Flush(os.Stdout)
 }
 
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type message struct {
+	sender int
+	round int
+	values []int
+}
+
+type crashPlan struct {
+	round int
+	reach int // number of peers that still get the message before the crash
+}
+
+type nodePool struct {
+	participants int
+	rounds int
+}
+
+func newNodePool(participants, rounds int) *nodePool {
+	pool := new(nodePool)
+	pool.participants = participants
+	pool.rounds = rounds
+	return pool
+}
+
+type node struct {
+	pool *nodePool
+	id int
+	l sim.Logger
+
+	proposal int
+	known map[int]bool
+	knownMu sync.Mutex
+
+	crash *crashPlan
+	crashed bool
+}
+
+func newNode(pool *nodePool, id, proposal int, l sim.Logger) *node {
+	n := new(node)
+	n.pool = pool
+	n.id = id
+	n.l = l
+	n.proposal = proposal
+	n.crash = nil
+	n.reset()
+	return n
+}
+
+func (n *node) reset() {
+	n.knownMu.Lock()
+	n.known = map[int]bool{n.proposal: true}
+	n.knownMu.Unlock()
+
+	n.crashed = false
+}
+
+func (n *node) values() []int {
+	n.knownMu.Lock()
+	values := make([]int, 0, len(n.known))
+	for v := range n.known {
+		values = append(values, v)
+	}
+	n.knownMu.Unlock()
+
+	sort.Ints(values)
+	return values
+}
+
+func (n *node) receive(m message) {
+	if n.crashed {
+		return
+	}
+
+	n.knownMu.Lock()
+	for _, v := range m.values {
+		n.known[v] = true
+	}
+	n.knownMu.Unlock()
+
+	n.l.Printf("Node %d receives %v (from node %d in round %d)", n.id, m.values, m.sender, m.round)
+}
+
+func (n *node) decision() int {
+	// FloodSet decision rule: the minimum of all values seen
+	values := n.values()
+	return values[0]
+}
+
+func formatValues(values []int) string {
+	s := make([]string, len(values))
+	for i := range values {
+		s[i] = strconv.Itoa(values[i])
+	}
+	return strings.Join(s, ", ")
+}
+
+func runRounds(nodes []*node, lmin, lmax int, l sim.Logger) {
+	for i := range nodes {
+		nodes[i].reset()
+	}
+
+	for r := 1; r <= nodes[0].pool.rounds; r++ {
+		l.Printf("Round %d begins", r)
+
+		// every node sends what it knew at the start of the round, and every
+		// crash of this round happens before any of its messages is delivered
+		type send struct {
+			m message
+			targets []*node
+		}
+		sends := make([]send, 0, len(nodes))
+		for i := range nodes {
+			if nodes[i].crashed {
+				continue
+			}
+
+			m := message{
+				sender: nodes[i].id,
+				round: r,
+				values: nodes[i].values(),
+			}
+
+			targets := make([]*node, 0, len(nodes))
+			for j := range nodes {
+				if j != i {
+					targets = append(targets, nodes[j])
+				}
+			}
+
+			if nodes[i].crash != nil && nodes[i].crash.round == r {
+				// crash in the middle of sending
+				if nodes[i].crash.reach < len(targets) {
+					targets = targets[:nodes[i].crash.reach]
+				}
+				nodes[i].crashed = true
+				l.Printf("Node %d crashes in round %d after reaching %d node(s)", nodes[i].id, r, len(targets))
+			}
+
+			sends = append(sends, send{m: m, targets: targets})
+		}
+
+		// every message of this round is delivered before the next round starts
+		var wg sync.WaitGroup
+		for _, s := range sends {
+			for j := range s.targets {
+				wg.Add(1)
+				go func(m message, target *node) {
+					defer wg.Done()
+
+					// round delay
+					latency := int64(lmin) + sim.Random(int64(lmax - lmin))
+					time.Sleep(time.Duration(latency) * time.Millisecond)
+
+					target.receive(m)
+				}(s.m, s.targets[j])
+			}
+		}
+		wg.Wait()
+
+		l.Printf("Round %d ends", r)
+	}
+}
+
+func main() {
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	pool := newNodePool(nodeCount, 2)
+
+	nodes := make([]*node, nodeCount)
+	for i := range nodes {
+		nodes[i] = newNode(pool, i, int(sim.Random(10)), l)
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, propose, crash, clear, rounds, run, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			fmt.Printf("Rounds: %d\n", pool.rounds)
+			for i := range nodes {
+				fmt.Printf("Node %d (proposal: %d, known: [%s]", nodes[i].id, nodes[i].proposal, formatValues(nodes[i].values()))
+				if nodes[i].crash != nil {
+					fmt.Printf(", crashes in round %d reaching %d", nodes[i].crash.round, nodes[i].crash.reach)
+				}
+				fmt.Printf(")\n")
+			}
+		} else if cmd == "propose" {
+			var id, value int
+
+			con.Scan("Node: ", &id)
+			con.Scan("Value: ", &value)
+
+			nodes[id].proposal = value
+			nodes[id].reset()
+		} else if cmd == "crash" {
+			var id, round, reach int
+
+			con.Scan("Node: ", &id)
+			con.Scan("Round: ", &round)
+			con.Scan("Nodes reached before crash: ", &reach)
+
+			if id < 0 || id >= len(nodes) {
+				fmt.Println("No such node")
+				continue
+			}
+			if round < 1 || reach < 0 {
+				fmt.Println("Round must be at least 1 and reach not negative")
+				continue
+			}
+
+			nodes[id].crash = &crashPlan{
+				round: round,
+				reach: reach,
+			}
+		} else if cmd == "clear" {
+			for i := range nodes {
+				nodes[i].crash = nil
+			}
+			fmt.Println("Crash plans cleared")
+		} else if cmd == "rounds" {
+			con.Scan("Rounds: ", &pool.rounds)
+		} else if cmd == "run" {
+			var lmin, lmax int
+
+			con.Scan("Min latency (ms): ", &lmin)
+			con.Scan("Max latency (ms): ", &lmax)
+
+			crashes := 0
+			for i := range nodes {
+				if nodes[i].crash != nil && nodes[i].crash.round <= pool.rounds {
+					crashes++
+				}
+			}
+
+			runRounds(nodes, lmin, lmax, l)
+
+			decisions := make(map[int]bool)
+			for i := range nodes {
+				if nodes[i].crashed {
+					fmt.Printf("Node %d crashed\n", nodes[i].id)
+					continue
+				}
+
+				d := nodes[i].decision()
+				decisions[d] = true
+				fmt.Printf("Node %d decides %d\n", nodes[i].id, d)
+			}
+
+			if len(decisions) <= 1 {
+				fmt.Printf("Agreement holds (%d round(s), %d crash(es))\n", pool.rounds, crashes)
+			} else {
+				fmt.Printf("Agreement VIOLATED (%d round(s), %d crash(es), f+1 = %d)\n", pool.rounds, crashes, crashes+1)
+			}
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	l.Flush(os.Stdout)
+}
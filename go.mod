@@ -0,0 +1,3 @@
+module github.com/michaelrk02/ds-sim
+
+go 1.21
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"flag"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+const (
+	modePush = "push"
+	modePull = "pull"
+	modePushPull = "push-pull"
+)
+
+type rumor struct {
+	id int
+	data string
+}
+
+type message struct {
+	kind string // push, pull or reply
+	from int
+	rumors []rumor // pushed or replied
+	known []int // rumors the puller already has
+}
+
+type nodePool struct {
+	*sim.Pool
+	participants int
+	send func(from, to int, m message)
+
+	fanout int
+	rounds int // a node spreads a rumor for this many rounds after learning it
+	mode string
+
+	// what nodes do with messages they cannot make sense of
+	policy *sim.PoisonPolicy
+}
+
+func newNodePool(participants int, send func(from, to int, m message)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.participants = participants
+	pool.send = send
+	pool.fanout = 1
+	pool.rounds = 10
+	pool.mode = modePushPull
+	pool.policy = nil
+	return pool
+}
+
+type node struct {
+	*sim.Process
+	pool *nodePool
+
+	rumors map[int]rumor
+	ages map[int]int // rounds since each rumor was learned
+	learned map[int]time.Time
+	mu sync.Mutex
+
+	inbox chan message
+}
+
+func newNode(pool *nodePool, id, clockSpeed int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.rumors = make(map[int]rumor)
+	n.ages = make(map[int]int)
+	n.learned = make(map[int]time.Time)
+	n.inbox = make(chan message)
+	return n
+}
+
+func (n *node) Run() {
+	// every tick is one gossip round
+	n.Start(n.tick)
+
+	// poll pushes, pulls and replies
+	sim.Listen(n.Process, n.inbox, sim.Screen(n.Process, n.pool.policy, n.check, n.receive))
+}
+
+// node lock must be held
+func (n *node) learn(r rumor, from int) {
+	if _, ok := n.rumors[r.id]; ok {
+		return
+	}
+
+	n.rumors[r.id] = r
+	n.ages[r.id] = 0
+	n.learned[r.id] = time.Now()
+	if from < 0 {
+		n.Printf("Node %d starts rumor #%d: %s", n.ID(), r.id, r.data)
+	} else {
+		n.Printf("Node %d hears rumor #%d from node %d: %s", n.ID(), r.id, from, r.data)
+	}
+}
+
+func (n *node) start(r rumor) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.learn(r, -1)
+}
+
+// rumors still being spread, sorted by ID (node lock must be held)
+func (n *node) hot() []rumor {
+	rumors := []rumor{}
+	for id, age := range n.ages {
+		if age < n.pool.rounds {
+			rumors = append(rumors, n.rumors[id])
+		}
+	}
+	sort.Slice(rumors, func(i, j int) bool {
+		return rumors[i].id < rumors[j].id
+	})
+	return rumors
+}
+
+// up to fanout distinct random peers
+func (n *node) peers() []int {
+	others := []int{}
+	for i := 0; i < n.pool.participants; i++ {
+		if i != n.ID() {
+			others = append(others, i)
+		}
+	}
+
+	peers := []int{}
+	for len(peers) < n.pool.fanout && len(others) > 0 {
+		i := int(sim.Random(int64(len(others))))
+		peers = append(peers, others[i])
+		others = append(others[:i], others[i+1:]...)
+	}
+	return peers
+}
+
+func (n *node) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	hot := n.hot()
+	for id := range n.ages {
+		n.ages[id]++
+	}
+
+	known := make([]int, 0, len(n.rumors))
+	for id := range n.rumors {
+		known = append(known, id)
+	}
+	sort.Ints(known)
+
+	for _, to := range n.peers() {
+		if n.pool.mode != modePull && len(hot) > 0 {
+			n.pool.send(n.ID(), to, message{kind: "push", from: n.ID(), rumors: hot})
+		}
+		if n.pool.mode != modePush {
+			n.pool.send(n.ID(), to, message{kind: "pull", from: n.ID(), known: known})
+		}
+	}
+}
+
+// reject messages the handler cannot make sense of
+func (n *node) check(m message) error {
+	if m.kind != "push" && m.kind != "pull" && m.kind != "reply" {
+		return fmt.Errorf("unknown kind %q", m.kind)
+	}
+	if m.from < 0 || m.from >= n.pool.participants {
+		return fmt.Errorf("sender %d does not exist", m.from)
+	}
+	for _, r := range m.rumors {
+		if r.id < 0 {
+			return errors.New("rumor with a negative ID")
+		}
+	}
+	return nil
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if m.kind == "pull" {
+		known := make(map[int]bool)
+		for _, id := range m.known {
+			known[id] = true
+		}
+
+		missing := []rumor{}
+		for _, r := range n.hot() {
+			if !known[r.id] {
+				missing = append(missing, r)
+			}
+		}
+		if len(missing) > 0 {
+			n.pool.send(n.ID(), m.from, message{kind: "reply", from: n.ID(), rumors: missing})
+		}
+		return
+	}
+
+	for _, r := range m.rumors {
+		n.learn(r, m.from)
+	}
+}
+
+// a message no correct node would send
+func garbage(participants int) message {
+	switch sim.Random(3) {
+	case 0:
+		return message{kind: fmt.Sprintf("junk-%d", sim.Random(1000)), from: 0}
+	case 1:
+		return message{kind: "pull", from: participants + int(sim.Random(100))}
+	default:
+		return message{kind: "reply", from: 0, rumors: []rumor{{id: -1 - int(sim.Random(100)), data: "garbage"}}}
+	}
+}
+
+func main() {
+	fanout := flag.Int("fanout", 1, "peers each node gossips with every round")
+	rounds := flag.Int("rounds", 10, "rounds a node keeps spreading a rumor after learning it")
+	mode := flag.String("mode", modePushPull, "push, pull or push-pull")
+	poison := flag.String("poison", sim.PoisonLog, "what nodes do with malformed messages: drop, log or crash")
+	period := flag.Duration("period", 500*time.Millisecond, "length of a gossip round")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *mode != modePush && *mode != modePull && *mode != modePushPull {
+		fmt.Println("Mode must be push, pull or push-pull")
+		return
+	}
+	if *fanout < 1 || *rounds < 1 || *period < time.Millisecond {
+		fmt.Println("Fanout, rounds and period must be positive")
+		return
+	}
+
+	policy, err := sim.NewPoisonPolicy(*poison)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	var lmin, lmax atomic.Int64
+	lmin.Store(20)
+	lmax.Store(100)
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		return sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+	})
+
+	sender := func(from, to int, m message) {
+		network.Send(from, to, m, sim.Latency(int(lmin.Load()), int(lmax.Load())))
+	}
+
+	pool := newNodePool(nodeCount, sender)
+	pool.fanout = *fanout
+	pool.rounds = *rounds
+	pool.mode = *mode
+	pool.policy = policy
+	for i := 0; i < nodeCount; i++ {
+		nodes[i] = newNode(pool, i, int(*period/time.Millisecond), l)
+		nodes[i].Run()
+	}
+
+	// when each rumor was started, to count rounds until it converged
+	started := []time.Time{}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, rumor, converged, crash, latency, loss, stats, inject, policy, partition, heal, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			fmt.Printf("Mode: %s, fanout: %d, rounds: %d, period: %v\n", pool.mode, pool.fanout, pool.rounds, *period)
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				status := ""
+				if !nodes[i].Running() {
+					status = " (crashed)"
+				}
+
+				ids := make([]int, 0, len(nodes[i].rumors))
+				for id := range nodes[i].rumors {
+					ids = append(ids, id)
+				}
+				sort.Ints(ids)
+
+				fmt.Printf("Node %d%s knows %d rumor(s) %v, %d still spreading\n", nodes[i].ID(), status, len(ids), ids, len(nodes[i].hot()))
+				nodes[i].mu.Unlock()
+			}
+		} else if cmd == "rumor" {
+			var origin int
+			var data string
+
+			con.Scan("Node: ", &origin)
+			con.Scan("Data: ", &data)
+
+			id := len(started)
+			started = append(started, time.Now())
+			network.Stats.Broadcasts.Add(1)
+			nodes[origin].start(rumor{id: id, data: data})
+
+			fmt.Printf("Rumor #%d started at node %d\n", id, origin)
+		} else if cmd == "converged" {
+			var id int
+
+			con.Scan("Rumor ID: ", &id)
+
+			if id < 0 || id >= len(started) {
+				fmt.Println("No such rumor")
+				continue
+			}
+
+			count := 0
+			var last time.Time
+			missing := []int{}
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				if t, ok := nodes[i].learned[id]; ok {
+					count++
+					if t.After(last) {
+						last = t
+					}
+				} else {
+					missing = append(missing, i)
+				}
+				nodes[i].mu.Unlock()
+			}
+
+			// rounds of the period, rounded up, from the start to the last node to hear it
+			rounds := int((last.Sub(started[id]) + *period - 1) / *period)
+
+			if len(missing) == 0 {
+				fmt.Printf("Rumor #%d reached all %d nodes after %d round(s)\n", id, nodeCount, rounds)
+			} else {
+				fmt.Printf("Rumor #%d reached %d of %d nodes so far (%d round(s)), missing %v\n", id, count, nodeCount, rounds, missing)
+			}
+		} else if cmd == "crash" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			nodes[id].Stop()
+		} else if cmd == "latency" {
+			var lo, hi int64
+
+			con.Scan("Min latency (ms): ", &lo)
+			con.Scan("Max latency (ms): ", &hi)
+
+			lmin.Store(lo)
+			lmax.Store(hi)
+		} else if cmd == "loss" {
+			var source, target, percent int
+
+			con.Scan("Source node: ", &source)
+			con.Scan("Target node: ", &target)
+			con.Scan("Drop probability (%): ", &percent)
+
+			if percent < 0 || percent > 100 {
+				fmt.Println("Invalid percentage")
+				continue
+			}
+			network.Lose(source, target, percent)
+
+			fmt.Printf("Link %d -> %d loses %d%% of messages\n", source, target, percent)
+		} else if cmd == "stats" {
+			delivered := 0
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				delivered += len(nodes[i].rumors)
+				nodes[i].mu.Unlock()
+			}
+			network.Stats.Report(os.Stdout, nodeCount, delivered)
+			fmt.Printf("Malformed messages rejected: %d, nodes crashed by them: %d (policy: %s)\n", policy.Rejected.Load(), policy.Crashes.Load(), policy.Mode())
+		} else if cmd == "inject" {
+			// garbage on the wire, from a random node
+			var target, count int
+
+			con.Scan("Target node: ", &target)
+			con.Scan("Messages: ", &count)
+
+			for i := 0; i < count; i++ {
+				from := int(sim.Random(int64(nodeCount)))
+				network.Send(from, target, garbage(nodeCount), sim.Latency(int(lmin.Load()), int(lmax.Load())))
+			}
+
+			fmt.Printf("%d malformed message(s) on their way to node %d\n", count, target)
+		} else if cmd == "policy" {
+			var mode string
+
+			con.Scan("Policy (drop, log, crash): ", &mode)
+
+			if err := policy.Set(mode); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("Malformed messages: %s\n", mode)
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+// the reference clock, it keeps real time
+const reference = 0
+
+// a link between two nodes, both directions unless the jams are asymmetric
+type link struct {
+	from, to int
+}
+
+type lab struct {
+	network *sim.Mesh[struct{}]
+	clocks []*sim.PhysicalClock
+	lmin, lmax int
+	asymmetric bool
+
+	// the user's (or the estimator's) answers
+	jams map[link]int
+	skews map[int]time.Duration
+	mu sync.Mutex
+}
+
+// one way of a probe, with the first hop's jam paid by the sender
+func (x *lab) latency(from, to int) time.Duration {
+	return time.Duration(x.network.Link(from, to).Latency)*time.Millisecond + sim.Latency(x.lmin, x.lmax)
+}
+
+// the links answers are checked on
+func (x *lab) links() []link {
+	links := []link{}
+	for i := range x.clocks {
+		for j := range x.clocks {
+			if i != j && (x.asymmetric || i < j) {
+				links = append(links, link{i, j})
+			}
+		}
+	}
+	return links
+}
+
+type syncRound struct {
+	sent, received time.Time // client clock
+	server time.Time // server clock when the request arrived
+	ok bool
+}
+
+func (r syncRound) rtt() time.Duration {
+	return r.received.Sub(r.sent)
+}
+
+// how far the client is behind the server, assuming both ways took as long
+func (r syncRound) offset() time.Duration {
+	return r.server.Add(r.rtt() / 2).Sub(r.received)
+}
+
+// one request for the server's time, as a client sees it
+func (x *lab) sync(client, server int) syncRound {
+	r := syncRound{sent: x.clocks[client].Now()}
+	if !x.network.Probe(client, server, x.latency(client, server)) {
+		return r
+	}
+	r.server = x.clocks[server].Now()
+	if !x.network.Probe(server, client, x.latency(server, client)) {
+		return r
+	}
+	r.received = x.clocks[client].Now()
+	r.ok = true
+	return r
+}
+
+// answer everything from pings and syncs alone
+func (x *lab) estimate(probes int) {
+	var wg sync.WaitGroup
+
+	for _, k := range x.links() {
+		wg.Add(1)
+		go func(k link) {
+			defer wg.Done()
+
+			// a round trip pays the base latency twice and the jam of both ways
+			r := x.network.Ping(k.from, k.to, probes, x.latency)
+			if len(r.RTTs) == 0 {
+				return
+			}
+			var sum time.Duration
+			for _, rtt := range r.RTTs {
+				sum += rtt
+			}
+			base := time.Duration(x.lmin+x.lmax) * time.Millisecond
+			jam := (sum/time.Duration(len(r.RTTs)) - base) / time.Millisecond
+			if !x.asymmetric {
+				jam /= 2
+			}
+
+			x.mu.Lock()
+			x.jams[k] = max(0, int(jam+5)/10*10)
+			x.mu.Unlock()
+		}(k)
+	}
+
+	for i := range x.clocks {
+		if i == reference {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// Cristian: the quickest round trip leaves the least room for error
+			var best syncRound
+			for j := 0; j < probes; j++ {
+				if r := x.sync(i, reference); r.ok && (!best.ok || r.rtt() < best.rtt()) {
+					best = r
+				}
+			}
+			if !best.ok {
+				return
+			}
+
+			x.mu.Lock()
+			x.skews[i] = (-best.offset()).Round(time.Millisecond)
+			x.mu.Unlock()
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// compare every answer with the hidden configuration
+func (x *lab) check(tolerance time.Duration) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	right, total := 0, 0
+	verdict := func(ok bool) string {
+		total++
+		if ok {
+			right++
+			return "right"
+		}
+		return "WRONG"
+	}
+
+	fmt.Println("Jams:")
+	for _, k := range x.links() {
+		truth := x.network.Link(k.from, k.to).Latency
+		guess, guessed := x.jams[k]
+		if truth == 0 && (!guessed || guess == 0) {
+			// an unjammed link left alone is not worth a point
+			continue
+		}
+
+		arrow := "<->"
+		if x.asymmetric {
+			arrow = "->"
+		}
+		answer := "no answer"
+		if guessed {
+			answer = fmt.Sprintf("+%dms", guess)
+		}
+		ok := guessed && abs(time.Duration(guess-truth)*time.Millisecond) <= tolerance
+		fmt.Printf("  %d %s %d: +%dms, answered %s, %s\n", k.from, arrow, k.to, truth, answer, verdict(ok))
+	}
+
+	fmt.Println("Skews:")
+	for i, clock := range x.clocks {
+		if i == reference {
+			continue
+		}
+		truth := clock.Skew()
+		guess, guessed := x.skews[i]
+
+		answer := "no answer"
+		if guessed {
+			answer = guess.String()
+		}
+		ok := guessed && abs(guess-truth) <= tolerance
+		fmt.Printf("  Node %d: %v, answered %s, %s\n", i, truth.Round(time.Millisecond), answer, verdict(ok))
+	}
+
+	fmt.Printf("Score: %d/%d within %v\n", right, total, tolerance)
+}
+
+func main() {
+	jams := flag.Int("jams", 3, "how many links get a hidden jam")
+	maxJam := flag.Int("maxjam", 200, "largest hidden jam (ms)")
+	skew := flag.Duration("skew", 500*time.Millisecond, "hide clock skews of up to this much, node 0 keeps real time")
+	asymmetric := flag.Bool("asymmetric", false, "jam single directions instead of both ways of a link")
+	tolerance := flag.Duration("tolerance", 20*time.Millisecond, "how close an answer must be to count")
+	probes := flag.Int("probes", 8, "pings per link and syncs per node the estimator sends")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *jams < 0 || *maxJam < 10 || *skew < 0 || *tolerance < 0 || *probes < 1 {
+		fmt.Println("Jams, skew and tolerance must not be negative, maxjam must be at least 10 and probes positive")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	if nodeCount < 2 {
+		fmt.Println("Need at least two nodes")
+		return
+	}
+
+	// probes only, nothing is ever delivered to a node
+	x := new(lab)
+	x.network = sim.NewMesh(nodeCount, l, func(to int, m struct{}) bool { return true })
+	x.clocks = make([]*sim.PhysicalClock, nodeCount)
+	x.lmin, x.lmax = 20, 100
+	x.asymmetric = *asymmetric
+	x.jams = map[link]int{}
+	x.skews = map[int]time.Duration{}
+
+	// the hidden configuration
+	for i := range x.clocks {
+		offset := time.Duration(0)
+		if i != reference {
+			offset = (time.Duration(sim.Random(int64(2**skew)+1)) - *skew).Round(time.Millisecond)
+		}
+		x.clocks[i] = sim.NewPhysicalClock(offset, 1)
+	}
+
+	candidates := x.links()
+	for i := 0; i < *jams && len(candidates) > 0; i++ {
+		pick := int(sim.Random(int64(len(candidates))))
+		k := candidates[pick]
+		candidates = append(candidates[:pick], candidates[pick+1:]...)
+
+		jam := 10 * (1 + int(sim.Random(int64(*maxJam/10))))
+		x.network.Jam(k.from, k.to, jam)
+		if !x.asymmetric {
+			x.network.Jam(k.to, k.from, jam)
+		}
+	}
+
+	if x.asymmetric {
+		fmt.Printf("Hidden: %d one-way jam(s) of up to %dms and clock skews of up to %v (node %d keeps real time)\n", *jams, *maxJam, *skew, reference)
+	} else {
+		fmt.Printf("Hidden: %d link jam(s) of up to %dms, the same both ways, and clock skews of up to %v (node %d keeps real time)\n", *jams, *maxJam, *skew, reference)
+	}
+	fmt.Printf("Every message also takes %d-%dms\n", x.lmin, x.lmax)
+
+	for {
+		var cmd string
+		fmt.Println("Commands: ping, sync, guess, answers, estimate, check, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "ping" {
+			var args string
+			con.ScanLine("From, to and probes (e.g. 0 3 or 0 3 10): ", &args)
+
+			from, to, count, err := sim.ParsePing(args, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			x.network.Ping(from, to, count, x.latency).Report(os.Stdout)
+		} else if cmd == "sync" {
+			// what a client sees asking a server for the time
+			var client, server, rounds int
+
+			con.Scan("Client: ", &client)
+			con.Scan("Server: ", &server)
+			con.Scan("Rounds: ", &rounds)
+
+			for i := 1; i <= rounds; i++ {
+				r := x.sync(client, server)
+				if !r.ok {
+					fmt.Printf("Round %d: lost\n", i)
+					continue
+				}
+				fmt.Printf("Round %d: sent at %s, server said %s, back at %s: rtt %v, client behind by %v\n", i, r.sent.Format("15:04:05.000"), r.server.Format("15:04:05.000"), r.received.Format("15:04:05.000"), r.rtt().Round(time.Millisecond), r.offset().Round(time.Millisecond))
+			}
+		} else if cmd == "guess" {
+			var kind string
+			con.Scan("Kind (jam or skew): ", &kind)
+
+			if kind == "jam" {
+				var source, target, jam int
+
+				con.Scan("Source node: ", &source)
+				con.Scan("Target node: ", &target)
+				con.Scan("Jam (ms): ", &jam)
+
+				if !x.asymmetric && source > target {
+					source, target = target, source
+				}
+				x.mu.Lock()
+				x.jams[link{source, target}] = jam
+				x.mu.Unlock()
+			} else if kind == "skew" {
+				var id int
+				var offset string
+
+				con.Scan("Node: ", &id)
+				con.Scan("Skew (e.g. 150ms or -2s): ", &offset)
+
+				d, err := time.ParseDuration(offset)
+				if err != nil {
+					fmt.Println("Invalid duration")
+					continue
+				}
+				x.mu.Lock()
+				x.skews[id] = d
+				x.mu.Unlock()
+			} else {
+				fmt.Println("Unknown kind")
+			}
+		} else if cmd == "answers" {
+			x.mu.Lock()
+			for _, k := range x.links() {
+				if jam, ok := x.jams[k]; ok {
+					fmt.Printf("Jam %d -> %d: +%dms\n", k.from, k.to, jam)
+				}
+			}
+			for i := range x.clocks {
+				if skew, ok := x.skews[i]; ok {
+					fmt.Printf("Skew of node %d: %v\n", i, skew)
+				}
+			}
+			x.mu.Unlock()
+		} else if cmd == "estimate" {
+			// let the automated estimator answer instead, overwriting guesses
+			fmt.Println("Estimating from pings and syncs only...")
+			x.estimate(*probes)
+			fmt.Println("Done, see answers or check")
+		} else if cmd == "check" {
+			x.check(*tolerance)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	x.network.Close()
+}
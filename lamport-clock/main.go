@@ -1,210 +1,360 @@
 package main
 
 import (
-	"bufio"
-	"crypto/rand"
+	"flag"
 	"fmt"
-	"log"
-	"math/big"
+	"math"
 	"os"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
 )
 
 type message struct {
+	id int
+	from int
 	t int64
 	data string
+
+	// the sender's wall clock, to compare physical timestamps with
+	wall time.Time
+	skew time.Duration
+	sentAt time.Time
+}
+
+// a message as seen by wall clocks
+type delivery struct {
+	from, to int
+	skew time.Duration // receiver's clock minus sender's clock
+	latency time.Duration
+	inverted bool // received before it was sent, by the two wall clocks
 }
 
 type nodePool struct {
-	aliveCount atomic.Int64
+	*sim.Pool
+
+	// every clock step of the run, for the happens-before check
+	trace *sim.ClockTrace
+	nextMsg atomic.Int64
+
+	deliveries []delivery
+	mu sync.Mutex
+
+	// deliberately weaken the protocol for demonstration
+	skipSync atomic.Bool
 }
 
 func newNodePool() *nodePool {
 	pool := new(nodePool)
-	pool.aliveCount.Store(0)
+	pool.Pool = sim.NewPool()
+	pool.trace = sim.NewClockTrace()
+	pool.nextMsg.Store(0)
+	pool.skipSync.Store(false)
 	return pool
 }
 
 type node struct {
+	*sim.Process
 	pool *nodePool
-	id int
-	clockSpeed int
-	l *log.Logger
 
-	t int64
-	tMu sync.Mutex
+	clock *sim.LamportClock
+	wall *sim.PhysicalClock
+	mu sync.Mutex // a clock step and its trace record happen together
 	msgCh chan message
-
-	running atomic.Bool
-	freezing atomic.Bool
 }
 
-func newNode(pool *nodePool, id, clockSpeed int, l *log.Logger) *node {
+func newNode(pool *nodePool, id, clockSpeed int, l sim.Logger) *node {
 	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
 	n.pool = pool
-	n.id = id
-	n.clockSpeed = clockSpeed
-	n.l = l
-	n.t = 0
+	n.clock = sim.NewLamportClock()
+	n.wall = sim.NewPhysicalClock(0, 1)
 	n.msgCh = make(chan message)
-	n.running.Store(false)
-	n.freezing.Store(false)
 	return n
 }
 
-func (n *node) run() {
-	n.running.Store(true)
-
+func (n *node) Run() {
 	// counter increment
-	go func() {
-		n.pool.aliveCount.Add(1)
-		n.l.Printf("Node %d started at %dms clock speed", n.id, n.clockSpeed)
-		for n.running.Load() {
-			for n.freezing.Load() {
-				// freeze, do nothing
-			}
-
-			n.tMu.Lock()
-			n.t++
-			n.tMu.Unlock()
-
-			time.Sleep(time.Duration(n.clockSpeed) * time.Millisecond)
-		}
-		n.l.Printf("Node %d shutdown", n.id)
-		n.pool.aliveCount.Add(-1)
-	}()
+	n.Start(n.tick)
 
 	// poll messages in separate thread
-	go func() {
-		for n.running.Load() {
-			var ok bool
+	sim.Listen(n.Process, n.msgCh, n.receiveMessage)
+}
 
-			m, ok := <-n.msgCh
-			if ok {
-				n.receiveMessage(m)
-			}
-		}
-	}()
+func (n *node) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	t1 := n.clock.Now()
+	t2 := n.clock.Tick()
+	n.pool.trace.Record(sim.ClockEvent{Node: n.ID(), Kind: "tick", Before: t1, After: t2, Msg: -1})
 }
 
 func (n *node) freeze(d time.Duration) {
 	go func() {
-		n.l.Printf("Node %d (#%d) frozen for %v", n.id, n.time(), d)
+		n.Printf("Node %d (#%d) frozen for %v", n.ID(), n.clock.Now(), d)
 
-		n.freezing.Store(true)
-		time.Sleep(d)
-		n.freezing.Store(false)
+		n.Freeze(d)
 
 		// n.t should not change much
-		n.l.Printf("Node %d (#%d) unfreezes", n.id, n.time())
+		n.Printf("Node %d (#%d) unfreezes", n.ID(), n.clock.Now())
 	}()
 }
 
-func (n *node) time() int64 {
-	n.tMu.Lock()
-	t := n.t
-	n.tMu.Unlock()
-	return t
-}
+func (n *node) receiveMessage(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 
-func (n *node) stop() {
-	close(n.msgCh)
-	n.running.Store(false)
-}
+	t1 := n.clock.Now()
 
-func (n *node) receiveMessage(m message) {
-	t1 := n.time()
+	var t2 int64
+	if n.pool.skipSync.Load() {
+		t2 = n.clock.Tick()
+	} else {
+		t2 = n.clock.Witness(m.t)
+	}
+	n.pool.trace.Record(sim.ClockEvent{Node: n.ID(), Kind: "receive", Before: t1, After: t2, Msg: m.id, Sent: m.t})
+
+	wall := n.wall.Now()
+	d := delivery{
+		from: m.from,
+		to: n.ID(),
+		skew: n.wall.Skew() - m.skew,
+		latency: time.Since(m.sentAt),
+		inverted: wall.Before(m.wall),
+	}
+	n.pool.mu.Lock()
+	n.pool.deliveries = append(n.pool.deliveries, d)
+	n.pool.mu.Unlock()
 
-	n.tMu.Lock()
-	if m.t > n.t {
-		n.t = m.t
+	if d.inverted {
+		n.Printf("Node %d receives message %d at %s by its clock, before node %d sent it at %s", n.ID(), m.id, wall.Format("15:04:05.000"), m.from, m.wall.Format("15:04:05.000"))
 	}
-	n.t++
-	n.tMu.Unlock()
 
-	t2 := n.time()
+	n.Printf("Node %d (#%d -> #%d) receives message: %s (#%d)", n.ID(), t1, t2, m.data, m.t)
 
-	n.l.Printf("Node %d (#%d -> #%d) receives message: %s (#%d)", n.id, t1, t2, m.data, m.t)
+	if t2 <= m.t {
+		// receive must happen after send
+		n.Printf("Node %d VIOLATION: receive timestamp #%d is not after send timestamp #%d", n.ID(), t2, m.t)
+	}
 }
 
-func (n *node) sendMessage(data string, target *node) {
-	n.tMu.Lock()
+func (n *node) sendMessage(data string, target *node, overrides map[int]time.Duration) bool {
+	n.mu.Lock()
 	m := message{
-		t: n.t,
+		id: int(n.pool.nextMsg.Add(1) - 1),
+		from: n.ID(),
+		t: n.clock.Now(),
 		data: data,
+		wall: n.wall.Now(),
+		skew: n.wall.Skew(),
+		sentAt: time.Now(),
 	}
-	n.tMu.Unlock()
+	n.pool.trace.Record(sim.ClockEvent{Node: n.ID(), Kind: "send", Before: m.t, After: m.t, Msg: m.id})
+	n.mu.Unlock()
 
-	n.l.Printf("Node %d (#%d) sends message to node %d", n.id, n.time(), target.id)
+	n.Printf("Node %d (#%d) sends message to node %d", n.ID(), m.t, target.ID())
 
-	// random delay
-	r, _ := rand.Int(rand.Reader, big.NewInt(500))
-	time.Sleep(time.Duration(r.Int64()) * time.Millisecond)
-	// message sent
-	target.msgCh <- m
+	// random delay, unless overridden for this target
+	if latency, ok := overrides[target.ID()]; ok {
+		time.Sleep(latency)
+	} else {
+		time.Sleep(sim.Latency(0, 500))
+	}
+	// message sent, unless the target has shut down meanwhile
+	return sim.Deliver(target.Process, target.msgCh, m)
+}
+
+// how much receiving before sending (by wall clocks) goes together with the
+// receiver's clock being behind: the point-biserial correlation between skew
+// and inversion, negative when behind clocks invert
+func correlation(deliveries []delivery) float64 {
+	var sum, sumInverted float64
+	inverted := 0
+	for _, d := range deliveries {
+		sum += float64(d.skew)
+		if d.inverted {
+			sumInverted += float64(d.skew)
+			inverted++
+		}
+	}
+	if inverted == 0 || inverted == len(deliveries) {
+		return 0
+	}
+
+	mean := sum / float64(len(deliveries))
+	variance := 0.0
+	for _, d := range deliveries {
+		variance += (float64(d.skew) - mean) * (float64(d.skew) - mean)
+	}
+	std := math.Sqrt(variance / float64(len(deliveries)))
+	if std == 0 {
+		return 0
+	}
+
+	p := float64(inverted) / float64(len(deliveries))
+	meanInverted := sumInverted / float64(inverted)
+	meanOther := (sum - sumInverted) / float64(len(deliveries)-inverted)
+	return (meanInverted - meanOther) / std * math.Sqrt(p*(1-p))
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
 }
 
 func main() {
-	var logBuilder strings.Builder
+	skew := flag.Duration("skew", 0, "start every wall clock off real time by up to this much")
+	drift := flag.Float64("drift", 0, "let every wall clock run up to this much faster or slower, e.g. 0.05")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
-	l := log.New(&logBuilder, " [LOG] ", log.LstdFlags)
+	l := sim.NewLog()
 
 	var nodeCount int
-	fmt.Printf("Enter number of nodes: ")
-	fmt.Scanf("%d", &nodeCount)
+	con.Scan("Enter number of nodes: ", &nodeCount)
 
 	pool := newNodePool()
 
 	fmt.Println("Starting nodes ...")
 	nodes := make([]*node, nodeCount)
 	for i := range nodes {
-		r, _ := rand.Int(rand.Reader, big.NewInt(500))
-		clockSpeed := int(500 + r.Int64())
+		clockSpeed := int(500 + sim.Random(500))
 		nodes[i] = newNode(pool, i, clockSpeed, l)
+		if *skew > 0 || *drift > 0 {
+			offset := time.Duration(sim.Random(int64(2**skew)+1)) - *skew
+			rate := 1 + (float64(sim.Random(2001))/1000-1)**drift
+			nodes[i].wall = sim.NewPhysicalClock(offset, rate)
+		}
 
-		nodes[i].run()
+		nodes[i].Run()
 	}
 
 	for {
 		var cmd string
-		fmt.Printf("Commands: state, send, logs, freeze, exit\n")
-		fmt.Printf(" > ")
-		fmt.Scanf("%s", &cmd)
+		fmt.Printf("Commands: state, send, check, skew, logs, freeze, toggle, exit\n")
+		con.Scan(" > ", &cmd)
 
 		if cmd == "state" {
 			for i := range nodes {
-				fmt.Printf("Node %d (#%d)\n", nodes[i].id, nodes[i].time())
+				fmt.Printf("Node %d (#%d)\n", nodes[i].ID(), nodes[i].clock.Now())
 			}
 		} else if cmd == "send" {
 			var source, target int
-			var data string
+			var data, to string
+
+			con.Scan("Source: ", &source)
+			con.Scan("Target: ", &target)
 
-			fmt.Printf("Source: ")
-			fmt.Scanf("%d", &source)
-			fmt.Printf("Target: ")
-			fmt.Scanf("%d", &target)
+			con.Scan("Data: ", &data)
+			con.Scan("Latency overrides (e.g. 1=500ms,2=50ms, - for none): ", &to)
 
-			fmt.Printf("Data: ")
-			fmt.Scanf("%s", &data)
+			overrides, err := sim.ParseOverrides(to)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
 
-			nodes[source].sendMessage(data, nodes[target])
+			start := time.Now()
+			if nodes[source].sendMessage(data, nodes[target], overrides) {
+				fmt.Printf("Message reached node %d in %v\n", target, time.Since(start).Round(time.Millisecond))
+			}
+		} else if cmd == "check" {
+			// replay the recorded run against the happens-before rules
+			violations := pool.trace.Check()
+			for _, v := range violations {
+				fmt.Printf("VIOLATION: %s\n", v)
+			}
+			fmt.Printf("Checked %d clock event(s), %d violation(s)\n", pool.trace.Len(), len(violations))
+		} else if cmd == "skew" {
+			// physical timestamps against the actual skew between the nodes
+			if *skew <= 0 && *drift <= 0 {
+				fmt.Println("Clock drift modeling is off, start with -skew or -drift")
+				continue
+			}
+
+			for i := range nodes {
+				fmt.Printf("Node %d: wall clock %v off real time, rate %.3f\n", i, nodes[i].wall.Skew().Round(time.Millisecond), nodes[i].wall.Rate())
+			}
+
+			pool.mu.Lock()
+			deliveries := append([]delivery{}, pool.deliveries...)
+			pool.mu.Unlock()
+
+			if len(deliveries) == 0 {
+				fmt.Println("No messages received yet")
+				continue
+			}
+
+			// per link, in order of first use
+			type link struct{ from, to int }
+			links := []link{}
+			byLink := make(map[link][]delivery)
+			for _, d := range deliveries {
+				k := link{d.from, d.to}
+				if _, ok := byLink[k]; !ok {
+					links = append(links, k)
+				}
+				byLink[k] = append(byLink[k], d)
+			}
+
+			inverted := 0
+			for _, k := range links {
+				var skew, latency time.Duration
+				count := 0
+				for _, d := range byLink[k] {
+					skew += d.skew
+					latency += d.latency
+					if d.inverted {
+						count++
+					}
+				}
+				inverted += count
+
+				n := time.Duration(len(byLink[k]))
+				fmt.Printf("Node %d -> node %d: %d message(s), %d received before sent, skew %v, latency %v\n", k.from, k.to, len(byLink[k]), count, (skew / n).Round(time.Millisecond), (latency / n).Round(time.Millisecond))
+			}
+
+			fmt.Printf("%d of %d message(s) were received before they were sent by wall clock time\n", inverted, len(deliveries))
+			fmt.Printf("Correlation between skew and inversion: %.2f (a receiver behind by more than the latency inverts)\n", correlation(deliveries))
+			fmt.Println("Lamport timestamps do not depend on skew, run check to confirm every receive comes after its send")
 		} else if cmd == "logs" {
-			bufio.NewReader(strings.NewReader(logBuilder.String())).WriteTo(os.Stdout)
-			logBuilder.Reset()
+			l.Flush(os.Stdout)
 		} else if cmd == "freeze" {
 			var node int
-			fmt.Printf("Node: ")
-			fmt.Scanf("%d", &node)
+			con.Scan("Node: ", &node)
 
 			var duration string
-			fmt.Printf("Duration: ")
-			fmt.Scanf("%s", &duration)
+			con.Scan("Duration: ", &duration)
 
 			d, _ := time.ParseDuration(duration)
 			nodes[node].freeze(d)
+		} else if cmd == "toggle" {
+			var mechanism string
+			con.Scan("Mechanism (sync): ", &mechanism)
+
+			if mechanism == "sync" {
+				skip := !pool.skipSync.Load()
+				pool.skipSync.Store(skip)
+				fmt.Printf("Lamport sync on receive: %s\n", enabledString(!skip))
+			} else {
+				fmt.Println("Unknown mechanism")
+			}
 		} else if cmd == "exit" {
 			fmt.Println("Bye")
 			break
@@ -214,13 +364,11 @@ func main() {
 	}
 
 	for i := range nodes {
-		nodes[i].stop()
+		nodes[i].Stop()
 	}
 
 	fmt.Println("Waiting for all nodes to shut down")
-	for pool.aliveCount.Load() > 0 {
-	}
+	pool.Wait()
 
-	bufio.NewReader(strings.NewReader(logBuilder.String())).WriteTo(os.Stdout)
+	l.Flush(os.Stdout)
 }
-
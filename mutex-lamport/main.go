@@ -0,0 +1,404 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type message struct {
+	kind string // request, reply or release
+	from int
+	t int64
+
+	// per link, the algorithm needs FIFO links and the network reorders
+	seq int
+}
+
+// a request in a node's queue, ordered by timestamp then node ID
+type request struct {
+	t int64
+	node int
+}
+
+func (r request) before(o request) bool {
+	return r.t < o.t || (r.t == o.t && r.node < o.node)
+}
+
+type nodePool struct {
+	*sim.Pool
+	participants int
+	send func(from, to int, m message)
+
+	// how long a node stays in the critical section
+	hold time.Duration
+
+	// nodes in the critical section right now, known to the observer only
+	inside atomic.Int64
+	entries atomic.Int64
+	violations atomic.Int64
+
+	// deliberately weaken the protocol for demonstration
+	skipFIFO atomic.Bool
+}
+
+func newNodePool(participants int, send func(from, to int, m message)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.participants = participants
+	pool.send = send
+	pool.hold = 0
+	pool.inside.Store(0)
+	pool.entries.Store(0)
+	pool.violations.Store(0)
+	pool.skipFIFO.Store(false)
+	return pool
+}
+
+type node struct {
+	*sim.Process
+	pool *nodePool
+
+	clock *sim.LamportClock
+	queue []request
+	lastHeard []int64 // latest timestamp received from each node
+	own *request // this node's pending request, nil if not requesting
+	inCS bool
+	waiting int // requests asked for while one is still pending
+
+	sendSeq []int
+	recvSeq []int
+	held []map[int]message // out of order messages per sender
+
+	mu sync.Mutex
+
+	inbox chan message
+}
+
+func newNode(pool *nodePool, id, clockSpeed int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.clock = sim.NewLamportClock()
+	n.queue = []request{}
+	n.lastHeard = make([]int64, pool.participants)
+	n.own = nil
+	n.inCS = false
+	n.waiting = 0
+	n.sendSeq = make([]int, pool.participants)
+	n.recvSeq = make([]int, pool.participants)
+	n.held = make([]map[int]message, pool.participants)
+	for i := range n.held {
+		n.held[i] = make(map[int]message)
+	}
+	n.inbox = make(chan message)
+	return n
+}
+
+func (n *node) Run() {
+	n.Start(nil)
+
+	// poll requests, replies and releases
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
+
+// node lock must be held
+func (n *node) send(to int, m message) {
+	m.from = n.ID()
+	m.seq = n.sendSeq[to]
+	n.sendSeq[to]++
+	n.pool.send(n.ID(), to, m)
+}
+
+// node lock must be held
+func (n *node) enqueue(r request) {
+	i := sort.Search(len(n.queue), func(i int) bool {
+		return r.before(n.queue[i])
+	})
+	n.queue = append(n.queue, request{})
+	copy(n.queue[i+1:], n.queue[i:])
+	n.queue[i] = r
+}
+
+// node lock must be held
+func (n *node) dequeue(node int) {
+	for i, r := range n.queue {
+		if r.node == node {
+			n.queue = append(n.queue[:i], n.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// ask every node for the critical section
+func (n *node) request() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.own != nil {
+		// one request at a time, the next goes out after the release
+		n.waiting++
+		n.Printf("Node %d already waits for the critical section, queues another request", n.ID())
+		return
+	}
+	n.requestLocked()
+}
+
+// node lock must be held
+func (n *node) requestLocked() {
+	r := request{t: n.clock.Tick(), node: n.ID()}
+	n.own = &r
+	n.enqueue(r)
+	n.Printf("Node %d requests the critical section at #%d", n.ID(), r.t)
+
+	for i := 0; i < n.pool.participants; i++ {
+		if i != n.ID() {
+			n.send(i, message{kind: "request", t: r.t})
+		}
+	}
+	n.tryEnter()
+}
+
+// enter once the own request heads the queue and every other node has sent
+// something later than it (node lock must be held)
+func (n *node) tryEnter() {
+	if n.own == nil || n.inCS || len(n.queue) == 0 || n.queue[0] != *n.own {
+		return
+	}
+	for i, t := range n.lastHeard {
+		if i != n.ID() && !n.own.before(request{t: t, node: i}) {
+			return
+		}
+	}
+
+	n.inCS = true
+	n.pool.entries.Add(1)
+	if inside := n.pool.inside.Add(1); inside > 1 {
+		n.pool.violations.Add(1)
+		n.Printf("Node %d VIOLATION: enters the critical section with %d other node(s) inside", n.ID(), inside-1)
+	} else {
+		n.Printf("Node %d enters the critical section (request #%d)", n.ID(), n.own.t)
+	}
+
+	time.AfterFunc(n.pool.hold, n.release)
+}
+
+func (n *node) release() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.Running() {
+		return
+	}
+
+	n.inCS = false
+	n.pool.inside.Add(-1)
+	n.own = nil
+	n.dequeue(n.ID())
+
+	t := n.clock.Tick()
+	n.Printf("Node %d leaves the critical section at #%d", n.ID(), t)
+	for i := 0; i < n.pool.participants; i++ {
+		if i != n.ID() {
+			n.send(i, message{kind: "release", t: t})
+		}
+	}
+
+	if n.waiting > 0 {
+		n.waiting--
+		n.requestLocked()
+	}
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.pool.skipFIFO.Load() {
+		n.handle(m)
+		return
+	}
+
+	// hold back messages that overtook earlier ones from the same node
+	n.held[m.from][m.seq] = m
+	for {
+		next, ok := n.held[m.from][n.recvSeq[m.from]]
+		if !ok {
+			return
+		}
+		delete(n.held[m.from], n.recvSeq[m.from])
+		n.recvSeq[m.from]++
+		n.handle(next)
+	}
+}
+
+// node lock must be held
+func (n *node) handle(m message) {
+	n.clock.Witness(m.t)
+	if m.t > n.lastHeard[m.from] {
+		n.lastHeard[m.from] = m.t
+	}
+
+	switch m.kind {
+	case "request":
+		n.enqueue(request{t: m.t, node: m.from})
+		n.send(m.from, message{kind: "reply", t: n.clock.Tick()})
+	case "release":
+		n.dequeue(m.from)
+	}
+
+	n.tryEnter()
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func main() {
+	hold := flag.Duration("hold", time.Second, "how long a node stays in the critical section")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *hold <= 0 {
+		fmt.Println("Hold must be positive")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	var lmin, lmax atomic.Int64
+	lmin.Store(20)
+	lmax.Store(100)
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		return sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+	})
+
+	sender := func(from, to int, m message) {
+		network.Send(from, to, m, sim.Latency(int(lmin.Load()), int(lmax.Load())))
+	}
+
+	pool := newNodePool(nodeCount, sender)
+	pool.hold = *hold
+	for i := 0; i < nodeCount; i++ {
+		nodes[i] = newNode(pool, i, 1000, l)
+		nodes[i].Run()
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: request, queues, stats, latency, partition, heal, logs, toggle, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "request" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			nodes[id].request()
+		} else if cmd == "queues" {
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				n := nodes[i]
+
+				status := "idle"
+				if n.inCS {
+					status = "in the critical section"
+				} else if n.own != nil {
+					status = fmt.Sprintf("waiting with request #%d", n.own.t)
+				}
+
+				queue := make([]string, len(n.queue))
+				for j, r := range n.queue {
+					queue[j] = fmt.Sprintf("(#%d, node %d)", r.t, r.node)
+				}
+
+				fmt.Printf("Node %d (#%d, %s): queue %v, last heard %v\n", i, n.clock.Now(), status, queue, n.lastHeard)
+				nodes[i].mu.Unlock()
+			}
+		} else if cmd == "stats" {
+			entries := pool.entries.Load()
+			fmt.Printf("Critical section entries: %d, violations: %d\n", entries, pool.violations.Load())
+			fmt.Printf("Network messages: %d", network.Stats.Messages.Load())
+			if entries > 0 {
+				fmt.Printf(" (%.1f per entry, 3(n-1) = %d expected)", float64(network.Stats.Messages.Load())/float64(entries), 3*(nodeCount-1))
+			}
+			fmt.Println()
+		} else if cmd == "latency" {
+			var lo, hi int64
+
+			con.Scan("Min latency (ms): ", &lo)
+			con.Scan("Max latency (ms): ", &hi)
+
+			lmin.Store(lo)
+			lmax.Store(hi)
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "toggle" {
+			var mechanism string
+			con.Scan("Mechanism (fifo): ", &mechanism)
+
+			if mechanism == "fifo" {
+				skip := !pool.skipFIFO.Load()
+				pool.skipFIFO.Store(skip)
+				fmt.Printf("FIFO links: %s\n", enabledString(!skip))
+			} else {
+				fmt.Println("Unknown mechanism")
+			}
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type message struct {
+	kind string // request or reply
+	from int
+	t int64
+}
+
+// a request, ordered by timestamp then node ID
+type request struct {
+	t int64
+	node int
+}
+
+func (r request) before(o request) bool {
+	return r.t < o.t || (r.t == o.t && r.node < o.node)
+}
+
+type nodePool struct {
+	*sim.Pool
+	participants int
+	send func(from, to int, m message)
+
+	// how long a node stays in the critical section
+	hold time.Duration
+
+	// nodes in the critical section right now, known to the observer only
+	inside atomic.Int64
+	entries atomic.Int64
+	violations atomic.Int64
+	deferred atomic.Int64 // replies held back until a release
+
+	// deliberately weaken the protocol for demonstration
+	skipDefer atomic.Bool
+}
+
+func newNodePool(participants int, send func(from, to int, m message)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.participants = participants
+	pool.send = send
+	pool.hold = 0
+	pool.inside.Store(0)
+	pool.entries.Store(0)
+	pool.violations.Store(0)
+	pool.deferred.Store(0)
+	pool.skipDefer.Store(false)
+	return pool
+}
+
+type node struct {
+	*sim.Process
+	pool *nodePool
+
+	clock *sim.LamportClock
+	own *request // this node's pending request, nil if not requesting
+	replies map[int]bool // who answered the pending request
+	inCS bool
+	waiting int // requests asked for while one is still pending
+
+	// requests answered only once this node leaves the critical section
+	deferred []int
+
+	mu sync.Mutex
+
+	inbox chan message
+}
+
+func newNode(pool *nodePool, id, clockSpeed int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.clock = sim.NewLamportClock()
+	n.own = nil
+	n.replies = map[int]bool{}
+	n.inCS = false
+	n.waiting = 0
+	n.deferred = []int{}
+	n.inbox = make(chan message)
+	return n
+}
+
+func (n *node) Run() {
+	n.Start(nil)
+
+	// poll requests and replies
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
+
+// node lock must be held
+func (n *node) send(to int, m message) {
+	m.from = n.ID()
+	n.pool.send(n.ID(), to, m)
+}
+
+// ask every node for the critical section
+func (n *node) request() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.own != nil {
+		// one request at a time, the next goes out after the release
+		n.waiting++
+		n.Printf("Node %d already waits for the critical section, queues another request", n.ID())
+		return
+	}
+	n.requestLocked()
+}
+
+// node lock must be held
+func (n *node) requestLocked() {
+	r := request{t: n.clock.Tick(), node: n.ID()}
+	n.own = &r
+	n.replies = map[int]bool{}
+	n.Printf("Node %d requests the critical section at #%d", n.ID(), r.t)
+
+	for i := 0; i < n.pool.participants; i++ {
+		if i != n.ID() {
+			n.send(i, message{kind: "request", t: r.t})
+		}
+	}
+	n.tryEnter()
+}
+
+// enter once every other node has replied (node lock must be held)
+func (n *node) tryEnter() {
+	if n.own == nil || n.inCS || len(n.replies) < n.pool.participants-1 {
+		return
+	}
+
+	n.inCS = true
+	n.pool.entries.Add(1)
+	if inside := n.pool.inside.Add(1); inside > 1 {
+		n.pool.violations.Add(1)
+		n.Printf("Node %d VIOLATION: enters the critical section with %d other node(s) inside", n.ID(), inside-1)
+	} else {
+		n.Printf("Node %d enters the critical section (request #%d)", n.ID(), n.own.t)
+	}
+
+	time.AfterFunc(n.pool.hold, n.release)
+}
+
+func (n *node) release() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.Running() {
+		return
+	}
+
+	n.inCS = false
+	n.pool.inside.Add(-1)
+	n.own = nil
+
+	// the release is the deferred replies, nobody else hears about it
+	t := n.clock.Tick()
+	n.Printf("Node %d leaves the critical section at #%d, replies to deferred %v", n.ID(), t, n.deferred)
+	for _, to := range n.deferred {
+		n.send(to, message{kind: "reply", t: t})
+	}
+	n.deferred = []int{}
+
+	if n.waiting > 0 {
+		n.waiting--
+		n.requestLocked()
+	}
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.clock.Witness(m.t)
+
+	switch m.kind {
+	case "request":
+		// hold the reply back while inside or asking with an earlier request
+		theirs := request{t: m.t, node: m.from}
+		if !n.pool.skipDefer.Load() && (n.inCS || (n.own != nil && n.own.before(theirs))) {
+			n.deferred = append(n.deferred, m.from)
+			n.pool.deferred.Add(1)
+			n.Printf("Node %d defers its reply to node %d (request #%d)", n.ID(), m.from, m.t)
+			return
+		}
+		n.send(m.from, message{kind: "reply", t: n.clock.Tick()})
+
+	case "reply":
+		if n.own != nil {
+			n.replies[m.from] = true
+			n.tryEnter()
+		}
+	}
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func main() {
+	hold := flag.Duration("hold", time.Second, "how long a node stays in the critical section")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *hold <= 0 {
+		fmt.Println("Hold must be positive")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	var lmin, lmax atomic.Int64
+	lmin.Store(20)
+	lmax.Store(100)
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		return sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+	})
+
+	sender := func(from, to int, m message) {
+		network.Send(from, to, m, sim.Latency(int(lmin.Load()), int(lmax.Load())))
+	}
+
+	pool := newNodePool(nodeCount, sender)
+	pool.hold = *hold
+	for i := 0; i < nodeCount; i++ {
+		nodes[i] = newNode(pool, i, 1000, l)
+		nodes[i].Run()
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: request, state, stats, latency, partition, heal, logs, toggle, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "request" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			nodes[id].request()
+		} else if cmd == "state" {
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				n := nodes[i]
+
+				status := "idle"
+				if n.inCS {
+					status = "in the critical section"
+				} else if n.own != nil {
+					status = fmt.Sprintf("waiting with request #%d, %d/%d replies", n.own.t, len(n.replies), nodeCount-1)
+				}
+
+				fmt.Printf("Node %d (#%d, %s): deferred %v\n", i, n.clock.Now(), status, n.deferred)
+				nodes[i].mu.Unlock()
+			}
+		} else if cmd == "stats" {
+			entries := pool.entries.Load()
+			fmt.Printf("Critical section entries: %d, violations: %d, deferred replies: %d\n", entries, pool.violations.Load(), pool.deferred.Load())
+			fmt.Printf("Network messages: %d", network.Stats.Messages.Load())
+			if entries > 0 {
+				fmt.Printf(" (%.1f per entry, 2(n-1) = %d expected, Lamport needs 3(n-1) = %d)", float64(network.Stats.Messages.Load())/float64(entries), 2*(nodeCount-1), 3*(nodeCount-1))
+			}
+			fmt.Println()
+		} else if cmd == "latency" {
+			var lo, hi int64
+
+			con.Scan("Min latency (ms): ", &lo)
+			con.Scan("Max latency (ms): ", &hi)
+
+			lmin.Store(lo)
+			lmax.Store(hi)
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "toggle" {
+			var mechanism string
+			con.Scan("Mechanism (defer): ", &mechanism)
+
+			if mechanism == "defer" {
+				skip := !pool.skipDefer.Load()
+				pool.skipDefer.Store(skip)
+				fmt.Printf("Deferring replies: %s\n", enabledString(!skip))
+			} else {
+				fmt.Println("Unknown mechanism")
+			}
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+// How nodes get a token back once it is lost.
+const (
+	recoverNone = "none" // the ring stalls
+	recoverTimeout = "timeout" // a node that has not seen the token for a while makes a new one
+	recoverGeneration = "generation" // same, and tokens older than one already seen are discarded
+)
+
+// a token, regenerated tokens outrank older ones
+type token struct {
+	gen int
+	creator int
+}
+
+func (t token) before(o token) bool {
+	return t.gen < o.gen || (t.gen == o.gen && t.creator < o.creator)
+}
+
+type message struct {
+	from int
+	token token
+}
+
+type nodePool struct {
+	*sim.Pool
+	ring []int // node IDs in the order the token goes round
+	send func(from, to int, m message)
+
+	// how long a node stays in the critical section
+	hold time.Duration
+	// how long a node waits for the token before it regenerates one
+	timeout time.Duration
+
+	recovery string
+	recoveryMu sync.Mutex
+
+	// known to the observer only
+	inside atomic.Int64
+	tokens atomic.Int64 // tokens on the ring right now
+	entries atomic.Int64
+	violations atomic.Int64
+	passes atomic.Int64
+	lost atomic.Int64
+	regenerated atomic.Int64
+	discarded atomic.Int64
+
+	// the next time the token is passed on it is lost
+	loseNext atomic.Bool
+}
+
+func newNodePool(ring []int, send func(from, to int, m message)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.ring = ring
+	pool.send = send
+	pool.hold = 0
+	pool.timeout = 0
+	pool.recovery = recoverGeneration
+	pool.inside.Store(0)
+	pool.tokens.Store(0)
+	pool.entries.Store(0)
+	pool.violations.Store(0)
+	pool.passes.Store(0)
+	pool.lost.Store(0)
+	pool.regenerated.Store(0)
+	pool.discarded.Store(0)
+	pool.loseNext.Store(false)
+	return pool
+}
+
+func (p *nodePool) Recovery() string {
+	p.recoveryMu.Lock()
+	defer p.recoveryMu.Unlock()
+	return p.recovery
+}
+
+func (p *nodePool) SetRecovery(recovery string) error {
+	if recovery != recoverNone && recovery != recoverTimeout && recovery != recoverGeneration {
+		return fmt.Errorf("unknown recovery: %s (none, timeout or generation)", recovery)
+	}
+
+	p.recoveryMu.Lock()
+	defer p.recoveryMu.Unlock()
+	p.recovery = recovery
+	return nil
+}
+
+type node struct {
+	*sim.Process
+	pool *nodePool
+
+	next int // successor on the ring
+	wants int // requests for the critical section not served yet
+
+	holding *token // nil unless the token is here
+	inCS bool
+
+	best token // newest token seen
+	lastSeen time.Time
+
+	mu sync.Mutex
+
+	inbox chan message
+}
+
+func newNode(pool *nodePool, id, next, clockSpeed int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.next = next
+	n.wants = 0
+	n.holding = nil
+	n.inCS = false
+	n.best = token{gen: 0, creator: 0}
+	n.lastSeen = time.Now()
+	n.inbox = make(chan message)
+	return n
+}
+
+func (n *node) Run() {
+	// every tick checks whether the token is overdue
+	n.Start(n.tick)
+
+	// poll the token
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
+
+func (n *node) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	recovery := n.pool.Recovery()
+	if recovery == recoverNone || n.holding != nil || time.Since(n.lastSeen) < n.pool.timeout {
+		return
+	}
+
+	t := token{gen: n.best.gen + 1, creator: n.ID()}
+	n.pool.regenerated.Add(1)
+	n.pool.tokens.Add(1)
+	n.Printf("Node %d has not seen the token for %v, regenerates it (generation %d)", n.ID(), time.Since(n.lastSeen).Round(time.Millisecond), t.gen)
+	n.take(t)
+}
+
+func (n *node) request() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.wants++
+	n.Printf("Node %d wants the critical section (%d pending)", n.ID(), n.wants)
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.pool.Recovery() == recoverGeneration && m.token.before(n.best) {
+		n.pool.discarded.Add(1)
+		n.pool.tokens.Add(-1)
+		n.Printf("Node %d discards a stale token (generation %d, newest seen %d)", n.ID(), m.token.gen, n.best.gen)
+		return
+	}
+	n.take(m.token)
+}
+
+// node lock must be held
+func (n *node) take(t token) {
+	if n.best.before(t) {
+		n.best = t
+	}
+	n.lastSeen = time.Now()
+
+	if n.holding != nil {
+		// a second token while holding one, merge them
+		n.pool.tokens.Add(-1)
+		n.Printf("Node %d already holds a token, drops generation %d", n.ID(), t.gen)
+		return
+	}
+	n.holding = &t
+
+	if n.wants == 0 {
+		n.pass()
+		return
+	}
+
+	n.wants--
+	n.inCS = true
+	n.pool.entries.Add(1)
+	if inside := n.pool.inside.Add(1); inside > 1 {
+		n.pool.violations.Add(1)
+		n.Printf("Node %d VIOLATION: enters the critical section with %d other node(s) inside", n.ID(), inside-1)
+	} else {
+		n.Printf("Node %d enters the critical section (token generation %d)", n.ID(), t.gen)
+	}
+
+	time.AfterFunc(n.pool.hold, n.release)
+}
+
+func (n *node) release() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.Running() {
+		return
+	}
+
+	n.inCS = false
+	n.pool.inside.Add(-1)
+	n.Printf("Node %d leaves the critical section", n.ID())
+	n.lastSeen = time.Now()
+	n.pass()
+}
+
+// node lock must be held
+func (n *node) pass() {
+	t := *n.holding
+	n.holding = nil
+
+	if n.pool.loseNext.CompareAndSwap(true, false) {
+		n.pool.lost.Add(1)
+		n.pool.tokens.Add(-1)
+		n.Printf("Node %d loses the token (generation %d) passing it to node %d", n.ID(), t.gen, n.next)
+		return
+	}
+
+	n.pool.passes.Add(1)
+	n.pool.send(n.ID(), n.next, message{from: n.ID(), token: t})
+}
+
+func main() {
+	ring := flag.String("ring", "", "order of the nodes on the ring, e.g. 0,2,1,3 (default by ID)")
+	hold := flag.Duration("hold", 500*time.Millisecond, "how long a node stays in the critical section")
+	timeout := flag.Duration("timeout", 5*time.Second, "how long a node waits for the token before it regenerates one")
+	recovery := flag.String("recovery", recoverGeneration, "what nodes do about a lost token: none, timeout or generation")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *hold <= 0 || *timeout <= 0 {
+		fmt.Println("Hold and timeout must be positive")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	order := make([]int, nodeCount)
+	for i := range order {
+		order[i] = i
+	}
+	if *ring != "" {
+		groups, err := sim.ParseGroups(*ring, nodeCount)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		seen := make([]bool, nodeCount)
+		for _, id := range groups[0] {
+			seen[id] = true
+		}
+		for _, ok := range seen {
+			if !ok || len(groups) != 1 || len(groups[0]) != nodeCount {
+				fmt.Println("The ring must list every node once")
+				return
+			}
+		}
+		order = groups[0]
+	}
+
+	var lmin, lmax atomic.Int64
+	lmin.Store(20)
+	lmax.Store(100)
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		return sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+	})
+
+	sender := func(from, to int, m message) {
+		network.Send(from, to, m, sim.Latency(int(lmin.Load()), int(lmax.Load())))
+	}
+
+	pool := newNodePool(order, sender)
+	pool.hold = *hold
+	pool.timeout = *timeout
+	if err := pool.SetRecovery(*recovery); err != nil {
+		fmt.Println(err)
+		return
+	}
+	for i, id := range order {
+		nodes[id] = newNode(pool, id, order[(i+1)%nodeCount], 100, l)
+	}
+	for i := range nodes {
+		nodes[i].Run()
+	}
+
+	// the first node on the ring starts with the token
+	pool.tokens.Add(1)
+	nodes[order[0]].mu.Lock()
+	nodes[order[0]].take(token{gen: 0, creator: 0})
+	nodes[order[0]].mu.Unlock()
+
+	for {
+		var cmd string
+		fmt.Println("Commands: request, state, lose, recovery, stats, latency, partition, heal, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "request" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			nodes[id].request()
+		} else if cmd == "state" {
+			fmt.Printf("Ring: %v, tokens on it: %d, recovery: %s\n", order, pool.tokens.Load(), pool.Recovery())
+			for _, id := range order {
+				nodes[id].mu.Lock()
+				n := nodes[id]
+
+				status := "idle"
+				if n.inCS {
+					status = "in the critical section"
+				} else if n.holding != nil {
+					status = "holding the token"
+				}
+
+				fmt.Printf("Node %d -> %d: %s, %d request(s) pending, newest generation %d, token last seen %v ago\n", id, n.next, status, n.wants, n.best.gen, time.Since(n.lastSeen).Round(time.Millisecond))
+				nodes[id].mu.Unlock()
+			}
+		} else if cmd == "lose" {
+			// drop the token on its way, or the next time its holder passes it on
+			dropped := 0
+			for _, p := range network.InFlight() {
+				if network.Signal(p.ID, "drop") {
+					dropped++
+				}
+			}
+
+			if dropped > 0 {
+				pool.lost.Add(int64(dropped))
+				pool.tokens.Add(-int64(dropped))
+				fmt.Printf("Dropped %d token(s) in flight\n", dropped)
+			} else {
+				pool.loseNext.Store(true)
+				fmt.Println("No token in flight, the next one passed on is lost")
+			}
+		} else if cmd == "recovery" {
+			var recovery string
+			con.Scan("Recovery (none, timeout or generation): ", &recovery)
+
+			if err := pool.SetRecovery(recovery); err != nil {
+				fmt.Println(err)
+			}
+		} else if cmd == "stats" {
+			entries := pool.entries.Load()
+			fmt.Printf("Critical section entries: %d, violations: %d\n", entries, pool.violations.Load())
+			fmt.Printf("Token passes: %d", pool.passes.Load())
+			if entries > 0 {
+				fmt.Printf(" (%.1f per entry)", float64(pool.passes.Load())/float64(entries))
+			}
+			fmt.Println()
+			fmt.Printf("Tokens lost: %d, regenerated: %d, discarded as stale: %d, on the ring now: %d\n", pool.lost.Load(), pool.regenerated.Load(), pool.discarded.Load(), pool.tokens.Load())
+		} else if cmd == "latency" {
+			var lo, hi int64
+
+			con.Scan("Min latency (ms): ", &lo)
+			con.Scan("Max latency (ms): ", &hi)
+
+			lmin.Store(lo)
+			lmax.Store(hi)
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
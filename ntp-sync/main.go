@@ -1,61 +1,378 @@
 package main
 
 import (
-	"crypto/rand"
+	"flag"
 	"fmt"
-	"math/big"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
 )
 
-func requestNTP(t time.Time) (t1, t2, t3 time.Time) {
-	var r *big.Int
-	var d time.Duration
+// the reference clock, it keeps real time
+const reference = 0
+
+type message struct {
+	kind string // request or response
+	from int
+	t1 time.Time // client clock when the request left
+	t2 time.Time // server clock when the request arrived
+	t3 time.Time // server clock when the response left
+
+	// known to the observer only: the server's clock against real time
+	skew time.Duration
+}
 
-	t1 = t
+// one sync round of a node
+type sample struct {
+	at time.Time // real time
+	before time.Duration // skew against real time before adjusting
+	after time.Duration
+	offset time.Duration // what the node estimated
+	delay time.Duration // round trip minus the server's processing time
 
-	// network delay
-	r, _ = rand.Int(rand.Reader, big.NewInt(500))
-	d, _ = time.ParseDuration(fmt.Sprintf("1s%dms", r.Int64()))
-	time.Sleep(d)
+	// skew against the server: the true one and the one the node estimated
+	trueSkew time.Duration
+	estimated time.Duration
+}
+
+type nodePool struct {
+	*sim.Pool
+	send func(from, to int, m message)
+}
 
-	t2 = time.Now()
+func newNodePool(send func(from, to int, m message)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.send = send
+	return pool
+}
 
-	// processing time
-	r, _ = rand.Int(rand.Reader, big.NewInt(500))
-	d, _ = time.ParseDuration(fmt.Sprintf("1s%dms", r.Int64()))
-	time.Sleep(d)
+type node struct {
+	*sim.Process
+	pool *nodePool
 
-	t3 = time.Now()
+	stratum int
+	server int // where this node syncs from, -1 for the reference
+	clock *sim.PhysicalClock
+	samples []sample
+	mu sync.Mutex
 
-	// network delay
-	r, _ = rand.Int(rand.Reader, big.NewInt(500))
-	d, _ = time.ParseDuration(fmt.Sprintf("1s%dms", r.Int64()))
-	time.Sleep(d)
+	inbox chan message
+}
 
-	return
+func newNode(pool *nodePool, id, clockSpeed, stratum, server int, clock *sim.PhysicalClock, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.stratum = stratum
+	n.server = server
+	n.clock = clock
+	n.samples = []sample{}
+	n.inbox = make(chan message)
+	return n
 }
 
-func main() {
-	var t1, t2, t3, t4 time.Time
-	var d time.Duration
+func (n *node) Run() {
+	// every tick is one sync round
+	n.Start(n.tick)
 
-	t1 = time.Now()
-	fmt.Printf("Time before sync: %s\n", t1.Format(time.RFC3339Nano))
+	// poll requests and responses
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
 
-	_, t2, t3 = requestNTP(t1)
+func (n *node) tick() {
+	if n.server < 0 {
+		return
+	}
+	n.pool.send(n.ID(), n.server, message{kind: "request", from: n.ID(), t1: n.clock.Now()})
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 
-	t4 = time.Now()
-	fmt.Printf("Time after sync: %s\n", t4.Format(time.RFC3339Nano))
+	if m.kind == "request" {
+		t2 := n.clock.Now()
+		n.pool.send(n.ID(), m.from, message{kind: "response", from: n.ID(), t1: m.t1, t2: t2, t3: n.clock.Now(), skew: n.clock.Skew()})
+		return
+	}
 
-	networkDelay := t4.Sub(t1).Nanoseconds() - t3.Sub(t2).Nanoseconds()
+	t4 := n.clock.Now()
 
-	d, _ = time.ParseDuration(fmt.Sprintf("%sns", networkDelay / 2))
-	serverTime := t3.Add(d)
+	// assume both ways took as long
+	offset := (m.t2.Sub(m.t1) + m.t3.Sub(t4)) / 2
+	delay := t4.Sub(m.t1) - m.t3.Sub(m.t2)
 
-	clockSkew := serverTime.Sub(t4).Nanoseconds()
+	before := n.clock.Skew()
+	n.clock.Adjust(offset)
+	after := n.clock.Skew()
 
-	fmt.Printf("Round-trip network delay: %dns\n", networkDelay)
-	fmt.Printf("Estimated server time: %s\n", serverTime.Format(time.RFC3339Nano))
-	fmt.Printf("Estimated clock skew: %dns\n", clockSkew)
+	n.samples = append(n.samples, sample{at: time.Now(), before: before, after: after, offset: offset, delay: delay, trueSkew: before - m.skew, estimated: -offset})
+	n.Printf("Node %d (stratum %d) sets its clock by %v (delay %v), now %v off real time", n.ID(), n.stratum, offset.Round(time.Microsecond), delay.Round(time.Microsecond), after.Round(time.Microsecond))
 }
 
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// a latency range like "20-100" in ms
+func parseRange(s string) (int, int, error) {
+	lo, hi, ok := strings.Cut(s, "-")
+	lmin, errMin := strconv.Atoi(lo)
+	lmax, errMax := strconv.Atoi(hi)
+	if !ok || errMin != nil || errMax != nil || lmin < 0 || lmax < lmin {
+		return 0, 0, fmt.Errorf("invalid latency range: %s", s)
+	}
+	return lmin, lmax, nil
+}
+
+func main() {
+	servers := flag.Int("servers", 2, "stratum 2 servers syncing from the reference, the other nodes sync from them")
+	period := flag.Duration("period", 2*time.Second, "interval between sync rounds")
+	skew := flag.Duration("skew", time.Second, "start every clock but the reference off real time by up to this much")
+	drift := flag.Float64("drift", 5000, "let every clock but the reference run up to this many ppm faster or slower")
+	uplink := flag.String("uplink", "20-100", "latency range of requests to the server (ms)")
+	downlink := flag.String("downlink", "20-100", "latency range of responses from the server (ms)")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *servers < 0 || *period < time.Millisecond || *skew < 0 || *drift < 0 {
+		fmt.Println("Servers, skew and drift must not be negative and period must be positive")
+		return
+	}
+
+	// latency bounds of both directions, the latency command changes them
+	// while nodes send
+	var upMin, upMax, downMin, downMax atomic.Int64
+
+	lo, hi, err := parseRange(*uplink)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	upMin.Store(int64(lo))
+	upMax.Store(int64(hi))
+
+	lo, hi, err = parseRange(*downlink)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	downMin.Store(int64(lo))
+	downMax.Store(int64(hi))
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	if nodeCount < *servers+1 {
+		fmt.Println("Need the reference and every server")
+		return
+	}
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		return sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+	})
+
+	// requests go up to the server, responses come back down
+	sender := func(from, to int, m message) {
+		if m.kind == "request" {
+			network.Send(from, to, m, sim.Latency(int(upMin.Load()), int(upMax.Load())))
+		} else {
+			network.Send(from, to, m, sim.Latency(int(downMin.Load()), int(downMax.Load())))
+		}
+	}
+
+	pool := newNodePool(sender)
+	for i := 0; i < nodeCount; i++ {
+		stratum, server := 1, -1
+		clock := sim.NewPhysicalClock(0, 1)
+
+		if i != reference {
+			if i <= *servers {
+				stratum, server = 2, reference
+			} else if *servers > 0 {
+				stratum, server = 3, 1+int(sim.Random(int64(*servers)))
+			} else {
+				stratum, server = 2, reference
+			}
+
+			offset := time.Duration(sim.Random(int64(2**skew)+1)) - *skew
+			ppm := float64(sim.Random(2001))/1000 - 1
+			clock = sim.NewPhysicalClock(offset, 1+ppm**drift/1e6)
+		}
+
+		nodes[i] = newNode(pool, i, int(*period/time.Millisecond), stratum, server, clock, l)
+		nodes[i].Run()
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: clocks, history, stats, skew, latency, partition, heal, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "clocks" {
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				n := nodes[i]
+				ppm := (n.clock.Rate() - 1) * 1e6
+				if n.server < 0 {
+					fmt.Printf("Node %d: stratum %d (reference), %v off real time\n", i, n.stratum, n.clock.Skew().Round(time.Microsecond))
+				} else {
+					fmt.Printf("Node %d: stratum %d, syncs from node %d, drifts %+.0f ppm, %v off real time after %d round(s)\n", i, n.stratum, n.server, ppm, n.clock.Skew().Round(time.Microsecond), len(n.samples))
+				}
+				nodes[i].mu.Unlock()
+			}
+		} else if cmd == "history" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			nodes[id].mu.Lock()
+			if len(nodes[id].samples) == 0 {
+				fmt.Println("No sync rounds yet")
+			}
+			start := time.Now()
+			if len(nodes[id].samples) > 0 {
+				start = nodes[id].samples[0].at
+			}
+			for i, s := range nodes[id].samples {
+				fmt.Printf("Round %d at +%v: %v off before, %v after, delay %v; against the server %v off, estimated %v (error %v)\n", i+1, s.at.Sub(start).Round(time.Millisecond), s.before.Round(time.Microsecond), s.after.Round(time.Microsecond), s.delay.Round(time.Microsecond), s.trueSkew.Round(time.Microsecond), s.estimated.Round(time.Microsecond), (s.estimated - s.trueSkew).Round(time.Microsecond))
+			}
+			nodes[id].mu.Unlock()
+		} else if cmd == "stats" {
+			// how far clocks drift between rounds and how close each round brings them, per stratum
+			type total struct {
+				nodes, rounds int
+				before, after, worst time.Duration
+				squares float64
+				errors time.Duration // estimated minus true skew against the server
+			}
+			strata := map[int]*total{}
+
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				if nodes[i].server >= 0 {
+					t, ok := strata[nodes[i].stratum]
+					if !ok {
+						t = new(total)
+						strata[nodes[i].stratum] = t
+					}
+					t.nodes++
+
+					// the first round only undoes the initial skew
+					for _, s := range nodes[i].samples[min(1, len(nodes[i].samples)):] {
+						t.errors += s.estimated - s.trueSkew
+						t.rounds++
+						t.before += abs(s.before)
+						t.after += abs(s.after)
+						t.squares += float64(s.after) * float64(s.after)
+						if abs(s.after) > t.worst {
+							t.worst = abs(s.after)
+						}
+					}
+				}
+				nodes[i].mu.Unlock()
+			}
+
+			for stratum := 2; stratum <= 3; stratum++ {
+				t, ok := strata[stratum]
+				if !ok {
+					continue
+				}
+				if t.rounds == 0 {
+					fmt.Printf("Stratum %d: %d node(s), no rounds after the first yet\n", stratum, t.nodes)
+					continue
+				}
+				rms := time.Duration(math.Sqrt(t.squares / float64(t.rounds)))
+				fmt.Printf("Stratum %d: %d node(s), %d round(s), mean skew %v before a round and %v after (rms %v, worst %v), mean estimation error %v\n", stratum, t.nodes, t.rounds, (t.before / time.Duration(t.rounds)).Round(time.Microsecond), (t.after / time.Duration(t.rounds)).Round(time.Microsecond), rms.Round(time.Microsecond), t.worst.Round(time.Microsecond), (t.errors / time.Duration(t.rounds)).Round(time.Microsecond))
+			}
+
+			// the estimate splits the round trip in half, so it is off by half the difference
+			uLo, uHi, dLo, dHi := upMin.Load(), upMax.Load(), downMin.Load(), downMax.Load()
+			bias := time.Duration((dLo+dHi)-(uLo+uHi)) * time.Millisecond / 4
+			fmt.Printf("Uplink %d-%dms, downlink %d-%dms: expected estimation error %v per round\n", uLo, uHi, dLo, dHi, bias)
+		} else if cmd == "skew" {
+			var id int
+			var offset string
+
+			con.Scan("Node: ", &id)
+			con.Scan("Offset (e.g. 5s or -300ms): ", &offset)
+
+			d, err := time.ParseDuration(offset)
+			if err != nil {
+				fmt.Println("Invalid duration")
+				continue
+			}
+			nodes[id].clock.Adjust(d)
+
+			fmt.Printf("Clock of node %d is now %v off real time\n", id, nodes[id].clock.Skew().Round(time.Millisecond))
+		} else if cmd == "latency" {
+			var uLo, uHi, dLo, dHi int64
+
+			con.Scan("Uplink min latency (ms): ", &uLo)
+			con.Scan("Uplink max latency (ms): ", &uHi)
+			con.Scan("Downlink min latency (ms): ", &dLo)
+			con.Scan("Downlink max latency (ms): ", &dHi)
+
+			upMin.Store(uLo)
+			upMax.Store(uHi)
+			downMin.Store(dLo)
+			downMax.Store(dHi)
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type message struct {
+	kind string // prepare, promise, accept, accepted or nack
+	from int
+	ballot int
+	value int
+
+	// promise: the proposal this acceptor accepted before (-1 if none)
+	// nack: the ballot this acceptor has promised instead
+	prior int
+	priorValue int
+
+	// latency range reused by replies
+	lmin, lmax int
+}
+
+type nodePool struct {
+	*sim.Pool
+	participants int
+	send func(from, to int, m message)
+
+	// a rejected proposer tries again with a higher ballot this many times
+	attempts int
+
+	// deliberately weaken the protocol for demonstration
+	skipBackoff atomic.Bool
+	skipAdopt atomic.Bool
+}
+
+func newNodePool(participants int, send func(from, to int, m message)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.participants = participants
+	pool.send = send
+	pool.attempts = 0
+	pool.skipBackoff.Store(false)
+	pool.skipAdopt.Store(false)
+	return pool
+}
+
+// every node is a proposer, an acceptor and a learner
+type node struct {
+	*sim.Process
+	pool *nodePool
+	mu sync.Mutex
+
+	// acceptor
+	promised int
+	accepted int
+	acceptedValue int
+
+	// proposer
+	ballot int
+	value int
+	phase string // idle, prepare, accept, rejected, chosen or gave up
+	promises map[int]message
+	attempt int
+	highest int // highest ballot seen, the next one must beat it
+	lmin, lmax int
+
+	// learner
+	votes map[int]map[int]bool // acceptors that accepted each ballot
+	learned bool
+	learnedValue int
+
+	inbox chan message
+}
+
+func newNode(pool *nodePool, id, clockSpeed int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.promised = -1
+	n.accepted = -1
+	n.acceptedValue = 0
+	n.ballot = -1
+	n.value = 0
+	n.phase = "idle"
+	n.promises = make(map[int]message)
+	n.attempt = 0
+	n.highest = -1
+	n.votes = make(map[int]map[int]bool)
+	n.learned = false
+	n.inbox = make(chan message)
+	return n
+}
+
+func (n *node) Run() {
+	n.Start(nil)
+
+	// poll protocol messages
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
+
+func (n *node) quorum() int {
+	return n.pool.participants/2 + 1
+}
+
+// node lock must be held
+func (n *node) sendAll(m message) {
+	m.from = n.ID()
+	m.lmin = n.lmin
+	m.lmax = n.lmax
+	for to := 0; to < n.pool.participants; to++ {
+		n.pool.send(n.ID(), to, m)
+	}
+}
+
+// node lock must be held
+func (n *node) reply(to int, m message, request message) {
+	m.from = n.ID()
+	m.lmin = request.lmin
+	m.lmax = request.lmax
+	n.pool.send(n.ID(), to, m)
+}
+
+func (n *node) propose(value, lmin, lmax int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.value = value
+	n.lmin = lmin
+	n.lmax = lmax
+	n.attempt = 0
+	n.prepare()
+}
+
+// phase 1: ask every acceptor to promise a new, higher ballot (node lock must be held)
+func (n *node) prepare() {
+	// ballots are unique per node: round * participants + id
+	round := n.highest/n.pool.participants + 1
+	if n.highest < 0 {
+		round = 0
+	}
+	n.ballot = round*n.pool.participants + n.ID()
+	n.highest = n.ballot
+	n.attempt++
+	n.phase = "prepare"
+	n.promises = make(map[int]message)
+
+	n.Printf("Node %d prepares ballot %d for value %d (attempt %d)", n.ID(), n.ballot, n.value, n.attempt)
+	n.sendAll(message{kind: "prepare", ballot: n.ballot})
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if m.ballot > n.highest {
+		n.highest = m.ballot
+	}
+
+	if m.kind == "prepare" {
+		if m.ballot < n.promised {
+			n.Printf("Node %d rejects prepare %d from node %d, promised %d", n.ID(), m.ballot, m.from, n.promised)
+			n.reply(m.from, message{kind: "nack", ballot: m.ballot, prior: n.promised}, m)
+			return
+		}
+
+		n.promised = m.ballot
+		n.Printf("Node %d promises ballot %d to node %d (accepted: %s)", n.ID(), m.ballot, m.from, proposalString(n.accepted, n.acceptedValue))
+		n.reply(m.from, message{kind: "promise", ballot: m.ballot, prior: n.accepted, priorValue: n.acceptedValue}, m)
+	} else if m.kind == "promise" {
+		if n.phase != "prepare" || m.ballot != n.ballot {
+			return
+		}
+
+		n.promises[m.from] = m
+		if len(n.promises) < n.quorum() {
+			return
+		}
+
+		// phase 2: propose the value of the highest proposal a quorum has accepted, if any
+		value := n.value
+		prior := -1
+		if !n.pool.skipAdopt.Load() {
+			for _, p := range n.promises {
+				if p.prior > prior {
+					prior = p.prior
+					value = p.priorValue
+				}
+			}
+		}
+		if prior != -1 && value != n.value {
+			n.Printf("Node %d adopts value %d from ballot %d instead of its own %d", n.ID(), value, prior, n.value)
+		}
+
+		n.value = value
+		n.phase = "accept"
+		n.Printf("Node %d has a quorum of promises for ballot %d, asks to accept %d", n.ID(), n.ballot, value)
+		n.sendAll(message{kind: "accept", ballot: n.ballot, value: value})
+	} else if m.kind == "accept" {
+		if m.ballot < n.promised {
+			n.Printf("Node %d rejects accept %d from node %d, promised %d", n.ID(), m.ballot, m.from, n.promised)
+			n.reply(m.from, message{kind: "nack", ballot: m.ballot, prior: n.promised}, m)
+			return
+		}
+
+		n.promised = m.ballot
+		n.accepted = m.ballot
+		n.acceptedValue = m.value
+		n.Printf("Node %d accepts value %d in ballot %d", n.ID(), m.value, m.ballot)
+
+		// tell every learner
+		accepted := message{kind: "accepted", ballot: m.ballot, value: m.value, from: n.ID(), lmin: m.lmin, lmax: m.lmax}
+		for to := 0; to < n.pool.participants; to++ {
+			n.pool.send(n.ID(), to, accepted)
+		}
+	} else if m.kind == "accepted" {
+		if n.votes[m.ballot] == nil {
+			n.votes[m.ballot] = make(map[int]bool)
+		}
+		n.votes[m.ballot][m.from] = true
+
+		if len(n.votes[m.ballot]) >= n.quorum() {
+			if !n.learned {
+				n.learned = true
+				n.learnedValue = m.value
+				n.Printf("Node %d learns value %d (ballot %d)", n.ID(), m.value, m.ballot)
+			} else if n.learnedValue != m.value {
+				n.Printf("Node %d VIOLATION: learned %d but ballot %d chose %d", n.ID(), n.learnedValue, m.ballot, m.value)
+			}
+
+			if m.ballot == n.ballot && n.phase == "accept" {
+				n.phase = "chosen"
+			}
+		}
+	} else if m.kind == "nack" {
+		if m.prior > n.highest {
+			n.highest = m.prior
+		}
+		if m.ballot != n.ballot || (n.phase != "prepare" && n.phase != "accept") {
+			return
+		}
+
+		if n.attempt >= n.pool.attempts {
+			n.phase = "gave up"
+			n.Printf("Node %d gives up on value %d after %d attempt(s)", n.ID(), n.value, n.attempt)
+			return
+		}
+
+		n.phase = "rejected"
+		go n.retry(n.ballot)
+	}
+}
+
+// wait, then prepare again unless something else happened meanwhile
+func (n *node) retry(ballot int) {
+	var delay time.Duration
+	if !n.pool.skipBackoff.Load() {
+		// randomized and growing, so dueling proposers stop preempting each other
+		n.mu.Lock()
+		shift := n.attempt
+		if shift > 6 {
+			shift = 6
+		}
+		delay = sim.Latency(0, (n.lmax+1)<<shift)
+		n.mu.Unlock()
+	}
+
+	select {
+	case <-time.After(delay):
+	case <-n.Done():
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.phase == "rejected" && n.ballot == ballot {
+		n.prepare()
+	}
+}
+
+// observers see every message delivered on the network but never send, so
+// they learn the chosen value without voting on it
+type observer struct {
+	id int
+	participants int
+	l sim.Logger
+
+	seen int
+	votes map[int]map[int]bool
+	learned bool
+	learnedValue int
+	mu sync.Mutex
+}
+
+func newObserver(id, participants int, l sim.Logger) *observer {
+	o := new(observer)
+	o.id = id
+	o.participants = participants
+	o.l = l
+	o.seen = 0
+	o.votes = make(map[int]map[int]bool)
+	o.learned = false
+	return o
+}
+
+func (o *observer) observe(p *sim.Packet[message]) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.seen++
+	m := p.Msg
+	if m.kind != "accepted" {
+		return
+	}
+
+	if o.votes[m.ballot] == nil {
+		o.votes[m.ballot] = make(map[int]bool)
+	}
+	o.votes[m.ballot][m.from] = true
+
+	if !o.learned && len(o.votes[m.ballot]) >= o.participants/2+1 {
+		o.learned = true
+		o.learnedValue = m.value
+		o.l.Printf("Observer %d learns value %d (ballot %d)", o.id, m.value, m.ballot)
+	}
+}
+
+func proposalString(ballot, value int) string {
+	if ballot == -1 {
+		return "none"
+	}
+	return fmt.Sprintf("%d in ballot %d", value, ballot)
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func main() {
+	attempts := flag.Int("attempts", 10, "a rejected proposer tries again at most this many times in total")
+	observerCount := flag.Int("observers", 0, "non-voting observers that learn from the traffic without sending")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		return sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+	})
+	network.OnDrop = func(p *sim.Packet[message], reason string) {
+		l.Printf("%s %d from node %d to node %d dropped (%s)", p.Msg.kind, p.Msg.ballot, p.From, p.To, reason)
+	}
+
+	sender := func(from, to int, m message) {
+		network.Send(from, to, m, sim.Latency(m.lmin, m.lmax))
+	}
+
+	observers := make([]*observer, *observerCount)
+	for i := range observers {
+		observers[i] = newObserver(i, nodeCount, l)
+		network.Tap(observers[i].observe)
+	}
+
+	pool := newNodePool(nodeCount, sender)
+	pool.attempts = *attempts
+	for i := 0; i < nodeCount; i++ {
+		clockSpeed := int(500 + sim.Random(500))
+
+		nodes[i] = newNode(pool, i, clockSpeed, l)
+		nodes[i].Run()
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, propose, duel, inflight, deliver, drop, drain, oracle, stats, partition, heal, logs, toggle, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				n := nodes[i]
+
+				promised := "none"
+				if n.promised != -1 {
+					promised = fmt.Sprintf("%d", n.promised)
+				}
+				learned := "nothing"
+				if n.learned {
+					learned = fmt.Sprintf("%d", n.learnedValue)
+				}
+
+				fmt.Printf("Node %d: promised %s, accepted %s, learned %s", n.ID(), promised, proposalString(n.accepted, n.acceptedValue), learned)
+				if n.ballot != -1 {
+					fmt.Printf(", proposing %d in ballot %d (%s, attempt %d)", n.value, n.ballot, n.phase, n.attempt)
+				}
+				fmt.Println()
+
+				nodes[i].mu.Unlock()
+			}
+
+			for _, o := range observers {
+				o.mu.Lock()
+				learned := "nothing"
+				if o.learned {
+					learned = fmt.Sprintf("%d", o.learnedValue)
+				}
+				fmt.Printf("Observer %d: seen %d message(s), learned %s\n", o.id, o.seen, learned)
+				o.mu.Unlock()
+			}
+		} else if cmd == "propose" {
+			var proposer, value int
+			var lmin, lmax int
+
+			con.Scan("Proposer: ", &proposer)
+			con.Scan("Value: ", &value)
+			con.Scan("Min latency (ms): ", &lmin)
+			con.Scan("Max latency (ms): ", &lmax)
+
+			nodes[proposer].propose(value, lmin, lmax)
+		} else if cmd == "duel" {
+			// two proposers at once, each preempting the other until one gets through
+			var first, second int
+			var lmin, lmax int
+
+			con.Scan("First proposer: ", &first)
+			con.Scan("Second proposer: ", &second)
+			con.Scan("Min latency (ms): ", &lmin)
+			con.Scan("Max latency (ms): ", &lmax)
+
+			if first == second {
+				fmt.Println("Proposers must differ")
+				continue
+			}
+
+			nodes[first].propose(100+first, lmin, lmax)
+			nodes[second].propose(100+second, lmin, lmax)
+			fmt.Printf("Node %d proposes %d, node %d proposes %d\n", first, 100+first, second, 100+second)
+		} else if cmd == "inflight" {
+			packets := network.InFlight()
+			if len(packets) == 0 {
+				fmt.Println("No messages in flight")
+			}
+			for _, p := range packets {
+				fmt.Printf("#%d: node %d -> node %d, %s %d", p.ID, p.From, p.To, p.Msg.kind, p.Msg.ballot)
+				if p.Msg.kind == "accept" || p.Msg.kind == "accepted" {
+					fmt.Printf(" (value %d)", p.Msg.value)
+				}
+				fmt.Printf(", due in %v\n", time.Until(p.Due).Round(time.Millisecond))
+			}
+		} else if cmd == "deliver" || cmd == "drop" {
+			var id int
+
+			con.Scan("Message ID: ", &id)
+
+			if !network.Signal(id, cmd) {
+				fmt.Println("No such message in flight")
+			}
+		} else if cmd == "drain" {
+			// deliver everything in flight now instead of waiting for it
+			fmt.Printf("Delivered %d message(s) early\n", network.Drain())
+		} else if cmd == "oracle" {
+			// agreement: every learner that learned something learned the same value
+			values := make(map[int][]string)
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				if nodes[i].learned {
+					values[nodes[i].learnedValue] = append(values[nodes[i].learnedValue], fmt.Sprintf("node %d", nodes[i].ID()))
+				}
+				nodes[i].mu.Unlock()
+			}
+			for _, o := range observers {
+				o.mu.Lock()
+				if o.learned {
+					values[o.learnedValue] = append(values[o.learnedValue], fmt.Sprintf("observer %d", o.id))
+				}
+				o.mu.Unlock()
+			}
+
+			if len(values) == 0 {
+				fmt.Println("Nothing learned yet")
+			} else if len(values) == 1 {
+				for v, learners := range values {
+					fmt.Printf("Agreement holds: value %d learned by %s\n", v, strings.Join(learners, ", "))
+				}
+			} else {
+				fmt.Println("Agreement VIOLATED:")
+				for v, learners := range values {
+					fmt.Printf("  value %d learned by %s\n", v, strings.Join(learners, ", "))
+				}
+			}
+		} else if cmd == "stats" {
+			ballots := 0
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				ballots += nodes[i].attempt
+				nodes[i].mu.Unlock()
+			}
+			fmt.Printf("Ballots started: %d, network messages: %d (%d dropped)\n", ballots, network.Stats.Messages.Load(), network.Stats.Dropped.Load())
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "toggle" {
+			var mechanism string
+			con.Scan("Mechanism (backoff, adopt): ", &mechanism)
+
+			if mechanism == "backoff" {
+				skip := !pool.skipBackoff.Load()
+				pool.skipBackoff.Store(skip)
+				fmt.Printf("Randomized retry backoff: %s\n", enabledString(!skip))
+			} else if mechanism == "adopt" {
+				skip := !pool.skipAdopt.Load()
+				pool.skipAdopt.Store(skip)
+				fmt.Printf("Adopting previously accepted values: %s\n", enabledString(!skip))
+			} else {
+				fmt.Println("Unknown mechanism")
+			}
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,71 @@
+package sim
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Breakpoint pauses a network just before a matching packet is delivered.
+type Breakpoint struct {
+	ID int
+	Event string // only "deliver" for now
+	Node int // receiving node, -1 matches any
+	Sender int // sending node, -1 matches any
+}
+
+// ParseBreakpoint reads "on deliver node=3 sender=1", the "on" and both
+// filters are optional.
+func ParseBreakpoint(s string) (Breakpoint, error) {
+	b := Breakpoint{Node: -1, Sender: -1}
+
+	fields := strings.Fields(s)
+	if len(fields) > 0 && fields[0] == "on" {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return b, fmt.Errorf("missing event: %s", s)
+	}
+
+	b.Event = fields[0]
+	if b.Event != "deliver" {
+		return b, fmt.Errorf("unknown event: %s", b.Event)
+	}
+
+	for _, filter := range fields[1:] {
+		key, value, found := strings.Cut(filter, "=")
+		if !found {
+			return b, fmt.Errorf("invalid filter: %s", filter)
+		}
+
+		id, err := strconv.Atoi(value)
+		if err != nil || id < 0 {
+			return b, fmt.Errorf("invalid node in filter: %s", filter)
+		}
+
+		if key == "node" {
+			b.Node = id
+		} else if key == "sender" {
+			b.Sender = id
+		} else {
+			return b, fmt.Errorf("unknown filter: %s", key)
+		}
+	}
+
+	return b, nil
+}
+
+func (b Breakpoint) String() string {
+	s := fmt.Sprintf("#%d: on %s", b.ID, b.Event)
+	if b.Node != -1 {
+		s += fmt.Sprintf(" node=%d", b.Node)
+	}
+	if b.Sender != -1 {
+		s += fmt.Sprintf(" sender=%d", b.Sender)
+	}
+	return s
+}
+
+func (b Breakpoint) matches(from, to int) bool {
+	return (b.Node == -1 || b.Node == to) && (b.Sender == -1 || b.Sender == from)
+}
@@ -0,0 +1,167 @@
+package sim
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Clock is a logical clock owned by a single node.
+type Clock interface {
+	Now() int64
+	Tick() int64 // local event, returns the new time
+	Witness(t int64) int64 // receive of an event stamped t, returns the new time
+}
+
+// LamportClock moves past any timestamp it witnesses.
+type LamportClock struct {
+	t int64
+	mu sync.Mutex
+}
+
+func NewLamportClock() *LamportClock {
+	c := new(LamportClock)
+	c.t = 0
+	return c
+}
+
+func (c *LamportClock) Now() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *LamportClock) Tick() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t++
+	return c.t
+}
+
+func (c *LamportClock) Witness(t int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t > c.t {
+		c.t = t
+	}
+	c.t++
+	return c.t
+}
+
+// PhysicalClock is a node's wall clock: off from real time by an offset and
+// running at its own rate, like an unsynchronized quartz clock.
+type PhysicalClock struct {
+	base time.Time // reading at ref
+	ref time.Time // real time of the last adjustment
+	rate float64 // speed relative to real time
+	mu sync.Mutex
+}
+
+func NewPhysicalClock(offset time.Duration, rate float64) *PhysicalClock {
+	c := new(PhysicalClock)
+	c.ref = time.Now()
+	c.base = c.ref.Add(offset)
+	c.rate = rate
+	return c
+}
+
+func (c *PhysicalClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.base.Add(time.Duration(float64(time.Since(c.ref)) * c.rate))
+}
+
+// Skew is how far the clock is ahead of real time right now, negative if behind.
+func (c *PhysicalClock) Skew() time.Duration {
+	return time.Until(c.Now())
+}
+
+// Adjust sets the clock forward by d, or back if d is negative. The rate
+// is kept, so the clock drifts off again.
+func (c *PhysicalClock) Adjust(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.base = c.base.Add(time.Duration(float64(now.Sub(c.ref))*c.rate) + d)
+	c.ref = now
+}
+
+func (c *PhysicalClock) Rate() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rate
+}
+
+// ClockEvent is one step of a node's logical clock.
+type ClockEvent struct {
+	Node int
+	Kind string // tick, send or receive
+	Before, After int64
+	Msg int // message ID for send and receive, -1 for ticks
+	Sent int64 // timestamp the message carried, for receive
+}
+
+// ClockTrace records clock events as they happen so a run can be checked for
+// happens-before violations afterwards. A node must record each event in the
+// same critical section as the clock update it describes.
+type ClockTrace struct {
+	events []ClockEvent
+	mu sync.Mutex
+}
+
+func NewClockTrace() *ClockTrace {
+	t := new(ClockTrace)
+	t.events = nil
+	return t
+}
+
+func (t *ClockTrace) Record(e ClockEvent) {
+	t.mu.Lock()
+	t.events = append(t.events, e)
+	t.mu.Unlock()
+}
+
+func (t *ClockTrace) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.events)
+}
+
+// Check validates every recorded event: clocks never go back on any node
+// (freezes included), ticks move them forward, and every receive is stamped
+// after the send it matches.
+func (t *ClockTrace) Check() []string {
+	t.mu.Lock()
+	events := append([]ClockEvent{}, t.events...)
+	t.mu.Unlock()
+
+	violations := []string{}
+	last := make(map[int]int64)
+	sends := make(map[int]int64)
+
+	for _, e := range events {
+		if prev, ok := last[e.Node]; ok && e.Before < prev {
+			violations = append(violations, fmt.Sprintf("node %d went back from #%d to #%d before a %s", e.Node, prev, e.Before, e.Kind))
+		}
+		if e.After < e.Before || (e.Kind == "tick" && e.After == e.Before) {
+			violations = append(violations, fmt.Sprintf("node %d %s moved its clock from #%d to #%d", e.Node, e.Kind, e.Before, e.After))
+		}
+		last[e.Node] = e.After
+
+		if e.Kind == "send" {
+			sends[e.Msg] = e.After
+		} else if e.Kind == "receive" {
+			sent, ok := sends[e.Msg]
+			if !ok {
+				violations = append(violations, fmt.Sprintf("node %d received message %d that was never sent", e.Node, e.Msg))
+			} else if sent != e.Sent {
+				violations = append(violations, fmt.Sprintf("message %d was sent at #%d but arrived stamped #%d", e.Msg, sent, e.Sent))
+			}
+			if e.After <= e.Sent {
+				violations = append(violations, fmt.Sprintf("node %d received message %d at #%d, not after its send at #%d", e.Node, e.Msg, e.After, e.Sent))
+			}
+		}
+	}
+	return violations
+}
@@ -0,0 +1,267 @@
+package sim
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// first line of a world file
+const worldHeader = "# ds-sim world"
+
+// Console reads commands and their arguments, either typed at the terminal or
+// from a script. Arguments may be given at their own prompts or on the same
+// line as the command, e.g. "broadcast 0 hello 10 50 -". In scripts, blank
+// lines and lines starting with # are skipped.
+type Console struct {
+	r *bufio.Reader
+	tokens []string // rest of the current line
+	echo bool // print what was read, so a scripted run reads like a session
+	closed bool
+
+	// world lines to replay before reading r, replaying is set while one is read
+	replay []string
+	replaying bool
+
+	// every line read so far, for exporting the world
+	transcript []string
+
+	// results of background work, shown before the next prompt
+	notices []string
+	noticesMu sync.Mutex
+}
+
+func NewConsole(r io.Reader, echo bool) *Console {
+	c := new(Console)
+	c.r = bufio.NewReader(r)
+	c.tokens = nil
+	c.echo = echo
+	c.closed = false
+	return c
+}
+
+// OpenConsole reads from the script file, or from standard input if script is
+// empty. Input is echoed unless it comes from a terminal. A world file (see
+// ExportWorld) is replayed with its seed and then standard input takes over.
+func OpenConsole(script string) (*Console, error) {
+	if script == "" {
+		info, err := os.Stdin.Stat()
+		terminal := err == nil && info.Mode()&os.ModeCharDevice != 0
+		return NewConsole(os.Stdin, !terminal), nil
+	}
+
+	f, err := os.Open(script)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	if header, _ := r.Peek(len(worldHeader)); string(header) != worldHeader {
+		return NewConsole(r, true), nil
+	}
+
+	data, err := io.ReadAll(r)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var replay []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, found := strings.CutPrefix(line, "# seed "); found {
+			seed, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid seed in world: %s", value)
+			}
+			if seed != 0 {
+				Seed(seed)
+			}
+			continue
+		}
+		replay = append(replay, line)
+	}
+
+	c, _ := OpenConsole("")
+	c.replay = replay
+	return c, nil
+}
+
+// ExportWorld writes the seed and every line read so far to a file. Topology,
+// faults and the scenario are all commands, so running the file with -script
+// rebuilds the same environment (timing aside, apart from sleeps) before
+// handing over to standard input.
+func (c *Console) ExportWorld(file string) error {
+	seed, seeded := Seeded()
+	if !seeded {
+		fmt.Println("Not seeded (see -seed), random choices will differ when the world is replayed")
+	}
+
+	var b strings.Builder
+	fmt.Fprintln(&b, worldHeader)
+	fmt.Fprintf(&b, "# seed %d\n", seed)
+	for _, line := range c.transcript {
+		fmt.Fprintln(&b, line)
+	}
+	return os.WriteFile(file, []byte(b.String()), 0644)
+}
+
+// "world export <file>" works at any prompt of any simulation
+func (c *Console) world(fields []string) {
+	if len(fields) != 3 || fields[1] != "export" {
+		fmt.Println("Usage: world export <file>")
+		return
+	}
+
+	if err := c.ExportWorld(fields[2]); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("World exported to %s\n", fields[2])
+}
+
+// "sleep <duration>" works at any prompt of any simulation, so a script can
+// give the nodes time to make progress before its next command
+func (c *Console) sleep(fields []string) {
+	if len(fields) != 2 {
+		fmt.Println("Usage: sleep <duration>, e.g. sleep 500ms")
+		return
+	}
+
+	d, err := time.ParseDuration(fields[1])
+	if err != nil || d < 0 {
+		fmt.Println("Usage: sleep <duration>, e.g. sleep 500ms")
+		return
+	}
+	time.Sleep(d)
+}
+
+// Notify queues a one-line message to print before the next prompt, so
+// background events do not break into what the user is typing.
+func (c *Console) Notify(format string, v ...any) {
+	c.noticesMu.Lock()
+	c.notices = append(c.notices, fmt.Sprintf(format, v...))
+	c.noticesMu.Unlock()
+}
+
+// Closed reports whether the input has run out.
+func (c *Console) Closed() bool {
+	return c.closed
+}
+
+func (c *Console) readLine() (string, bool) {
+	if len(c.replay) > 0 {
+		line := c.replay[0]
+		c.replay = c.replay[1:]
+		c.replaying = true
+		return line, true
+	}
+	c.replaying = false
+
+	if c.closed {
+		return "", false
+	}
+
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.closed = true
+	}
+	return line, true
+}
+
+// prompt is printed again after a world or sleep command
+func (c *Console) next(prompt string) (string, bool) {
+	for len(c.tokens) == 0 {
+		line, ok := c.readLine()
+		if !ok {
+			return "", false
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if fields[0] == "world" || fields[0] == "sleep" {
+			if c.echoing() {
+				fmt.Println(line)
+			}
+			if fields[0] == "world" {
+				c.world(fields)
+			} else {
+				// kept in the world, so a replay waits too
+				c.transcript = append(c.transcript, line)
+				c.sleep(fields)
+			}
+			fmt.Print(prompt)
+			continue
+		}
+
+		c.transcript = append(c.transcript, line)
+		c.tokens = fields
+	}
+
+	token := c.tokens[0]
+	c.tokens = c.tokens[1:]
+	return token, true
+}
+
+// ScanLine prints the prompt and reads the rest of the current line, or the
+// next line if nothing is left, into s.
+func (c *Console) ScanLine(prompt string, s *string) {
+	c.printNotices()
+	fmt.Print(prompt)
+
+	if len(c.tokens) == 0 {
+		if token, ok := c.next(prompt); ok {
+			c.tokens = append([]string{token}, c.tokens...)
+		}
+	}
+	*s = strings.Join(c.tokens, " ")
+	c.tokens = nil
+
+	if c.echoing() {
+		fmt.Println(*s)
+	}
+}
+
+// replayed world lines are always shown
+func (c *Console) echoing() bool {
+	return c.echo || c.replaying
+}
+
+func (c *Console) printNotices() {
+	c.noticesMu.Lock()
+	for _, notice := range c.notices {
+		fmt.Println(notice)
+	}
+	c.notices = nil
+	c.noticesMu.Unlock()
+}
+
+// Scan prints the prompt and reads the next word into v (*string, *int,
+// *int64 or *float64). Once the input runs out every string reads "exit", so
+// a script without one still shuts the simulation down cleanly.
+func (c *Console) Scan(prompt string, v any) {
+	c.printNotices()
+	fmt.Print(prompt)
+
+	token, ok := c.next(prompt)
+	if !ok {
+		token = "exit"
+	}
+	if c.echoing() {
+		fmt.Println(token)
+	}
+
+	if s, isString := v.(*string); isString {
+		*s = token
+	} else {
+		fmt.Sscan(token, v)
+	}
+}
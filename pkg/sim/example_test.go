@@ -0,0 +1,541 @@
+package sim_test
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+// Three nodes exchanging Lamport timestamps. The network is paused and every
+// message is stepped through by hand, soonest due first, so the run is the
+// same every time.
+func Example_lamportClocks() {
+	type stamped struct {
+		from int
+		t int64
+	}
+
+	clocks := []*sim.LamportClock{sim.NewLamportClock(), sim.NewLamportClock(), sim.NewLamportClock()}
+	handled := make(chan struct{})
+	network := sim.NewMesh(3, sim.NewLog(), func(to int, m stamped) bool {
+		t := clocks[to].Witness(m.t)
+		fmt.Printf("Node %d receives #%d from node %d, clock now %d\n", to, m.t, m.from, t)
+		handled <- struct{}{}
+		return true
+	})
+	defer network.Close()
+	network.Pause()
+
+	send := func(from, to int, latency time.Duration) {
+		network.Send(from, to, stamped{from: from, t: clocks[from].Tick()}, latency)
+	}
+	step := func() {
+		for {
+			if _, ok := network.Step(); !ok {
+				return
+			}
+			<-handled
+		}
+	}
+
+	// node 2 has been busy, so its message overtakes node 0's in time and in clock
+	clocks[2].Tick()
+	clocks[2].Tick()
+	send(0, 1, 30*time.Millisecond)
+	send(2, 1, 10*time.Millisecond)
+	step()
+
+	send(1, 0, 10*time.Millisecond)
+	step()
+
+	for i, c := range clocks {
+		fmt.Printf("Node %d: %d\n", i, c.Now())
+	}
+	// Output:
+	// Node 1 receives #3 from node 2, clock now 4
+	// Node 1 receives #1 from node 0, clock now 5
+	// Node 0 receives #6 from node 1, clock now 7
+	// Node 0: 7
+	// Node 1: 6
+	// Node 2: 3
+}
+
+// Chang-Roberts on a ring of three: node 0 starts, every node passes on the
+// higher of the candidate and its own ID, and the ID that comes back to its
+// owner wins.
+func Example_ringElection() {
+	type election struct {
+		candidate int
+		elected bool
+	}
+
+	const size = 3
+	var network *sim.Mesh[election]
+	participant := make([]bool, size)
+	handled := make(chan struct{})
+	network = sim.NewMesh(size, sim.NewLog(), func(to int, m election) bool {
+		next := (to + 1) % size
+		if m.elected {
+			fmt.Printf("Node %d learns node %d leads\n", to, m.candidate)
+			if m.candidate != next {
+				network.Send(to, next, m, time.Millisecond)
+			}
+		} else if m.candidate == to {
+			fmt.Printf("Node %d is elected\n", to)
+			network.Send(to, next, election{candidate: to, elected: true}, time.Millisecond)
+		} else if m.candidate > to || !participant[to] {
+			participant[to] = true
+			candidate := max(m.candidate, to)
+			fmt.Printf("Node %d passes on %d\n", to, candidate)
+			network.Send(to, next, election{candidate: candidate}, time.Millisecond)
+		}
+		handled <- struct{}{}
+		return true
+	})
+	defer network.Close()
+	network.Pause()
+
+	participant[0] = true
+	network.Send(0, 1, election{candidate: 0}, time.Millisecond)
+	for {
+		if _, ok := network.Step(); !ok {
+			break
+		}
+		<-handled
+	}
+	fmt.Printf("Messages: %d\n", network.Stats.Messages.Load())
+	// Output:
+	// Node 1 passes on 1
+	// Node 2 passes on 2
+	// Node 0 passes on 2
+	// Node 1 passes on 2
+	// Node 2 is elected
+	// Node 0 learns node 2 leads
+	// Node 1 learns node 2 leads
+	// Messages: 7
+}
+
+// FIFO broadcast: node 0 sends a then b, b overtakes a on the way to node 2,
+// and node 2 holds it back until a is delivered.
+func Example_fifoBroadcast() {
+	type numbered struct {
+		from, seq int
+		data string
+	}
+
+	const size = 3
+	next := make([][]int, size) // sequence number each node delivers next, per sender
+	held := make([]map[int]numbered, size)
+	for i := range next {
+		next[i] = make([]int, size)
+		held[i] = make(map[int]numbered)
+	}
+
+	handled := make(chan struct{})
+	network := sim.NewMesh(size, sim.NewLog(), func(to int, m numbered) bool {
+		fmt.Printf("Node %d receives #%d from node %d\n", to, m.seq, m.from)
+		held[to][m.seq] = m
+		for {
+			m, ok := held[to][next[to][m.from]]
+			if !ok {
+				break
+			}
+			delete(held[to], m.seq)
+			next[to][m.from]++
+			fmt.Printf("Node %d delivers %s\n", to, m.data)
+		}
+		handled <- struct{}{}
+		return true
+	})
+	defer network.Close()
+	network.Pause()
+
+	seq := 0
+	broadcast := func(from int, data string, latency map[int]time.Duration) {
+		for to, d := range latency {
+			network.Send(from, to, numbered{from: from, seq: seq, data: data}, d)
+		}
+		seq++
+	}
+
+	broadcast(0, "a", map[int]time.Duration{1: 10 * time.Millisecond, 2: 40 * time.Millisecond})
+	broadcast(0, "b", map[int]time.Duration{1: 20 * time.Millisecond, 2: 30 * time.Millisecond})
+	for {
+		if _, ok := network.Step(); !ok {
+			break
+		}
+		<-handled
+	}
+	// Output:
+	// Node 1 receives #0 from node 0
+	// Node 1 delivers a
+	// Node 1 receives #1 from node 0
+	// Node 1 delivers b
+	// Node 2 receives #1 from node 0
+	// Node 2 receives #0 from node 0
+	// Node 2 delivers a
+	// Node 2 delivers b
+}
+
+// Causal broadcast with vector clocks: node 1 answers node 0's question, the
+// answer reaches node 2 first and waits there for the question.
+func Example_causalBroadcast() {
+	type stamped struct {
+		from int
+		vc [3]int
+		data string
+	}
+
+	const size = 3
+	var network *sim.Mesh[stamped]
+	clocks := make([][3]int, size)
+	held := make([][]stamped, size)
+	handled := make(chan struct{})
+
+	broadcast := func(from int, data string, latency map[int]time.Duration) {
+		clocks[from][from]++
+		for to, d := range latency {
+			network.Send(from, to, stamped{from: from, vc: clocks[from], data: data}, d)
+		}
+	}
+	deliverable := func(to int, m stamped) bool {
+		for k := range m.vc {
+			if k == m.from && m.vc[k] != clocks[to][k]+1 || k != m.from && m.vc[k] > clocks[to][k] {
+				return false
+			}
+		}
+		return true
+	}
+
+	network = sim.NewMesh(size, sim.NewLog(), func(to int, m stamped) bool {
+		if !deliverable(to, m) {
+			fmt.Printf("Node %d holds %s from node %d %v\n", to, m.data, m.from, m.vc)
+			held[to] = append(held[to], m)
+		} else {
+			queue := []stamped{m}
+			for len(queue) > 0 {
+				m := queue[0]
+				queue = queue[1:]
+				clocks[to][m.from]++
+				fmt.Printf("Node %d delivers %s from node %d\n", to, m.data, m.from)
+				if to == 1 && m.data == "question" {
+					broadcast(1, "answer", map[int]time.Duration{0: 10 * time.Millisecond, 2: 20 * time.Millisecond})
+				}
+
+				// anything held may be deliverable now
+				waiting := held[to][:0]
+				for _, h := range held[to] {
+					if deliverable(to, h) {
+						queue = append(queue, h)
+					} else {
+						waiting = append(waiting, h)
+					}
+				}
+				held[to] = waiting
+			}
+		}
+		handled <- struct{}{}
+		return true
+	})
+	defer network.Close()
+	network.Pause()
+
+	broadcast(0, "question", map[int]time.Duration{1: 10 * time.Millisecond, 2: 50 * time.Millisecond})
+	for {
+		if _, ok := network.Step(); !ok {
+			break
+		}
+		<-handled
+	}
+
+	for i, vc := range clocks {
+		fmt.Printf("Node %d: %v\n", i, vc)
+	}
+	// Output:
+	// Node 1 delivers question from node 0
+	// Node 0 delivers answer from node 1
+	// Node 2 holds answer from node 1 [1 1 0]
+	// Node 2 delivers question from node 0
+	// Node 2 delivers answer from node 1
+	// Node 0: [1 1 0]
+	// Node 1: [1 1 0]
+	// Node 2: [1 1 0]
+}
+
+// Total order broadcast through a sequencer: node 0 numbers every message and
+// the others deliver by number, so both see y before x although they receive
+// the numbered messages in different orders. This is the sequencer variant of
+// throughput-ceiling, not total-order-broadcast's Lamport timestamps.
+func Example_totalOrderBroadcast() {
+	type ordered struct {
+		seq int // 0 until the sequencer numbers it
+		data string
+	}
+
+	const size = 3
+	var network *sim.Mesh[ordered]
+	counter := 0
+	next := []int{1, 1, 1}
+	held := []map[int]string{{}, {}, {}}
+	handled := make(chan struct{})
+
+	// the latency from the sequencer to nodes 1 and 2, for the first and second message
+	latency := [][]time.Duration{{60 * time.Millisecond, 30 * time.Millisecond}, {40 * time.Millisecond, 70 * time.Millisecond}}
+
+	network = sim.NewMesh(size, sim.NewLog(), func(to int, m ordered) bool {
+		if m.seq == 0 {
+			counter++
+			fmt.Printf("Node 0 orders %s as #%d\n", m.data, counter)
+			for i, d := range latency[counter-1] {
+				network.Send(0, i+1, ordered{seq: counter, data: m.data}, d)
+			}
+		} else {
+			if m.seq != next[to] {
+				fmt.Printf("Node %d holds #%d %s\n", to, m.seq, m.data)
+			}
+			held[to][m.seq] = m.data
+			for {
+				data, ok := held[to][next[to]]
+				if !ok {
+					break
+				}
+				delete(held[to], next[to])
+				fmt.Printf("Node %d delivers #%d %s\n", to, next[to], data)
+				next[to]++
+			}
+		}
+		handled <- struct{}{}
+		return true
+	})
+	defer network.Close()
+	network.Pause()
+
+	network.Send(1, 0, ordered{data: "x"}, 20*time.Millisecond)
+	network.Send(2, 0, ordered{data: "y"}, 10*time.Millisecond)
+	for {
+		if _, ok := network.Step(); !ok {
+			break
+		}
+		<-handled
+	}
+	// Output:
+	// Node 0 orders y as #1
+	// Node 0 orders x as #2
+	// Node 2 delivers #1 y
+	// Node 1 holds #2 x
+	// Node 1 delivers #1 y
+	// Node 1 delivers #2 x
+	// Node 2 delivers #2 x
+}
+
+// Ricart-Agrawala: nodes 1 and 2 ask for the critical section with the same
+// Lamport timestamp, the lower ID goes first and node 2 gets its reply once
+// node 1 leaves.
+func Example_mutex() {
+	type request struct {
+		from int
+		t int64
+		reply bool
+	}
+
+	const size = 3
+	var network *sim.Mesh[request]
+	clocks := []*sim.LamportClock{sim.NewLamportClock(), sim.NewLamportClock(), sim.NewLamportClock()}
+	asked := make([]int64, size) // timestamp of the pending request, 0 if none
+	replies := make([]int, size)
+	deferred := make([][]int, size)
+	handled := make(chan struct{})
+
+	reply := func(from, to int, latency time.Duration) {
+		network.Send(from, to, request{from: from, t: clocks[from].Tick(), reply: true}, latency)
+	}
+
+	network = sim.NewMesh(size, sim.NewLog(), func(to int, m request) bool {
+		clocks[to].Witness(m.t)
+		if m.reply {
+			replies[to]++
+			if replies[to] == size-1 {
+				fmt.Printf("Node %d enters the critical section\n", to)
+				asked[to] = 0
+				fmt.Printf("Node %d leaves\n", to)
+				for _, d := range deferred[to] {
+					fmt.Printf("Node %d replies to node %d\n", to, d)
+					reply(to, d, 10*time.Millisecond)
+				}
+				deferred[to] = nil
+			}
+		} else if asked[to] != 0 && (asked[to] < m.t || asked[to] == m.t && to < m.from) {
+			fmt.Printf("Node %d defers node %d\n", to, m.from)
+			deferred[to] = append(deferred[to], m.from)
+		} else {
+			fmt.Printf("Node %d replies to node %d\n", to, m.from)
+			reply(to, m.from, time.Duration(30+20*m.from+10*to)*time.Millisecond)
+		}
+		handled <- struct{}{}
+		return true
+	})
+	defer network.Close()
+	network.Pause()
+
+	ask := func(from int, latency map[int]time.Duration) {
+		asked[from] = clocks[from].Tick()
+		for to, d := range latency {
+			network.Send(from, to, request{from: from, t: asked[from]}, d)
+		}
+	}
+
+	ask(1, map[int]time.Duration{0: 10 * time.Millisecond, 2: 30 * time.Millisecond})
+	ask(2, map[int]time.Duration{0: 20 * time.Millisecond, 1: 40 * time.Millisecond})
+	for {
+		if _, ok := network.Step(); !ok {
+			break
+		}
+		<-handled
+	}
+	// Output:
+	// Node 0 replies to node 1
+	// Node 0 replies to node 2
+	// Node 2 replies to node 1
+	// Node 1 defers node 2
+	// Node 1 enters the critical section
+	// Node 1 leaves
+	// Node 1 replies to node 2
+	// Node 2 enters the critical section
+	// Node 2 leaves
+}
+
+// Push gossip with a fixed seed: every round, each node that knows the rumor
+// tells a peer picked at random, until everyone knows it.
+func Example_gossip() {
+	sim.Seed(3)
+
+	const size = 3
+	knows := []bool{true, false, false}
+	handled := make(chan struct{})
+	network := sim.NewMesh(size, sim.NewLog(), func(to int, from int) bool {
+		if !knows[to] {
+			knows[to] = true
+			fmt.Printf("Node %d learns the rumor from node %d\n", to, from)
+		}
+		handled <- struct{}{}
+		return true
+	})
+	defer network.Close()
+	network.Pause()
+
+	for round := 1; ; round++ {
+		informed := 0
+		for _, k := range knows {
+			if k {
+				informed++
+			}
+		}
+		if informed == size {
+			fmt.Printf("Everyone knows after %d round(s), %d message(s)\n", round-1, network.Stats.Messages.Load())
+			break
+		}
+
+		sent := 0
+		for from, k := range knows {
+			if !k {
+				continue
+			}
+			to := (from + 1 + int(sim.Random(size-1))) % size
+			fmt.Printf("Round %d: node %d tells node %d\n", round, from, to)
+			sent++
+			network.Send(from, to, from, time.Duration(10*sent)*time.Millisecond)
+		}
+		for {
+			if _, ok := network.Step(); !ok {
+				break
+			}
+			<-handled
+		}
+	}
+	// Output:
+	// Round 1: node 0 tells node 2
+	// Node 2 learns the rumor from node 0
+	// Round 2: node 0 tells node 1
+	// Round 2: node 2 tells node 1
+	// Node 1 learns the rumor from node 0
+	// Everyone knows after 2 round(s), 3 message(s)
+}
+
+func ExampleSeed() {
+	draw := func() []int64 {
+		sim.Seed(42)
+		return []int64{sim.Random(100), sim.Random(100), sim.Random(100)}
+	}
+
+	a, b := draw(), draw()
+	fmt.Println(a[0] == b[0] && a[1] == b[1] && a[2] == b[2])
+	// Output:
+	// true
+}
+
+func ExampleReplayKV() {
+	kv := sim.ReplayKV([]string{sim.PutOp("x", "1"), sim.PutOp("y", "2"), sim.PutOp("x", "3")})
+	fmt.Println(kv)
+	fmt.Println(kv.Keys())
+	// Output:
+	// {x=3, y=2}
+	// [x y]
+}
+
+func ExampleInversions() {
+	// a node delivered message 2 before 1, and 4 before 3
+	fmt.Println(sim.Inversions([]int64{2, 1, 4, 3}))
+	// Output:
+	// 2
+}
+
+func ExampleParseTopology() {
+	ring, err := sim.ParseTopology("ring", 5)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	route := ring.Route(0, 2)
+	fmt.Printf("%v%s\n", route, sim.Via(route))
+	fmt.Println(ring.Neighbors(0))
+	// Output:
+	// [0 1 2] via 1
+	// [1 4]
+}
+
+func ExampleParsePing() {
+	from, to, count, err := sim.ParsePing("0 2", 3)
+	fmt.Println(from, to, count, err)
+
+	_, _, _, err = sim.ParsePing("0 5", 3)
+	fmt.Println(err)
+	// Output:
+	// 0 2 4 <nil>
+	// invalid ping: 5
+}
+
+func ExampleWatcher_WriteMetrics() {
+	depths := []int64{0, 2, 5}
+
+	w := sim.NewWatcher(3)
+	w.Probe("buffer", func(node int) int64 {
+		return depths[node]
+	})
+	w.Exemplars("buffer", func(node int) (sim.Exemplar, bool) {
+		return sim.Exemplar{Trace: int64(10 + node), Value: depths[node], Count: depths[node]}, node > 0
+	})
+	w.WriteMetrics(os.Stdout, "demo")
+	// Output:
+	// # TYPE demo_buffer gauge
+	// demo_buffer{node="0"} 0
+	// demo_buffer{node="1"} 2
+	// demo_buffer{node="2"} 5
+	// # TYPE demo_buffer_advances counter
+	// demo_buffer_advances_total{node="0"} 0
+	// demo_buffer_advances_total{node="1"} 2 # {trace_id="11"} 2
+	// demo_buffer_advances_total{node="2"} 5 # {trace_id="12"} 5
+	// # EOF
+}
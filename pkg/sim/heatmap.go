@@ -0,0 +1,98 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+)
+
+// darker is slower, relative to the slowest pair
+var shades = []string{"··", "░░", "▒▒", "▓▓", "██"}
+
+// what a message from one node to another goes through on its route
+type pathState struct {
+	added int // latency added by jams on every hop, in ms
+	keep float64 // chance it survives the lossy links
+	down bool
+	flapping bool
+}
+
+// Heatmap draws every pair of nodes as one cell: the latency jams add along
+// its route, shaded, and whether it is lossy, flapping or cut off (by a cut,
+// a partition, a relay that is down or a missing route).
+func (n *Mesh[M]) Heatmap(w io.Writer) {
+	size := n.Size()
+
+	n.mu.Lock()
+	topology := n.topology
+	paths := make([][]pathState, size)
+	routes := make([][][]int, size)
+	for i := range paths {
+		paths[i] = make([]pathState, size)
+		routes[i] = make([][]int, size)
+		for j := range paths[i] {
+			route := n.route(i, j)
+			routes[i][j] = route
+
+			p := pathState{keep: 1, down: route == nil}
+			for k := 0; k+1 < len(route); k++ {
+				link := n.links[route[k]][route[k+1]]
+				p.added += link.Latency
+				p.keep *= 1 - float64(link.Loss)/100
+				p.down = p.down || link.Down
+				p.flapping = p.flapping || link.Flapping
+			}
+			paths[i][j] = p
+		}
+	}
+	n.mu.Unlock()
+
+	// relays are asked outside the mesh lock, as when a packet is sent
+	slowest := 0
+	for i := range paths {
+		for j := range paths[i] {
+			route := routes[i][j]
+			for k := 1; k+1 < len(route); k++ {
+				if n.Relaying != nil && !n.Relaying(route[k]) {
+					paths[i][j].down = true
+				}
+			}
+			if paths[i][j].added > slowest {
+				slowest = paths[i][j].added
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "from\\to")
+	for j := 0; j < size; j++ {
+		fmt.Fprintf(w, " %2d ", j)
+	}
+	fmt.Fprintln(w)
+
+	for i := range paths {
+		fmt.Fprintf(w, "%7d", i)
+		for j, p := range paths[i] {
+			cell := shades[0]
+			if i == j {
+				cell = "--"
+			} else if p.down && !p.flapping {
+				cell = "XX"
+			} else if p.flapping {
+				cell = "~~"
+			} else if p.added > 0 {
+				cell = shades[(p.added*(len(shades)-1)+slowest-1)/slowest]
+			}
+
+			mark := " "
+			if i != j && !p.down && p.keep < 1 {
+				mark = "%"
+			}
+			fmt.Fprintf(w, " %s%s", cell, mark)
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "Added latency: %s none, %s up to +%dms; %% lossy, ~~ flapping, XX unreachable\n", shades[0], shades[len(shades)-1], slowest)
+	if topology != nil {
+		fmt.Fprintf(w, "Routes follow the %s topology, every hop adds its own latency and jam\n", topology)
+	}
+}
@@ -0,0 +1,140 @@
+package sim
+
+import (
+	"sync"
+	"time"
+)
+
+// History records the real-time (oracle) order in which a node delivered
+// messages, optionally forgetting old deliveries.
+type History struct {
+	order []int64
+	at []time.Time
+	forgotten int // deliveries dropped by retention
+
+	// zero keeps everything
+	retainCount int
+	retainFor time.Duration
+
+	mu sync.Mutex
+}
+
+func NewHistory(retainCount int, retainFor time.Duration) *History {
+	h := new(History)
+	h.order = nil
+	h.at = nil
+	h.forgotten = 0
+	h.retainCount = retainCount
+	h.retainFor = retainFor
+	return h
+}
+
+func (h *History) Record(global int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.order = append(h.order, global)
+	h.at = append(h.at, time.Now())
+
+	// forget the oldest deliveries beyond the retention window
+	drop := 0
+	if h.retainCount > 0 && len(h.order) > h.retainCount {
+		drop = len(h.order) - h.retainCount
+	}
+	if h.retainFor > 0 {
+		for drop < len(h.at) && time.Since(h.at[drop]) > h.retainFor {
+			drop++
+		}
+	}
+	if drop > 0 {
+		h.order = append([]int64{}, h.order[drop:]...)
+		h.at = append([]time.Time{}, h.at[drop:]...)
+		h.forgotten += drop
+	}
+}
+
+// Order returns the retained deliveries, oldest first.
+func (h *History) Order() []int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]int64{}, h.order...)
+}
+
+// Count returns every delivery, including those no longer retained.
+func (h *History) Count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.forgotten + len(h.order)
+}
+
+// Inversions counts pairs delivered in a different order than they were sent.
+func Inversions(order []int64) int {
+	count := 0
+	for i := range order {
+		for j := i + 1; j < len(order); j++ {
+			if order[i] > order[j] {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// Disagreements counts pairs of messages both orders contain but in a
+// different order, zero for two nodes that agree on a total order.
+func Disagreements(a, b []int64) int {
+	position := make(map[int64]int, len(b))
+	for i, id := range b {
+		position[id] = i
+	}
+
+	common := []int{}
+	for _, id := range a {
+		if i, ok := position[id]; ok {
+			common = append(common, i)
+		}
+	}
+
+	count := 0
+	for i := range common {
+		for j := i + 1; j < len(common); j++ {
+			if common[i] > common[j] {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// Backlog keeps the most recent messages, e.g. to replay them to a node that
+// missed them.
+type Backlog[M any] struct {
+	messages []M
+	limit int // zero keeps everything
+
+	mu sync.Mutex
+}
+
+func NewBacklog[M any](limit int) *Backlog[M] {
+	b := new(Backlog[M])
+	b.messages = nil
+	b.limit = limit
+	return b
+}
+
+func (b *Backlog[M]) Add(m M) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.messages = append(b.messages, m)
+	if b.limit > 0 && len(b.messages) > b.limit {
+		b.messages = append([]M{}, b.messages[len(b.messages)-b.limit:]...)
+	}
+}
+
+// All returns the kept messages, oldest first.
+func (b *Backlog[M]) All() []M {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]M{}, b.messages...)
+}
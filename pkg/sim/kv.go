@@ -0,0 +1,147 @@
+package sim
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// KV is the key-value store the replication simulations use as their state
+// machine, so put and get mean the same thing whichever protocol replicates
+// the writes.
+type KV struct {
+	data map[string]string
+	mu sync.Mutex
+}
+
+func NewKV() *KV {
+	kv := new(KV)
+	kv.data = make(map[string]string)
+	return kv
+}
+
+// ReplayKV builds a store from operations in the order they were executed.
+func ReplayKV(ops []string) *KV {
+	kv := NewKV()
+	for _, op := range ops {
+		kv.Apply(op)
+	}
+	return kv
+}
+
+// PutOp encodes a write as a single operation for a replicated log.
+func PutOp(key, value string) string {
+	return "put " + key + " " + value
+}
+
+// Apply executes an operation made by PutOp, anything else is ignored and
+// reported as false.
+func (kv *KV) Apply(op string) bool {
+	fields := strings.Fields(op)
+	if len(fields) != 3 || fields[0] != "put" {
+		return false
+	}
+
+	kv.Put(fields[1], fields[2])
+	return true
+}
+
+func (kv *KV) Put(key, value string) {
+	kv.mu.Lock()
+	kv.data[key] = value
+	kv.mu.Unlock()
+}
+
+func (kv *KV) Get(key string) (string, bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	value, ok := kv.data[key]
+	return value, ok
+}
+
+func (kv *KV) Delete(key string) {
+	kv.mu.Lock()
+	delete(kv.data, key)
+	kv.mu.Unlock()
+}
+
+// Keys returns every key, sorted.
+func (kv *KV) Keys() []string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	keys := make([]string, 0, len(kv.data))
+	for key := range kv.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (kv *KV) Clone() *KV {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	clone := NewKV()
+	for key, value := range kv.data {
+		clone.data[key] = value
+	}
+	return clone
+}
+
+// String lists the pairs sorted by key, e.g. "{x=1, y=2}".
+func (kv *KV) String() string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	keys := make([]string, 0, len(kv.data))
+	for key := range kv.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + kv.data[key]
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// Digest is a short hash of the contents, equal stores have equal digests.
+func (kv *KV) Digest() string {
+	h := fnv.New64a()
+	h.Write([]byte(kv.String()))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// ReportDigests prints the digest of every node's store (captured together,
+// as one consistent cut) and a combined digest, and flags nodes that applied
+// the same number of operations but ended up with different states. label
+// names a node, e.g. "Node" or "Replica".
+func ReportDigests(w io.Writer, label string, applied []int, stores []*KV) {
+	combined := fnv.New64a()
+	digests := make([]string, len(stores))
+	for i, kv := range stores {
+		digests[i] = kv.Digest()
+		combined.Write([]byte(digests[i]))
+		fmt.Fprintf(w, "%s %d: %s (%d operation(s) applied)\n", label, i, digests[i], applied[i])
+	}
+	fmt.Fprintf(w, "Combined: %016x\n", combined.Sum64())
+
+	diverged := false
+	for i := range stores {
+		for j := i + 1; j < len(stores); j++ {
+			if applied[i] == applied[j] && digests[i] != digests[j] {
+				fmt.Fprintf(w, "%ss %d and %d DIVERGE after %d operation(s)\n", label, i, j, applied[i])
+				diverged = true
+			}
+		}
+	}
+	if !diverged {
+		fmt.Fprintln(w, "No divergence: nodes that applied as many operations hold the same state")
+	}
+}
@@ -0,0 +1,44 @@
+package sim
+
+import (
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Logger is where nodes report what happens to them.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Log keeps log lines in memory until the user asks for them, so they do not
+// interleave with the REPL.
+type Log struct {
+	*log.Logger
+
+	b strings.Builder
+	mu sync.Mutex
+}
+
+func NewLog() *Log {
+	lg := new(Log)
+	lg.Logger = log.New(lg, " [LOG] ", log.LstdFlags)
+	return lg
+}
+
+func (lg *Log) Write(p []byte) (int, error) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	return lg.b.Write(p)
+}
+
+// Flush writes everything logged so far to w and forgets it.
+func (lg *Log) Flush(w io.Writer) {
+	lg.mu.Lock()
+	s := lg.b.String()
+	lg.b.Reset()
+	lg.mu.Unlock()
+
+	io.WriteString(w, s)
+}
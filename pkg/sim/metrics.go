@@ -0,0 +1,55 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+)
+
+// Exemplar is the message that last moved a probe on a node, and how many
+// times the probe was moved so far.
+type Exemplar struct {
+	Trace int64 // oracle ID of the message
+	Value int64 // what the probe read right after
+	Count int64
+}
+
+// Exemplars registers where to find the message that last moved a probe, ok
+// is false while none has.
+func (w *Watcher) Exemplars(name string, e func(node int) (Exemplar, bool)) {
+	w.mu.Lock()
+	w.exemplars[name] = e
+	w.mu.Unlock()
+}
+
+// WriteMetrics writes every probe as an OpenMetrics gauge, one sample per
+// node. Gauges cannot carry exemplars, so a probe with exemplars also gets a
+// <name>_advances counter with the trace ID of the message that last moved it.
+func (w *Watcher) WriteMetrics(out io.Writer, prefix string) {
+	names := w.Probes()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, name := range names {
+		family := prefix + "_" + name
+		fmt.Fprintf(out, "# TYPE %s gauge\n", family)
+		for node := 0; node < w.nodes; node++ {
+			fmt.Fprintf(out, "%s{node=\"%d\"} %d\n", family, node, w.probes[name](node))
+		}
+
+		exemplar, ok := w.exemplars[name]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(out, "# TYPE %s_advances counter\n", family)
+		for node := 0; node < w.nodes; node++ {
+			e, ok := exemplar(node)
+			if !ok {
+				fmt.Fprintf(out, "%s_advances_total{node=\"%d\"} 0\n", family, node)
+				continue
+			}
+			fmt.Fprintf(out, "%s_advances_total{node=\"%d\"} %d # {trace_id=\"%d\"} %d\n", family, node, e.Count, e.Trace, e.Value)
+		}
+	}
+	fmt.Fprintln(out, "# EOF")
+}
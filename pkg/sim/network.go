@@ -0,0 +1,679 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Network carries messages of type M between nodes.
+type Network[M any] interface {
+	Send(from, to int, m M, latency time.Duration)
+}
+
+// Link is the state of one direction between two nodes.
+type Link struct {
+	Latency int // base latency in ms added by the sender (network jam)
+	Down bool // messages in this direction are dropped
+	Flapping bool
+	Loss int // percentage of messages lost at random
+	Distribution string // latency distribution of this link, "" for the mesh default
+
+	dist Distribution
+
+	stopFlap chan bool // closed to stop flapping
+}
+
+// Reasons a packet is dropped.
+const (
+	DropManual = "dropped by hand"
+	DropLinkDown = "link down"
+	DropLoss = "lost on the link"
+	DropNoRoute = "no route"
+	DropRelayDown = "relay down"
+	DropExpired = "expired"
+)
+
+// Packet is a message currently travelling through the network.
+type Packet[M any] struct {
+	ID int
+	Msg M
+	From, To int
+	Due time.Time
+	Route []int // nodes it is forwarded through, sender and target included
+	Expires time.Time // zero if the message lives until delivered
+
+	control chan string // deliver or drop before the due time
+}
+
+// Traffic is the network cost of a protocol.
+type Traffic struct {
+	Broadcasts atomic.Int64
+	Messages atomic.Int64 // every copy put on the network, including the sender's own
+	Dropped atomic.Int64
+	Relayed atomic.Int64 // hops forwarded by nodes between the sender and the target
+	Expired atomic.Int64 // dropped because their TTL ran out, also counted in Dropped
+}
+
+func (t *Traffic) Report(w io.Writer, participants int, delivered int) {
+	broadcasts := t.Broadcasts.Load()
+	messages := t.Messages.Load()
+
+	fmt.Fprintf(w, "Broadcasts: %d, network messages: %d (%d dropped), deliveries: %d\n", broadcasts, messages, t.Dropped.Load(), delivered)
+	if broadcasts > 0 {
+		fmt.Fprintf(w, "Messages per broadcast: %.2f (n = %d)\n", float64(messages)/float64(broadcasts), participants)
+	}
+	if delivered > 0 {
+		fmt.Fprintf(w, "Messages per delivered message: %.2f\n", float64(messages)/float64(delivered))
+	}
+	if relayed := t.Relayed.Load(); relayed > 0 {
+		fmt.Fprintf(w, "Hops forwarded by relays: %d\n", relayed)
+	}
+	if expired := t.Expired.Load(); expired > 0 {
+		fmt.Fprintf(w, "Expired before delivery: %d\n", expired)
+	}
+}
+
+// Mesh connects every pair of nodes with one-way links that can be jammed,
+// cut or made to flap. Packets in flight can be delivered early or dropped by
+// hand before they are due.
+type Mesh[M any] struct {
+	links [][]Link
+	deliver func(to int, m M) bool // false if the node did not take the message
+	l Logger
+
+	nextID int
+	packets map[int]*Packet[M]
+	mu sync.Mutex
+
+	active atomic.Int64 // packets not yet delivered or dropped
+	closing atomic.Bool
+	resume chan struct{} // not nil while paused, closed on resume
+
+	breakpoints []Breakpoint
+	nextBreakpoint int
+
+	taps []func(p *Packet[M])
+
+	topology *Topology // nil wires every pair directly
+
+	// draws delays for Latency on links without their own distribution,
+	// uniform unless set
+	Latencies Distribution
+
+	// reports whether a node is up to forward packets for others, nil treats
+	// every node as up
+	Relaying func(node int) bool
+
+	// lifetime of a message, a packet still in flight when it runs out is
+	// dropped; nil or 0 lets it live until delivered
+	TTL func(m M) time.Duration
+
+	// called when a packet is lost with one of the Drop reasons
+	OnDrop func(p *Packet[M], reason string)
+
+	// called once every copy of a broadcast has arrived or been lost
+	OnSettled func(r BroadcastResult[M])
+
+	// called when a packet hits a breakpoint, the network is already paused
+	OnBreak func(p *Packet[M], b Breakpoint)
+
+	Stats Traffic
+}
+
+func NewMesh[M any](size int, l Logger, deliver func(to int, m M) bool) *Mesh[M] {
+	n := new(Mesh[M])
+	n.links = make([][]Link, size)
+	for i := range n.links {
+		n.links[i] = make([]Link, size)
+	}
+	n.deliver = deliver
+	n.l = l
+	n.nextID = 0
+	n.packets = make(map[int]*Packet[M])
+	n.Latencies = Latency
+	return n
+}
+
+func (n *Mesh[M]) Size() int {
+	return len(n.links)
+}
+
+func (n *Mesh[M]) Link(from, to int) Link {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.links[from][to]
+}
+
+// SetTopology wires the nodes as a graph instead of a full mesh. A message
+// is forwarded along the shortest path: its latency is paid on every hop and
+// every link on the way must carry it. nil goes back to a full mesh.
+func (n *Mesh[M]) SetTopology(t *Topology) {
+	n.mu.Lock()
+	n.topology = t
+	n.mu.Unlock()
+}
+
+// mesh lock must be held
+func (n *Mesh[M]) route(from, to int) []int {
+	if n.topology != nil {
+		return n.topology.Route(from, to)
+	}
+	if from == to {
+		return []int{from}
+	}
+	return []int{from, to}
+}
+
+// why a packet cannot make it along its route, or "" if it can
+func (n *Mesh[M]) blocked(route []int) string {
+	if route == nil {
+		return DropNoRoute
+	}
+	for i := 0; i+1 < len(route); i++ {
+		if i > 0 && n.Relaying != nil && !n.Relaying(route[i]) {
+			return DropRelayDown
+		}
+
+		link := n.Link(route[i], route[i+1])
+		if link.Down {
+			return DropLinkDown
+		}
+		if link.Loss > 0 && Random(100) < int64(link.Loss) {
+			return DropLoss
+		}
+	}
+	return ""
+}
+
+// Latency draws a delay between lmin and lmax milliseconds (how far beyond
+// depends on the distribution) for a link.
+func (n *Mesh[M]) Latency(from, to, lmin, lmax int) time.Duration {
+	n.mu.Lock()
+	dist := n.links[from][to].dist
+	n.mu.Unlock()
+
+	if dist == nil {
+		dist = n.Latencies
+	}
+	return dist(lmin, lmax)
+}
+
+// Distribute gives a link its own latency distribution, "" goes back to the
+// mesh default.
+func (n *Mesh[M]) Distribute(from, to int, name string) error {
+	var dist Distribution
+	if name != "" {
+		var err error
+		if dist, err = ParseDistribution(name); err != nil {
+			return err
+		}
+	}
+
+	n.mu.Lock()
+	n.links[from][to].Distribution = name
+	n.links[from][to].dist = dist
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *Mesh[M]) Jam(from, to, latency int) {
+	n.mu.Lock()
+	n.links[from][to].Latency = latency
+	n.mu.Unlock()
+}
+
+// Lose makes a link lose the given percentage of messages at random.
+func (n *Mesh[M]) Lose(from, to, percent int) {
+	n.mu.Lock()
+	n.links[from][to].Loss = percent
+	n.mu.Unlock()
+}
+
+// Cut takes a link down or restores it, stopping any flapping.
+func (n *Mesh[M]) Cut(from, to int, down bool) {
+	n.mu.Lock()
+	n.stopFlapping(from, to)
+	n.links[from][to].Down = down
+	n.mu.Unlock()
+}
+
+// Flap breaks and heals a link every period until it is cut or restored.
+func (n *Mesh[M]) Flap(from, to int, period time.Duration) {
+	n.mu.Lock()
+	n.stopFlapping(from, to)
+	stop := make(chan bool)
+	n.links[from][to].Flapping = true
+	n.links[from][to].stopFlap = stop
+	n.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				n.mu.Lock()
+				n.links[from][to].Down = !n.links[from][to].Down
+				down := n.links[from][to].Down
+				n.mu.Unlock()
+				n.l.Printf("Link %d -> %d flaps (down: %v)", from, to, down)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Partition cuts every link between nodes of different groups and restores
+// the links within each group. Nodes left out of every group are cut off
+// from everyone.
+func (n *Mesh[M]) Partition(groups [][]int) {
+	group := make([]int, len(n.links))
+	for i := range group {
+		group[i] = -1
+	}
+	for g := range groups {
+		for _, id := range groups[g] {
+			group[id] = g
+		}
+	}
+
+	for i := range n.links {
+		for j := range n.links[i] {
+			n.Cut(i, j, i != j && (group[i] != group[j] || group[i] < 0))
+		}
+	}
+	n.l.Printf("Network partitioned into %v", groups)
+}
+
+// Heal restores every link, undoing partitions as well as single cuts.
+func (n *Mesh[M]) Heal() {
+	for i := range n.links {
+		for j := range n.links[i] {
+			n.Cut(i, j, false)
+		}
+	}
+	n.l.Printf("Network healed")
+}
+
+// mesh lock must be held
+func (n *Mesh[M]) stopFlapping(from, to int) {
+	if n.links[from][to].stopFlap != nil {
+		close(n.links[from][to].stopFlap)
+		n.links[from][to].stopFlap = nil
+	}
+	n.links[from][to].Flapping = false
+}
+
+// Send puts a copy of m on the link, it arrives after latency unless released
+// or dropped by hand, and is lost if the link is down when it arrives or at
+// random on a lossy link.
+func (n *Mesh[M]) Send(from, to int, m M, latency time.Duration) {
+	n.send(from, to, m, latency, nil)
+}
+
+// arrived, if not nil, learns whether the copy reached its target
+func (n *Mesh[M]) send(from, to int, m M, latency time.Duration, arrived func(to int, ok bool)) {
+	n.Stats.Messages.Add(1)
+
+	n.mu.Lock()
+	route := n.route(from, to)
+	p := &Packet[M]{
+		ID: n.nextID,
+		Msg: m,
+		From: from,
+		To: to,
+		Due: time.Now().Add(n.delay(route, latency)),
+		Route: route,
+		control: make(chan string, 1),
+	}
+	if n.TTL != nil {
+		if ttl := n.TTL(m); ttl > 0 {
+			p.Expires = time.Now().Add(ttl)
+		}
+	}
+	n.packets[p.ID] = p
+	n.nextID++
+	n.mu.Unlock()
+
+	n.active.Add(1)
+	go func() {
+		defer n.active.Add(-1)
+
+		ok := false
+		if !n.wait(p) {
+			if !n.closing.Load() {
+				n.drop(p, DropManual)
+			}
+		} else if reason := n.blocked(p.Route); reason != "" {
+			n.drop(p, reason)
+		} else if !p.Expires.IsZero() && time.Now().After(p.Expires) {
+			// held up too long, by latency, a pause or a breakpoint
+			n.Stats.Expired.Add(1)
+			n.drop(p, DropExpired)
+		} else {
+			ok = n.deliver(to, m)
+			if ok && len(p.Route) > 2 {
+				n.Stats.Relayed.Add(int64(len(p.Route) - 2))
+			}
+		}
+
+		if ok {
+			n.mu.Lock()
+			taps := n.taps
+			n.mu.Unlock()
+
+			for _, tap := range taps {
+				tap(p)
+			}
+		}
+
+		if arrived != nil && !n.closing.Load() {
+			arrived(to, ok)
+		}
+	}()
+}
+
+// how long a packet sent with latency takes along its route (mesh lock must
+// be held)
+func (n *Mesh[M]) delay(route []int, latency time.Duration) time.Duration {
+	if hops := len(route) - 1; hops > 1 {
+		// every relay sends it on, after its own jam
+		latency *= time.Duration(hops)
+		for i := 1; i < hops; i++ {
+			latency += time.Duration(n.links[route[i]][route[i+1]].Latency) * time.Millisecond
+		}
+	}
+	return latency
+}
+
+// release every packet in flight with the given action and wait until none are left
+func (n *Mesh[M]) release(action string) int {
+	released := 0
+	for {
+		packets := n.InFlight()
+		if len(packets) == 0 && n.active.Load() == 0 {
+			return released
+		}
+		for _, p := range packets {
+			if n.Signal(p.ID, action) {
+				released++
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Drain delivers every packet in flight right away (links that are down
+// still lose them) and returns once all have been handed over.
+func (n *Mesh[M]) Drain() int {
+	return n.release("deliver")
+}
+
+// Close discards every packet in flight without counting it as dropped. Stop
+// the receiving nodes first so deliveries in progress give up.
+func (n *Mesh[M]) Close() {
+	n.closing.Store(true)
+	n.release("drop")
+}
+
+// BroadcastResult describes a broadcast once every copy has arrived or been lost.
+type BroadcastResult[M any] struct {
+	Msg M
+	From int
+	Elapsed time.Duration
+	Reached, Lost []int
+}
+
+// Broadcast sends m to every node, including the sender, and reports to
+// OnSettled once every copy has arrived or been lost.
+func (n *Mesh[M]) Broadcast(from int, m M, latency func(to int) time.Duration) {
+	n.Stats.Broadcasts.Add(1)
+
+	start := time.Now()
+	result := BroadcastResult[M]{Msg: m, From: from}
+	var mu sync.Mutex
+	remaining := len(n.links)
+
+	arrived := func(to int, ok bool) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if ok {
+			result.Reached = append(result.Reached, to)
+		} else {
+			result.Lost = append(result.Lost, to)
+		}
+		remaining--
+		if remaining == 0 && n.OnSettled != nil {
+			result.Elapsed = time.Since(start)
+			sort.Ints(result.Reached)
+			sort.Ints(result.Lost)
+			n.OnSettled(result)
+		}
+	}
+
+	for to := range n.links {
+		n.send(from, to, m, latency(to), arrived)
+	}
+}
+
+func (n *Mesh[M]) drop(p *Packet[M], reason string) {
+	n.Stats.Dropped.Add(1)
+	if n.OnDrop != nil {
+		n.OnDrop(p, reason)
+	}
+}
+
+// wait until the packet is due (or manually released), returns false if dropped
+func (n *Mesh[M]) wait(p *Packet[M]) bool {
+	select {
+	case <-time.After(time.Until(p.Due)):
+	case action := <-p.control:
+		return action == "deliver"
+	}
+
+	// stop just before handing the packet over
+	if b, ok := n.breakpoint(p); ok && !n.closing.Load() {
+		n.Pause()
+		if n.OnBreak != nil {
+			n.OnBreak(p, b)
+		}
+	}
+
+	// due, but held for as long as the network is paused
+	for {
+		n.mu.Lock()
+		resume := n.resume
+		n.mu.Unlock()
+
+		if resume == nil {
+			break
+		}
+		select {
+		case <-resume:
+		case action := <-p.control:
+			return action == "deliver"
+		}
+	}
+
+	n.mu.Lock()
+	_, ok := n.packets[p.ID]
+	delete(n.packets, p.ID)
+	n.mu.Unlock()
+
+	if !ok {
+		// released by hand at the same moment
+		return <-p.control == "deliver"
+	}
+	return true
+}
+
+// Pause holds every packet that falls due until Resume, packets can still be
+// delivered or dropped by hand.
+func (n *Mesh[M]) Pause() {
+	n.mu.Lock()
+	if n.resume == nil {
+		n.resume = make(chan struct{})
+	}
+	n.mu.Unlock()
+}
+
+func (n *Mesh[M]) Resume() {
+	n.mu.Lock()
+	if n.resume != nil {
+		close(n.resume)
+		n.resume = nil
+	}
+	n.mu.Unlock()
+}
+
+func (n *Mesh[M]) Paused() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.resume != nil
+}
+
+// Tap calls f with every packet once it is delivered, for observers that
+// follow the protocol without taking part in it.
+func (n *Mesh[M]) Tap(f func(p *Packet[M])) {
+	n.mu.Lock()
+	n.taps = append(n.taps, f)
+	n.mu.Unlock()
+}
+
+// Step pauses the network and delivers the packet due soonest without
+// checking breakpoints, returns false if nothing is in flight.
+func (n *Mesh[M]) Step() (*Packet[M], bool) {
+	n.Pause()
+	for _, p := range n.InFlight() {
+		if n.Signal(p.ID, "deliver") {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// Break adds a breakpoint and returns its ID.
+func (n *Mesh[M]) Break(b Breakpoint) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	b.ID = n.nextBreakpoint
+	n.breakpoints = append(n.breakpoints, b)
+	n.nextBreakpoint++
+	return b.ID
+}
+
+func (n *Mesh[M]) Unbreak(id int) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for i, b := range n.breakpoints {
+		if b.ID == id {
+			n.breakpoints = append(n.breakpoints[:i], n.breakpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Mesh[M]) Breakpoints() []Breakpoint {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]Breakpoint{}, n.breakpoints...)
+}
+
+// first breakpoint matching the packet
+func (n *Mesh[M]) breakpoint(p *Packet[M]) (Breakpoint, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, b := range n.breakpoints {
+		if b.matches(p.From, p.To) {
+			return b, true
+		}
+	}
+	return Breakpoint{}, false
+}
+
+// Signal delivers ("deliver") or drops ("drop") a packet before it is due.
+func (n *Mesh[M]) Signal(id int, action string) bool {
+	n.mu.Lock()
+	p, ok := n.packets[id]
+	delete(n.packets, id)
+	n.mu.Unlock()
+
+	if ok {
+		p.control <- action
+	}
+	return ok
+}
+
+// InFlight lists the packets on the network, soonest due first.
+func (n *Mesh[M]) InFlight() []*Packet[M] {
+	n.mu.Lock()
+	packets := make([]*Packet[M], 0, len(n.packets))
+	for _, p := range n.packets {
+		packets = append(packets, p)
+	}
+	n.mu.Unlock()
+
+	sort.Slice(packets, func(i, j int) bool {
+		return packets[i].Due.Before(packets[j].Due)
+	})
+	return packets
+}
+
+// ParseOverrides reads exact per-destination latencies, e.g. "1=500ms,2=50ms".
+func ParseOverrides(s string) (map[int]time.Duration, error) {
+	overrides := make(map[int]time.Duration)
+	if s == "" || s == "-" {
+		return overrides, nil
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid latency override: %s", entry)
+		}
+
+		target, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid node in latency override: %s", entry)
+		}
+
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid latency in override: %s", entry)
+		}
+
+		overrides[target] = d
+	}
+
+	return overrides, nil
+}
+
+// ParseGroups reads groups of nodes for Partition, e.g. "0,1|2,3".
+func ParseGroups(s string, size int) ([][]int, error) {
+	var groups [][]int
+	for _, group := range strings.Split(s, "|") {
+		var ids []int
+		for _, id := range strings.Split(group, ",") {
+			v, err := strconv.Atoi(id)
+			if err != nil || v < 0 || v >= size {
+				return nil, fmt.Errorf("invalid node: %s", id)
+			}
+			ids = append(ids, v)
+		}
+		groups = append(groups, ids)
+	}
+	return groups, nil
+}
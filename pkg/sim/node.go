@@ -0,0 +1,159 @@
+package sim
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Node is one simulated process.
+type Node interface {
+	ID() int
+	Run()
+	Stop()
+}
+
+// Pool tracks running nodes so a simulation can wait for a clean shutdown.
+type Pool struct {
+	alive sync.WaitGroup
+}
+
+func NewPool() *Pool {
+	return new(Pool)
+}
+
+// Go runs f in its own goroutine, counted by Wait like a node. It is for work
+// that outlives the command that started it, such as a message in flight.
+func (p *Pool) Go(f func()) {
+	p.alive.Add(1)
+
+	go func() {
+		defer p.alive.Done()
+		f()
+	}()
+}
+
+// Wait blocks until every node started in the pool has stopped.
+func (p *Pool) Wait() {
+	p.alive.Wait()
+}
+
+// Process is the part every node shares: an identity, a local clock loop
+// running at its own speed, freezing and shutdown. Nodes embed it and add
+// their protocol on top.
+type Process struct {
+	pool *Pool
+	id int
+	clockSpeed int
+	l Logger
+
+	running atomic.Bool
+	freezing atomic.Bool
+	done chan struct{} // closed by Stop
+	stopOnce *sync.Once
+}
+
+func NewProcess(pool *Pool, id, clockSpeed int, l Logger) *Process {
+	p := new(Process)
+	p.pool = pool
+	p.id = id
+	p.clockSpeed = clockSpeed
+	p.l = l
+	p.running.Store(false)
+	p.freezing.Store(false)
+	p.done = make(chan struct{})
+	p.stopOnce = new(sync.Once)
+	return p
+}
+
+func (p *Process) ID() int {
+	return p.id
+}
+
+func (p *Process) ClockSpeed() int {
+	return p.clockSpeed
+}
+
+func (p *Process) Printf(format string, v ...any) {
+	p.l.Printf(format, v...)
+}
+
+func (p *Process) Running() bool {
+	return p.running.Load()
+}
+
+// Done is closed once the process is stopped.
+func (p *Process) Done() <-chan struct{} {
+	return p.done
+}
+
+// Start runs tick every clock period until Stop, tick may be nil.
+func (p *Process) Start(tick func()) {
+	p.running.Store(true)
+	p.pool.alive.Add(1)
+
+	go func() {
+		defer p.pool.alive.Done()
+
+		p.l.Printf("Node %d started at %dms clock speed", p.id, p.clockSpeed)
+
+		clock := time.NewTicker(time.Duration(p.clockSpeed) * time.Millisecond)
+		defer clock.Stop()
+
+		for {
+			select {
+			case <-clock.C:
+				if !p.freezing.Load() && tick != nil {
+					tick()
+				}
+			case <-p.done:
+				p.l.Printf("Node %d stopping", p.id)
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the clock loop and every Listen loop of the process.
+func (p *Process) Stop() {
+	p.stopOnce.Do(func() {
+		p.running.Store(false)
+		close(p.done)
+	})
+}
+
+// Freeze stops the clock loop for d, it blocks until the node thaws.
+func (p *Process) Freeze(d time.Duration) {
+	p.freezing.Store(true)
+	time.Sleep(d)
+	p.freezing.Store(false)
+}
+
+// Listen hands every message from inbox to receive until the process stops.
+func Listen[M any](p *Process, inbox <-chan M, receive func(m M)) {
+	p.pool.alive.Add(1)
+
+	go func() {
+		defer p.pool.alive.Done()
+
+		for {
+			select {
+			case m := <-inbox:
+				receive(m)
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+// Deliver puts m in the inbox of p, it gives up and returns false if p stops
+// first instead of blocking forever.
+func Deliver[M any](p *Process, inbox chan<- M, m M) bool {
+	select {
+	case inbox <- m:
+		return true
+	case <-p.done:
+		return false
+	}
+}
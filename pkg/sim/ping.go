@@ -0,0 +1,79 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PingResult is what a series of probes measured between two nodes.
+type PingResult struct {
+	From, To int
+	Sent int
+	RTTs []time.Duration // of the probes that made it back, in order
+}
+
+// Ping sends count probes from one node to another and back, one after the
+// other. A probe takes the route, jams, losses and cuts a message would, with
+// latency drawn like the sender's own messages, but it is not a message: no
+// node sees it, it is not counted in Stats and it ignores pauses and
+// breakpoints.
+func (n *Mesh[M]) Ping(from, to, count int, latency func(from, to int) time.Duration) PingResult {
+	r := PingResult{From: from, To: to, Sent: count}
+	for i := 0; i < count; i++ {
+		start := time.Now()
+		if n.Probe(from, to, latency(from, to)) && n.Probe(to, from, latency(to, from)) {
+			r.RTTs = append(r.RTTs, time.Since(start))
+		}
+	}
+	return r
+}
+
+// Probe sends one probe one way and returns once it arrives, false if it
+// was lost on the way.
+func (n *Mesh[M]) Probe(from, to int, latency time.Duration) bool {
+	n.mu.Lock()
+	route := n.route(from, to)
+	delay := n.delay(route, latency)
+	n.mu.Unlock()
+
+	time.Sleep(delay)
+	return n.blocked(route) == ""
+}
+
+func (r PingResult) Report(w io.Writer) {
+	lost := r.Sent - len(r.RTTs)
+	fmt.Fprintf(w, "Ping %d -> %d -> %d: %d probe(s), %d lost (%.0f%%)\n", r.From, r.To, r.From, r.Sent, lost, 100*float64(lost)/float64(max(r.Sent, 1)))
+	if len(r.RTTs) == 0 {
+		return
+	}
+
+	lo, hi := r.RTTs[0], r.RTTs[0]
+	var sum time.Duration
+	for _, rtt := range r.RTTs {
+		lo = min(lo, rtt)
+		hi = max(hi, rtt)
+		sum += rtt
+	}
+	fmt.Fprintf(w, "Round trip min/avg/max: %v/%v/%v\n", lo.Round(time.Millisecond), (sum / time.Duration(len(r.RTTs))).Round(time.Millisecond), hi.Round(time.Millisecond))
+}
+
+// ParsePing reads "<from> <to> [count]", count defaulting to 4.
+func ParsePing(s string, size int) (int, int, int, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 || len(fields) > 3 {
+		return 0, 0, 0, fmt.Errorf("invalid ping: %s (from, to and an optional count)", s)
+	}
+
+	values := []int{0, 0, 4}
+	for i, field := range fields {
+		v, err := strconv.Atoi(field)
+		if err != nil || v < 0 || (i < 2 && v >= size) || (i == 2 && v == 0) {
+			return 0, 0, 0, fmt.Errorf("invalid ping: %s", field)
+		}
+		values[i] = v
+	}
+	return values[0], values[1], values[2], nil
+}
@@ -0,0 +1,82 @@
+package sim
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// What a node does with a message its handler cannot make sense of.
+const (
+	PoisonDrop = "drop" // ignore it silently
+	PoisonLog = "log" // ignore it and say so in the log
+	PoisonCrash = "crash" // stop the node, as an unguarded handler would
+)
+
+// PoisonPolicy is the shared choice of what nodes do with malformed or
+// unknown-type messages.
+type PoisonPolicy struct {
+	mode string
+	mu sync.Mutex
+
+	Rejected atomic.Int64
+	Crashes atomic.Int64
+}
+
+func NewPoisonPolicy(mode string) (*PoisonPolicy, error) {
+	p := new(PoisonPolicy)
+	if err := p.Set(mode); err != nil {
+		return nil, err
+	}
+	p.Rejected.Store(0)
+	p.Crashes.Store(0)
+	return p, nil
+}
+
+func (p *PoisonPolicy) Set(mode string) error {
+	if mode != PoisonDrop && mode != PoisonLog && mode != PoisonCrash {
+		return fmt.Errorf("unknown policy: %s (drop, log or crash)", mode)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mode = mode
+	return nil
+}
+
+func (p *PoisonPolicy) Mode() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mode
+}
+
+// Screen wraps a message handler for Listen. A message check rejects, or one
+// that makes receive panic, is handled by the policy instead.
+func Screen[M any](proc *Process, policy *PoisonPolicy, check func(m M) error, receive func(m M)) func(m M) {
+	reject := func(err error) {
+		policy.Rejected.Add(1)
+
+		switch policy.Mode() {
+		case PoisonLog:
+			proc.Printf("Node %d rejects a message: %v", proc.ID(), err)
+		case PoisonCrash:
+			policy.Crashes.Add(1)
+			proc.Printf("Node %d crashes on a message: %v", proc.ID(), err)
+			proc.Stop()
+		}
+	}
+
+	return func(m M) {
+		if err := check(m); err != nil {
+			reject(err)
+			return
+		}
+
+		defer func() {
+			if r := recover(); r != nil {
+				reject(fmt.Errorf("handler panicked: %v", r))
+			}
+		}()
+		receive(m)
+	}
+}
@@ -0,0 +1,126 @@
+package sim
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math"
+	"math/big"
+	mrand "math/rand"
+	"sync"
+	"time"
+)
+
+// seeded source, nil until Seed is called
+var (
+	source *mrand.Rand
+	sourceSeed int64
+	sourceMu sync.Mutex
+)
+
+// Seed switches every later draw to a math/rand source seeded with seed, so
+// a run makes the same random choices again. Goroutines may still be
+// scheduled differently.
+func Seed(seed int64) {
+	sourceMu.Lock()
+	source = mrand.New(mrand.NewSource(seed))
+	sourceSeed = seed
+	sourceMu.Unlock()
+}
+
+// Seeded returns the seed given to Seed, or false if random choices come
+// from crypto/rand.
+func Seeded() (int64, bool) {
+	sourceMu.Lock()
+	defer sourceMu.Unlock()
+	return sourceSeed, source != nil
+}
+
+// Random returns a uniform number in [0, max), or 0 if max is not positive.
+func Random(max int64) int64 {
+	if max <= 0 {
+		return 0
+	}
+
+	sourceMu.Lock()
+	defer sourceMu.Unlock()
+	if source != nil {
+		return source.Int63n(max)
+	}
+
+	r, _ := rand.Int(rand.Reader, big.NewInt(max))
+	return r.Int64()
+}
+
+// ExpFloat64 returns an exponentially distributed number with mean 1.
+func ExpFloat64() float64 {
+	sourceMu.Lock()
+	defer sourceMu.Unlock()
+	if source != nil {
+		return source.ExpFloat64()
+	}
+	return mrand.ExpFloat64()
+}
+
+// NormFloat64 returns a normally distributed number with mean 0 and standard
+// deviation 1.
+func NormFloat64() float64 {
+	sourceMu.Lock()
+	defer sourceMu.Unlock()
+	if source != nil {
+		return source.NormFloat64()
+	}
+	return mrand.NormFloat64()
+}
+
+// Float64 returns a uniform number in [0, 1).
+func Float64() float64 {
+	return float64(Random(1<<53)) / (1 << 53)
+}
+
+// Latency returns a uniform delay between lmin and lmax milliseconds.
+func Latency(lmin, lmax int) time.Duration {
+	return time.Duration(int64(lmin)+Random(int64(lmax-lmin))) * time.Millisecond
+}
+
+// Distribution draws a delay for a latency range given in milliseconds.
+type Distribution func(lmin, lmax int) time.Duration
+
+// normal around the middle of the range, a sixth of it as standard deviation
+func normalLatency(lmin, lmax int) time.Duration {
+	mean := float64(lmin+lmax) / 2
+	ms := mean + NormFloat64()*float64(lmax-lmin)/6
+	return time.Duration(math.Max(ms, float64(lmin)) * float64(time.Millisecond))
+}
+
+// lmin plus an exponential wait averaging half the range
+func exponentialLatency(lmin, lmax int) time.Duration {
+	ms := float64(lmin) + ExpFloat64()*float64(lmax-lmin)/2
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// lmin plus a Pareto (Lomax, shape 1.5) wait averaging half the range: most
+// delays stay near lmin, a few are many times lmax (capped at 50 ranges)
+func paretoLatency(lmin, lmax int) time.Duration {
+	const shape = 1.5
+	scale := float64(lmax-lmin) / 2 * (shape - 1)
+	wait := scale * (math.Pow(1-Float64(), -1/shape) - 1)
+	ms := float64(lmin) + math.Min(wait, 50*float64(lmax-lmin))
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+var distributions = map[string]Distribution{
+	"uniform": Latency,
+	"normal": normalLatency,
+	"exponential": exponentialLatency,
+	"pareto": paretoLatency,
+}
+
+// ParseDistribution looks up a latency distribution: uniform, normal,
+// exponential or pareto.
+func ParseDistribution(name string) (Distribution, error) {
+	d, ok := distributions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown latency distribution: %s", name)
+	}
+	return d, nil
+}
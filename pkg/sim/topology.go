@@ -0,0 +1,175 @@
+package sim
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Topology is an undirected graph of which nodes are wired to each other.
+// Messages between nodes that are not neighbors are forwarded along the
+// shortest path.
+type Topology struct {
+	name string
+	adj [][]bool
+}
+
+func newTopology(name string, size int) *Topology {
+	t := new(Topology)
+	t.name = name
+	t.adj = make([][]bool, size)
+	for i := range t.adj {
+		t.adj[i] = make([]bool, size)
+	}
+	return t
+}
+
+func (t *Topology) connect(a, b int) {
+	if a != b {
+		t.adj[a][b] = true
+		t.adj[b][a] = true
+	}
+}
+
+// ParseTopology builds a topology of size nodes from its name: mesh, ring,
+// line, star (node 0 in the middle), tree (binary, rooted at node 0),
+// random:<p> (each pair wired with probability p) or file:<path> (one
+// "a b" edge per line, # starts a comment).
+func ParseTopology(spec string, size int) (*Topology, error) {
+	t := newTopology(spec, size)
+
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "mesh":
+		for i := 0; i < size; i++ {
+			for j := i + 1; j < size; j++ {
+				t.connect(i, j)
+			}
+		}
+	case "ring", "line":
+		for i := 0; i+1 < size; i++ {
+			t.connect(i, i+1)
+		}
+		if kind == "ring" && size > 2 {
+			t.connect(size-1, 0)
+		}
+	case "star":
+		for i := 1; i < size; i++ {
+			t.connect(0, i)
+		}
+	case "tree":
+		for i := 1; i < size; i++ {
+			t.connect((i-1)/2, i)
+		}
+	case "random":
+		p, err := strconv.ParseFloat(arg, 64)
+		if err != nil || p < 0 || p > 1 {
+			return nil, fmt.Errorf("invalid probability in topology: %s", spec)
+		}
+		for i := 0; i < size; i++ {
+			for j := i + 1; j < size; j++ {
+				if float64(Random(1000000)) < p*1000000 {
+					t.connect(i, j)
+				}
+			}
+		}
+	case "file":
+		if err := t.load(arg); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown topology: %s", spec)
+	}
+
+	return t, nil
+}
+
+func (t *Topology) load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid edge: %s", line)
+		}
+		a, errA := strconv.Atoi(fields[0])
+		b, errB := strconv.Atoi(fields[1])
+		if errA != nil || errB != nil || a < 0 || b < 0 || a >= len(t.adj) || b >= len(t.adj) {
+			return fmt.Errorf("invalid edge: %s", line)
+		}
+		t.connect(a, b)
+	}
+	return scanner.Err()
+}
+
+// Route is the shortest path from one node to another, both included, or
+// nil if the graph does not connect them.
+func (t *Topology) Route(from, to int) []int {
+	prev := make([]int, len(t.adj))
+	for i := range prev {
+		prev[i] = -1
+	}
+	prev[from] = from
+
+	queue := []int{from}
+	for len(queue) > 0 && prev[to] < 0 {
+		at := queue[0]
+		queue = queue[1:]
+		for next, wired := range t.adj[at] {
+			if wired && prev[next] < 0 {
+				prev[next] = at
+				queue = append(queue, next)
+			}
+		}
+	}
+	if prev[to] < 0 {
+		return nil
+	}
+
+	route := []int{to}
+	for at := to; at != from; at = prev[at] {
+		route = append([]int{prev[at]}, route...)
+	}
+	return route
+}
+
+// Neighbors lists the nodes wired to a node.
+func (t *Topology) Neighbors(node int) []int {
+	neighbors := []int{}
+	for i, wired := range t.adj[node] {
+		if wired {
+			neighbors = append(neighbors, i)
+		}
+	}
+	return neighbors
+}
+
+// Via describes the relays on a route, e.g. " via 1, 2", or "" if the
+// route is a direct link.
+func Via(route []int) string {
+	if len(route) <= 2 {
+		return ""
+	}
+
+	relays := make([]string, len(route)-2)
+	for i, node := range route[1 : len(route)-1] {
+		relays[i] = strconv.Itoa(node)
+	}
+	return " via " + strings.Join(relays, ", ")
+}
+
+func (t *Topology) String() string {
+	return t.name
+}
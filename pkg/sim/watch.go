@@ -0,0 +1,213 @@
+package sim
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var operators = map[string]bool{">": true, ">=": true, "<": true, "<=": true, "==": true, "!=": true}
+
+// Probe reads one number from a node, e.g. the length of its hold-back buffer.
+type Probe func(node int) int64
+
+type watch struct {
+	id int
+	expr string
+	node int // -1 watches every node
+	probe string
+	op string
+	value int64
+	pause bool
+
+	held map[int]bool // nodes where the predicate is currently true
+}
+
+func (w *watch) test(v int64) bool {
+	switch w.op {
+	case ">":
+		return v > w.value
+	case ">=":
+		return v >= w.value
+	case "<":
+		return v < w.value
+	case "<=":
+		return v <= w.value
+	case "==":
+		return v == w.value
+	case "!=":
+		return v != w.value
+	}
+	return false
+}
+
+// Watcher polls predicates such as "node[2].buffer > 5" or "node[*].t >= 10"
+// and reports when one becomes true.
+type Watcher struct {
+	nodes int
+	probes map[string]Probe
+	exemplars map[string]func(node int) (Exemplar, bool)
+	watches []*watch
+	nextID int
+	mu sync.Mutex
+
+	// called with an alert when a predicate becomes true on a node
+	OnTrigger func(alert string, pause bool)
+}
+
+func NewWatcher(nodes int) *Watcher {
+	w := new(Watcher)
+	w.nodes = nodes
+	w.probes = make(map[string]Probe)
+	w.exemplars = make(map[string]func(node int) (Exemplar, bool))
+	w.watches = nil
+	w.nextID = 0
+	return w
+}
+
+func (w *Watcher) Probe(name string, p Probe) {
+	w.mu.Lock()
+	w.probes[name] = p
+	w.mu.Unlock()
+}
+
+// Probes lists the names that can be watched.
+func (w *Watcher) Probes() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	names := make([]string, 0, len(w.probes))
+	for name := range w.probes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Watch parses "node[<id>|*].<probe> <op> <number>" and starts watching it.
+func (w *Watcher) Watch(expr string, pause bool) (int, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 3 {
+		return 0, fmt.Errorf("expected node[<id>].<probe> <op> <number>: %s", expr)
+	}
+
+	target, probe, found := strings.Cut(fields[0], ".")
+	if !found || !strings.HasPrefix(target, "node[") || !strings.HasSuffix(target, "]") {
+		return 0, fmt.Errorf("invalid target: %s", fields[0])
+	}
+
+	node := -1
+	if index := target[len("node[") : len(target)-1]; index != "*" {
+		var err error
+		node, err = strconv.Atoi(index)
+		if err != nil || node < 0 || node >= w.nodes {
+			return 0, fmt.Errorf("invalid node: %s", index)
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.probes[probe]; !ok {
+		return 0, fmt.Errorf("unknown probe: %s", probe)
+	}
+
+	op := fields[1]
+	if !operators[op] {
+		return 0, fmt.Errorf("invalid operator: %s", op)
+	}
+
+	value, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number: %s", fields[2])
+	}
+
+	wt := &watch{id: w.nextID, expr: strings.Join(fields, " "), node: node, probe: probe, op: op, value: value, pause: pause, held: make(map[int]bool)}
+	w.watches = append(w.watches, wt)
+	w.nextID++
+	return wt.id, nil
+}
+
+func (w *Watcher) Unwatch(id int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i, wt := range w.watches {
+		if wt.id == id {
+			w.watches = append(w.watches[:i], w.watches[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// List describes the active watches.
+func (w *Watcher) List() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	list := make([]string, len(w.watches))
+	for i, wt := range w.watches {
+		list[i] = fmt.Sprintf("#%d: %s", wt.id, wt.expr)
+		if wt.pause {
+			list[i] += " (pauses)"
+		}
+	}
+	return list
+}
+
+// Run polls every watch at the given period until done is closed.
+func (w *Watcher) Run(period time.Duration, done <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				w.poll()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func (w *Watcher) poll() {
+	type alert struct {
+		text string
+		pause bool
+	}
+	alerts := []alert{}
+
+	w.mu.Lock()
+	for _, wt := range w.watches {
+		probe := w.probes[wt.probe]
+		for node := 0; node < w.nodes; node++ {
+			if wt.node != -1 && wt.node != node {
+				continue
+			}
+
+			v := probe(node)
+			if !wt.test(v) {
+				wt.held[node] = false
+				continue
+			}
+			if !wt.held[node] {
+				// only report the moment the predicate becomes true
+				wt.held[node] = true
+				alerts = append(alerts, alert{fmt.Sprintf("Watch #%d: %s holds on node %d (%s = %d)", wt.id, wt.expr, node, wt.probe, v), wt.pause})
+			}
+		}
+	}
+	w.mu.Unlock()
+
+	if w.OnTrigger != nil {
+		for _, a := range alerts {
+			w.OnTrigger(a.text, a.pause)
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+// When the primary answers the client.
+const (
+	modeSync = "sync" // once every live backup has the write
+	modeAsync = "async" // right away, backups catch up later
+)
+
+type message struct {
+	kind string // replicate, ack or snapshot
+	from int
+	view int // messages from an older primary are ignored
+	seq int
+	key, value string
+	state *sim.KV // snapshot
+}
+
+// a write the client is waiting on
+type write struct {
+	seq int
+	key, value string
+	acks map[int]bool
+	need int
+	done chan struct{}
+}
+
+type nodePool struct {
+	*sim.Pool
+	participants int
+	send func(from, to int, m message)
+	crashed func(id int) bool
+
+	primary int
+	view int
+	mode string
+	pending map[int]*write
+	acknowledged []*write // answered to the client, in order
+	mu sync.Mutex
+
+	lost atomic.Int64
+	reads atomic.Int64
+	stale atomic.Int64
+}
+
+func newNodePool(participants int, mode string, send func(from, to int, m message), crashed func(id int) bool) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.participants = participants
+	pool.send = send
+	pool.crashed = crashed
+	pool.primary = 0
+	pool.view = 0
+	pool.mode = mode
+	pool.pending = map[int]*write{}
+	pool.acknowledged = []*write{}
+	pool.lost.Store(0)
+	pool.reads.Store(0)
+	pool.stale.Store(0)
+	return pool
+}
+
+func (p *nodePool) current() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.primary, p.view
+}
+
+// count a backup's ack, the write is done once every live backup has it
+func (p *nodePool) acked(seq, from int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	w, ok := p.pending[seq]
+	if !ok || w.acks[from] {
+		return
+	}
+	w.acks[from] = true
+	if len(w.acks) == w.need {
+		delete(p.pending, seq)
+		close(w.done)
+	}
+}
+
+type node struct {
+	*sim.Process
+	pool *nodePool
+
+	store *sim.KV
+	applied int
+	view int
+	holdback map[int]message // replicated out of order, waiting for the gap
+
+	crashed atomic.Bool
+	mu sync.Mutex
+
+	inbox chan message
+}
+
+func newNode(pool *nodePool, id, clockSpeed int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.store = sim.NewKV()
+	n.applied = 0
+	n.view = 0
+	n.holdback = map[int]message{}
+	n.crashed.Store(false)
+	n.inbox = make(chan message)
+	return n
+}
+
+func (n *node) Run() {
+	n.Start(nil)
+
+	// poll replicated writes, acks and snapshots
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if m.view < n.view {
+		// from a primary that has been replaced
+		return
+	}
+
+	switch m.kind {
+	case "replicate":
+		if m.seq <= n.applied {
+			return
+		}
+		n.holdback[m.seq] = m
+		for {
+			next, ok := n.holdback[n.applied+1]
+			if !ok {
+				break
+			}
+			delete(n.holdback, next.seq)
+			n.store.Put(next.key, next.value)
+			n.applied = next.seq
+			n.Printf("Node %d applies #%d %s = %s", n.ID(), next.seq, next.key, next.value)
+			n.pool.send(n.ID(), m.from, message{kind: "ack", from: n.ID(), view: n.view, seq: next.seq})
+		}
+
+	case "ack":
+		n.pool.acked(m.seq, m.from)
+
+	case "snapshot":
+		if n.applied > m.seq {
+			n.Printf("Node %d rolls back from #%d to #%d", n.ID(), n.applied, m.seq)
+		}
+		n.view = m.view
+		n.store = m.state
+		n.applied = m.seq
+		n.holdback = map[int]message{}
+	}
+}
+
+// apply a client write on the primary and send it to every live backup
+func (n *node) write(key, value string) *write {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.applied++
+	n.store.Put(key, value)
+	w := &write{seq: n.applied, key: key, value: value, acks: map[int]bool{}, done: make(chan struct{})}
+
+	for i := 0; i < n.pool.participants; i++ {
+		if i != n.ID() && !n.pool.crashed(i) {
+			w.need++
+			n.pool.send(n.ID(), i, message{kind: "replicate", from: n.ID(), view: n.view, seq: w.seq, key: key, value: value})
+		}
+	}
+
+	n.pool.mu.Lock()
+	if w.need == 0 {
+		close(w.done)
+	} else {
+		n.pool.pending[w.seq] = w
+	}
+	n.pool.mu.Unlock()
+
+	n.Printf("Node %d (primary) writes #%d %s = %s", n.ID(), w.seq, key, value)
+	return w
+}
+
+// bring a backup in line with the primary, rolling back what it has beyond
+func (n *node) snapshot(to int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.pool.send(n.ID(), to, message{kind: "snapshot", from: n.ID(), view: n.view, seq: n.applied, state: n.store.Clone()})
+}
+
+func main() {
+	mode := flag.String("mode", modeSync, "when the primary answers the client: sync (every live backup has the write) or async (right away)")
+	timeout := flag.Duration("timeout", 3*time.Second, "how long a synchronous write waits for the backups")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *mode != modeSync && *mode != modeAsync {
+		fmt.Printf("Unknown mode: %s\n", *mode)
+		return
+	}
+	if *timeout <= 0 {
+		fmt.Println("Timeout must be positive")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	if nodeCount < 2 {
+		fmt.Println("Need a primary and at least one backup")
+		return
+	}
+
+	var lmin, lmax atomic.Int64
+	lmin.Store(20)
+	lmax.Store(100)
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		if nodes[to].crashed.Load() {
+			return false
+		}
+		return sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+	})
+
+	sender := func(from, to int, m message) {
+		network.Send(from, to, m, sim.Latency(int(lmin.Load()), int(lmax.Load())))
+	}
+	crashed := func(id int) bool {
+		return nodes[id].crashed.Load()
+	}
+
+	pool := newNodePool(nodeCount, *mode, sender, crashed)
+	for i := 0; i < nodeCount; i++ {
+		nodes[i] = newNode(pool, i, 1000, l)
+		nodes[i].Run()
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, put, read, mode, failover, recover, stats, latency, partition, heal, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			pool.mu.Lock()
+			fmt.Printf("Primary: node %d (view %d, %s replication)\n", pool.primary, pool.view, pool.mode)
+			primary := pool.primary
+			pool.mu.Unlock()
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				role := "backup"
+				if i == primary {
+					role = "primary"
+				}
+				if nodes[i].crashed.Load() {
+					role = "crashed"
+				}
+				fmt.Printf("Node %d (%s, applied: #%d, held back: %d) %s\n", i, role, nodes[i].applied, len(nodes[i].holdback), nodes[i].store)
+				nodes[i].mu.Unlock()
+			}
+		} else if cmd == "put" {
+			var key, value string
+
+			con.Scan("Key: ", &key)
+			con.Scan("Value: ", &value)
+
+			primary, _ := pool.current()
+			if nodes[primary].crashed.Load() {
+				fmt.Println("The primary is down, fail over first")
+				continue
+			}
+
+			start := time.Now()
+			w := nodes[primary].write(key, value)
+
+			pool.mu.Lock()
+			replication := pool.mode
+			pool.mu.Unlock()
+
+			if replication == modeSync {
+				select {
+				case <-w.done:
+				case <-time.After(*timeout):
+					fmt.Printf("Write #%d timed out waiting for the backups, not acknowledged\n", w.seq)
+					continue
+				}
+			}
+
+			pool.mu.Lock()
+			pool.acknowledged = append(pool.acknowledged, w)
+			pool.mu.Unlock()
+			fmt.Printf("Write #%d acknowledged to the client after %v (%s)\n", w.seq, time.Since(start).Round(time.Millisecond), replication)
+		} else if cmd == "read" {
+			// any node answers from its own copy
+			var id int
+			var key string
+
+			con.Scan("Node: ", &id)
+			con.Scan("Key: ", &key)
+
+			if nodes[id].crashed.Load() {
+				fmt.Println("Node is crashed")
+				continue
+			}
+
+			primary, _ := pool.current()
+			nodes[id].mu.Lock()
+			v, ok := nodes[id].store.Get(key)
+			nodes[id].mu.Unlock()
+			nodes[primary].mu.Lock()
+			latest, _ := nodes[primary].store.Get(key)
+			nodes[primary].mu.Unlock()
+			if !ok {
+				v = "(none)"
+			}
+			pool.reads.Add(1)
+
+			fmt.Printf("%s = %s from node %d", key, v, id)
+			if id != primary && v != latest {
+				pool.stale.Add(1)
+				fmt.Printf(" (STALE, the primary has %s)", latest)
+			}
+			fmt.Println()
+		} else if cmd == "mode" {
+			var m string
+
+			con.Scan("Mode (sync or async): ", &m)
+
+			if m != modeSync && m != modeAsync {
+				fmt.Println("Unknown mode")
+				continue
+			}
+			pool.mu.Lock()
+			pool.mode = m
+			pool.mu.Unlock()
+		} else if cmd == "failover" {
+			// the primary crashes and a backup takes over with whatever it has
+			var next int
+
+			con.Scan("New primary (-1 for the most up to date backup): ", &next)
+
+			old, _ := pool.current()
+			if next == old || (next >= 0 && (next >= nodeCount || nodes[next].crashed.Load())) {
+				fmt.Println("Pick a live backup")
+				continue
+			}
+
+			nodes[old].crashed.Store(true)
+			if next < 0 {
+				best := -1
+				for i := range nodes {
+					if i == old || nodes[i].crashed.Load() {
+						continue
+					}
+					nodes[i].mu.Lock()
+					applied := nodes[i].applied
+					nodes[i].mu.Unlock()
+					if applied > best {
+						next, best = i, applied
+					}
+				}
+			}
+			if next < 0 {
+				fmt.Println("No live backup to take over")
+				nodes[old].crashed.Store(false)
+				continue
+			}
+
+			nodes[next].mu.Lock()
+			applied := nodes[next].applied
+			nodes[next].holdback = map[int]message{}
+
+			pool.mu.Lock()
+			pool.primary = next
+			pool.view++
+			nodes[next].view = pool.view
+
+			// the client was told these made it, the new primary never saw them
+			kept := []*write{}
+			for _, w := range pool.acknowledged {
+				if w.seq > applied {
+					pool.lost.Add(1)
+					fmt.Printf("LOST: write #%d %s = %s was acknowledged to the client\n", w.seq, w.key, w.value)
+				} else {
+					kept = append(kept, w)
+				}
+			}
+			pool.acknowledged = kept
+			pool.pending = map[int]*write{}
+			pool.mu.Unlock()
+			nodes[next].mu.Unlock()
+
+			l.Printf("Node %d crashes, node %d takes over at #%d", old, next, applied)
+			fmt.Printf("Node %d is the primary at #%d\n", next, applied)
+
+			for i := range nodes {
+				if i != next && !nodes[i].crashed.Load() {
+					nodes[next].snapshot(i)
+				}
+			}
+		} else if cmd == "recover" {
+			// back as a backup with the primary's state
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			if !nodes[id].crashed.Load() {
+				fmt.Println("Node is not crashed")
+				continue
+			}
+			nodes[id].crashed.Store(false)
+			primary, _ := pool.current()
+			nodes[primary].snapshot(id)
+		} else if cmd == "stats" {
+			pool.mu.Lock()
+			fmt.Printf("Writes acknowledged: %d, lost on failover: %d\n", len(pool.acknowledged)+int(pool.lost.Load()), pool.lost.Load())
+			pool.mu.Unlock()
+			fmt.Printf("Reads: %d, stale: %d\n", pool.reads.Load(), pool.stale.Load())
+		} else if cmd == "latency" {
+			var lo, hi int64
+
+			con.Scan("Min latency (ms): ", &lo)
+			con.Scan("Max latency (ms): ", &hi)
+
+			lmin.Store(lo)
+			lmax.Store(hi)
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,740 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type tag struct {
+	ts int
+	writer int
+}
+
+func (t tag) less(other tag) bool {
+	if t.ts != other.ts {
+		return t.ts < other.ts
+	}
+	return t.writer < other.writer
+}
+
+type reply struct {
+	ok bool
+	epoch int
+	tag tag
+	value string
+}
+
+type configuration struct {
+	epoch int
+	members []int
+}
+
+func (c configuration) quorum() int {
+	return len(c.members)/2 + 1
+}
+
+func (c configuration) has(id int) bool {
+	for _, member := range c.members {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (c configuration) String() string {
+	s := make([]string, len(c.members))
+	for i := range c.members {
+		s[i] = strconv.Itoa(c.members[i])
+	}
+	return fmt.Sprintf("epoch %d {%s}", c.epoch, strings.Join(s, ", "))
+}
+
+// operation counts and latencies, kept apart for leases on and off
+type opStats struct {
+	reads, localReads, writes int
+	readTime, writeTime time.Duration
+}
+
+type serverPool struct {
+	*sim.Pool
+
+	config configuration
+	reconfiguring bool
+	configMu sync.Mutex
+
+	lmin, lmax atomic.Int64
+
+	// quorum leases: members holding one serve reads from their own copy
+	leases atomic.Bool
+	leaseFor time.Duration
+	local time.Duration // between a client and its home server, each way
+
+	stats [2]opStats
+	statsMu sync.Mutex
+
+	servers []*server
+	stop chan struct{} // closed on exit
+}
+
+func newServerPool(members []int) *serverPool {
+	pool := new(serverPool)
+	pool.Pool = sim.NewPool()
+	pool.config = configuration{epoch: 0, members: members}
+	pool.reconfiguring = false
+	pool.lmin.Store(50)
+	pool.lmax.Store(300)
+	pool.leases.Store(false)
+	pool.leaseFor = 0
+	pool.local = 0
+	pool.stop = make(chan struct{})
+	return pool
+}
+
+func (pool *serverPool) record(leases, write, local bool, d time.Duration) {
+	pool.statsMu.Lock()
+	defer pool.statsMu.Unlock()
+
+	s := &pool.stats[0]
+	if leases {
+		s = &pool.stats[1]
+	}
+	if write {
+		s.writes++
+		s.writeTime += d
+	} else {
+		s.reads++
+		s.readTime += d
+		if local {
+			s.localReads++
+		}
+	}
+}
+
+func (pool *serverPool) current() (configuration, bool) {
+	pool.configMu.Lock()
+	defer pool.configMu.Unlock()
+	return pool.config, pool.reconfiguring
+}
+
+// stopped reports whether exit has been typed, operations still running give up
+func (pool *serverPool) stopped() bool {
+	select {
+	case <-pool.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// back off before a retry, false if exit is typed in the meantime
+func (pool *serverPool) backoff() bool {
+	select {
+	case <-time.After(100 * time.Millisecond):
+		return true
+	case <-pool.stop:
+		return false
+	}
+}
+
+func (pool *serverPool) delay() {
+	time.Sleep(sim.Latency(int(pool.lmin.Load()), int(pool.lmax.Load())))
+}
+
+type server struct {
+	pool *serverPool
+	id int
+	l sim.Logger
+
+	epoch int
+	stopped bool
+	tag tag
+	value string
+	mu sync.Mutex
+
+	// lease: until when this server may answer reads on its own, writes in
+	// progress that revoked it, and how often it was revoked
+	leaseUntil time.Time
+	blocked int
+	revocations int
+
+	crashed atomic.Bool
+}
+
+func newServer(pool *serverPool, id int, l sim.Logger) *server {
+	s := new(server)
+	s.pool = pool
+	s.id = id
+	s.l = l
+	s.epoch = 0
+	s.stopped = false
+	s.tag = tag{ts: 0, writer: -1}
+	s.value = ""
+	s.leaseUntil = time.Time{}
+	s.blocked = 0
+	s.revocations = 0
+	s.crashed.Store(false)
+	return s
+}
+
+// remote call with network delay in both directions, fails if the server is down
+func (s *server) call(handler func() reply) (reply, bool) {
+	s.pool.delay()
+	if s.crashed.Load() {
+		return reply{}, false
+	}
+
+	s.mu.Lock()
+	r := handler()
+	s.mu.Unlock()
+
+	s.pool.delay()
+	return r, true
+}
+
+func (s *server) query(epoch int) reply {
+	if s.stopped || epoch != s.epoch {
+		return reply{ok: false, epoch: s.epoch}
+	}
+	return reply{ok: true, epoch: s.epoch, tag: s.tag, value: s.value}
+}
+
+func (s *server) store(epoch int, t tag, value string) reply {
+	if s.stopped || epoch != s.epoch {
+		return reply{ok: false, epoch: s.epoch}
+	}
+	if s.tag.less(t) {
+		s.tag = t
+		s.value = value
+	}
+	return reply{ok: true, epoch: s.epoch}
+}
+
+// reconfiguration: freeze the old configuration and hand over the latest state
+func (s *server) stop(epoch int) reply {
+	if epoch != s.epoch {
+		return reply{ok: false, epoch: s.epoch}
+	}
+	s.stopped = true
+	return reply{ok: true, epoch: s.epoch, tag: s.tag, value: s.value}
+}
+
+// lease grantor: hand out the latest state unless a write is revoking leases
+func (s *server) grant(epoch int) reply {
+	if s.stopped || epoch != s.epoch || s.blocked > 0 {
+		return reply{ok: false, epoch: s.epoch}
+	}
+	return reply{ok: true, epoch: s.epoch, tag: s.tag, value: s.value}
+}
+
+// a write is coming: drop the lease and refuse to grant until it is done
+func (s *server) revoke() reply {
+	s.leaseUntil = time.Time{}
+	s.blocked++
+	s.revocations++
+	return reply{ok: true, epoch: s.epoch}
+}
+
+func (s *server) release() reply {
+	if s.blocked > 0 {
+		s.blocked--
+	}
+	return reply{ok: true, epoch: s.epoch}
+}
+
+// answer a read from the local copy while the lease holds
+func (s *server) localRead() reply {
+	if s.stopped || !time.Now().Before(s.leaseUntil) {
+		return reply{ok: false, epoch: s.epoch}
+	}
+	return reply{ok: true, epoch: s.epoch, tag: s.tag, value: s.value}
+}
+
+// renew the lease from a quorum of grantors, taking the latest state along
+func (s *server) renew() {
+	config, reconfiguring := s.pool.current()
+	if reconfiguring || s.crashed.Load() || !config.has(s.id) {
+		return
+	}
+
+	s.mu.Lock()
+	revocations := s.revocations
+	s.mu.Unlock()
+
+	start := time.Now()
+	replies, ok := gather(s.pool.servers, config, func(g *server) func() reply {
+		return func() reply { return g.grant(config.epoch) }
+	})
+	if !ok {
+		return
+	}
+	latest := highest(replies)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// a write revoked the lease while the grants were on their way
+	if s.revocations != revocations || s.blocked > 0 || s.epoch != config.epoch {
+		return
+	}
+	if s.tag.less(latest.tag) {
+		s.tag = latest.tag
+		s.value = latest.value
+	}
+	s.leaseUntil = start.Add(s.pool.leaseFor)
+}
+
+func (s *server) install(epoch int, t tag, value string) reply {
+	if epoch < s.epoch {
+		return reply{ok: false, epoch: s.epoch}
+	}
+	s.epoch = epoch
+	s.stopped = false
+	if s.tag.less(t) {
+		s.tag = t
+		s.value = value
+	}
+	return reply{ok: true, epoch: s.epoch}
+}
+
+// send a request to every member and wait for a quorum of successful replies
+func gather(servers []*server, c configuration, request func(s *server) func() reply) ([]reply, bool) {
+	replies := make(chan reply, len(c.members))
+	for _, id := range c.members {
+		s := servers[id]
+		s.pool.Go(func() {
+			r, ok := s.call(request(s))
+			if !ok {
+				r = reply{ok: false, epoch: -1}
+			}
+			replies <- r
+		})
+	}
+
+	collected := make([]reply, 0, len(c.members))
+	for range c.members {
+		r := <-replies
+		if !r.ok {
+			continue
+		}
+
+		collected = append(collected, r)
+		if len(collected) == c.quorum() {
+			return collected, true
+		}
+	}
+	return collected, false
+}
+
+func highest(replies []reply) reply {
+	best := replies[0]
+	for _, r := range replies {
+		if best.tag.less(r.tag) {
+			best = r
+		}
+	}
+	return best
+}
+
+type client struct {
+	id int
+	servers []*server
+	l sim.Logger
+}
+
+// read from the home server's copy if it holds a lease
+func (c *client) readLocal(config configuration) (reply, bool) {
+	pool := c.servers[0].pool
+	home := c.servers[config.members[c.id%len(config.members)]]
+
+	time.Sleep(pool.local)
+	if home.crashed.Load() {
+		return reply{}, false
+	}
+	home.mu.Lock()
+	r := home.localRead()
+	home.mu.Unlock()
+	time.Sleep(pool.local)
+
+	return r, r.ok
+}
+
+// revoke every member's lease before a write, waiting out the leases of
+// members that do not answer
+func (c *client) revoke(config configuration) {
+	replies := make(chan bool, len(config.members))
+	for _, id := range config.members {
+		s := c.servers[id]
+		s.pool.Go(func() {
+			_, ok := s.call(s.revoke)
+			replies <- ok
+		})
+	}
+
+	all := true
+	for range config.members {
+		all = <-replies && all
+	}
+	if !all {
+		c.l.Printf("Client %d waits %v for the leases of unreachable servers to run out", c.id, c.servers[0].pool.leaseFor)
+		time.Sleep(c.servers[0].pool.leaseFor)
+	}
+}
+
+func (c *client) release(config configuration) {
+	for _, id := range config.members {
+		s := c.servers[id]
+		s.pool.Go(func() {
+			s.call(s.release)
+		})
+	}
+}
+
+// run an ABD operation, retrying when the configuration changes underneath,
+// returns false if it gave up because of exit
+func (c *client) operate(write bool, value string) bool {
+	start := time.Now()
+	attempts := 0
+	pool := c.servers[0].pool
+	leases := pool.leases.Load()
+
+	for {
+		if pool.stopped() {
+			c.l.Printf("Client %d gave up after %d attempt(s), shutting down", c.id, attempts)
+			return false
+		}
+
+		attempts++
+		config, reconfiguring := c.servers[0].pool.current()
+		if reconfiguring {
+			pool.backoff()
+			continue
+		}
+
+		if leases && !write {
+			if r, ok := c.readLocal(config); ok {
+				c.l.Printf("Client %d read %s (ts %d) locally under a lease after %v", c.id, r.value, r.tag.ts, time.Since(start).Round(time.Millisecond))
+				pool.record(leases, false, true, time.Since(start))
+				return true
+			}
+		}
+
+		// phase 1: find the latest tag
+		replies, ok := gather(c.servers, config, func(s *server) func() reply {
+			return func() reply { return s.query(config.epoch) }
+		})
+		if !ok {
+			c.l.Printf("Client %d found no quorum in %s, retrying", c.id, config)
+			pool.backoff()
+			continue
+		}
+
+		latest := highest(replies)
+		t, v := latest.tag, latest.value
+		if write {
+			t = tag{ts: latest.tag.ts + 1, writer: c.id}
+			v = value
+		}
+
+		// no lease holder may answer from its copy while the write lands
+		if leases && write {
+			c.revoke(config)
+		}
+
+		// phase 2: store (or write back) on a quorum
+		_, ok = gather(c.servers, config, func(s *server) func() reply {
+			return func() reply { return s.store(config.epoch, t, v) }
+		})
+		if leases && write {
+			c.release(config)
+		}
+		if !ok {
+			c.l.Printf("Client %d lost its quorum in %s, retrying", c.id, config)
+			pool.backoff()
+			continue
+		}
+
+		if write {
+			c.l.Printf("Client %d wrote %s (ts %d) in %s after %v, %d attempt(s)", c.id, v, t.ts, config, time.Since(start).Round(time.Millisecond), attempts)
+		} else {
+			c.l.Printf("Client %d read %s (ts %d) in %s after %v, %d attempt(s)", c.id, v, t.ts, config, time.Since(start).Round(time.Millisecond), attempts)
+		}
+		pool.record(leases, write, false, time.Since(start))
+		return true
+	}
+}
+
+func reconfigure(pool *serverPool, servers []*server, members []int, l sim.Logger) bool {
+	pool.configMu.Lock()
+	if pool.reconfiguring {
+		pool.configMu.Unlock()
+		return false
+	}
+	pool.reconfiguring = true
+	old := pool.config
+	pool.configMu.Unlock()
+
+	next := configuration{epoch: old.epoch + 1, members: members}
+	l.Printf("Reconfiguration from %s to %s started", old, next)
+
+	// stop the world: a quorum of the old configuration stops serving
+	ok := false
+	var replies []reply
+	if !pool.stopped() {
+		replies, ok = gather(servers, old, func(s *server) func() reply {
+			return func() reply { return s.stop(old.epoch) }
+		})
+	}
+	// exit abandons it before the new configuration is installed
+	abandoned := pool.stopped()
+	if ok && !abandoned {
+		// install the latest state in a quorum of the new configuration
+		latest := highest(replies)
+		_, ok = gather(servers, next, func(s *server) func() reply {
+			return func() reply { return s.install(next.epoch, latest.tag, latest.value) }
+		})
+	}
+
+	if !ok || abandoned {
+		ok = false
+
+		// resume the old configuration
+		gather(servers, old, func(s *server) func() reply {
+			return func() reply { return s.install(old.epoch, tag{ts: 0, writer: -1}, "") }
+		})
+	}
+
+	pool.configMu.Lock()
+	if ok {
+		pool.config = next
+		l.Printf("Reconfiguration to %s done", next)
+	} else if abandoned {
+		l.Printf("Reconfiguration to %s abandoned, shutting down", next)
+	} else {
+		l.Printf("Reconfiguration to %s failed (no quorum)", next)
+	}
+	pool.reconfiguring = false
+	pool.configMu.Unlock()
+
+	return ok
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func main() {
+	leases := flag.Bool("leases", false, "start with quorum leases, members holding one serve reads from their own copy")
+	leaseFor := flag.Duration("lease", 2*time.Second, "how long a lease lasts, members renew it every third of that")
+	local := flag.Duration("local", 2*time.Millisecond, "one-way delay between a client and its home server (the others are remote)")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *leaseFor <= 0 || *local < 0 {
+		fmt.Println("Lease must be positive and local not negative")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var serverCount, clientCount, memberCount int
+	con.Scan("Number of servers: ", &serverCount)
+	con.Scan("Initial members (first N servers): ", &memberCount)
+	con.Scan("Number of clients: ", &clientCount)
+
+	members := make([]int, memberCount)
+	for i := range members {
+		members[i] = i
+	}
+	pool := newServerPool(members)
+	pool.leases.Store(*leases)
+	pool.leaseFor = *leaseFor
+	pool.local = *local
+
+	servers := make([]*server, serverCount)
+	for i := range servers {
+		servers[i] = newServer(pool, i, l)
+	}
+	pool.servers = servers
+
+	// members keep their leases fresh while leases are on
+	for i := range servers {
+		s := servers[i]
+		pool.Go(func() {
+			renewal := time.NewTicker(pool.leaseFor / 3)
+			defer renewal.Stop()
+
+			for {
+				select {
+				case <-renewal.C:
+					if pool.leases.Load() {
+						s.renew()
+					}
+				case <-pool.stop:
+					return
+				}
+			}
+		})
+	}
+
+	clients := make([]*client, clientCount)
+	for i := range clients {
+		clients[i] = &client{id: i, servers: servers, l: l}
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, write, read, bench, leases, stats, reconfig, crash, recover, latency, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			config, reconfiguring := pool.current()
+			fmt.Printf("Configuration: %s (reconfiguring: %v)\n", config, reconfiguring)
+			for i := range servers {
+				servers[i].mu.Lock()
+				lease := "none"
+				if left := time.Until(servers[i].leaseUntil); left > 0 {
+					lease = left.Round(time.Millisecond).String() + " left"
+				}
+				fmt.Printf("Server %d (epoch: %d, stopped: %v, crashed: %v, lease: %s) %s (ts %d, writer %d)\n", servers[i].id, servers[i].epoch, servers[i].stopped, servers[i].crashed.Load(), lease, servers[i].value, servers[i].tag.ts, servers[i].tag.writer)
+				servers[i].mu.Unlock()
+			}
+		} else if cmd == "write" || cmd == "read" {
+			var id int
+			var value string
+
+			con.Scan("Client: ", &id)
+			if cmd == "write" {
+				con.Scan("Value: ", &value)
+			}
+
+			// operations run concurrently, results appear in the logs
+			pool.Go(func() {
+				clients[id].operate(cmd == "write", value)
+			})
+		} else if cmd == "bench" {
+			// a stream of operations from one client, one after the other
+			var id, count, writes int
+
+			con.Scan("Client: ", &id)
+			con.Scan("Operations: ", &count)
+			con.Scan("Writes (%): ", &writes)
+
+			pool.Go(func() {
+				for i := 0; i < count; i++ {
+					done := false
+					if sim.Random(100) < int64(writes) {
+						done = clients[id].operate(true, fmt.Sprintf("b%d", i))
+					} else {
+						done = clients[id].operate(false, "")
+					}
+					if !done {
+						l.Printf("Client %d stopped after %d of %d operation(s)", id, i, count)
+						return
+					}
+				}
+				l.Printf("Client %d finished %d operation(s)", id, count)
+			})
+		} else if cmd == "leases" {
+			enabled := !pool.leases.Load()
+			pool.leases.Store(enabled)
+			fmt.Printf("Quorum leases: %s\n", enabledString(enabled))
+		} else if cmd == "stats" {
+			pool.statsMu.Lock()
+			for i, label := range []string{"Without leases", "With leases"} {
+				st := pool.stats[i]
+				if st.reads == 0 && st.writes == 0 {
+					continue
+				}
+
+				fmt.Printf("%s: %d read(s)", label, st.reads)
+				if st.reads > 0 {
+					fmt.Printf(" (%d local), mean %v", st.localReads, (st.readTime / time.Duration(st.reads)).Round(time.Millisecond))
+				}
+				fmt.Printf(", %d write(s)", st.writes)
+				if st.writes > 0 {
+					fmt.Printf(", mean %v", (st.writeTime / time.Duration(st.writes)).Round(time.Millisecond))
+				}
+				fmt.Println()
+			}
+			pool.statsMu.Unlock()
+		} else if cmd == "reconfig" {
+			var list string
+
+			con.Scan("New members (e.g. 2,3,4): ", &list)
+
+			next := []int{}
+			for _, s := range strings.Split(list, ",") {
+				id, err := strconv.Atoi(s)
+				if err != nil || id < 0 || id >= serverCount {
+					next = nil
+					break
+				}
+				next = append(next, id)
+			}
+			if len(next) == 0 {
+				fmt.Println("Invalid member list")
+				continue
+			}
+
+			pool.Go(func() {
+				reconfigure(pool, servers, next, l)
+			})
+		} else if cmd == "crash" || cmd == "recover" {
+			var id int
+
+			con.Scan("Server: ", &id)
+
+			servers[id].crashed.Store(cmd == "crash")
+			if cmd == "recover" {
+				// lease state does not survive a crash
+				servers[id].mu.Lock()
+				servers[id].leaseUntil = time.Time{}
+				servers[id].blocked = 0
+				servers[id].mu.Unlock()
+			}
+		} else if cmd == "latency" {
+			var lmin, lmax int64
+
+			con.Scan("Min latency (ms): ", &lmin)
+			con.Scan("Max latency (ms): ", &lmax)
+
+			pool.lmin.Store(lmin)
+			pool.lmax.Store(lmax)
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	close(pool.stop)
+
+	fmt.Println("Waiting for operations in flight")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
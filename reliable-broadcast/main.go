@@ -0,0 +1,402 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type message struct {
+	ack bool
+	from int // node that put this copy on the network
+	sender int // node that broadcast the message
+	sequence int
+	data string
+
+	// latency range reused by acknowledgements and retransmissions
+	lmin, lmax int
+}
+
+type key struct {
+	sender int
+	sequence int
+}
+
+type nodePool struct {
+	*sim.Pool
+	participants int
+	send func(from, to int, m message)
+
+	// wait this long for an acknowledgement before sending again
+	timeout time.Duration
+	retransmissions atomic.Int64
+
+	// deliberately weaken the protocol for demonstration
+	skipRetransmit atomic.Bool
+}
+
+func newNodePool(participants int, send func(from, to int, m message)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.participants = participants
+	pool.send = send
+	pool.timeout = 0
+	pool.retransmissions.Store(0)
+	pool.skipRetransmit.Store(false)
+	return pool
+}
+
+type node struct {
+	*sim.Process
+	pool *nodePool
+
+	sendSeq int
+	delivered map[key]bool
+	unacked map[key]map[int]bool // nodes yet to acknowledge each of our broadcasts
+	mu sync.Mutex
+
+	inbox chan message
+}
+
+func newNode(pool *nodePool, id, clockSpeed int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.sendSeq = 0
+	n.delivered = make(map[key]bool)
+	n.unacked = make(map[key]map[int]bool)
+	n.inbox = make(chan message)
+	return n
+}
+
+func (n *node) Run() {
+	n.Start(nil)
+
+	// poll messages and acknowledgements
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
+
+func (n *node) send(data string, lmin, lmax int) {
+	n.mu.Lock()
+	m := message{
+		from: n.ID(),
+		sender: n.ID(),
+		sequence: n.sendSeq,
+		data: data,
+		lmin: lmin,
+		lmax: lmax,
+	}
+	n.sendSeq++
+
+	targets := make(map[int]bool)
+	for i := 0; i < n.pool.participants; i++ {
+		if i != n.ID() {
+			targets[i] = true
+		}
+	}
+	n.unacked[key{m.sender, m.sequence}] = targets
+
+	n.Printf("Node %d sends broadcast #%d: %s", n.ID(), m.sequence, data)
+
+	// the sender delivers its own broadcast right away
+	n.deliver(m)
+	n.mu.Unlock()
+
+	for to := range targets {
+		n.pool.send(n.ID(), to, m)
+	}
+
+	go n.retransmit(m)
+}
+
+// send again to every node that has not acknowledged in time, until all have
+func (n *node) retransmit(m message) {
+	k := key{m.sender, m.sequence}
+
+	for {
+		select {
+		case <-time.After(n.pool.timeout):
+		case <-n.Done():
+			return
+		}
+
+		n.mu.Lock()
+		targets := []int{}
+		for to := range n.unacked[k] {
+			targets = append(targets, to)
+		}
+		n.mu.Unlock()
+
+		if len(targets) == 0 {
+			return
+		}
+		if n.pool.skipRetransmit.Load() {
+			continue
+		}
+
+		sort.Ints(targets)
+		for _, to := range targets {
+			n.Printf("Node %d retransmits broadcast #%d to node %d", n.ID(), m.sequence, to)
+			n.pool.retransmissions.Add(1)
+			n.pool.send(n.ID(), to, m)
+		}
+	}
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	k := key{m.sender, m.sequence}
+
+	if m.ack {
+		targets, ok := n.unacked[k]
+		if !ok || !targets[m.from] {
+			return
+		}
+
+		delete(targets, m.from)
+		n.Printf("Node %d got acknowledgement of broadcast #%d from node %d", n.ID(), m.sequence, m.from)
+		if len(targets) == 0 {
+			delete(n.unacked, k)
+			n.Printf("Node %d: broadcast #%d acknowledged by every node", n.ID(), m.sequence)
+		}
+		return
+	}
+
+	// acknowledge every copy, the previous acknowledgement may have been lost
+	ack := m
+	ack.ack = true
+	ack.from = n.ID()
+	n.pool.send(n.ID(), m.from, ack)
+
+	if n.delivered[k] {
+		n.Printf("Node %d ignores duplicate broadcast #%d from node %d", n.ID(), m.sequence, m.sender)
+		return
+	}
+	n.deliver(m)
+}
+
+// node lock must be held
+func (n *node) deliver(m message) {
+	n.delivered[key{m.sender, m.sequence}] = true
+	n.Printf("Node %d receives broadcast: %s (from node %d)", n.ID(), m.data, m.sender)
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func main() {
+	timeout := flag.Duration("timeout", 500*time.Millisecond, "retransmit a broadcast that has not been acknowledged within this time")
+	distribution := flag.String("latency", "uniform", "latency distribution: uniform, normal, exponential or pareto")
+	topology := flag.String("topology", "mesh", "how nodes are wired: mesh, ring, line, star, tree, random:<p> or file:<path>")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *timeout <= 0 {
+		fmt.Println("Timeout must be positive")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		return sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+	})
+
+	wiring, err := sim.ParseTopology(*topology, nodeCount)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	network.SetTopology(wiring)
+
+	network.Latencies, err = sim.ParseDistribution(*distribution)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	network.OnDrop = func(p *sim.Packet[message], reason string) {
+		if p.Msg.ack {
+			l.Printf("Acknowledgement of broadcast #%d from node %d to node %d dropped (%s)", p.Msg.sequence, p.From, p.To, reason)
+		} else {
+			l.Printf("Broadcast #%d from node %d to node %d dropped (%s)", p.Msg.sequence, p.Msg.sender, p.To, reason)
+		}
+	}
+
+	sender := func(from, to int, m message) {
+		network.Send(from, to, m, network.Latency(from, to, m.lmin, m.lmax))
+	}
+
+	pool := newNodePool(nodeCount, sender)
+	pool.timeout = *timeout
+	for i := 0; i < nodeCount; i++ {
+		clockSpeed := int(500 + sim.Random(500))
+
+		nodes[i] = newNode(pool, i, clockSpeed, l)
+		nodes[i].Run()
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, broadcast, inflight, deliver, drop, loss, cut, restore, stats, drain, topology, partition, heal, logs, toggle, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				fmt.Printf("Node %d delivered %d of %d broadcast(s), %d awaiting acknowledgement\n", nodes[i].ID(), len(nodes[i].delivered), network.Stats.Broadcasts.Load(), len(nodes[i].unacked))
+				nodes[i].mu.Unlock()
+			}
+		} else if cmd == "broadcast" {
+			var sender int
+			var data string
+			var lmin, lmax int
+
+			con.Scan("Sender: ", &sender)
+			con.Scan("Data: ", &data)
+			con.Scan("Min latency (ms): ", &lmin)
+			con.Scan("Max latency (ms): ", &lmax)
+
+			network.Stats.Broadcasts.Add(1)
+			nodes[sender].send(data, lmin, lmax)
+		} else if cmd == "inflight" {
+			packets := network.InFlight()
+			if len(packets) == 0 {
+				fmt.Println("No messages in flight")
+			}
+			for _, p := range packets {
+				kind := "broadcast"
+				if p.Msg.ack {
+					kind = "ack of"
+				}
+				fmt.Printf("#%d: node %d -> node %d, %s #%d from node %d, due in %v%s\n", p.ID, p.From, p.To, kind, p.Msg.sequence, p.Msg.sender, time.Until(p.Due).Round(time.Millisecond), sim.Via(p.Route))
+			}
+		} else if cmd == "deliver" || cmd == "drop" {
+			var id int
+
+			con.Scan("Message ID: ", &id)
+
+			if !network.Signal(id, cmd) {
+				fmt.Println("No such message in flight")
+			}
+		} else if cmd == "loss" {
+			// lossy link: every message on it is lost with the given probability
+
+			var source, target, percent int
+
+			con.Scan("Source node: ", &source)
+			con.Scan("Target node: ", &target)
+			con.Scan("Drop probability (%): ", &percent)
+
+			if percent < 0 || percent > 100 {
+				fmt.Println("Invalid percentage")
+				continue
+			}
+			network.Lose(source, target, percent)
+
+			fmt.Printf("Link %d -> %d loses %d%% of messages\n", source, target, percent)
+		} else if cmd == "cut" || cmd == "restore" {
+			// one-way link failure, retransmissions get through once it is restored
+
+			var source, target int
+
+			con.Scan("Source node: ", &source)
+			con.Scan("Target node: ", &target)
+
+			network.Cut(source, target, cmd == "cut")
+
+			if cmd == "cut" {
+				fmt.Printf("Link %d -> %d is down\n", source, target)
+			} else {
+				fmt.Printf("Link %d -> %d is restored\n", source, target)
+			}
+		} else if cmd == "stats" {
+			delivered := 0
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				delivered += len(nodes[i].delivered)
+				nodes[i].mu.Unlock()
+			}
+			network.Stats.Report(os.Stdout, nodeCount, delivered)
+			fmt.Printf("Retransmissions: %d\n", pool.retransmissions.Load())
+		} else if cmd == "drain" {
+			// deliver everything in flight now instead of waiting for it
+			fmt.Printf("Delivered %d message(s) early\n", network.Drain())
+		} else if cmd == "topology" {
+			// messages to non-neighbors are forwarded hop by hop along the shortest path
+			fmt.Printf("Topology: %s\n", wiring)
+			for i := 0; i < nodeCount; i++ {
+				fmt.Printf("Node %d: neighbors %v\n", i, wiring.Neighbors(i))
+			}
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "toggle" {
+			var mechanism string
+			con.Scan("Mechanism (retransmit): ", &mechanism)
+
+			if mechanism == "retransmit" {
+				skip := !pool.skipRetransmit.Load()
+				pool.skipRetransmit.Store(skip)
+				fmt.Printf("Retransmission: %s\n", enabledString(!skip))
+			} else {
+				fmt.Println("Unknown mechanism")
+			}
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
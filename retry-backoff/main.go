@@ -0,0 +1,504 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type policy struct {
+	name string
+	base, cap time.Duration
+	backoff bool
+	jitter string // none, full, equal
+}
+
+// delay before the given retry (attempt starts at 1)
+func (p policy) delay(attempt int) time.Duration {
+	d := p.base
+	if p.backoff {
+		for i := 1; i < attempt && d < p.cap; i++ {
+			d *= 2
+		}
+		if d > p.cap {
+			d = p.cap
+		}
+	}
+
+	if p.jitter == "full" {
+		return time.Duration(sim.Random(int64(d)))
+	} else if p.jitter == "equal" {
+		return d/2 + time.Duration(sim.Random(int64(d/2)))
+	}
+	return d
+}
+
+type job struct {
+	deadline time.Time // when the client stops waiting
+	done chan bool
+}
+
+// a recovering server with a fixed number of workers and a bounded queue
+type server struct {
+	*sim.Pool
+
+	workers int
+	queueLimit int
+	service time.Duration
+	slot time.Duration
+	downtime time.Duration
+
+	// temporary slowdown that triggers overload
+	slowdown float64
+	slowFrom, slowUntil time.Duration
+
+	queue chan *job
+	start time.Time
+	arrivals []int
+	accepted []int // served before the client gave up
+	rejected []int // queue full or server down
+	wasted []int // served after the client gave up
+	mu sync.Mutex
+}
+
+func newServer() *server {
+	s := new(server)
+	s.Pool = sim.NewPool()
+	s.workers = 4
+	s.queueLimit = 200
+	s.service = 20 * time.Millisecond
+	s.slot = 100 * time.Millisecond
+	s.downtime = 2 * time.Second
+	s.slowdown = 1
+	s.start = time.Now()
+	s.startWorkers()
+	return s
+}
+
+func (s *server) startWorkers() {
+	queue := make(chan *job, s.queueLimit)
+	s.queue = queue
+	for i := 0; i < s.workers; i++ {
+		s.Go(func() {
+			for j := range queue {
+				s.mu.Lock()
+				service := s.service
+				elapsed := time.Since(s.start)
+				if elapsed >= s.slowFrom && elapsed < s.slowUntil {
+					service = time.Duration(float64(service) * s.slowdown)
+				}
+				s.mu.Unlock()
+
+				time.Sleep(service)
+
+				// the server cannot tell whether the client is still waiting, so late work is wasted
+				s.count(func(i int) {
+					if time.Now().After(j.deadline) {
+						s.wasted[i]++
+					} else {
+						s.accepted[i]++
+					}
+				})
+				j.done <- true
+			}
+		})
+	}
+}
+
+// restart the workers with new limits, requests already queued are drained by the old ones
+func (s *server) resize(workers, queueLimit int) {
+	old := s.queue
+	s.workers = workers
+	s.queueLimit = queueLimit
+	s.startWorkers()
+	close(old)
+}
+
+func (s *server) reset() {
+	s.mu.Lock()
+	s.start = time.Now()
+	s.arrivals = nil
+	s.accepted = nil
+	s.rejected = nil
+	s.wasted = nil
+	s.mu.Unlock()
+}
+
+// update the counters of the current slot
+func (s *server) count(update func(i int)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := int(time.Since(s.start) / s.slot)
+	for len(s.arrivals) <= i {
+		s.arrivals = append(s.arrivals, 0)
+		s.accepted = append(s.accepted, 0)
+		s.rejected = append(s.rejected, 0)
+		s.wasted = append(s.wasted, 0)
+	}
+	update(i)
+}
+
+func (s *server) handle(timeout time.Duration) bool {
+	time.Sleep(5 * time.Millisecond)
+
+	down := false
+	s.count(func(i int) {
+		s.arrivals[i]++
+		down = time.Since(s.start) < s.downtime
+		if down {
+			s.rejected[i]++
+		}
+	})
+	if down {
+		return false
+	}
+
+	j := &job{deadline: time.Now().Add(timeout), done: make(chan bool, 1)}
+	select {
+	case s.queue <- j:
+	default:
+		s.count(func(i int) { s.rejected[i]++ })
+		return false
+	}
+
+	select {
+	case <-j.done:
+		return time.Now().Before(j.deadline)
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+type result struct {
+	attempts int
+	recovery time.Duration // from server recovery until the last client succeeded
+	peak int
+	gaveUp int
+}
+
+func run(s *server, p policy, clients int, timeout, requestTimeout time.Duration, l sim.Logger) result {
+	s.reset()
+	deadline := s.start.Add(timeout)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	res := result{}
+	last := s.start
+
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+
+			for attempt := 1; ; attempt++ {
+				mu.Lock()
+				res.attempts++
+				mu.Unlock()
+
+				if s.handle(requestTimeout) {
+					mu.Lock()
+					if time.Now().After(last) {
+						last = time.Now()
+					}
+					mu.Unlock()
+					return
+				}
+
+				d := p.delay(attempt)
+				if time.Now().Add(d).After(deadline) {
+					mu.Lock()
+					res.gaveUp++
+					mu.Unlock()
+					l.Printf("Client %d gave up after %d attempt(s)", id, attempt)
+					return
+				}
+				time.Sleep(d)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	res.recovery = last.Sub(s.start.Add(s.downtime))
+	if res.recovery < 0 {
+		res.recovery = 0
+	}
+	for _, a := range s.arrivals {
+		if a > res.peak {
+			res.peak = a
+		}
+	}
+
+	l.Printf("Policy %s: %d attempt(s), recovered in %v, peak %d arrivals per slot, %d gave up", p.name, res.attempts, res.recovery.Round(time.Millisecond), res.peak, res.gaveUp)
+	return res
+}
+
+// open-loop traffic below capacity, a temporary slowdown, and clients retrying failed requests
+func storm(s *server, p policy, rate, retries int, duration, requestTimeout time.Duration, l sim.Logger) {
+	s.reset()
+	deadline := s.start.Add(duration)
+
+	var wg sync.WaitGroup
+	next := s.start
+	for next.Before(deadline) {
+		time.Sleep(time.Until(next))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for attempt := 1; attempt <= retries+1; attempt++ {
+				if s.handle(requestTimeout) {
+					return
+				}
+				if attempt <= retries {
+					time.Sleep(p.delay(attempt))
+				}
+			}
+		}()
+
+		next = next.Add(time.Second / time.Duration(rate))
+	}
+	wg.Wait()
+
+	// compare goodput before, during and after the trigger
+	s.mu.Lock()
+	phases := [3]struct{ served, slots int }{}
+	for i := range s.accepted {
+		at := time.Duration(i) * s.slot
+		if at >= duration {
+			break
+		}
+		phase := 0
+		if at >= s.slowUntil {
+			phase = 2
+		} else if at >= s.slowFrom {
+			phase = 1
+		}
+		phases[phase].served += s.accepted[i]
+		phases[phase].slots++
+	}
+	s.mu.Unlock()
+
+	goodput := [3]float64{}
+	for i, phase := range phases {
+		if phase.slots > 0 {
+			goodput[i] = float64(phase.served) / (float64(phase.slots) * s.slot.Seconds())
+		}
+	}
+
+	fmt.Printf("Goodput: %.0f req/s before, %.0f during, %.0f after the trigger (offered %d req/s)\n", goodput[0], goodput[1], goodput[2], rate)
+	if goodput[2] < goodput[0]/2 {
+		fmt.Println("METASTABLE: the overload outlived its trigger, retries keep the server saturated")
+	}
+	l.Printf("Storm with %s, %d retries: goodput %.0f/%.0f/%.0f req/s before/during/after", p.name, retries, goodput[0], goodput[1], goodput[2])
+}
+
+func plot(s *server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	max := 0
+	for _, a := range s.arrivals {
+		if a > max {
+			max = a
+		}
+	}
+
+	fmt.Printf("%6s %s %9s %5s %5s %s\n", "t", " ", "ok/total", "rej", "late", "arrivals")
+	idle := false
+	for i, a := range s.arrivals {
+		if a == 0 {
+			// collapse quiet stretches
+			if !idle {
+				fmt.Println("   ...")
+			}
+			idle = true
+			continue
+		}
+		idle = false
+
+		at := time.Duration(i) * s.slot
+		marker := " "
+		if at < s.downtime {
+			marker = "x" // server still down
+		} else if at >= s.slowFrom && at < s.slowUntil {
+			marker = "!" // slowdown trigger active
+		}
+		fmt.Printf("%6v %s %4d/%-4d %5d %5d %s\n", at, marker, s.accepted[i], a, s.rejected[i], s.wasted[i], strings.Repeat("#", a*50/max))
+	}
+}
+
+func main() {
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var clients int
+	con.Scan("Number of clients: ", &clients)
+
+	s := newServer()
+	timeout := 30 * time.Second
+	requestTimeout := 500 * time.Millisecond
+
+	policies := []policy{
+		{name: "fixed", base: 100 * time.Millisecond, cap: 5 * time.Second, backoff: false, jitter: "none"},
+		{name: "exponential", base: 100 * time.Millisecond, cap: 5 * time.Second, backoff: true, jitter: "none"},
+		{name: "full-jitter", base: 100 * time.Millisecond, cap: 5 * time.Second, backoff: true, jitter: "full"},
+		{name: "equal-jitter", base: 100 * time.Millisecond, cap: 5 * time.Second, backoff: true, jitter: "equal"},
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, server, backoff, run, compare, storm, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			fmt.Printf("Clients: %d, request timeout %v, server down for %v\n", clients, requestTimeout, s.downtime)
+			fmt.Printf("Server: %d worker(s), queue limit %d, %v per request (%.0f req/s capacity)\n", s.workers, s.queueLimit, s.service, float64(s.workers)/s.service.Seconds())
+			for _, p := range policies {
+				fmt.Printf("Policy %s (base %v, cap %v, backoff: %v, jitter: %s)\n", p.name, p.base, p.cap, p.backoff, p.jitter)
+			}
+		} else if cmd == "server" {
+			var downtime, service, timeout string
+			var workers, queueLimit int
+
+			con.Scan("Downtime (e.g. 2s): ", &downtime)
+			con.Scan("Workers: ", &workers)
+			con.Scan("Queue limit: ", &queueLimit)
+			con.Scan("Service time (e.g. 20ms): ", &service)
+			con.Scan("Client request timeout (e.g. 500ms): ", &timeout)
+
+			d, err1 := time.ParseDuration(downtime)
+			st, err2 := time.ParseDuration(service)
+			rt, err3 := time.ParseDuration(timeout)
+			if err1 != nil || err2 != nil || err3 != nil || workers < 1 || queueLimit < 0 {
+				fmt.Println("Invalid server settings")
+				continue
+			}
+
+			s.downtime = d
+			s.service = st
+			requestTimeout = rt
+			s.resize(workers, queueLimit)
+		} else if cmd == "backoff" {
+			var base, cap string
+
+			con.Scan("Base delay (e.g. 100ms): ", &base)
+			con.Scan("Max delay (e.g. 5s): ", &cap)
+
+			b, err1 := time.ParseDuration(base)
+			c, err2 := time.ParseDuration(cap)
+			if err1 != nil || err2 != nil || b <= 0 || c < b {
+				fmt.Println("Invalid delays")
+				continue
+			}
+			for i := range policies {
+				policies[i].base = b
+				policies[i].cap = c
+			}
+		} else if cmd == "run" {
+			var name string
+			con.Scan("Policy (fixed, exponential, full-jitter, equal-jitter): ", &name)
+
+			found := false
+			for _, p := range policies {
+				if p.name == name {
+					found = true
+					res := run(s, p, clients, timeout, requestTimeout, l)
+					plot(s)
+					fmt.Printf("%d attempt(s), all served %v after recovery, peak %d arrivals per slot, %d gave up\n", res.attempts, res.recovery.Round(time.Millisecond), res.peak, res.gaveUp)
+				}
+			}
+			if !found {
+				fmt.Println("Unknown policy")
+			}
+		} else if cmd == "compare" {
+			results := make([]result, len(policies))
+			for i, p := range policies {
+				results[i] = run(s, p, clients, timeout, requestTimeout, l)
+			}
+
+			fmt.Printf("%-14s %9s %10s %6s %7s\n", "policy", "attempts", "recovery", "peak", "gaveup")
+			for i, p := range policies {
+				fmt.Printf("%-14s %9d %10v %6d %7d\n", p.name, results[i].attempts, results[i].recovery.Round(time.Millisecond), results[i].peak, results[i].gaveUp)
+			}
+		} else if cmd == "storm" {
+			// metastable failure: a short slowdown turns into a retry storm that does not go away
+			var name, duration, from, until string
+			var rate, retries int
+			var factor float64
+
+			con.Scan("Policy (fixed, exponential, full-jitter, equal-jitter): ", &name)
+			con.Scan("Arrival rate (req/s): ", &rate)
+			con.Scan("Retries per request: ", &retries)
+			con.Scan("Duration (e.g. 10s): ", &duration)
+			con.Scan("Slowdown from (e.g. 2s): ", &from)
+			con.Scan("Slowdown until (e.g. 4s): ", &until)
+			con.Scan("Slowdown factor (e.g. 3): ", &factor)
+
+			d, err1 := time.ParseDuration(duration)
+			f, err2 := time.ParseDuration(from)
+			u, err3 := time.ParseDuration(until)
+			if err1 != nil || err2 != nil || err3 != nil || rate < 1 || retries < 0 || factor <= 0 {
+				fmt.Println("Invalid parameters")
+				continue
+			}
+
+			var chosen *policy
+			for i := range policies {
+				if policies[i].name == name {
+					chosen = &policies[i]
+				}
+			}
+			if chosen == nil {
+				fmt.Println("Unknown policy")
+				continue
+			}
+
+			// the server is up from the start in this scenario
+			downtime := s.downtime
+			s.mu.Lock()
+			s.downtime = 0
+			s.slowdown, s.slowFrom, s.slowUntil = factor, f, u
+			s.mu.Unlock()
+
+			storm(s, *chosen, rate, retries, d, requestTimeout, l)
+			plot(s)
+
+			s.mu.Lock()
+			s.downtime = downtime
+			s.slowdown, s.slowFrom, s.slowUntil = 1, 0, 0
+			s.mu.Unlock()
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	// the workers drain what is still queued, then stop
+	close(s.queue)
+
+	fmt.Println("Waiting all workers to shut down")
+	s.Wait()
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+type message struct {
+	kind string // transfer or marker
+	from int
+	seq int // per channel, so channels can be made FIFO
+	amount int
+	snapshot int
+}
+
+type nodePool struct {
+	*sim.Pool
+	participants int
+	send func(from, to int, m message)
+
+	// nodes send random transfers to each other while enabled
+	traffic atomic.Bool
+
+	// deliberately weaken the protocol for demonstration
+	skipChannels atomic.Bool
+	skipFIFO atomic.Bool
+}
+
+func newNodePool(participants int, send func(from, to int, m message)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.participants = participants
+	pool.send = send
+	pool.traffic.Store(true)
+	pool.skipChannels.Store(false)
+	pool.skipFIFO.Store(false)
+	return pool
+}
+
+type node struct {
+	*sim.Process
+	pool *nodePool
+	mu sync.Mutex
+
+	balance int
+
+	// FIFO channels: next sequence number out, next expected in, and early arrivals
+	sendSeq []int
+	expected []int
+	held []map[int]message
+
+	// the latest snapshot as seen by this node
+	snapshot int
+	recorded bool
+	recordedBalance int
+	channels [][]int // transfers recorded on each incoming channel
+	recording []bool
+	markers int // incoming channels still waiting for a marker
+
+	inbox chan message
+}
+
+func newNode(pool *nodePool, id, clockSpeed, balance int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.balance = balance
+	n.sendSeq = make([]int, pool.participants)
+	n.expected = make([]int, pool.participants)
+	n.held = make([]map[int]message, pool.participants)
+	for i := range n.held {
+		n.held[i] = make(map[int]message)
+	}
+	n.snapshot = 0
+	n.recorded = false
+	n.inbox = make(chan message)
+	return n
+}
+
+func (n *node) Run() {
+	n.Start(n.tick)
+
+	// poll channel messages
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
+
+// node lock must be held
+func (n *node) send(to int, m message) {
+	m.from = n.ID()
+	m.seq = n.sendSeq[to]
+	n.sendSeq[to]++
+	n.pool.send(n.ID(), to, m)
+}
+
+func (n *node) transfer(to, amount int) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if to == n.ID() || amount <= 0 || amount > n.balance {
+		return false
+	}
+
+	n.balance -= amount
+	n.Printf("Node %d sends %d to node %d (balance: %d)", n.ID(), amount, to, n.balance)
+	n.send(to, message{kind: "transfer", amount: amount})
+	return true
+}
+
+func (n *node) tick() {
+	if !n.pool.traffic.Load() || n.pool.participants < 2 {
+		return
+	}
+
+	n.mu.Lock()
+	balance := n.balance
+	n.mu.Unlock()
+
+	if balance == 0 {
+		return
+	}
+
+	to := int(sim.Random(int64(n.pool.participants - 1)))
+	if to >= n.ID() {
+		to++
+	}
+	n.transfer(to, int(1+sim.Random(int64(balance))))
+}
+
+// record local state and send markers on every outgoing channel (node lock must be held)
+func (n *node) record(snapshot int) {
+	n.snapshot = snapshot
+	n.recorded = true
+	n.recordedBalance = n.balance
+	n.channels = make([][]int, n.pool.participants)
+	n.recording = make([]bool, n.pool.participants)
+	n.markers = 0
+	for i := range n.recording {
+		if i != n.ID() {
+			n.recording[i] = true
+			n.markers++
+		}
+	}
+
+	n.Printf("Node %d records balance %d for snapshot %d", n.ID(), n.balance, snapshot)
+	for to := 0; to < n.pool.participants; to++ {
+		if to != n.ID() {
+			n.send(to, message{kind: "marker", snapshot: snapshot})
+		}
+	}
+}
+
+func (n *node) initiate(snapshot int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.Printf("Node %d initiates snapshot %d", n.ID(), snapshot)
+	n.record(snapshot)
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.pool.skipFIFO.Load() || m.seq < n.expected[m.from] {
+		// late arrivals from while FIFO was off are taken as they come
+		if m.seq >= n.expected[m.from] {
+			n.expected[m.from] = m.seq + 1
+		}
+		n.process(m)
+		return
+	}
+
+	// hold back messages that overtook earlier ones on the same channel
+	n.held[m.from][m.seq] = m
+	for {
+		next, ok := n.held[m.from][n.expected[m.from]]
+		if !ok {
+			break
+		}
+		delete(n.held[m.from], n.expected[m.from])
+		n.expected[m.from]++
+		n.process(next)
+	}
+}
+
+// node lock must be held
+func (n *node) process(m message) {
+	if m.kind == "transfer" {
+		n.balance += m.amount
+		n.Printf("Node %d receives %d from node %d (balance: %d)", n.ID(), m.amount, m.from, n.balance)
+
+		// in flight when the sender recorded, arrived after we did
+		if n.recorded && n.recording[m.from] && !n.pool.skipChannels.Load() {
+			n.channels[m.from] = append(n.channels[m.from], m.amount)
+		}
+	} else if m.kind == "marker" {
+		if m.snapshot > n.snapshot {
+			// first marker: the channel it came on is empty
+			n.record(m.snapshot)
+		} else if m.snapshot < n.snapshot {
+			return
+		}
+
+		if n.recording[m.from] {
+			n.recording[m.from] = false
+			n.markers--
+			n.Printf("Node %d closes channel %d -> %d with %v", n.ID(), m.from, n.ID(), n.channels[m.from])
+			if n.markers == 0 {
+				n.Printf("Node %d is done with snapshot %d", n.ID(), n.snapshot)
+			}
+		}
+	}
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func main() {
+	balance := flag.Int("balance", 100, "money each node starts with")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	var lmin, lmax atomic.Int64
+	lmin.Store(50)
+	lmax.Store(500)
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		return sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+	})
+
+	sender := func(from, to int, m message) {
+		network.Send(from, to, m, sim.Latency(int(lmin.Load()), int(lmax.Load())))
+	}
+
+	pool := newNodePool(nodeCount, sender)
+	for i := 0; i < nodeCount; i++ {
+		clockSpeed := int(200 + sim.Random(300))
+
+		nodes[i] = newNode(pool, i, clockSpeed, *balance, l)
+		nodes[i].Run()
+	}
+
+	total := *balance * nodeCount
+	snapshot := 0
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, transfer, snapshot, traffic, latency, partition, heal, logs, toggle, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			live := 0
+			recorded := 0
+			complete := true
+
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				n := nodes[i]
+				live += n.balance
+
+				fmt.Printf("Node %d: balance %d", n.ID(), n.balance)
+				if n.recorded && n.snapshot == snapshot {
+					fmt.Printf(", recorded %d", n.recordedBalance)
+					recorded += n.recordedBalance
+
+					for from := range n.channels {
+						if from == n.ID() {
+							continue
+						}
+						status := ""
+						if n.recording[from] {
+							status = " (still recording)"
+							complete = false
+						}
+						fmt.Printf(", channel %d -> %d: %v%s", from, n.ID(), n.channels[from], status)
+						for _, amount := range n.channels[from] {
+							recorded += amount
+						}
+					}
+				} else if snapshot > 0 {
+					fmt.Printf(", not recorded yet")
+					complete = false
+				}
+				fmt.Println()
+
+				nodes[i].mu.Unlock()
+			}
+
+			fmt.Printf("Money held by nodes right now: %d of %d (the rest is in flight)\n", live, total)
+			if snapshot == 0 {
+				fmt.Println("No snapshot taken yet")
+			} else if !complete {
+				fmt.Printf("Snapshot %d is still being taken\n", snapshot)
+			} else if recorded == total {
+				fmt.Printf("Snapshot %d is consistent: recorded states and channels add up to %d\n", snapshot, recorded)
+			} else {
+				fmt.Printf("Snapshot %d is INCONSISTENT: recorded states and channels add up to %d, expected %d\n", snapshot, recorded, total)
+			}
+		} else if cmd == "transfer" {
+			var from, to, amount int
+
+			con.Scan("From: ", &from)
+			con.Scan("To: ", &to)
+			con.Scan("Amount: ", &amount)
+
+			if !nodes[from].transfer(to, amount) {
+				fmt.Println("Invalid transfer")
+			}
+		} else if cmd == "snapshot" {
+			var initiator int
+
+			con.Scan("Initiator: ", &initiator)
+
+			snapshot++
+			nodes[initiator].initiate(snapshot)
+		} else if cmd == "traffic" {
+			traffic := !pool.traffic.Load()
+			pool.traffic.Store(traffic)
+			fmt.Printf("Random transfers: %s\n", enabledString(traffic))
+		} else if cmd == "latency" {
+			var lo, hi int64
+
+			con.Scan("Min latency (ms): ", &lo)
+			con.Scan("Max latency (ms): ", &hi)
+
+			lmin.Store(lo)
+			lmax.Store(hi)
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "toggle" {
+			var mechanism string
+			con.Scan("Mechanism (channels, fifo): ", &mechanism)
+
+			if mechanism == "channels" {
+				skip := !pool.skipChannels.Load()
+				pool.skipChannels.Store(skip)
+				fmt.Printf("Recording channel states: %s\n", enabledString(!skip))
+			} else if mechanism == "fifo" {
+				skip := !pool.skipFIFO.Load()
+				pool.skipFIFO.Store(skip)
+				fmt.Printf("FIFO channels: %s\n", enabledString(!skip))
+			} else {
+				fmt.Println("Unknown mechanism")
+			}
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+const root = 0
+
+type message struct {
+	kind string // ping, explore, adopt, leave, detach, rejoin, query or report
+	from int
+	dist int // explore: hops from the root through the sender
+	round int // query and report
+	sum int // report: total of the sender's subtree
+}
+
+type nodePool struct {
+	*sim.Pool
+	send func(from, to int, m message)
+	topology *sim.Topology
+
+	// a tree neighbor not heard from within the timeout is gone
+	timeout time.Duration
+
+	// the root reports convergecast results here
+	report func(round, sum int)
+}
+
+func newNodePool(send func(from, to int, m message), topology *sim.Topology) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.send = send
+	pool.topology = topology
+	pool.timeout = 0
+	pool.report = nil
+	return pool
+}
+
+type node struct {
+	*sim.Process
+	pool *nodePool
+
+	value int
+	parent int // -1 while detached from the tree
+	dist int
+	children map[int]bool
+	lastHeard map[int]time.Time
+
+	// convergecast in progress: children still to report and the sum so far
+	round int
+	waiting map[int]bool
+	partial int
+
+	mu sync.Mutex
+
+	inbox chan message
+}
+
+func newNode(pool *nodePool, id, clockSpeed, value int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.value = value
+	n.parent = -1
+	n.dist = math.MaxInt
+	n.children = make(map[int]bool)
+	n.lastHeard = make(map[int]time.Time)
+	n.round = 0
+	n.waiting = nil
+	n.inbox = make(chan message)
+	if id == root {
+		n.dist = 0
+	}
+	return n
+}
+
+func (n *node) Run() {
+	// heartbeats to the neighbors and failure detection
+	n.Start(n.tick)
+
+	// poll tree messages
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
+
+// node lock must be held
+func (n *node) send(to int, m message) {
+	m.from = n.ID()
+	n.pool.send(n.ID(), to, m)
+}
+
+// offer every neighbor a path to the root through this node (node lock must be held)
+func (n *node) explore(except int) {
+	for _, to := range n.pool.topology.Neighbors(n.ID()) {
+		if to != except {
+			n.send(to, message{kind: "explore", dist: n.dist + 1})
+		}
+	}
+}
+
+// the root starts building the tree
+func (n *node) build() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.Printf("Node %d (root) starts building the tree", n.ID())
+	n.explore(-1)
+}
+
+// lost the way to the root: take the whole subtree off the tree and ask
+// the neighbors for a new parent (node lock must be held)
+func (n *node) orphan(reason string) {
+	n.Printf("Node %d is detached from the tree (%s)", n.ID(), reason)
+
+	n.parent = -1
+	n.dist = math.MaxInt
+	for child := range n.children {
+		n.send(child, message{kind: "detach"})
+	}
+	n.children = make(map[int]bool)
+	n.waiting = nil
+
+	for _, to := range n.pool.topology.Neighbors(n.ID()) {
+		n.send(to, message{kind: "rejoin"})
+	}
+}
+
+// node lock must be held
+func (n *node) removeChild(child int) {
+	delete(n.children, child)
+	if n.waiting[child] {
+		// its subtree will be missing from the sum
+		delete(n.waiting, child)
+		n.Printf("Node %d gives up on node %d for round %d", n.ID(), child, n.round)
+		n.converge()
+	}
+}
+
+func (n *node) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, to := range n.pool.topology.Neighbors(n.ID()) {
+		n.send(to, message{kind: "ping"})
+	}
+
+	if n.parent >= 0 && time.Since(n.lastHeard[n.parent]) > n.pool.timeout {
+		n.orphan(fmt.Sprintf("parent %d is silent", n.parent))
+		return
+	}
+	for child := range n.children {
+		if time.Since(n.lastHeard[child]) > n.pool.timeout {
+			n.Printf("Node %d lost child %d", n.ID(), child)
+			n.removeChild(child)
+		}
+	}
+
+	// detached nodes keep asking, a neighbor may have been cut off itself
+	if n.ID() != root && n.parent < 0 {
+		for _, to := range n.pool.topology.Neighbors(n.ID()) {
+			n.send(to, message{kind: "rejoin"})
+		}
+	}
+}
+
+// start a convergecast round at the root
+func (n *node) query(round int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.startRound(round)
+}
+
+// node lock must be held
+func (n *node) startRound(round int) {
+	n.round = round
+	n.partial = n.value
+	n.waiting = make(map[int]bool)
+	for child := range n.children {
+		n.waiting[child] = true
+		n.send(child, message{kind: "query", round: round})
+	}
+	n.converge()
+}
+
+// report the subtree sum once every child has (node lock must be held)
+func (n *node) converge() {
+	if n.waiting == nil || len(n.waiting) > 0 {
+		return
+	}
+	n.waiting = nil
+
+	if n.ID() == root {
+		n.pool.report(n.round, n.partial)
+	} else if n.parent >= 0 {
+		n.send(n.parent, message{kind: "report", round: n.round, sum: n.partial})
+	}
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.lastHeard[m.from] = time.Now()
+
+	switch m.kind {
+	case "explore":
+		if n.ID() == root || m.dist >= n.dist {
+			return
+		}
+		if n.parent >= 0 {
+			n.send(n.parent, message{kind: "leave"})
+		}
+		n.parent = m.from
+		n.dist = m.dist
+		n.Printf("Node %d joins the tree under node %d (%d hop(s) from the root)", n.ID(), m.from, m.dist)
+		n.send(m.from, message{kind: "adopt"})
+		n.explore(m.from)
+
+	case "adopt":
+		n.children[m.from] = true
+
+	case "leave":
+		n.removeChild(m.from)
+
+	case "detach":
+		if m.from == n.parent {
+			n.orphan(fmt.Sprintf("parent %d was detached", m.from))
+		}
+
+	case "rejoin":
+		if n.dist < math.MaxInt {
+			n.send(m.from, message{kind: "explore", dist: n.dist + 1})
+		}
+
+	case "query":
+		if m.from == n.parent {
+			n.startRound(m.round)
+		}
+
+	case "report":
+		if m.round != n.round || !n.waiting[m.from] {
+			return
+		}
+		delete(n.waiting, m.from)
+		n.partial += m.sum
+		n.converge()
+	}
+}
+
+// lines of the tree below a node by parent pointers, marking the nodes reached
+func printTree(b *strings.Builder, parents, values []int, reached []bool, at, depth int) {
+	reached[at] = true
+	fmt.Fprintf(b, "%s%d (value %d)\n", strings.Repeat("  ", depth), at, values[at])
+	for i, parent := range parents {
+		if parent == at && !reached[i] {
+			printTree(b, parents, values, reached, i, depth+1)
+		}
+	}
+}
+
+func main() {
+	topology := flag.String("topology", "ring", "how nodes are wired: mesh, ring, line, star, tree, random:<p> or file:<path>")
+	timeout := flag.Duration("timeout", 1500*time.Millisecond, "a tree neighbor not heard from within this time is gone")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *timeout <= 0 {
+		fmt.Println("Timeout must be positive")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	wiring, err := sim.ParseTopology(*topology, nodeCount)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	var lmin, lmax atomic.Int64
+	lmin.Store(20)
+	lmax.Store(100)
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		return sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+	})
+	network.SetTopology(wiring)
+
+	sender := func(from, to int, m message) {
+		network.Send(from, to, m, sim.Latency(int(lmin.Load()), int(lmax.Load())))
+	}
+
+	pool := newNodePool(sender, wiring)
+	pool.timeout = *timeout
+
+	// what the sum should be for each round, known to the observer only
+	expected := make(map[int]int)
+	var expectedMu sync.Mutex
+
+	pool.report = func(round, sum int) {
+		expectedMu.Lock()
+		want := expected[round]
+		expectedMu.Unlock()
+
+		if sum == want {
+			con.Notify("Round %d: global sum is %d (correct)", round, sum)
+		} else {
+			con.Notify("Round %d: global sum is %d, actual %d (subtrees were missing)", round, sum, want)
+		}
+	}
+
+	for i := 0; i < nodeCount; i++ {
+		nodes[i] = newNode(pool, i, 300, int(1+sim.Random(100)), l)
+		nodes[i].Run()
+	}
+	nodes[root].build()
+
+	round := 0
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, tree, sum, value, cut, restore, crash, latency, partition, heal, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			fmt.Printf("Topology: %s\n", wiring)
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				n := nodes[i]
+
+				children := []int{}
+				for child := range n.children {
+					children = append(children, child)
+				}
+				sort.Ints(children)
+
+				status := ""
+				if !n.Running() {
+					status = " (crashed)"
+				}
+				if n.ID() == root {
+					fmt.Printf("Node %d%s: root, value %d, children %v, neighbors %v\n", n.ID(), status, n.value, children, wiring.Neighbors(i))
+				} else if n.parent < 0 {
+					fmt.Printf("Node %d%s: detached, value %d, neighbors %v\n", n.ID(), status, n.value, wiring.Neighbors(i))
+				} else {
+					fmt.Printf("Node %d%s: parent %d, %d hop(s), value %d, children %v, neighbors %v\n", n.ID(), status, n.parent, n.dist, n.value, children, wiring.Neighbors(i))
+				}
+				nodes[i].mu.Unlock()
+			}
+		} else if cmd == "tree" {
+			parents := make([]int, nodeCount)
+			values := make([]int, nodeCount)
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				parents[i] = nodes[i].parent
+				values[i] = nodes[i].value
+				if !nodes[i].Running() {
+					parents[i] = -1
+				}
+				nodes[i].mu.Unlock()
+			}
+
+			var b strings.Builder
+			reached := make([]bool, nodeCount)
+			printTree(&b, parents, values, reached, root, 0)
+			fmt.Print(b.String())
+
+			detached := []int{}
+			for i := range reached {
+				if !reached[i] {
+					detached = append(detached, i)
+				}
+			}
+			if len(detached) > 0 {
+				fmt.Printf("Not in the tree: %v\n", detached)
+			}
+		} else if cmd == "sum" {
+			// convergecast: the query goes down the tree, subtree sums come back up
+			round++
+
+			total := 0
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				if nodes[i].Running() {
+					total += nodes[i].value
+				}
+				nodes[i].mu.Unlock()
+			}
+			expectedMu.Lock()
+			expected[round] = total
+			expectedMu.Unlock()
+
+			fmt.Printf("Round %d started, the answer is reported when it comes back\n", round)
+			nodes[root].query(round)
+		} else if cmd == "value" {
+			var id, value int
+
+			con.Scan("Node: ", &id)
+			con.Scan("Value: ", &value)
+
+			nodes[id].mu.Lock()
+			nodes[id].value = value
+			nodes[id].mu.Unlock()
+		} else if cmd == "cut" || cmd == "restore" {
+			// both directions, a cut tree link forces the subtree to find another way
+			var a, b int
+
+			con.Scan("Node: ", &a)
+			con.Scan("Other node: ", &b)
+
+			network.Cut(a, b, cmd == "cut")
+			network.Cut(b, a, cmd == "cut")
+
+			if cmd == "cut" {
+				fmt.Printf("Link %d <-> %d is down\n", a, b)
+			} else {
+				fmt.Printf("Link %d <-> %d is restored\n", a, b)
+			}
+		} else if cmd == "crash" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			if id == root {
+				fmt.Println("The root cannot crash in this demo")
+				continue
+			}
+			nodes[id].Stop()
+		} else if cmd == "latency" {
+			var lo, hi int64
+
+			con.Scan("Min latency (ms): ", &lo)
+			con.Scan("Max latency (ms): ", &hi)
+
+			lmin.Store(lo)
+			lmax.Store(hi)
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+const (
+	stateInitial = "initial"
+	stateUncertain = "uncertain" // voted yes, outcome unknown
+	statePrepared = "prepared" // pre-committed, everyone voted yes
+	stateCommitted = "committed"
+	stateAborted = "aborted"
+)
+
+type message struct {
+	kind string // can-commit, yes, no, pre-commit, ack, do-commit, abort, state-req or state
+	from int
+	txn int
+	state string
+}
+
+type crashPlan struct {
+	phase string // precommit or commit
+	reach int // number of participants that still get the message before the crash
+}
+
+type nodePool struct {
+	*sim.Pool
+	participants int
+	send func(from, to int, m message)
+
+	// a node waiting longer than this for the next step stops waiting
+	timeout time.Duration
+
+	// deliberately weaken the protocol for demonstration (two-phase commit)
+	skipPreCommit atomic.Bool
+}
+
+func newNodePool(participants int, send func(from, to int, m message)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.participants = participants
+	pool.send = send
+	pool.timeout = 0
+	pool.skipPreCommit.Store(false)
+	return pool
+}
+
+// node 0 coordinates, the others participate
+type node struct {
+	*sim.Process
+	pool *nodePool
+	mu sync.Mutex
+
+	txn int
+	state string
+	voteNo bool
+	deadline time.Time // zero when not waiting for anything
+
+	// coordinator
+	votes map[int]bool
+	acks map[int]bool
+	crash *crashPlan
+
+	// termination protocol run by a participant that timed out
+	terminating bool
+	reports map[int]string
+
+	crashed atomic.Bool
+	inbox chan message
+}
+
+func newNode(pool *nodePool, id, clockSpeed int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.voteNo = false
+	n.crash = nil
+	n.crashed.Store(false)
+	n.inbox = make(chan message)
+	n.reset(0)
+	return n
+}
+
+func (n *node) reset(txn int) {
+	n.mu.Lock()
+	n.txn = txn
+	n.state = stateInitial
+	n.deadline = time.Time{}
+	n.votes = make(map[int]bool)
+	n.acks = make(map[int]bool)
+	n.terminating = false
+	n.reports = make(map[int]string)
+	n.mu.Unlock()
+}
+
+func (n *node) Run() {
+	n.Start(n.tick)
+
+	// poll protocol messages
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
+
+func (n *node) coordinator() bool {
+	return n.ID() == 0
+}
+
+// node lock must be held
+func (n *node) send(to int, m message) {
+	if n.crashed.Load() {
+		return
+	}
+	m.from = n.ID()
+	m.txn = n.txn
+	n.pool.send(n.ID(), to, m)
+}
+
+// send to every participant, crashing halfway if the plan says so (node lock must be held)
+func (n *node) sendParticipants(kind, phase string) {
+	reach := n.pool.participants
+	if n.crash != nil && n.crash.phase == phase {
+		reach = n.crash.reach
+	}
+
+	for to := 1; to < n.pool.participants; to++ {
+		if to > reach {
+			n.crashed.Store(true)
+			n.crash = nil
+			n.Printf("Node %d (coordinator) crashes after sending %s to %d participant(s)", n.ID(), kind, reach)
+			return
+		}
+		n.send(to, message{kind: kind})
+	}
+}
+
+func (n *node) begin() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.voteNo {
+		n.decide(stateAborted)
+		return
+	}
+
+	n.state = stateUncertain
+	n.votes[n.ID()] = true
+	n.deadline = time.Now().Add(n.pool.timeout)
+	n.Printf("Node %d (coordinator) asks everyone whether transaction %d can commit", n.ID(), n.txn)
+	n.sendParticipants("can-commit", "")
+}
+
+// final outcome, sent to everyone that may still be waiting (node lock must be held)
+func (n *node) decide(outcome string) {
+	n.state = outcome
+	n.deadline = time.Time{}
+	n.terminating = false
+	n.Printf("Node %d %s transaction %d", n.ID(), outcome, n.txn)
+
+	kind := "do-commit"
+	if outcome == stateAborted {
+		kind = "abort"
+	}
+
+	if n.coordinator() {
+		n.sendParticipants(kind, "commit")
+	} else if len(n.reports) > 0 {
+		// tell the others what the termination protocol decided
+		for to := 0; to < n.pool.participants; to++ {
+			if to != n.ID() {
+				n.send(to, message{kind: kind})
+			}
+		}
+	}
+}
+
+func (n *node) receive(m message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if m.txn != n.txn {
+		return
+	}
+	decided := n.state == stateCommitted || n.state == stateAborted
+
+	if m.kind == "can-commit" {
+		if n.voteNo {
+			n.Printf("Node %d votes no", n.ID())
+			n.state = stateAborted
+			n.send(m.from, message{kind: "no"})
+			return
+		}
+
+		n.Printf("Node %d votes yes", n.ID())
+		n.state = stateUncertain
+		n.deadline = time.Now().Add(n.pool.timeout)
+		n.send(m.from, message{kind: "yes"})
+	} else if m.kind == "yes" || m.kind == "no" {
+		if !n.coordinator() || n.state != stateUncertain {
+			return
+		}
+
+		if m.kind == "no" {
+			n.decide(stateAborted)
+			return
+		}
+
+		n.votes[m.from] = true
+		if len(n.votes) < n.pool.participants {
+			return
+		}
+
+		if n.pool.skipPreCommit.Load() {
+			// two-phase commit: decide as soon as every vote is in
+			n.decide(stateCommitted)
+			return
+		}
+
+		n.state = statePrepared
+		n.acks[n.ID()] = true
+		n.deadline = time.Now().Add(n.pool.timeout)
+		n.Printf("Node %d (coordinator) has every vote, pre-commits transaction %d", n.ID(), n.txn)
+		n.sendParticipants("pre-commit", "precommit")
+	} else if m.kind == "pre-commit" {
+		if decided {
+			return
+		}
+
+		n.state = statePrepared
+		n.deadline = time.Now().Add(n.pool.timeout)
+		n.Printf("Node %d is prepared to commit", n.ID())
+		n.send(m.from, message{kind: "ack"})
+	} else if m.kind == "ack" {
+		if !n.coordinator() || n.state != statePrepared {
+			return
+		}
+
+		n.acks[m.from] = true
+		if len(n.acks) == n.pool.participants {
+			n.decide(stateCommitted)
+		}
+	} else if m.kind == "do-commit" || m.kind == "abort" {
+		outcome := stateCommitted
+		if m.kind == "abort" {
+			outcome = stateAborted
+		}
+
+		if decided {
+			if n.state != outcome {
+				n.Printf("Node %d VIOLATION: already %s, told to %s by node %d", n.ID(), n.state, m.kind, m.from)
+			}
+			return
+		}
+
+		n.state = outcome
+		n.deadline = time.Time{}
+		n.terminating = false
+		n.Printf("Node %d %s transaction %d (told by node %d)", n.ID(), outcome, n.txn, m.from)
+	} else if m.kind == "state-req" {
+		n.send(m.from, message{kind: "state", state: n.state})
+	} else if m.kind == "state" {
+		if !n.terminating {
+			return
+		}
+
+		n.reports[m.from] = m.state
+		if len(n.reports) == n.pool.participants {
+			n.terminate()
+		}
+	}
+}
+
+func (n *node) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.crashed.Load() || n.deadline.IsZero() || time.Now().Before(n.deadline) {
+		return
+	}
+
+	if n.coordinator() {
+		if n.state == stateUncertain {
+			n.Printf("Node %d (coordinator) timed out waiting for votes", n.ID())
+			n.decide(stateAborted)
+		} else if n.state == statePrepared {
+			// everyone voted yes, a missing ack does not change that
+			n.Printf("Node %d (coordinator) timed out waiting for acks", n.ID())
+			n.decide(stateCommitted)
+		}
+		return
+	}
+
+	if n.terminating {
+		n.terminate()
+		return
+	}
+
+	// the coordinator went quiet: ask everyone reachable what they know
+	n.Printf("Node %d timed out while %s, starts the termination protocol", n.ID(), n.state)
+	n.terminating = true
+	n.reports = map[int]string{n.ID(): n.state}
+	n.deadline = time.Now().Add(n.pool.timeout)
+	for to := 0; to < n.pool.participants; to++ {
+		if to != n.ID() {
+			n.send(to, message{kind: "state-req"})
+		}
+	}
+}
+
+// decide from the states reported so far (node lock must be held)
+func (n *node) terminate() {
+	found := make(map[string]bool)
+	for _, state := range n.reports {
+		found[state] = true
+	}
+	n.Printf("Node %d collected %d state(s): %v", n.ID(), len(n.reports), n.reports)
+
+	if found[stateCommitted] {
+		n.decide(stateCommitted)
+	} else if found[stateAborted] || found[stateInitial] {
+		n.decide(stateAborted)
+	} else if n.pool.skipPreCommit.Load() {
+		// two-phase commit: the coordinator may have committed, nobody can tell
+		n.Printf("Node %d is blocked: every reachable node is uncertain", n.ID())
+		n.terminating = false
+		n.deadline = time.Now().Add(n.pool.timeout)
+	} else if found[statePrepared] {
+		// everyone voted yes, or nobody could have pre-committed
+		n.decide(stateCommitted)
+	} else {
+		// nobody is prepared, so nobody can have committed
+		n.decide(stateAborted)
+	}
+}
+
+// parse "0,1|2,3" into groups of node IDs
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func main() {
+	timeout := flag.Duration("timeout", time.Second, "stop waiting for the next step of the protocol after this long")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *timeout <= 0 {
+		fmt.Println("Timeout must be positive")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes (node 0 coordinates): ", &nodeCount)
+
+	var lmin, lmax atomic.Int64
+	lmin.Store(50)
+	lmax.Store(150)
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		if nodes[to].crashed.Load() {
+			return false
+		}
+		return sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+	})
+	network.OnDrop = func(p *sim.Packet[message], reason string) {
+		l.Printf("%s from node %d to node %d dropped (%s)", p.Msg.kind, p.From, p.To, reason)
+	}
+
+	sender := func(from, to int, m message) {
+		network.Send(from, to, m, sim.Latency(int(lmin.Load()), int(lmax.Load())))
+	}
+
+	pool := newNodePool(nodeCount, sender)
+	pool.timeout = *timeout
+	for i := 0; i < nodeCount; i++ {
+		clockSpeed := int(100 + sim.Random(100))
+
+		nodes[i] = newNode(pool, i, clockSpeed, l)
+		nodes[i].Run()
+	}
+
+	txn := 0
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, begin, vote, fail, crash, recover, partition, heal, latency, oracle, logs, toggle, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				role := "participant"
+				if nodes[i].coordinator() {
+					role = "coordinator"
+				}
+
+				vote := "yes"
+				if nodes[i].voteNo {
+					vote = "no"
+				}
+
+				status := ""
+				if nodes[i].crashed.Load() {
+					status += ", crashed"
+				}
+				if nodes[i].terminating {
+					status += ", terminating"
+				}
+				fmt.Printf("Node %d (%s, votes %s): %s%s\n", nodes[i].ID(), role, vote, nodes[i].state, status)
+				nodes[i].mu.Unlock()
+			}
+		} else if cmd == "begin" {
+			if nodes[0].crashed.Load() {
+				fmt.Println("The coordinator is crashed")
+				continue
+			}
+
+			txn++
+			for i := range nodes {
+				nodes[i].reset(txn)
+			}
+			nodes[0].begin()
+			fmt.Printf("Transaction %d started\n", txn)
+		} else if cmd == "vote" {
+			var id int
+			var vote string
+
+			con.Scan("Node: ", &id)
+			con.Scan("Vote (yes/no): ", &vote)
+
+			nodes[id].mu.Lock()
+			nodes[id].voteNo = vote == "no"
+			nodes[id].mu.Unlock()
+		} else if cmd == "fail" {
+			// crash the coordinator partway through the next transaction
+			var phase string
+			var reach int
+
+			con.Scan("Crash while sending (precommit, commit, - for never): ", &phase)
+			if phase == "-" {
+				nodes[0].mu.Lock()
+				nodes[0].crash = nil
+				nodes[0].mu.Unlock()
+				continue
+			}
+			if phase != "precommit" && phase != "commit" {
+				fmt.Println("Unknown phase")
+				continue
+			}
+			con.Scan("Participants reached first: ", &reach)
+
+			nodes[0].mu.Lock()
+			nodes[0].crash = &crashPlan{phase: phase, reach: reach}
+			nodes[0].mu.Unlock()
+		} else if cmd == "crash" || cmd == "recover" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			nodes[id].crashed.Store(cmd == "crash")
+			if cmd == "recover" {
+				// pick up where it left off, an undecided node soon times out
+				nodes[id].mu.Lock()
+				if !nodes[id].deadline.IsZero() {
+					nodes[id].deadline = time.Now()
+				}
+				nodes[id].mu.Unlock()
+			}
+		} else if cmd == "partition" {
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
+		} else if cmd == "latency" {
+			var lo, hi int64
+
+			con.Scan("Min latency (ms): ", &lo)
+			con.Scan("Max latency (ms): ", &hi)
+
+			lmin.Store(lo)
+			lmax.Store(hi)
+		} else if cmd == "oracle" {
+			// atomicity: nobody commits if anybody aborts
+			outcomes := make(map[string][]int)
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				outcomes[nodes[i].state] = append(outcomes[nodes[i].state], nodes[i].ID())
+				nodes[i].mu.Unlock()
+			}
+
+			for _, state := range []string{stateCommitted, stateAborted, statePrepared, stateUncertain, stateInitial} {
+				if len(outcomes[state]) > 0 {
+					fmt.Printf("%s: %v\n", state, outcomes[state])
+				}
+			}
+			if len(outcomes[stateCommitted]) > 0 && len(outcomes[stateAborted]) > 0 {
+				fmt.Println("Atomicity VIOLATED")
+			} else {
+				fmt.Println("Atomicity holds")
+			}
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "toggle" {
+			var mechanism string
+			con.Scan("Mechanism (precommit): ", &mechanism)
+
+			if mechanism == "precommit" {
+				skip := !pool.skipPreCommit.Load()
+				pool.skipPreCommit.Store(skip)
+				fmt.Printf("Pre-commit phase: %s\n", enabledString(!skip))
+			} else {
+				fmt.Println("Unknown mechanism")
+			}
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Close()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
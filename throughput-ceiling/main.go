@@ -0,0 +1,337 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+// Ways to agree on one delivery order.
+const (
+	variantSequencer = "sequencer" // node 0 numbers every message
+	variantLamport = "lamport" // Lamport timestamps, delivered once everyone acked
+)
+
+const sequencer = 0
+
+type message struct {
+	kind string // submit, data, order or ack
+	from int
+	id int64
+	step int // load step the message was submitted in
+	submitted time.Time
+
+	seq int64 // order: position in the sequencer's order
+	t int64 // data: Lamport timestamp
+}
+
+// deliveries of the messages submitted in one load step
+type step struct {
+	rate int
+	submitted atomic.Int64
+	delivered atomic.Int64 // one per message and node
+	latency atomic.Int64 // sum over deliveries, in ns
+	worst atomic.Int64
+}
+
+type nodePool struct {
+	*sim.Pool
+	variant string
+	participants int
+	send func(from, to int, m message)
+
+	// what handling or sending one message costs a node, nodes do one thing at a time
+	cost time.Duration
+
+	steps []*step
+	stepsMu sync.Mutex
+}
+
+func newNodePool(variant string, participants int, cost time.Duration, send func(from, to int, m message)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.variant = variant
+	pool.participants = participants
+	pool.send = send
+	pool.cost = cost
+	pool.steps = []*step{}
+	return pool
+}
+
+func (p *nodePool) step(i int) *step {
+	p.stepsMu.Lock()
+	defer p.stepsMu.Unlock()
+	return p.steps[i]
+}
+
+func (p *nodePool) delivered(m message) {
+	s := p.step(m.step)
+	latency := int64(time.Since(m.submitted))
+	s.delivered.Add(1)
+	s.latency.Add(latency)
+	for {
+		worst := s.worst.Load()
+		if latency <= worst || s.worst.CompareAndSwap(worst, latency) {
+			break
+		}
+	}
+}
+
+type node struct {
+	*sim.Process
+	pool *nodePool
+
+	// sequencer
+	nextSeq int64 // the sequencer's next number
+	expected int64 // next number to deliver
+	holdback map[int64]message
+
+	// lamport
+	clock *sim.LamportClock
+	queue []message // by timestamp then sender
+	acks map[int64]int
+
+	// only the node's own goroutine touches its state
+	inbox chan message
+}
+
+func newNode(pool *nodePool, id, clockSpeed int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
+	n.pool = pool
+	n.nextSeq = 0
+	n.expected = 0
+	n.holdback = map[int64]message{}
+	n.clock = sim.NewLamportClock()
+	n.queue = []message{}
+	n.acks = map[int64]int{}
+	n.inbox = make(chan message)
+	return n
+}
+
+func (n *node) Run() {
+	n.Start(nil)
+
+	// poll submissions and protocol messages, one at a time
+	sim.Listen(n.Process, n.inbox, n.receive)
+}
+
+func (n *node) send(to int, m message) {
+	time.Sleep(n.pool.cost)
+	m.from = n.ID()
+	n.pool.send(n.ID(), to, m)
+}
+
+func (n *node) broadcast(m message) {
+	for i := 0; i < n.pool.participants; i++ {
+		n.send(i, m)
+	}
+}
+
+func (n *node) receive(m message) {
+	time.Sleep(n.pool.cost)
+
+	switch m.kind {
+	case "submit":
+		if n.pool.variant == variantSequencer {
+			m.kind = "data"
+			n.send(sequencer, m)
+		} else {
+			m.kind = "data"
+			m.t = n.clock.Tick()
+			n.broadcast(m)
+		}
+
+	case "data":
+		if n.pool.variant == variantSequencer {
+			// only the sequencer gets data, everyone gets the order
+			m.kind = "order"
+			m.seq = n.nextSeq
+			n.nextSeq++
+			n.broadcast(m)
+			return
+		}
+
+		n.clock.Witness(m.t)
+		i := sort.Search(len(n.queue), func(i int) bool {
+			q := n.queue[i]
+			return m.t < q.t || (m.t == q.t && m.from < q.from)
+		})
+		n.queue = append(n.queue, message{})
+		copy(n.queue[i+1:], n.queue[i:])
+		n.queue[i] = m
+
+		n.broadcast(message{kind: "ack", id: m.id, t: n.clock.Tick()})
+		n.deliverAcked()
+
+	case "order":
+		n.holdback[m.seq] = m
+		for {
+			next, ok := n.holdback[n.expected]
+			if !ok {
+				break
+			}
+			delete(n.holdback, n.expected)
+			n.expected++
+			n.pool.delivered(next)
+		}
+
+	case "ack":
+		n.clock.Witness(m.t)
+		n.acks[m.id]++
+		n.deliverAcked()
+	}
+}
+
+// deliver from the head of the queue while everyone has acked, the order is
+// not checked here, only what it costs to get there
+func (n *node) deliverAcked() {
+	for len(n.queue) > 0 && n.acks[n.queue[0].id] == n.pool.participants {
+		head := n.queue[0]
+		n.queue = n.queue[1:]
+		delete(n.acks, head.id)
+		n.pool.delivered(head)
+	}
+}
+
+type result struct {
+	rate int
+	throughput float64 // deliveries per second and node
+	mean, worst time.Duration
+	backlog float64 // share of deliveries still missing after the settle time
+}
+
+// ramp the offered load on one variant until latency blows up, returns every
+// step and the index of the last one that kept up (-1 if none did)
+func run(variant string, nodeCount int, cost time.Duration, lmin, lmax, start, increase, limit int, window, settle time.Duration, blowup float64) ([]result, int) {
+	l := sim.NewLog()
+
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		return sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+	})
+
+	sender := func(from, to int, m message) {
+		network.Send(from, to, m, sim.Latency(lmin, lmax))
+	}
+
+	pool := newNodePool(variant, nodeCount, cost, sender)
+	for i := 0; i < nodeCount; i++ {
+		nodes[i] = newNode(pool, i, 1000, l)
+		nodes[i].Run()
+	}
+
+	results := []result{}
+	last := -1
+	var nextID int64
+	var baseline time.Duration
+
+	for rate := start; rate <= limit; rate += increase {
+		s := &step{rate: rate}
+		pool.stepsMu.Lock()
+		pool.steps = append(pool.steps, s)
+		index := len(pool.steps) - 1
+		pool.stepsMu.Unlock()
+
+		// offered load: submissions arrive on time whether or not nodes keep up
+		interval := time.Second / time.Duration(rate)
+		began := time.Now()
+		for next := began; next.Sub(began) < window; next = next.Add(interval) {
+			time.Sleep(time.Until(next))
+
+			to := int(sim.Random(int64(nodeCount)))
+			m := message{kind: "submit", from: to, id: nextID, step: index, submitted: time.Now()}
+			nextID++
+			s.submitted.Add(1)
+			go sim.Deliver(nodes[to].Process, nodes[to].inbox, m)
+		}
+		time.Sleep(settle)
+
+		expected := s.submitted.Load() * int64(nodeCount)
+		delivered := s.delivered.Load()
+		r := result{rate: rate, throughput: float64(delivered) / float64(nodeCount) / window.Seconds()}
+		if delivered > 0 {
+			r.mean = time.Duration(s.latency.Load() / delivered)
+			r.worst = time.Duration(s.worst.Load())
+		}
+		if expected > 0 {
+			r.backlog = float64(expected-delivered) / float64(expected)
+		}
+		results = append(results, r)
+
+		if baseline == 0 {
+			baseline = r.mean
+		}
+		fmt.Printf("  %-8d %-12.1f %-12v %-12v %.0f%%\n", r.rate, r.throughput, r.mean.Round(time.Millisecond), r.worst.Round(time.Millisecond), 100*r.backlog)
+
+		if r.backlog > 0.01 || float64(r.mean) > blowup*float64(baseline) {
+			break
+		}
+		last = len(results) - 1
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+	network.Close()
+	pool.Wait()
+
+	return results, last
+}
+
+func main() {
+	nodeCount := flag.Int("nodes", 4, "number of nodes")
+	cost := flag.Duration("cost", 2*time.Millisecond, "what handling or sending one message costs a node")
+	lmin := flag.Int("min", 5, "min one-way latency (ms)")
+	lmax := flag.Int("max", 15, "max one-way latency (ms)")
+	start := flag.Int("start", 10, "offered load of the first step (messages per second)")
+	increase := flag.Int("step", 10, "added load per step (messages per second)")
+	limit := flag.Int("limit", 500, "stop ramping at this load")
+	window := flag.Duration("window", 2*time.Second, "how long each load step lasts")
+	settle := flag.Duration("settle", time.Second, "how long to wait for a step's stragglers")
+	blowup := flag.Float64("blowup", 4, "saturated once mean latency reaches this multiple of the first step's")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *nodeCount < 2 || *cost <= 0 || *lmin < 0 || *lmax < *lmin || *start < 1 || *increase < 1 || *limit < *start || *window <= 0 || *settle < 0 || *blowup <= 1 {
+		fmt.Println("Need at least two nodes, a positive cost, load and window, 0 <= min <= max latency and a blowup above 1")
+		return
+	}
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	ceilings := map[string]float64{}
+	for _, variant := range []string{variantSequencer, variantLamport} {
+		fmt.Printf("%s, %d nodes, %v per message:\n", variant, *nodeCount, *cost)
+		fmt.Println("  offered  delivered/s  mean         worst        behind")
+
+		results, last := run(variant, *nodeCount, *cost, *lmin, *lmax, *start, *increase, *limit, *window, *settle, *blowup)
+		if last < 0 {
+			fmt.Printf("Saturated from the first step (%d/s)\n\n", results[0].rate)
+			continue
+		}
+		if last == len(results)-1 {
+			fmt.Printf("Kept up to the limit, %d/s\n\n", results[last].rate)
+		} else {
+			fmt.Printf("Saturation point: %d/s kept up, %d/s did not\n\n", results[last].rate, results[last+1].rate)
+		}
+		ceilings[variant] = float64(results[last].rate)
+	}
+
+	// what the busiest node can do at all, ignoring latency: the sequencer
+	// handles 2 messages and sends n per broadcast, a Lamport node handles
+	// n+1 and sends n acks, and submits one broadcast in n to all n itself
+	n := float64(*nodeCount)
+	perMessage := float64(*cost) / float64(time.Second)
+	fmt.Printf("Expected ceilings from the busiest node's work: sequencer %.0f/s, lamport %.0f/s\n", 1/((n+2)*perMessage), 1/((2*n+1+(n+1)/n)*perMessage))
+	if ceilings[variantSequencer] > 0 && ceilings[variantLamport] > 0 {
+		fmt.Printf("Measured: the sequencer kept up with %.1fx the load of the Lamport variant\n", ceilings[variantSequencer]/ceilings[variantLamport])
+	}
+}
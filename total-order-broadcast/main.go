@@ -1,49 +1,88 @@
 package main
 
 import (
-	"bufio"
 	"container/list"
-	"crypto/rand"
+	"flag"
 	"fmt"
-	"log"
-	"math/big"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+// protocol versions: v2 acknowledges every broadcast, so nodes do not have
+// to wait for everyone to speak before delivering
+const (
+	v1 = 1
+	v2 = 2
 )
 
 type message struct {
+	version int // schema version, a node cannot decode newer ones
+	kind string // data, or ack from v2 nodes
 	sender int
 	t int64
 	data string
+
+	// ground truth order assigned by the omniscient observer at send time
+	global int64
 }
 
 type nodePool struct {
+	*sim.Pool
 	participants int
-	broadcast func(m message, lmin, lmax int)
+	broadcast func(m message, lmin, lmax int, overrides map[int]time.Duration)
+
+	oracle atomic.Int64
+
+	// bounded delivery history, zero keeps everything
+	retainCount int
+	retainFor time.Duration
+
+	// recent broadcasts replayed to recovering nodes
+	replay *sim.Backlog[message]
 
-	aliveCount atomic.Int64
+	// acks are numbered below zero so they never clash with broadcasts
+	acks atomic.Int64
+
+	// what nodes do with messages of a version they do not know
+	policy *sim.PoisonPolicy
+
+	// deliberately weaken the protocol for demonstration
+	skipSync atomic.Bool
+	skipTieBreak atomic.Bool
+	skipShim atomic.Bool
 }
 
-func newNodePool(participants int, broadcast func(m message, lmin, lmax int)) *nodePool {
+func newNodePool(participants int, broadcast func(m message, lmin, lmax int, overrides map[int]time.Duration)) *nodePool {
 	pool := new(nodePool)
 	pool.participants = participants
+	pool.Pool = sim.NewPool()
 	pool.broadcast = broadcast
-	pool.aliveCount.Store(0)
+	pool.oracle.Store(0)
+	pool.retainCount = 0
+	pool.retainFor = 0
+	pool.replay = sim.NewBacklog[message](0)
+	pool.acks.Store(0)
+	pool.policy, _ = sim.NewPoisonPolicy(sim.PoisonLog)
+	pool.skipSync.Store(false)
+	pool.skipTieBreak.Store(false)
+	pool.skipShim.Store(false)
 	return pool
 }
 
 type node struct {
+	*sim.Process
 	pool *nodePool
-	id int
-	clockSpeed int
-	l *log.Logger
 
 	// temporarily store broadcasted message in the staging area
 	primaryBuffer *list.List
 	secondaryBuffer *list.List
+	seen map[int64]bool // oracle IDs queued or delivered, so replays are not taken twice
 	bufferMu sync.Mutex
 
 	// will wait for all nodes to synchronize
@@ -53,91 +92,120 @@ type node struct {
 
 	broadcast chan message
 
-	running atomic.Bool
+	// real-time order of delivered messages
+	history *sim.History
 
 	// lamport timestamp
-	t int64
-	tMu sync.Mutex
+	clock *sim.LamportClock
+
+	// last delivered message (for detecting order violations)
+	last *message
+
+	// a human decides when this node delivers
+	attached atomic.Bool
+
+	// crashed nodes lose every message that reaches them
+	crashed atomic.Bool
+
+	// protocol version the node runs, raised by a rolling upgrade
+	version atomic.Int32
+
+	// message that last moved each probe, exported as exemplars
+	traces map[string]sim.Exemplar
+	tracesMu sync.Mutex
 }
 
-func newNode(pool *nodePool, id, clockSpeed int, l *log.Logger) *node {
+func newNode(pool *nodePool, id, clockSpeed int, l sim.Logger) *node {
 	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, clockSpeed, l)
 	n.pool = pool
-	n.id = id
-	n.clockSpeed = clockSpeed
-	n.l = l
 	n.primaryBuffer = list.New()
 	n.secondaryBuffer = list.New()
+	n.seen = make(map[int64]bool)
 	n.tWait = 0
 	n.broadcast = make(chan message)
-	n.running.Store(false)
-	n.t = 0
+	n.history = sim.NewHistory(pool.retainCount, pool.retainFor)
+	n.clock = sim.NewLamportClock()
+	n.attached.Store(false)
+	n.crashed.Store(false)
+	n.version.Store(v1)
+	n.traces = make(map[string]sim.Exemplar)
 
 	return n
 }
 
-func (n *node) run() {
-	n.running.Store(true)
+// remember m as the message that last moved the probe to value
+func (n *node) trace(probe string, m message, value int64) {
+	n.tracesMu.Lock()
+	defer n.tracesMu.Unlock()
 
-	go func() {
-		n.pool.aliveCount.Add(1)
-		n.l.Printf("Node %d started at %dms clock speed", n.id, n.clockSpeed)
-		for n.running.Load() {
-			n.tMu.Lock()
-			n.t++
-			n.tMu.Unlock()
+	e := n.traces[probe]
+	n.traces[probe] = sim.Exemplar{Trace: m.global, Value: value, Count: e.Count + 1}
+}
 
-			time.Sleep(time.Duration(n.clockSpeed) * time.Millisecond)
-		}
-		n.l.Printf("Node %d stopping", n.id)
-		n.pool.aliveCount.Add(-1)
-	}()
+func (n *node) Run() {
+	n.Start(func() { n.clock.Tick() })
 
 	// poll broadcast messages
-	go func() {
-		for n.running.Load() {
-			var ok bool
-
-			m, ok := <-n.broadcast
-			if ok {
-				n.receive(m)
-			}
-		}
-	}()
+	sim.Listen(n.Process, n.broadcast, sim.Screen(n.Process, n.pool.policy, n.check, n.receive))
 }
 
-func (n *node) stop() {
-	n.running.Store(false)
+// a node only decodes the versions it was built with
+func (n *node) check(m message) error {
+	if version := int(n.version.Load()); m.version > version {
+		return fmt.Errorf("v%d node cannot decode a v%d %s message from node %d", version, m.version, m.kind, m.sender)
+	}
+	return nil
 }
 
-func (n *node) send(data string, lmin, lmax int) {
-	n.tMu.Lock()
-	t := n.t
-	n.tMu.Unlock()
+func (n *node) send(data string, lmin, lmax int, overrides map[int]time.Duration) {
+	t := n.clock.Now()
 
 	m := message{
-		sender: n.id,
+		version: int(n.version.Load()),
+		kind: "data",
+		sender: n.ID(),
 		t: t,
 		data: data,
+		global: n.pool.oracle.Add(1) - 1,
 	}
 
-	n.l.Printf("Node %d sends broadcast at %d", n.id, t)
+	n.Printf("Node %d sends broadcast at %d", n.ID(), t)
 
-	n.pool.broadcast(m, lmin, lmax)
+	n.pool.broadcast(m, lmin, lmax, overrides)
 }
 
 func (n *node) receive(m message) {
+	n.bufferMu.Lock()
+	duplicate := n.seen[m.global]
+	n.seen[m.global] = true
+	n.bufferMu.Unlock()
+
+	if duplicate {
+		// a replayed message that was already queued or delivered
+		return
+	}
+
 	// sync lamport timestamp
-	n.tMu.Lock()
-	if m.t > n.t {
-		n.t = m.t
+	if n.pool.skipSync.Load() {
+		n.trace("t", m, n.clock.Tick())
+	} else {
+		n.trace("t", m, n.clock.Witness(m.t))
 	}
-	n.t++
-	n.tMu.Unlock()
 
 	n.queue(m)
 
-	if n.synchronized() {
+	// v2: tell everyone this node has moved past the message, the sender
+	// included, so delivery does not wait for every node to broadcast
+	if m.kind == "data" && n.version.Load() >= v2 {
+		n.pool.broadcast(message{version: v2, kind: "ack", sender: n.ID(), t: n.clock.Tick(), global: -n.pool.acks.Add(1)}, 20, 100, nil)
+	}
+
+	if n.attached.Load() {
+		if m.kind == "data" {
+			n.Printf("Node %d (attached) holds broadcast: %s (from node %d at #%d)", n.ID(), m.data, m.sender, m.t)
+		}
+	} else if n.synchronized() {
 		// deliver messages in the primary buffer
 		n.flush()
 	}
@@ -156,6 +224,7 @@ func (n *node) queue(m message) {
 		}
 	} else {
 		n.tWait = m.t
+		n.trace("twait", m, n.tWait)
 		target = n.primaryBuffer // store first message in the primary buffer
 	}
 	n.tWaitMu.Unlock()
@@ -163,7 +232,7 @@ func (n *node) queue(m message) {
 	mark := target.Front()
 	for mark != nil {
 		// total ordering of lamport timestamp
-		if m.t < mark.Value.(message).t {
+		if n.before(m, mark.Value.(message)) {
 			break
 		}
 		mark = mark.Next()
@@ -174,10 +243,23 @@ func (n *node) queue(m message) {
 	} else {
 		target.PushBack(m)
 	}
+	n.trace("buffer", m, int64(n.primaryBuffer.Len()+n.secondaryBuffer.Len()))
 
 	n.bufferMu.Unlock()
 }
 
+func (n *node) before(a, b message) bool {
+	if a.t != b.t {
+		return a.t < b.t
+	}
+
+	// break ties on equal timestamps by sender ID
+	if n.pool.skipTieBreak.Load() {
+		return false
+	}
+	return a.sender < b.sender
+}
+
 func (n *node) synchronized() bool {
 	// ensure all nodes are mentioned in secondary buffer (i.e. no more old messages to wait)
 
@@ -198,133 +280,778 @@ func (n *node) flush() {
 
 	// flush the primary buffer to the network
 	for n.primaryBuffer.Front() != nil {
-		m := n.primaryBuffer.Remove(n.primaryBuffer.Front()).(message)
+		n.deliver(n.primaryBuffer.Remove(n.primaryBuffer.Front()).(message))
+	}
+
+	n.promote()
+
+	n.bufferMu.Unlock()
+}
 
-		n.tMu.Lock()
-		n.t++
-		n.l.Printf("Node %d #%d receives broadcast: %s (from node %d at #%d)", n.id, n.t, m.data, m.sender, m.t)
-		n.tMu.Unlock()
+// deliver a message to the application (buffer lock must be held)
+func (n *node) deliver(m message) {
+	if m.kind == "ack" {
+		// only there to move synchronization along
+		return
 	}
 
-	// flush the secondary buffer to the primary buffer
+	t := n.clock.Tick()
+	n.Printf("Node %d #%d receives broadcast: %s (from node %d at #%d)", n.ID(), t, m.data, m.sender, m.t)
+
+	n.history.Record(m.global)
+
+	if n.last != nil && !(n.last.t < m.t || (n.last.t == m.t && n.last.sender < m.sender)) {
+		n.Printf("Node %d VIOLATION: (#%d, node %d) delivered after (#%d, node %d)", n.ID(), m.t, m.sender, n.last.t, n.last.sender)
+	}
+	n.last = &m
+}
+
+// flush the secondary buffer to the primary buffer (buffer lock must be held)
+func (n *node) promote() {
 	n.tWaitMu.Lock()
 	for n.secondaryBuffer.Front() != nil {
 		m := n.secondaryBuffer.Remove(n.secondaryBuffer.Front()).(message)
 		if m.t > n.tWait {
 			n.tWait = m.t
+			n.trace("twait", m, n.tWait)
 		}
 		n.primaryBuffer.PushBack(m)
 	}
 	n.tWaitMu.Unlock()
+}
+
+// buffered messages in delivery order, primary buffer first
+func (n *node) held() []message {
+	n.bufferMu.Lock()
+	defer n.bufferMu.Unlock()
+
+	held := []message{}
+	for _, b := range []*list.List{n.primaryBuffer, n.secondaryBuffer} {
+		for e := b.Front(); e != nil; e = e.Next() {
+			held = append(held, e.Value.(message))
+		}
+	}
+	return held
+}
 
+// deliver any held message chosen by hand, possibly out of order
+func (n *node) deliverAt(index int) bool {
+	n.bufferMu.Lock()
+	defer n.bufferMu.Unlock()
+
+	for _, b := range []*list.List{n.primaryBuffer, n.secondaryBuffer} {
+		for e := b.Front(); e != nil; e = e.Next() {
+			if index == 0 {
+				n.deliver(b.Remove(e).(message))
+				if n.primaryBuffer.Len() == 0 {
+					n.promote()
+				}
+				return true
+			}
+			index--
+		}
+	}
+	return false
+}
+
+// the clock and delivery history survive a crash (stable storage), the buffers only if kept
+func (n *node) crash(keepBuffer bool) {
+	n.crashed.Store(true)
+
+	n.bufferMu.Lock()
+	lost := 0
+	if !keepBuffer {
+		for _, b := range []*list.List{n.primaryBuffer, n.secondaryBuffer} {
+			for e := b.Front(); e != nil; e = e.Next() {
+				// forget it was seen so a replay can bring it back
+				delete(n.seen, e.Value.(message).global)
+				lost++
+			}
+			b.Init()
+		}
+	}
 	n.bufferMu.Unlock()
+
+	n.Printf("Node %d crashes, %d buffered message(s) lost", n.ID(), lost)
+}
+
+// replay retained broadcasts, those already seen are skipped
+func (n *node) recover() {
+	n.crashed.Store(false)
+
+	replay := n.pool.replay.All()
+	n.Printf("Node %d recovers, replaying %d retained broadcast(s)", n.ID(), len(replay))
+
+	for _, m := range replay {
+		n.receive(m)
+	}
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
 }
 
 func main() {
-	var logBuilder strings.Builder
+	l := sim.NewLog()
+
+	retainCount := flag.Int("retain-count", 0, "keep at most this many delivered messages per node (0 keeps all)")
+	retainFor := flag.Duration("retain-for", 0, "forget delivered messages older than this (0 keeps all)")
+	replayCount := flag.Int("replay-count", 0, "broadcasts kept for replay to recovering nodes (0 keeps all)")
+	distribution := flag.String("latency", "uniform", "latency distribution: uniform, normal, exponential or pareto")
+	topology := flag.String("topology", "mesh", "how nodes are wired: mesh, ring, line, star, tree, random:<p> or file:<path>")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
 
-	l := log.New(&logBuilder, " [LOG] ", log.LstdFlags)
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
 	var nodeCount int
-	fmt.Printf("Number of nodes: ")
-	fmt.Scanf("%d", &nodeCount)
-
-	networkJam := make([][]int, nodeCount)
-	for i := range networkJam {
-		networkJam[i] = make([]int, nodeCount)
-		for j := range networkJam[i] {
-			networkJam[i][j] = 0
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	var pool *nodePool
+	nodes := make([]*node, nodeCount)
+	network := sim.NewMesh(nodeCount, l, func(to int, m message) bool {
+		if nodes[to].crashed.Load() {
+			l.Printf("Node %d is crashed, broadcast from node %d at %d lost", to, m.sender, m.t)
+			return false
+		}
+
+		// compatibility shim: the sender encodes each copy in the receiver's version
+		if version := int(nodes[to].version.Load()); m.version > version && !pool.skipShim.Load() {
+			if m.kind == "ack" {
+				// older nodes have no use for acks
+				return true
+			}
+			m.version = version
 		}
+		return sim.Deliver(nodes[to].Process, nodes[to].broadcast, m)
+	})
+
+	wiring, err := sim.ParseTopology(*topology, nodeCount)
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
+	network.SetTopology(wiring)
 
-	nodes := make([]*node, nodeCount)
-	broadcaster := func(m message, lmin, lmax int) {
-		for i := range nodes {
-			go func(i int) {
-				// broadcast delay (+ network jam)
-				r, _ := rand.Int(rand.Reader, big.NewInt(int64(lmax - lmin)))
-				latency := int64(networkJam[m.sender][i]) + int64(lmin) + r.Int64()
-				time.Sleep(time.Duration(latency) * time.Millisecond)
-
-				nodes[i].broadcast <- m
-			}(i)
+	network.Latencies, err = sim.ParseDistribution(*distribution)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	network.Relaying = func(node int) bool {
+		return !nodes[node].crashed.Load()
+	}
+	network.OnDrop = func(p *sim.Packet[message], reason string) {
+		if reason == sim.DropLinkDown {
+			l.Printf("Link %d -> %d is down, broadcast from node %d at %d dropped", p.From, p.To, p.Msg.sender, p.Msg.t)
+		} else if reason == sim.DropLoss {
+			l.Printf("Link %d -> %d lost broadcast from node %d at %d", p.From, p.To, p.Msg.sender, p.Msg.t)
+		} else {
+			l.Printf("Broadcast from node %d at %d to node %d dropped", p.Msg.sender, p.Msg.t, p.To)
+		}
+	}
+
+	network.OnSettled = func(r sim.BroadcastResult[message]) {
+		if r.Msg.kind == "ack" {
+			return
+		}
+		if len(r.Lost) > 0 {
+			con.Notify("Broadcast from node %d at %d settled in %v: reached %v, lost at %v", r.From, r.Msg.t, r.Elapsed.Round(time.Millisecond), r.Reached, r.Lost)
+		} else {
+			con.Notify("Broadcast from node %d at %d reached all nodes in %v", r.From, r.Msg.t, r.Elapsed.Round(time.Millisecond))
 		}
 	}
 
-	pool := newNodePool(nodeCount, broadcaster)
+	broadcaster := func(m message, lmin, lmax int, overrides map[int]time.Duration) {
+		if m.kind == "data" {
+			pool.replay.Add(m)
+		}
+		latency := func(to int) time.Duration {
+			// broadcast delay (+ network jam), exact if overridden
+			if latency, ok := overrides[to]; ok {
+				return latency
+			}
+			return time.Duration(network.Link(m.sender, to).Latency)*time.Millisecond + network.Latency(m.sender, to, lmin, lmax)
+		}
+
+		if m.kind == "ack" {
+			// v2 acks are protocol overhead, their copies count as messages
+			// but not as broadcasts so stats compares v1 and v2 fairly
+			for to := 0; to < network.Size(); to++ {
+				network.Send(m.sender, to, m, latency(to))
+			}
+			return
+		}
+		network.Broadcast(m.sender, m, latency)
+	}
+
+	pool = newNodePool(nodeCount, broadcaster)
+	pool.retainCount = *retainCount
+	pool.retainFor = *retainFor
+	pool.replay = sim.NewBacklog[message](*replayCount)
 	for i := 0; i < nodeCount; i++ {
-		r, _ := rand.Int(rand.Reader, big.NewInt(500))
-		clockSpeed := int(500 + r.Int64())
+		clockSpeed := int(500 + sim.Random(500))
 
 		nodes[i] = newNode(pool, i, clockSpeed, l)
-		nodes[i].run()
+		nodes[i].Run()
+	}
+
+	network.OnBreak = func(p *sim.Packet[message], b sim.Breakpoint) {
+		con.Notify("Breakpoint #%d: broadcast %s (#%d) from node %d about to be delivered to node %d, network paused (step or resume)", b.ID, p.Msg.data, p.Msg.t, p.From, p.To)
 	}
 
+	watcher := sim.NewWatcher(nodeCount)
+	watcher.OnTrigger = func(alert string, pause bool) {
+		if pause && !network.Paused() {
+			network.Pause()
+			alert += ", network paused (resume to continue)"
+		}
+		con.Notify("%s", alert)
+	}
+	watcher.Probe("primary", func(i int) int64 {
+		nodes[i].bufferMu.Lock()
+		defer nodes[i].bufferMu.Unlock()
+		return int64(nodes[i].primaryBuffer.Len())
+	})
+	watcher.Probe("secondary", func(i int) int64 {
+		nodes[i].bufferMu.Lock()
+		defer nodes[i].bufferMu.Unlock()
+		return int64(nodes[i].secondaryBuffer.Len())
+	})
+	watcher.Probe("buffer", func(i int) int64 {
+		nodes[i].bufferMu.Lock()
+		defer nodes[i].bufferMu.Unlock()
+		return int64(nodes[i].primaryBuffer.Len() + nodes[i].secondaryBuffer.Len())
+	})
+	watcher.Probe("t", func(i int) int64 {
+		return nodes[i].clock.Now()
+	})
+	watcher.Probe("twait", func(i int) int64 {
+		nodes[i].tWaitMu.Lock()
+		defer nodes[i].tWaitMu.Unlock()
+		return nodes[i].tWait
+	})
+	for _, probe := range []string{"t", "twait", "buffer"} {
+		probe := probe
+		watcher.Exemplars(probe, func(i int) (sim.Exemplar, bool) {
+			nodes[i].tracesMu.Lock()
+			defer nodes[i].tracesMu.Unlock()
+			e, ok := nodes[i].traces[probe]
+			return e, ok
+		})
+	}
+	watcher.Probe("delivered", func(i int) int64 {
+		return int64(nodes[i].history.Count())
+	})
+
+	stopWatching := make(chan struct{})
+	watcher.Run(10*time.Millisecond, stopWatching)
+
 	for {
 		var cmd string
-		fmt.Println("Commands: state, broadcast, jam, logs, exit")
-		fmt.Printf(" > ")
-		fmt.Scanf("%s", &cmd)
+		fmt.Println("Commands: state, broadcast, inflight, deliver, drop, oracle, stats, metrics, drain, crash, recover, upgrade, rollout, jam, cut, restore, flap, loss, links, network, ping, distribution, attach, watch, unwatch, break, unbreak, step, resume, topology, partition, heal, logs, toggle, exit")
+		con.Scan(" > ", &cmd)
 
 		if cmd == "state" {
 			for i := range nodes {
-				nodes[i].tMu.Lock()
+				t := nodes[i].clock.Now()
 				nodes[i].tWaitMu.Lock()
 				nodes[i].bufferMu.Lock()
 
-				fmt.Printf("Node %d (t: %d, tWait: %d, primary: %d, secondary: %d)\n", nodes[i].id, nodes[i].t, nodes[i].tWait, nodes[i].primaryBuffer.Len(), nodes[i].secondaryBuffer.Len())
+				status := ""
+				if nodes[i].crashed.Load() {
+					status = " crashed"
+				}
+				fmt.Printf("Node %d (v%d, t: %d, tWait: %d, primary: %d, secondary: %d)%s\n", nodes[i].ID(), nodes[i].version.Load(), t, nodes[i].tWait, nodes[i].primaryBuffer.Len(), nodes[i].secondaryBuffer.Len(), status)
 
 				nodes[i].bufferMu.Unlock()
 				nodes[i].tWaitMu.Unlock()
-				nodes[i].tMu.Unlock()
 			}
 		} else if cmd == "broadcast" {
 			var sender int
-			var data string
+			var data, to string
 			var lmin, lmax int
 
-			fmt.Printf("Sender: ")
-			fmt.Scanf("%d", &sender)
-			fmt.Printf("Data: ")
-			fmt.Scanf("%s", &data)
-			fmt.Printf("Min latency (ms): ")
-			fmt.Scanf("%d", &lmin)
-			fmt.Printf("Max latency (ms): ")
-			fmt.Scanf("%d", &lmax)
+			con.Scan("Sender: ", &sender)
+			con.Scan("Data: ", &data)
+			con.Scan("Min latency (ms): ", &lmin)
+			con.Scan("Max latency (ms): ", &lmax)
+			con.Scan("Latency overrides (e.g. 1=500ms,2=50ms, - for none): ", &to)
+
+			overrides, err := sim.ParseOverrides(to)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			if nodes[sender].crashed.Load() {
+				fmt.Println("Node is crashed")
+				continue
+			}
+			nodes[sender].send(data, lmin, lmax, overrides)
+		} else if cmd == "crash" {
+			var id int
+			var keep string
+
+			con.Scan("Node: ", &id)
+			con.Scan("Keep buffered messages (yes/no): ", &keep)
+
+			if nodes[id].crashed.Load() {
+				fmt.Println("Node is already crashed")
+				continue
+			}
+			nodes[id].crash(keep == "yes")
+		} else if cmd == "recover" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			if !nodes[id].crashed.Load() {
+				fmt.Println("Node is not crashed")
+				continue
+			}
+			nodes[id].recover()
+		} else if cmd == "upgrade" {
+			// swap the node's protocol version in place, or roll it back
+			var id, version int
+
+			con.Scan("Node: ", &id)
+			con.Scan("Version (1 or 2): ", &version)
+
+			if version != v1 && version != v2 {
+				fmt.Println("Unknown version")
+				continue
+			}
+			nodes[id].version.Store(int32(version))
+			fmt.Printf("Node %d runs v%d\n", id, version)
+		} else if cmd == "rollout" {
+			// rolling upgrade: one node at a time, the cluster runs mixed versions meanwhile
+			var interval string
+
+			con.Scan("Interval between nodes (e.g. 2s): ", &interval)
 
-			nodes[sender].send(data, lmin, lmax)
+			d, err := time.ParseDuration(interval)
+			if err != nil || d <= 0 {
+				fmt.Println("Invalid interval")
+				continue
+			}
+
+			go func() {
+				for i := range nodes {
+					if nodes[i].version.Load() >= v2 {
+						continue
+					}
+					time.Sleep(d)
+					nodes[i].version.Store(v2)
+					con.Notify("Rollout: node %d now runs v2", i)
+				}
+				con.Notify("Rollout finished, every node runs v2")
+			}()
+			fmt.Printf("Upgrading one node to v2 every %v\n", d)
 		} else if cmd == "jam" {
 			// simulate network jam (to ensure total ordering of timestamp works)
 
 			var source, target, latency int
 
-			fmt.Printf("Source node: ")
-			fmt.Scanf("%d", &source)
-			fmt.Printf("Target node: ")
-			fmt.Scanf("%d", &target)
-			fmt.Printf("Base latency (ms): ")
-			fmt.Scanf("%d", &latency)
+			con.Scan("Source node: ", &source)
+			con.Scan("Target node: ", &target)
+			con.Scan("Base latency (ms): ", &latency)
 
-			networkJam[source][target] = latency
+			network.Jam(source, target, latency)
 
 			fmt.Println("Network jam has been set")
+		} else if cmd == "cut" || cmd == "restore" {
+			// one-way link failure: source can no longer reach target (but target may still reach source)
+
+			var source, target int
+
+			con.Scan("Source node: ", &source)
+			con.Scan("Target node: ", &target)
+
+			network.Cut(source, target, cmd == "cut")
+
+			if cmd == "cut" {
+				fmt.Printf("Link %d -> %d is down\n", source, target)
+			} else {
+				fmt.Printf("Link %d -> %d is restored\n", source, target)
+			}
+		} else if cmd == "flap" {
+			// intermittent connectivity: the link breaks and heals every period
+
+			var source, target int
+			var period string
+
+			con.Scan("Source node: ", &source)
+			con.Scan("Target node: ", &target)
+			con.Scan("Period: ", &period)
+
+			d, err := time.ParseDuration(period)
+			if err != nil || d <= 0 {
+				fmt.Println("Invalid period")
+				continue
+			}
+
+			network.Flap(source, target, d)
+
+			fmt.Printf("Link %d -> %d flaps every %v (restore to stop)\n", source, target, d)
+		} else if cmd == "loss" {
+			// lossy link: every message on it is lost with the given probability
+
+			var source, target, percent int
+
+			con.Scan("Source node: ", &source)
+			con.Scan("Target node: ", &target)
+			con.Scan("Drop probability (%): ", &percent)
+
+			if percent < 0 || percent > 100 {
+				fmt.Println("Invalid percentage")
+				continue
+			}
+			network.Lose(source, target, percent)
+
+			fmt.Printf("Link %d -> %d loses %d%% of messages\n", source, target, percent)
+		} else if cmd == "distribution" {
+			// a long-tailed link stalls total-order delivery for everyone
+			var source, target int
+			var name string
+
+			con.Scan("Source node: ", &source)
+			con.Scan("Target node: ", &target)
+			con.Scan("Distribution (uniform, normal, exponential, pareto, default): ", &name)
+
+			if name == "default" {
+				name = ""
+			}
+			if err := network.Distribute(source, target, name); err != nil {
+				fmt.Println(err)
+			}
+		} else if cmd == "links" {
+			fmt.Printf("from\\to")
+			for j := range nodes {
+				fmt.Printf("\t%d", j)
+			}
+			fmt.Println()
+
+			for i := range nodes {
+				fmt.Printf("%d", i)
+				for j := range nodes {
+					link := network.Link(i, j)
+					dist := ""
+					if link.Distribution != "" {
+						dist = " " + link.Distribution
+					}
+
+					if link.Flapping {
+						fmt.Printf("\tflap")
+					} else if link.Down {
+						fmt.Printf("\tdown")
+					} else if link.Loss > 0 {
+						fmt.Printf("\t+%dms%s %d%%", link.Latency, dist, link.Loss)
+					} else {
+						fmt.Printf("\t+%dms%s", link.Latency, dist)
+					}
+				}
+				fmt.Println()
+			}
+		} else if cmd == "network" {
+			var action string
+			con.Scan("Action (show): ", &action)
+
+			if action == "show" {
+				network.Heatmap(os.Stdout)
+			} else {
+				fmt.Println("Unknown action")
+			}
+		} else if cmd == "ping" {
+			var args string
+			con.ScanLine("From, to and probes (e.g. 0 3 or 0 3 10): ", &args)
+
+			from, to, count, err := sim.ParsePing(args, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			network.Ping(from, to, count, func(from, to int) time.Duration {
+				// as the acks go: 20-100ms (+ network jam)
+				return time.Duration(network.Link(from, to).Latency)*time.Millisecond + network.Latency(from, to, 20, 100)
+			}).Report(os.Stdout)
+		} else if cmd == "inflight" {
+			packets := network.InFlight()
+			if len(packets) == 0 {
+				fmt.Println("No messages in flight")
+			}
+			for _, p := range packets {
+				fmt.Printf("#%d: node %d -> node %d, %s (at %d), due in %v%s\n", p.ID, p.Msg.sender, p.To, p.Msg.data, p.Msg.t, time.Until(p.Due).Round(time.Millisecond), sim.Via(p.Route))
+			}
+		} else if cmd == "deliver" || cmd == "drop" {
+			var id int
+
+			con.Scan("Message ID: ", &id)
+
+			if !network.Signal(id, cmd) {
+				fmt.Println("No such message in flight")
+			}
+		} else if cmd == "oracle" {
+			// compare delivery order with the real-time send order
+			for i := range nodes {
+				order := nodes[i].history.Order()
+
+				s := make([]string, len(order))
+				for j := range order {
+					s[j] = strconv.FormatInt(order[j], 10)
+				}
+
+				fmt.Printf("Node %d delivered [%s], %d inversion(s)", nodes[i].ID(), strings.Join(s, ", "), sim.Inversions(order))
+				if forgotten := nodes[i].history.Count() - len(order); forgotten > 0 {
+					fmt.Printf(" in the last %d, %d older forgotten", len(order), forgotten)
+				}
+				fmt.Println()
+			}
+		} else if cmd == "attach" {
+			// act as one node: the protocol stops delivering on its own and waits for you
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			n := nodes[id]
+			n.attached.Store(true)
+			fmt.Printf("You are node %d, nothing is delivered until you say so\n", id)
+
+			for {
+				var sub string
+				fmt.Println("Node commands: inbox, deliver, flush, send, logs, detach")
+				con.Scan(fmt.Sprintf(" node %d > ", id), &sub)
+
+				if sub == "inbox" {
+					fmt.Printf("Clock: %d\n", n.clock.Now())
+
+					// a flush that started before attaching may still be delivering
+					n.bufferMu.Lock()
+					last := n.last
+					n.bufferMu.Unlock()
+
+					if last != nil {
+						fmt.Printf("Last delivered: %s (from node %d at #%d)\n", last.data, last.sender, last.t)
+					}
+
+					held := n.held()
+					if len(held) == 0 {
+						fmt.Println("No messages held")
+					}
+					for i, m := range held {
+						if m.kind == "ack" {
+							fmt.Printf("[%d] ack (from node %d at #%d)\n", i, m.sender, m.t)
+						} else {
+							fmt.Printf("[%d] %s (from node %d at #%d)\n", i, m.data, m.sender, m.t)
+						}
+					}
+
+					// the protocol only delivers once every node has been heard from with a later timestamp
+					if n.synchronized() {
+						fmt.Println("The protocol would flush now: every node has a newer message in the secondary buffer")
+					} else {
+						fmt.Println("The protocol would wait: an older message may still arrive from a node that has not spoken yet")
+					}
+				} else if sub == "deliver" {
+					var index int
+
+					con.Scan("Index: ", &index)
+
+					if !n.deliverAt(index) {
+						fmt.Println("No such message")
+					}
+				} else if sub == "flush" {
+					n.flush()
+				} else if sub == "send" {
+					var data string
+					var lmin, lmax int
+
+					con.Scan("Data: ", &data)
+					con.Scan("Min latency (ms): ", &lmin)
+					con.Scan("Max latency (ms): ", &lmax)
+
+					n.send(data, lmin, lmax, nil)
+				} else if sub == "logs" {
+					l.Flush(os.Stdout)
+				} else if sub == "detach" || con.Closed() {
+					break
+				}
+			}
+
+			n.attached.Store(false)
+			if n.synchronized() {
+				n.flush()
+			}
+			fmt.Printf("Node %d is back under protocol control\n", id)
+		} else if cmd == "metrics" {
+			// OpenMetrics text, trace IDs are the oracle IDs of the messages
+			var path string
+			con.Scan("File (- for the console): ", &path)
+
+			if path == "-" {
+				watcher.WriteMetrics(os.Stdout, "tob")
+				continue
+			}
+			f, err := os.Create(path)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			watcher.WriteMetrics(f, "tob")
+			f.Close()
+			fmt.Printf("Written to %s\n", path)
+		} else if cmd == "drain" {
+			// deliver everything in flight now instead of waiting for it
+			fmt.Printf("Delivered %d message(s) early\n", network.Drain())
+		} else if cmd == "stats" {
+			delivered := 0
+			for i := range nodes {
+				delivered += nodes[i].history.Count()
+			}
+			network.Stats.Report(os.Stdout, nodeCount, delivered)
+			fmt.Printf("Acks sent by v2 nodes: %d, messages a node could not decode: %d\n", pool.acks.Load(), pool.policy.Rejected.Load())
+		} else if cmd == "watch" {
+			var expr, pause string
+
+			con.ScanLine(fmt.Sprintf("Expression (e.g. node[2].buffer > 5, probes: %s): ", strings.Join(watcher.Probes(), ", ")), &expr)
+			con.Scan("Pause when triggered (yes/no): ", &pause)
+
+			id, err := watcher.Watch(expr, pause == "yes")
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("Watching #%d\n", id)
+		} else if cmd == "unwatch" {
+			var id int
+
+			watches := watcher.List()
+			if len(watches) == 0 {
+				fmt.Println("No watches")
+				continue
+			}
+			for _, w := range watches {
+				fmt.Println(w)
+			}
+			con.Scan("Watch ID: ", &id)
+
+			if !watcher.Unwatch(id) {
+				fmt.Println("No such watch")
+			}
+		} else if cmd == "break" {
+			var spec string
+
+			con.ScanLine("Breakpoint (e.g. on deliver node=3 sender=1): ", &spec)
+
+			b, err := sim.ParseBreakpoint(spec)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("Breakpoint #%d set\n", network.Break(b))
+		} else if cmd == "unbreak" {
+			var id int
+
+			breakpoints := network.Breakpoints()
+			if len(breakpoints) == 0 {
+				fmt.Println("No breakpoints")
+				continue
+			}
+			for _, b := range breakpoints {
+				fmt.Println(b)
+			}
+			con.Scan("Breakpoint ID: ", &id)
+
+			if !network.Unbreak(id) {
+				fmt.Println("No such breakpoint")
+			}
+		} else if cmd == "step" {
+			// deliver the next packet while keeping everything else paused
+			p, ok := network.Step()
+			if !ok {
+				fmt.Println("No messages in flight")
+				continue
+			}
+			fmt.Printf("Stepped #%d: broadcast %s (#%d) from node %d to node %d\n", p.ID, p.Msg.data, p.Msg.t, p.From, p.To)
+		} else if cmd == "resume" {
+			if !network.Paused() {
+				fmt.Println("Network is not paused")
+				continue
+			}
+			network.Resume()
+			fmt.Println("Network resumed")
+		} else if cmd == "topology" {
+			// messages to non-neighbors are forwarded hop by hop along the shortest path
+			fmt.Printf("Topology: %s\n", wiring)
+			for i := 0; i < nodeCount; i++ {
+				fmt.Printf("Node %d: neighbors %v\n", i, wiring.Neighbors(i))
+			}
+		} else if cmd == "partition" {
+			// split brain: no messages between groups until heal
+			var spec string
+
+			con.Scan("Groups (e.g. 0,1|2,3): ", &spec)
+
+			groups, err := sim.ParseGroups(spec, nodeCount)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			network.Partition(groups)
+			fmt.Println("Network partitioned, nodes left out are isolated")
+		} else if cmd == "heal" {
+			network.Heal()
+			fmt.Println("Network healed")
 		} else if cmd == "logs" {
-			bufio.NewReader(strings.NewReader(logBuilder.String())).WriteTo(os.Stdout)
-			logBuilder.Reset()
+			l.Flush(os.Stdout)
+		} else if cmd == "toggle" {
+			var mechanism string
+			con.Scan("Mechanism (sync, tiebreak, shim): ", &mechanism)
+
+			if mechanism == "sync" {
+				skip := !pool.skipSync.Load()
+				pool.skipSync.Store(skip)
+				fmt.Printf("Lamport sync on receive: %s\n", enabledString(!skip))
+			} else if mechanism == "tiebreak" {
+				skip := !pool.skipTieBreak.Load()
+				pool.skipTieBreak.Store(skip)
+				fmt.Printf("Tie-breaking by sender: %s\n", enabledString(!skip))
+			} else if mechanism == "shim" {
+				skip := !pool.skipShim.Load()
+				pool.skipShim.Store(skip)
+				fmt.Printf("Encoding messages for older nodes: %s\n", enabledString(!skip))
+			} else {
+				fmt.Println("Unknown mechanism")
+			}
 		} else if cmd == "exit" {
 			fmt.Println("Bye")
 			break
 		}
 	}
 
+	close(stopWatching)
 	for i := range nodes {
-		nodes[i].stop()
+		nodes[i].Stop()
 	}
+	network.Resume()
+	network.Close()
 
 	fmt.Println("Waiting all nodes to shut down")
-	for pool.aliveCount.Load() > 0 {
-	}
+	pool.Wait()
 
-	bufio.NewReader(strings.NewReader(logBuilder.String())).WriteTo(os.Stdout)
+	l.Flush(os.Stdout)
 }
 
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+const (
+	statusNormal = "normal"
+	statusViewChange = "view-change"
+	statusRecovering = "recovering"
+)
+
+type entry struct {
+	op int
+	request string
+}
+
+type message struct {
+	kind string // prepare, prepare-ok, commit, get-state, new-state, start-view-change, do-view-change, start-view, recovery, recovery-response
+	sender int
+	view int
+	op int
+	commit int
+	lastNormal int
+	nonce int64
+	log []entry
+	request string
+}
+
+type nodePool struct {
+	*sim.Pool
+
+	participants int
+	send func(m message, target int)
+
+	heartbeat time.Duration
+	timeout time.Duration
+}
+
+func newNodePool(participants int, send func(m message, target int)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.participants = participants
+	pool.send = send
+	pool.heartbeat = 500 * time.Millisecond
+	pool.timeout = 2 * time.Second
+	return pool
+}
+
+func (pool *nodePool) primary(view int) int {
+	return view % pool.participants
+}
+
+func (pool *nodePool) quorum() int {
+	// f + 1 where n = 2f + 1
+	return pool.participants/2 + 1
+}
+
+type node struct {
+	*sim.Process
+
+	pool *nodePool
+	id int
+	l sim.Logger
+
+	view int
+	status string
+	lastNormal int
+	log []entry
+	op int
+	commit int
+	executed []string
+
+	prepareOKs map[int]map[int]bool // op -> acknowledging replicas
+	prepares map[int]message // prepares that arrived ahead of a gap
+	viewChanges map[int]bool
+	doViewChanges []message
+	recoveryNonce int64
+	recoveryResponses []message
+
+	lastHeard time.Time
+	mu sync.Mutex
+
+	inbox chan message
+	crashed atomic.Bool
+}
+
+func newNode(pool *nodePool, id int, l sim.Logger) *node {
+	n := new(node)
+	n.Process = sim.NewProcess(pool.Pool, id, int(pool.heartbeat/time.Millisecond), l)
+	n.pool = pool
+	n.id = id
+	n.l = l
+	n.reset()
+	n.status = statusNormal
+	n.inbox = make(chan message, 1024)
+	n.crashed.Store(false)
+	return n
+}
+
+func (n *node) reset() {
+	n.view = 0
+	n.lastNormal = 0
+	n.log = nil
+	n.op = 0
+	n.commit = 0
+	n.executed = nil
+	n.prepareOKs = make(map[int]map[int]bool)
+	n.prepares = make(map[int]message)
+	n.viewChanges = make(map[int]bool)
+	n.doViewChanges = nil
+	n.recoveryResponses = nil
+	n.lastHeard = time.Now()
+}
+
+// a crashed replica keeps its loops but ignores the heartbeat and every
+// message until it recovers
+func (n *node) run() {
+	n.Start(func() {
+		n.mu.Lock()
+		if !n.crashed.Load() {
+			n.tick()
+		}
+		n.mu.Unlock()
+	})
+
+	sim.Listen(n.Process, n.inbox, func(m message) {
+		n.mu.Lock()
+		if !n.crashed.Load() {
+			n.handle(m)
+		}
+		n.mu.Unlock()
+	})
+}
+
+func (n *node) broadcast(m message) {
+	m.sender = n.id
+	for i := 0; i < n.pool.participants; i++ {
+		if i != n.id {
+			n.pool.send(m, i)
+		}
+	}
+}
+
+func (n *node) reply(m message, target int) {
+	m.sender = n.id
+	n.pool.send(m, target)
+}
+
+func (n *node) isPrimary() bool {
+	return n.status == statusNormal && n.pool.primary(n.view) == n.id
+}
+
+func (n *node) tick() {
+	if n.isPrimary() {
+		// heartbeat carrying the commit number
+		n.broadcast(message{kind: "commit", view: n.view, commit: n.commit})
+		return
+	}
+
+	if n.status == statusRecovering {
+		if time.Since(n.lastHeard) > n.pool.timeout {
+			n.startRecovery()
+		}
+		return
+	}
+
+	if time.Since(n.lastHeard) > n.pool.timeout {
+		// primary (or the view change) is not making progress
+		n.startViewChange(n.view + 1)
+	}
+}
+
+func (n *node) execute(upTo int) {
+	for n.commit < upTo && n.commit < n.op {
+		n.commit++
+		n.executed = append(n.executed, n.log[n.commit-1].request)
+		n.l.Printf("Replica %d executes op %d: %s (view %d)", n.id, n.commit, n.log[n.commit-1].request, n.view)
+	}
+}
+
+func (n *node) request(r string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.isPrimary() {
+		return false
+	}
+
+	n.op++
+	n.log = append(n.log, entry{op: n.op, request: r})
+	n.prepareOKs[n.op] = map[int]bool{n.id: true}
+	n.l.Printf("Replica %d (primary) prepares op %d: %s", n.id, n.op, r)
+
+	n.broadcast(message{kind: "prepare", view: n.view, op: n.op, commit: n.commit, request: r})
+	return true
+}
+
+// the key-value store after every executed request (node lock must be held)
+func (n *node) store() *sim.KV {
+	return sim.ReplayKV(n.executed)
+}
+
+func (n *node) startViewChange(view int) {
+	n.l.Printf("Replica %d starts view change to view %d", n.id, view)
+
+	n.view = view
+	n.status = statusViewChange
+	n.prepares = make(map[int]message)
+	n.viewChanges = map[int]bool{n.id: true}
+	n.doViewChanges = nil
+	n.lastHeard = time.Now()
+
+	n.broadcast(message{kind: "start-view-change", view: view})
+}
+
+func (n *node) startRecovery() {
+	n.recoveryNonce = sim.Random(1 << 62)
+	n.recoveryResponses = nil
+	n.lastHeard = time.Now()
+
+	n.l.Printf("Replica %d requests recovery", n.id)
+	n.broadcast(message{kind: "recovery", nonce: n.recoveryNonce})
+}
+
+func (n *node) handle(m message) {
+	if n.status == statusRecovering && m.kind != "recovery-response" {
+		return
+	}
+
+	switch m.kind {
+	case "prepare", "commit":
+		if m.view < n.view || (m.view == n.view && n.status != statusNormal) {
+			return
+		}
+		if m.view > n.view {
+			// missed a view change: drop uncommitted entries and fetch the new primary's state
+			n.view = m.view
+			n.status = statusNormal
+			n.lastNormal = m.view
+			n.log = n.log[:n.commit]
+			n.op = n.commit
+			n.prepares = make(map[int]message)
+			n.lastHeard = time.Now()
+			n.l.Printf("Replica %d learns of view %d, fetching state", n.id, n.view)
+
+			n.reply(message{kind: "get-state", view: n.view, op: n.op}, m.sender)
+			return
+		}
+		n.lastHeard = time.Now()
+
+		if m.kind == "prepare" && m.op > n.op {
+			n.prepares[m.op] = m
+		}
+		for {
+			p, ok := n.prepares[n.op+1]
+			if !ok {
+				break
+			}
+			delete(n.prepares, p.op)
+
+			n.op++
+			n.log = append(n.log, entry{op: p.op, request: p.request})
+			n.reply(message{kind: "prepare-ok", view: n.view, op: p.op}, m.sender)
+		}
+		n.execute(m.commit)
+
+		if m.kind == "commit" && m.commit > n.op && len(n.prepares) == 0 {
+			// lost prepares, fetch the missing entries from the primary
+			n.reply(message{kind: "get-state", view: n.view, op: n.op}, m.sender)
+		}
+
+	case "get-state":
+		if !n.isPrimary() || m.view != n.view || m.op > n.op {
+			return
+		}
+		n.reply(message{kind: "new-state", view: n.view, op: n.op, commit: n.commit, log: append([]entry{}, n.log[m.op:]...)}, m.sender)
+
+	case "new-state":
+		if m.view != n.view || n.status != statusNormal {
+			return
+		}
+		for _, e := range m.log {
+			if e.op == n.op+1 {
+				n.op++
+				n.log = append(n.log, e)
+			}
+		}
+		n.l.Printf("Replica %d catches up to op %d", n.id, n.op)
+		n.execute(m.commit)
+
+	case "prepare-ok":
+		if !n.isPrimary() || m.view != n.view || n.prepareOKs[m.op] == nil {
+			return
+		}
+
+		n.prepareOKs[m.op][m.sender] = true
+		if len(n.prepareOKs[m.op]) >= n.pool.quorum() && m.op > n.commit {
+			n.execute(m.op)
+		}
+
+	case "start-view-change":
+		if m.view < n.view || (m.view == n.view && n.status == statusNormal) {
+			return
+		}
+		if m.view > n.view {
+			n.startViewChange(m.view)
+		}
+
+		n.viewChanges[m.sender] = true
+		if len(n.viewChanges) == n.pool.quorum() {
+			primary := n.pool.primary(n.view)
+			dvc := message{kind: "do-view-change", view: n.view, lastNormal: n.lastNormal, op: n.op, commit: n.commit, log: append([]entry{}, n.log...)}
+			if primary == n.id {
+				dvc.sender = n.id
+				n.handle(dvc)
+			} else {
+				n.reply(dvc, primary)
+			}
+		}
+
+	case "do-view-change":
+		if m.view < n.view || (m.view == n.view && n.status == statusNormal) {
+			return
+		}
+		if m.view > n.view {
+			n.startViewChange(m.view)
+		}
+
+		n.doViewChanges = append(n.doViewChanges, m)
+		if len(n.doViewChanges) != n.pool.quorum() {
+			return
+		}
+
+		// adopt the log from the latest normal view with the highest op number
+		best := n.doViewChanges[0]
+		commit := 0
+		for _, d := range n.doViewChanges {
+			if d.lastNormal > best.lastNormal || (d.lastNormal == best.lastNormal && d.op > best.op) {
+				best = d
+			}
+			if d.commit > commit {
+				commit = d.commit
+			}
+		}
+
+		n.log = append([]entry{}, best.log...)
+		n.op = best.op
+		n.status = statusNormal
+		n.lastNormal = n.view
+		n.lastHeard = time.Now()
+		n.prepareOKs = make(map[int]map[int]bool)
+		for op := commit + 1; op <= n.op; op++ {
+			n.prepareOKs[op] = map[int]bool{n.id: true}
+		}
+		n.l.Printf("Replica %d becomes primary of view %d (op %d, commit %d)", n.id, n.view, n.op, commit)
+
+		n.execute(commit)
+		n.broadcast(message{kind: "start-view", view: n.view, op: n.op, commit: n.commit, log: append([]entry{}, n.log...)})
+
+	case "start-view":
+		if m.view < n.view {
+			return
+		}
+
+		n.view = m.view
+		n.status = statusNormal
+		n.lastNormal = m.view
+		n.log = append([]entry{}, m.log...)
+		n.op = m.op
+		n.prepares = make(map[int]message)
+		n.lastHeard = time.Now()
+		n.l.Printf("Replica %d enters view %d (primary: %d)", n.id, n.view, m.sender)
+
+		n.execute(m.commit)
+		for op := n.commit + 1; op <= n.op; op++ {
+			n.reply(message{kind: "prepare-ok", view: n.view, op: op}, m.sender)
+		}
+
+	case "recovery":
+		if n.status != statusNormal {
+			return
+		}
+
+		r := message{kind: "recovery-response", view: n.view, nonce: m.nonce}
+		if n.isPrimary() {
+			r.log = append([]entry{}, n.log...)
+			r.op = n.op
+			r.commit = n.commit
+			r.lastNormal = 1 // marks a response from the primary
+		}
+		n.reply(r, m.sender)
+
+	case "recovery-response":
+		if n.status != statusRecovering || m.nonce != n.recoveryNonce {
+			return
+		}
+
+		n.recoveryResponses = append(n.recoveryResponses, m)
+		if len(n.recoveryResponses) < n.pool.quorum() {
+			return
+		}
+
+		// needs the primary of the latest view among the responses
+		view := 0
+		for _, r := range n.recoveryResponses {
+			if r.view > view {
+				view = r.view
+			}
+		}
+		for _, r := range n.recoveryResponses {
+			if r.view == view && r.lastNormal == 1 {
+				n.view = view
+				n.lastNormal = view
+				n.log = append([]entry{}, r.log...)
+				n.op = r.op
+				n.status = statusNormal
+				n.lastHeard = time.Now()
+				n.l.Printf("Replica %d recovered in view %d (op %d)", n.id, view, n.op)
+
+				n.execute(r.commit)
+				return
+			}
+		}
+	}
+}
+
+func main() {
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of replicas: ", &nodeCount)
+
+	lmin, lmax := 20, 100
+
+	// isolated replicas can neither send nor receive
+	isolated := make([]atomic.Bool, nodeCount)
+
+	nodes := make([]*node, nodeCount)
+	sender := func(m message, target int) {
+		latency := int64(lmin) + sim.Random(int64(lmax - lmin))
+		nodes[m.sender].pool.Go(func() {
+			time.Sleep(time.Duration(latency) * time.Millisecond)
+
+			if isolated[m.sender].Load() || isolated[target].Load() || nodes[target].crashed.Load() {
+				return
+			}
+			sim.Deliver(nodes[target].Process, nodes[target].inbox, m)
+		})
+	}
+
+	pool := newNodePool(nodeCount, sender)
+	for i := range nodes {
+		nodes[i] = newNode(pool, i, l)
+		nodes[i].run()
+	}
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, put, get, hash, request, isolate, connect, crash, recover, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				role := "backup"
+				if nodes[i].isPrimary() {
+					role = "primary"
+				}
+				if nodes[i].crashed.Load() {
+					role = "crashed"
+				}
+				fmt.Printf("Replica %d (%s, view: %d, status: %s, op: %d, commit: %d, isolated: %v) %v\n", nodes[i].id, role, nodes[i].view, nodes[i].status, nodes[i].op, nodes[i].commit, isolated[i].Load(), nodes[i].executed)
+				nodes[i].mu.Unlock()
+			}
+		} else if cmd == "request" || cmd == "put" {
+			var data string
+
+			if cmd == "put" {
+				var key, value string
+
+				con.Scan("Key: ", &key)
+				con.Scan("Value: ", &value)
+				data = sim.PutOp(key, value)
+			} else {
+				con.Scan("Request: ", &data)
+			}
+
+			// the client sends to whoever claims to be primary in the highest view
+			target := -1
+			view := -1
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				if !nodes[i].crashed.Load() && !isolated[i].Load() && nodes[i].isPrimary() && nodes[i].view > view {
+					target, view = i, nodes[i].view
+				}
+				nodes[i].mu.Unlock()
+			}
+
+			if target < 0 || !nodes[target].request(data) {
+				fmt.Println("No reachable primary, try again after the view change")
+			} else {
+				fmt.Printf("Sent to replica %d (view %d)\n", target, view)
+			}
+		} else if cmd == "get" {
+			// a local read, only as fresh as what this replica has executed
+			var id int
+			var key string
+
+			con.Scan("Replica: ", &id)
+			con.Scan("Key: ", &key)
+
+			nodes[id].mu.Lock()
+			v, ok := nodes[id].store().Get(key)
+			commit := nodes[id].commit
+			nodes[id].mu.Unlock()
+
+			if !ok {
+				v = "(none)"
+			}
+			fmt.Printf("%s = %s from replica %d (executed up to op %d)\n", key, v, id, commit)
+		} else if cmd == "hash" {
+			// lock every replica at once so the digests come from one consistent cut
+			applied := make([]int, len(nodes))
+			stores := make([]*sim.KV, len(nodes))
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				applied[i] = len(nodes[i].executed)
+				stores[i] = nodes[i].store()
+			}
+			for i := range nodes {
+				nodes[i].mu.Unlock()
+			}
+			sim.ReportDigests(os.Stdout, "Replica", applied, stores)
+		} else if cmd == "isolate" || cmd == "connect" {
+			var id int
+
+			con.Scan("Replica: ", &id)
+
+			isolated[id].Store(cmd == "isolate")
+		} else if cmd == "crash" {
+			var id int
+
+			con.Scan("Replica: ", &id)
+
+			nodes[id].crashed.Store(true)
+			l.Printf("Replica %d crashed", id)
+		} else if cmd == "recover" {
+			// restart with no state and run the recovery protocol
+			var id int
+
+			con.Scan("Replica: ", &id)
+
+			if !nodes[id].crashed.Load() {
+				fmt.Println("Replica is running")
+				continue
+			}
+
+			nodes[id].mu.Lock()
+			nodes[id].reset()
+			nodes[id].status = statusRecovering
+			nodes[id].crashed.Store(false)
+			nodes[id].startRecovery()
+			nodes[id].mu.Unlock()
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].Stop()
+	}
+
+	fmt.Println("Waiting all replicas to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}
@@ -0,0 +1,1098 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelrk02/ds-sim/pkg/sim"
+)
+
+const (
+	stateLooking = "looking"
+	stateFollowing = "following"
+	stateLeading = "leading"
+
+	phaseDiscovery = "discovery"
+	phaseSync = "synchronization"
+	phaseBroadcast = "broadcast"
+)
+
+type zxid struct {
+	epoch int
+	counter int
+}
+
+func (z zxid) less(other zxid) bool {
+	if z.epoch != other.epoch {
+		return z.epoch < other.epoch
+	}
+	return z.counter < other.counter
+}
+
+func (z zxid) String() string {
+	return fmt.Sprintf("%d.%d", z.epoch, z.counter)
+}
+
+type txn struct {
+	zxid zxid
+	data string
+}
+
+type vote struct {
+	zxid zxid
+	leader int
+}
+
+func (v vote) less(other vote) bool {
+	if v.zxid != other.zxid {
+		return v.zxid.less(other.zxid)
+	}
+	return v.leader < other.leader
+}
+
+type message struct {
+	kind string // vote, ping, pong, follower-info, new-epoch, ack-epoch, new-leader, ack-new-leader, proposal, ack, commit
+	sender int
+	state string
+	vote vote
+	epoch int
+	zxid zxid
+	history []txn
+	data string
+}
+
+type nodePool struct {
+	*sim.Pool
+
+	participants int
+	send func(m message, target int)
+
+	heartbeat time.Duration
+	timeout time.Duration
+
+	// each write to disk takes this long, writes within the window share one
+	fsync time.Duration
+	window time.Duration
+
+	fsyncs atomic.Int64
+	commits atomic.Int64
+	commitLatency atomic.Int64 // nanoseconds, summed over commits
+
+	stop chan struct{} // closed on exit
+}
+
+func newNodePool(participants int, send func(m message, target int)) *nodePool {
+	pool := new(nodePool)
+	pool.Pool = sim.NewPool()
+	pool.participants = participants
+	pool.send = send
+	pool.heartbeat = 500 * time.Millisecond
+	pool.timeout = 2 * time.Second
+	pool.fsync = 0
+	pool.window = 0
+	pool.fsyncs.Store(0)
+	pool.commits.Store(0)
+	pool.commitLatency.Store(0)
+	pool.stop = make(chan struct{})
+	return pool
+}
+
+func (pool *nodePool) quorum() int {
+	return pool.participants/2 + 1
+}
+
+type node struct {
+	pool *nodePool
+	id int
+	l sim.Logger
+
+	state string
+	phase string
+	leader int
+	acceptedEpoch int
+	currentEpoch int
+	history []txn
+	delivered int
+
+	vote vote
+	votes map[int]vote
+	outOfElection map[int]message
+
+	followerInfos map[int]bool
+	ackEpochs map[int]message
+	newLeaderAcks map[int]bool
+	acks map[zxid]map[int]bool
+	proposedAt map[zxid]time.Time
+	pongs map[int]time.Time
+	counter int
+
+	// the leader's own proposals waiting to be written to its disk, in zxid
+	// order (appendMu is held from numbering a proposal until it is queued)
+	appended chan zxid
+	appendMu sync.Mutex
+	// appended but not yet on disk, flushed together at the end of the window
+	unsynced []zxid
+	flushing bool
+	flush chan struct{}
+	// writes to disk block until this time (unix nanoseconds)
+	stallUntil atomic.Int64
+
+	lastHeard time.Time
+	mu sync.Mutex
+
+	inbox chan message
+	running atomic.Bool
+
+	// the event loop of the current run, a new one for every restart
+	proc *sim.Process
+	exited chan struct{}
+}
+
+func newNode(pool *nodePool, id int, l sim.Logger) *node {
+	n := new(node)
+	n.pool = pool
+	n.id = id
+	n.l = l
+	n.acceptedEpoch = 0
+	n.currentEpoch = 0
+	n.history = nil
+	n.delivered = 0
+	n.appended = make(chan zxid, 1024)
+	n.unsynced = nil
+	n.flushing = false
+	n.flush = make(chan struct{}, 1)
+	n.stallUntil.Store(0)
+	n.inbox = make(chan message, 1024)
+	n.running.Store(false)
+	n.exited = make(chan struct{})
+	close(n.exited)
+	n.look()
+	return n
+}
+
+func (n *node) lastZxid() zxid {
+	if len(n.history) == 0 {
+		return zxid{epoch: n.currentEpoch, counter: 0}
+	}
+	return n.history[len(n.history)-1].zxid
+}
+
+// one event loop handles everything, so a stalled disk holds up the whole
+// node (the previous run must have exited, see wait)
+func (n *node) run() {
+	p := sim.NewProcess(n.pool.Pool, n.id, int(n.pool.heartbeat/time.Millisecond), n.l)
+	exited := make(chan struct{})
+	n.proc = p
+	n.exited = exited
+	n.running.Store(true)
+
+	n.pool.Go(func() {
+		defer close(exited)
+
+		n.l.Printf("Node %d started", n.id)
+
+		ticker := time.NewTicker(n.pool.heartbeat)
+		defer ticker.Stop()
+
+		n.mu.Lock()
+		n.broadcast(message{kind: "vote", state: n.state, vote: n.vote})
+		n.mu.Unlock()
+
+		for {
+			// a stopped node handles nothing more, even if messages are waiting
+			select {
+			case <-p.Done():
+				n.l.Printf("Node %d stopped", n.id)
+				return
+			default:
+			}
+
+			select {
+			case <-p.Done():
+				continue
+			case m := <-n.inbox:
+				n.mu.Lock()
+				n.handle(m)
+				n.mu.Unlock()
+			case z := <-n.appended:
+				n.mu.Lock()
+				n.sync(z)
+				n.mu.Unlock()
+			case <-n.flush:
+				n.mu.Lock()
+				n.flushUnsynced()
+				n.mu.Unlock()
+			case <-ticker.C:
+				n.mu.Lock()
+				n.tick()
+				n.mu.Unlock()
+			}
+		}
+	})
+}
+
+func (n *node) stop() {
+	n.running.Store(false)
+	n.proc.Stop()
+}
+
+// wait blocks until the event loop has exited, including a write to disk it
+// was in the middle of
+func (n *node) wait() {
+	<-n.exited
+}
+
+// forget everything that was not on disk when the power went, returns how
+// many proposals were lost (node lock must be held, the event loop must have
+// exited)
+func (n *node) powerLoss() int {
+	lost := map[zxid]bool{}
+	for _, z := range n.unsynced {
+		lost[z] = true
+	}
+	for len(n.appended) > 0 {
+		lost[<-n.appended] = true
+	}
+	for len(n.inbox) > 0 {
+		<-n.inbox
+	}
+	for len(n.flush) > 0 {
+		<-n.flush
+	}
+	n.unsynced = nil
+	n.flushing = false
+
+	kept := []txn{}
+	for _, t := range n.history {
+		if !lost[t.zxid] {
+			kept = append(kept, t)
+		}
+	}
+	n.history = kept
+
+	n.delivered = 0
+	n.look()
+	return len(lost)
+}
+
+func (n *node) broadcast(m message) {
+	m.sender = n.id
+	for i := 0; i < n.pool.participants; i++ {
+		if i != n.id {
+			n.pool.send(m, i)
+		}
+	}
+}
+
+func (n *node) reply(m message, target int) {
+	m.sender = n.id
+	n.pool.send(m, target)
+}
+
+// phase 0: leader election
+func (n *node) look() {
+	n.state = stateLooking
+	n.phase = ""
+	n.leader = -1
+	n.vote = vote{zxid: n.lastZxid(), leader: n.id}
+	n.votes = map[int]vote{n.id: n.vote}
+	n.outOfElection = make(map[int]message)
+	n.lastHeard = time.Now()
+}
+
+func (n *node) tick() {
+	if n.state == stateLeading {
+		// a leader without a quorum of followers steps down
+		alive := 1
+		for _, t := range n.pongs {
+			if time.Since(t) < n.pool.timeout {
+				alive++
+			}
+		}
+		if alive < n.pool.quorum() && time.Since(n.lastHeard) > n.pool.timeout {
+			n.l.Printf("Node %d lost its quorum, stepping down", n.id)
+			n.look()
+			n.broadcast(message{kind: "vote", state: n.state, vote: n.vote})
+			return
+		}
+
+		n.broadcast(message{kind: "ping", epoch: n.currentEpoch})
+		return
+	}
+
+	if time.Since(n.lastHeard) > n.pool.timeout {
+		if n.state == stateFollowing {
+			n.l.Printf("Node %d lost leader %d", n.id, n.leader)
+		}
+		n.look()
+		n.broadcast(message{kind: "vote", state: n.state, vote: n.vote})
+	}
+}
+
+func (n *node) elected() {
+	count := 0
+	for _, v := range n.votes {
+		if v == n.vote {
+			count++
+		}
+	}
+	if count < n.pool.quorum() {
+		return
+	}
+
+	n.leader = n.vote.leader
+	n.lastHeard = time.Now()
+	if n.leader == n.id {
+		// phase 1: discovery
+		n.state = stateLeading
+		n.phase = phaseDiscovery
+		n.followerInfos = map[int]bool{n.id: true}
+		n.ackEpochs = make(map[int]message)
+		n.newLeaderAcks = make(map[int]bool)
+		n.acks = make(map[zxid]map[int]bool)
+		n.proposedAt = make(map[zxid]time.Time)
+		n.pongs = make(map[int]time.Time)
+		n.l.Printf("Node %d is elected as leader", n.id)
+	} else {
+		n.state = stateFollowing
+		n.l.Printf("Node %d follows node %d", n.id, n.leader)
+		n.reply(message{kind: "follower-info", epoch: n.acceptedEpoch}, n.leader)
+	}
+}
+
+func (n *node) deliver(upTo zxid) {
+	for n.delivered < len(n.history) && !upTo.less(n.history[n.delivered].zxid) {
+		t := n.history[n.delivered]
+		n.delivered++
+		n.l.Printf("Node %d delivers %s: %s", n.id, t.zxid, t.data)
+	}
+}
+
+// fsync the history, a stalled disk keeps this node from handling anything
+// else until the stall is over (node lock must be held, it is released while
+// waiting)
+func (n *node) persist() {
+	n.pool.fsyncs.Add(1)
+
+	wait := n.pool.fsync
+	if stall := time.Until(time.Unix(0, n.stallUntil.Load())); stall > wait {
+		n.l.Printf("Node %d waits %v for its disk", n.id, stall.Round(time.Millisecond))
+		wait = stall
+	}
+	if wait <= 0 {
+		return
+	}
+
+	n.mu.Unlock()
+	time.Sleep(wait)
+	n.mu.Lock()
+}
+
+// make an appended proposal durable before acknowledging it, right away or
+// with the rest of the group commit window (node lock must be held)
+func (n *node) sync(z zxid) {
+	if n.pool.window <= 0 {
+		n.persist()
+		n.synced(z)
+		return
+	}
+
+	n.unsynced = append(n.unsynced, z)
+	if !n.flushing {
+		n.flushing = true
+		time.AfterFunc(n.pool.window, func() {
+			n.flush <- struct{}{}
+		})
+	}
+}
+
+// node lock must be held
+func (n *node) flushUnsynced() {
+	n.persist()
+
+	batch := n.unsynced
+	n.unsynced = nil
+	n.flushing = false
+	if len(batch) > 1 {
+		n.l.Printf("Node %d writes %d proposals with one fsync", n.id, len(batch))
+	}
+	for _, z := range batch {
+		n.synced(z)
+	}
+}
+
+// node lock must be held
+func (n *node) synced(z zxid) {
+	if n.state == stateLeading {
+		n.acked(z, n.id)
+	} else if n.state == stateFollowing {
+		n.reply(message{kind: "ack", zxid: z}, n.leader)
+	}
+}
+
+// count an acknowledgement, the leader's own once its disk has the proposal (node lock must be held)
+func (n *node) acked(z zxid, sender int) {
+	if n.state != stateLeading || n.phase != phaseBroadcast || n.acks[z] == nil {
+		return
+	}
+
+	n.acks[z][sender] = true
+	if len(n.acks[z]) == n.pool.quorum() {
+		latency := time.Since(n.proposedAt[z])
+		n.pool.commits.Add(1)
+		n.pool.commitLatency.Add(int64(latency))
+		n.l.Printf("Node %d commits %s after %v", n.id, z, latency.Round(time.Millisecond))
+		delete(n.proposedAt, z)
+		n.deliver(z)
+		n.broadcast(message{kind: "commit", zxid: z})
+	}
+}
+
+// the key-value store after every delivered transaction (node lock must be held)
+func (n *node) store() *sim.KV {
+	ops := make([]string, n.delivered)
+	for i := range ops {
+		ops[i] = n.history[i].data
+	}
+	return sim.ReplayKV(ops)
+}
+
+// the proposal is queued for the disk after the node lock is released, the
+// event loop needs it to make room
+func (n *node) write(data string) bool {
+	n.appendMu.Lock()
+	defer n.appendMu.Unlock()
+
+	n.mu.Lock()
+	if !n.running.Load() || n.state != stateLeading || n.phase != phaseBroadcast {
+		n.mu.Unlock()
+		return false
+	}
+
+	// phase 3: broadcast
+	n.counter++
+	t := txn{zxid: zxid{epoch: n.currentEpoch, counter: n.counter}, data: data}
+	n.history = append(n.history, t)
+	n.acks[t.zxid] = make(map[int]bool)
+	n.proposedAt[t.zxid] = time.Now()
+	n.l.Printf("Node %d proposes %s: %s", n.id, t.zxid, data)
+
+	n.broadcast(message{kind: "proposal", epoch: n.currentEpoch, zxid: t.zxid, data: data})
+	p := n.proc
+	n.mu.Unlock()
+
+	select {
+	case n.appended <- t.zxid:
+	case <-p.Done():
+		// crashed before the proposal was queued, it is not on disk either
+		n.mu.Lock()
+		n.unsynced = append(n.unsynced, t.zxid)
+		n.mu.Unlock()
+	}
+	return true
+}
+
+func (n *node) handle(m message) {
+	switch m.kind {
+	case "vote":
+		if n.state != stateLooking {
+			// let the looking node know who leads
+			if n.leader >= 0 {
+				n.reply(message{kind: "vote", state: n.state, vote: vote{zxid: n.lastZxid(), leader: n.leader}}, m.sender)
+			}
+			return
+		}
+
+		if m.state != stateLooking {
+			// join an established ensemble only once its leader and a quorum confirm it
+			n.outOfElection[m.sender] = message{state: m.state, vote: m.vote}
+
+			count := 0
+			confirmed := false
+			for sender, o := range n.outOfElection {
+				if o.vote.leader == m.vote.leader {
+					count++
+					if sender == m.vote.leader && o.state == stateLeading {
+						confirmed = true
+					}
+				}
+			}
+			if !confirmed || count+1 < n.pool.quorum() {
+				return
+			}
+
+			n.vote = m.vote
+			n.votes = map[int]vote{n.id: n.vote}
+			n.leader = m.vote.leader
+			n.state = stateFollowing
+			n.lastHeard = time.Now()
+			n.l.Printf("Node %d follows node %d", n.id, n.leader)
+			n.reply(message{kind: "follower-info", epoch: n.acceptedEpoch}, n.leader)
+			return
+		}
+
+		n.votes[m.sender] = m.vote
+		if n.vote.less(m.vote) {
+			n.vote = m.vote
+			n.votes[n.id] = n.vote
+			n.broadcast(message{kind: "vote", state: n.state, vote: n.vote})
+		}
+		n.elected()
+
+	case "ping":
+		if n.state == stateFollowing && m.sender == n.leader {
+			n.lastHeard = time.Now()
+			n.reply(message{kind: "pong"}, m.sender)
+		}
+
+	case "pong":
+		if n.state == stateLeading {
+			n.pongs[m.sender] = time.Now()
+			n.lastHeard = time.Now()
+		}
+
+	case "follower-info":
+		if n.state != stateLeading {
+			return
+		}
+		n.pongs[m.sender] = time.Now()
+
+		if n.phase != phaseDiscovery {
+			// late follower, synchronize it right away
+			n.reply(message{kind: "new-epoch", epoch: n.currentEpoch}, m.sender)
+			n.reply(message{kind: "new-leader", epoch: n.currentEpoch, history: append([]txn{}, n.history...)}, m.sender)
+			return
+		}
+
+		n.followerInfos[m.sender] = true
+		if m.epoch > n.acceptedEpoch {
+			n.acceptedEpoch = m.epoch
+		}
+		if len(n.followerInfos) == n.pool.quorum() {
+			n.acceptedEpoch++
+			n.ackEpochs[n.id] = message{epoch: n.currentEpoch, history: n.history}
+			n.l.Printf("Node %d proposes epoch %d", n.id, n.acceptedEpoch)
+			n.broadcast(message{kind: "new-epoch", epoch: n.acceptedEpoch})
+		}
+
+	case "new-epoch":
+		if n.state != stateFollowing || m.sender != n.leader || m.epoch < n.acceptedEpoch {
+			return
+		}
+		n.acceptedEpoch = m.epoch
+		n.lastHeard = time.Now()
+		n.reply(message{kind: "ack-epoch", epoch: n.currentEpoch, history: append([]txn{}, n.history...)}, m.sender)
+
+	case "ack-epoch":
+		if n.state != stateLeading || n.phase != phaseDiscovery {
+			return
+		}
+
+		n.ackEpochs[m.sender] = m
+		if len(n.ackEpochs) < n.pool.quorum() {
+			return
+		}
+
+		// phase 2: synchronization with the most up-to-date history
+		best := n.ackEpochs[n.id]
+		for _, a := range n.ackEpochs {
+			if a.epoch > best.epoch || (a.epoch == best.epoch && len(a.history) > len(best.history)) {
+				best = a
+			}
+		}
+
+		n.history = append([]txn{}, best.history...)
+		n.persist()
+		n.currentEpoch = n.acceptedEpoch
+		n.counter = 0
+		n.phase = phaseSync
+		n.newLeaderAcks = map[int]bool{n.id: true}
+		n.l.Printf("Node %d synchronizes epoch %d with %d transaction(s)", n.id, n.currentEpoch, len(n.history))
+		n.broadcast(message{kind: "new-leader", epoch: n.currentEpoch, history: append([]txn{}, n.history...)})
+
+	case "new-leader":
+		if n.state != stateFollowing || m.sender != n.leader || m.epoch < n.acceptedEpoch {
+			return
+		}
+		n.currentEpoch = m.epoch
+		n.acceptedEpoch = m.epoch
+		n.history = append([]txn{}, m.history...)
+		if n.delivered > len(n.history) {
+			n.delivered = len(n.history)
+		}
+		n.persist()
+		n.lastHeard = time.Now()
+		n.reply(message{kind: "ack-new-leader", epoch: m.epoch}, m.sender)
+
+	case "ack-new-leader":
+		if n.state != stateLeading {
+			return
+		}
+
+		if n.phase == phaseBroadcast {
+			// a late follower is in sync, deliver what has been committed
+			n.reply(message{kind: "commit", zxid: n.lastZxid()}, m.sender)
+			return
+		}
+		if n.phase != phaseSync {
+			return
+		}
+
+		n.newLeaderAcks[m.sender] = true
+		if len(n.newLeaderAcks) == n.pool.quorum() {
+			n.phase = phaseBroadcast
+			n.l.Printf("Node %d starts broadcasting in epoch %d", n.id, n.currentEpoch)
+			n.deliver(n.lastZxid())
+			n.broadcast(message{kind: "commit", zxid: n.lastZxid()})
+		}
+
+	case "proposal":
+		if n.state != stateFollowing || m.sender != n.leader || m.epoch != n.currentEpoch {
+			return
+		}
+		n.history = append(n.history, txn{zxid: m.zxid, data: m.data})
+		n.lastHeard = time.Now()
+		n.sync(m.zxid)
+
+	case "ack":
+		if n.state != stateLeading || n.phase != phaseBroadcast || n.acks[m.zxid] == nil {
+			return
+		}
+		n.pongs[m.sender] = time.Now()
+		n.acked(m.zxid, m.sender)
+
+	case "commit":
+		if n.state != stateFollowing || m.sender != n.leader {
+			return
+		}
+		n.lastHeard = time.Now()
+		n.deliver(m.zxid)
+	}
+}
+
+// links are FIFO (like TCP), which ZAB relies on: every message is due its
+// latency after it is sent, but never before the one ahead of it. Sending
+// never blocks, so a node can send while holding its lock.
+type link struct {
+	queue []message
+	due []time.Time
+	last time.Time // when the last message queued is due
+	mu sync.Mutex
+
+	ready chan struct{}
+}
+
+func newLink() *link {
+	k := new(link)
+	k.ready = make(chan struct{}, 1)
+	return k
+}
+
+func (k *link) push(m message, latency time.Duration) {
+	k.mu.Lock()
+	due := time.Now().Add(latency)
+	if due.Before(k.last) {
+		due = k.last
+	}
+	k.last = due
+	k.queue = append(k.queue, m)
+	k.due = append(k.due, due)
+	k.mu.Unlock()
+
+	select {
+	case k.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop waits for the next message to be due, false once stop is closed
+func (k *link) pop(stop <-chan struct{}) (message, bool) {
+	for {
+		k.mu.Lock()
+		if len(k.queue) > 0 {
+			m, due := k.queue[0], k.due[0]
+			k.queue = k.queue[1:]
+			k.due = k.due[1:]
+			k.mu.Unlock()
+
+			select {
+			case <-time.After(time.Until(due)):
+				return m, true
+			case <-stop:
+				return message{}, false
+			}
+		}
+		k.mu.Unlock()
+
+		select {
+		case <-k.ready:
+		case <-stop:
+			return message{}, false
+		}
+	}
+}
+
+func main() {
+	fsync := flag.Duration("fsync", 0, "time each write to disk takes")
+	window := flag.Duration("group-commit", 0, "write proposals appended within this window with one fsync (0 writes each one right away)")
+	script := flag.String("script", "", "read commands from this file instead of standard input")
+	seed := flag.Int64("seed", 0, "replay random choices from a seeded source (0 uses crypto/rand)")
+	flag.Parse()
+
+	if *seed != 0 {
+		sim.Seed(*seed)
+	}
+
+	con, err := sim.OpenConsole(*script)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	l := sim.NewLog()
+
+	var nodeCount int
+	con.Scan("Number of nodes: ", &nodeCount)
+
+	lmin, lmax := 20, 100
+
+	// isolated nodes can neither send nor receive
+	isolated := make([]atomic.Bool, nodeCount)
+
+	links := make([][]*link, nodeCount)
+	for i := range links {
+		links[i] = make([]*link, nodeCount)
+		for j := range links[i] {
+			links[i][j] = newLink()
+		}
+	}
+
+	nodes := make([]*node, nodeCount)
+	sender := func(m message, target int) {
+		latency := time.Duration(int64(lmin)+sim.Random(int64(lmax-lmin))) * time.Millisecond
+		links[m.sender][target].push(m, latency)
+	}
+
+	pool := newNodePool(nodeCount, sender)
+	pool.fsync = *fsync
+	pool.window = *window
+
+	for i := range links {
+		for j := range links[i] {
+			source, target := i, j
+
+			pool.Go(func() {
+				for {
+					m, ok := links[source][target].pop(pool.stop)
+					if !ok {
+						return
+					}
+
+					if isolated[source].Load() || isolated[target].Load() || !nodes[target].running.Load() {
+						continue
+					}
+					select {
+					case nodes[target].inbox <- m:
+					case <-pool.stop:
+						return
+					}
+				}
+			})
+		}
+	}
+	for i := range nodes {
+		nodes[i] = newNode(pool, i, l)
+	}
+	for i := range nodes {
+		nodes[i].run()
+	}
+
+	// crashes, restarts and power failures take turns
+	var lifecycle sync.Mutex
+
+	for {
+		var cmd string
+		fmt.Println("Commands: state, put, get, hash, write, isolate, connect, crash, restart, powerfail, diskstall, load, stats, logs, exit")
+		con.Scan(" > ", &cmd)
+
+		if cmd == "state" {
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				state := nodes[i].state
+				if nodes[i].phase != "" {
+					state += " (" + nodes[i].phase + ")"
+				}
+				if !nodes[i].running.Load() {
+					state = "crashed"
+				}
+
+				delivered := make([]string, nodes[i].delivered)
+				for j := range delivered {
+					delivered[j] = nodes[i].history[j].data
+				}
+
+				fmt.Printf("Node %d (%s, leader: %d, epoch: %d/%d, last zxid: %s, history: %d, isolated: %v) [%s]\n", nodes[i].id, state, nodes[i].leader, nodes[i].acceptedEpoch, nodes[i].currentEpoch, nodes[i].lastZxid(), len(nodes[i].history), isolated[i].Load(), strings.Join(delivered, ", "))
+				nodes[i].mu.Unlock()
+			}
+		} else if cmd == "write" || cmd == "put" {
+			var data string
+
+			if cmd == "put" {
+				var key, value string
+
+				con.Scan("Key: ", &key)
+				con.Scan("Value: ", &value)
+				data = sim.PutOp(key, value)
+			} else {
+				con.Scan("Data: ", &data)
+			}
+
+			sent := false
+			for i := range nodes {
+				if nodes[i].running.Load() && !isolated[i].Load() && nodes[i].write(data) {
+					fmt.Printf("Proposed by leader %d\n", nodes[i].id)
+					sent = true
+					break
+				}
+			}
+			if !sent {
+				fmt.Println("No established leader, try again later")
+			}
+		} else if cmd == "load" {
+			// back to back writes, to see what group commit does to throughput and latency
+			var count int
+
+			con.Scan("Writes: ", &count)
+
+			sent := 0
+			for i := range nodes {
+				if !nodes[i].running.Load() || isolated[i].Load() {
+					continue
+				}
+				for sent < count && nodes[i].write(fmt.Sprintf("load-%d", sent)) {
+					sent++
+				}
+				if sent > 0 {
+					fmt.Printf("Proposed %d write(s) by leader %d\n", sent, nodes[i].id)
+					break
+				}
+			}
+			if sent == 0 {
+				fmt.Println("No established leader, try again later")
+			}
+		} else if cmd == "stats" {
+			commits := pool.commits.Load()
+			fsyncs := pool.fsyncs.Load()
+
+			fmt.Printf("Commits: %d\n", commits)
+			fmt.Printf("Fsyncs (all nodes): %d\n", fsyncs)
+			if commits > 0 {
+				fmt.Printf("Average commit latency: %v\n", (time.Duration(pool.commitLatency.Load()) / time.Duration(commits)).Round(time.Millisecond))
+				fmt.Printf("Fsyncs per commit: %.2f\n", float64(fsyncs)/float64(commits))
+			}
+		} else if cmd == "get" {
+			// a local read, only as fresh as what this node has delivered
+			var id int
+			var key string
+
+			con.Scan("Node: ", &id)
+			con.Scan("Key: ", &key)
+
+			nodes[id].mu.Lock()
+			v, ok := nodes[id].store().Get(key)
+			delivered := nodes[id].delivered
+			nodes[id].mu.Unlock()
+
+			if !ok {
+				v = "(none)"
+			}
+			fmt.Printf("%s = %s from node %d (%d transaction(s) delivered)\n", key, v, id, delivered)
+		} else if cmd == "hash" {
+			// lock every node at once so the digests come from one consistent cut
+			applied := make([]int, len(nodes))
+			stores := make([]*sim.KV, len(nodes))
+			for i := range nodes {
+				nodes[i].mu.Lock()
+				applied[i] = nodes[i].delivered
+				stores[i] = nodes[i].store()
+			}
+			for i := range nodes {
+				nodes[i].mu.Unlock()
+			}
+			sim.ReportDigests(os.Stdout, "Node", applied, stores)
+		} else if cmd == "isolate" || cmd == "connect" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			isolated[id].Store(cmd == "isolate")
+		} else if cmd == "crash" {
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			lifecycle.Lock()
+			if nodes[id].running.Load() {
+				nodes[id].stop()
+			}
+			lifecycle.Unlock()
+		} else if cmd == "restart" {
+			// restart from the persisted history and epochs
+			var id int
+
+			con.Scan("Node: ", &id)
+
+			lifecycle.Lock()
+			if nodes[id].running.Load() {
+				lifecycle.Unlock()
+				fmt.Println("Node is running")
+				continue
+			}
+
+			nodes[id].wait()
+			nodes[id].mu.Lock()
+			nodes[id].delivered = 0
+			nodes[id].look()
+			nodes[id].mu.Unlock()
+			nodes[id].run()
+			lifecycle.Unlock()
+		} else if cmd == "powerfail" {
+			// every node goes down at once and comes back from its disk
+			var duration string
+			var clients int
+
+			con.Scan("Down for (e.g. 2s): ", &duration)
+			con.Scan("Clients retrying a write (0 for none): ", &clients)
+
+			d, err := time.ParseDuration(duration)
+			if err != nil || d < 0 {
+				fmt.Println("Invalid duration")
+				continue
+			}
+
+			lifecycle.Lock()
+			for i := range nodes {
+				if nodes[i].running.Load() {
+					nodes[i].stop()
+				}
+			}
+			lifecycle.Unlock()
+			failed := time.Now()
+			fmt.Println("Power failure, every node is down")
+
+			var restored atomic.Int64
+			pool.Go(func() {
+				select {
+				case <-time.After(d):
+				case <-pool.stop:
+					return
+				}
+
+				lifecycle.Lock()
+				defer lifecycle.Unlock()
+
+				// a node restarted by hand meanwhile goes down with the rest
+				lost := 0
+				for i := range nodes {
+					if nodes[i].running.Load() {
+						nodes[i].stop()
+					}
+					nodes[i].wait()
+					nodes[i].mu.Lock()
+					lost += nodes[i].powerLoss()
+					nodes[i].mu.Unlock()
+				}
+
+				select {
+				case <-pool.stop:
+					return
+				default:
+				}
+				l.Printf("Power is back after %v, every node restarts from disk (%d proposal(s) were not on disk)", time.Since(failed).Round(time.Millisecond), lost)
+				restored.Store(time.Now().UnixNano())
+				for i := range nodes {
+					nodes[i].run()
+				}
+			})
+
+			// clients keep retrying without backoff until a leader takes their write
+			var attempts atomic.Int64
+			var done sync.WaitGroup
+			for c := 0; c < clients; c++ {
+				c := c
+				done.Add(1)
+				pool.Go(func() {
+					defer done.Done()
+					for {
+						attempts.Add(1)
+						for i := range nodes {
+							if !isolated[i].Load() && nodes[i].write(fmt.Sprintf("client-%d", c)) {
+								return
+							}
+						}
+
+						select {
+						case <-time.After(50 * time.Millisecond):
+						case <-pool.stop:
+							return
+						}
+					}
+				})
+			}
+			if clients > 0 {
+				pool.Go(func() {
+					done.Wait()
+
+					select {
+					case <-pool.stop:
+						return
+					default:
+					}
+					back := time.Unix(0, restored.Load())
+					l.Printf("All %d client(s) had their write proposed %v after power came back, %d attempt(s) in total", clients, time.Since(back).Round(time.Millisecond), attempts.Load())
+				})
+			}
+		} else if cmd == "diskstall" {
+			// every fsync on this node blocks until the stall is over
+			var id int
+			var duration string
+
+			con.Scan("Node: ", &id)
+			con.Scan("Duration (e.g. 3s): ", &duration)
+
+			d, err := time.ParseDuration(duration)
+			if err != nil || d <= 0 {
+				fmt.Println("Invalid duration")
+				continue
+			}
+			nodes[id].stallUntil.Store(time.Now().Add(d).UnixNano())
+
+			fmt.Printf("Disk of node %d stalls for %v\n", id, d)
+		} else if cmd == "logs" {
+			l.Flush(os.Stdout)
+		} else if cmd == "exit" {
+			fmt.Println("Bye")
+			break
+		}
+	}
+
+	close(pool.stop)
+
+	lifecycle.Lock()
+	for i := range nodes {
+		if nodes[i].running.Load() {
+			nodes[i].stop()
+		}
+	}
+	lifecycle.Unlock()
+
+	fmt.Println("Waiting all nodes to shut down")
+	pool.Wait()
+
+	l.Flush(os.Stdout)
+}